@@ -0,0 +1,510 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// AzureAPIVersion is the IoT Hub API version that AzureBackend sends when connecting.
+const AzureAPIVersion = "2021-04-12"
+
+// ConfigRequestQOS is the QoS level used to request the current config from backends that don't send it automatically.
+const ConfigRequestQOS = 1
+
+// ErrUnsupportedBackend is returned when a feature isn't supported by ThingOptions.Backend, such as gateways on AWS.
+var ErrUnsupportedBackend = fmt.Errorf("not supported by the backend")
+
+// ErrInvalidState is returned by PublishState if the backend stores state in a JSON document and the state is not a JSON object.
+var ErrInvalidState = fmt.Errorf("state must be a JSON object")
+
+// Backend adapts a Thing to the client IDs, topics and authentication used by an IoT platform.
+// GoogleBackend is used if ThingOptions.Backend is not set.
+//
+// The Thing API is the same for every backend. Backends that keep configs and state in a JSON document,
+// such as AWS device shadows and Azure device twins, deliver the desired part of the document as the config
+// and store the state passed to PublishState as the reported part, so the state must be a JSON object.
+type Backend interface {
+	// Validate returns ErrConfigurationError if the options don't contain the values the backend needs to connect.
+	Validate(options *ThingOptions) error
+
+	// ClientID returns the MQTT client ID of the device.
+	ClientID(id *ID) string
+
+	// Credentials returns the MQTT username and password, and the time the password expires.
+	// The Thing reconnects with a new password shortly before it expires. The zero time means it doesn't expire.
+	// The credentials are nil if the Thing doesn't have any.
+	Credentials(options *ThingOptions, credentials *Credentials) (username string, password string, expiry time.Time, err error)
+
+	// ConfigTopics returns the topics that configs are received on.
+	ConfigTopics(id *ID) []string
+
+	// ConfigRequest returns the message that is published after subscribing to ConfigTopics to request the current config.
+	// The topic is empty if the server sends the current config automatically.
+	ConfigRequest(id *ID) (topic string, payload []byte)
+
+	// DecodeConfig returns the config contained in a message received on one of ConfigTopics.
+	// It returns false if the message doesn't contain a new config.
+	// If refresh is true, the message only contained the changes and the config is requested again using ConfigRequest.
+	DecodeConfig(id *ID, topic string, payload []byte) (config []byte, ok bool, refresh bool)
+
+	// StateTopic returns the topic that state is published to.
+	StateTopic(id *ID) string
+
+	// EncodeState returns the payload published to StateTopic for the state passed to PublishState.
+	EncodeState(state []byte) ([]byte, error)
+
+	// EventsTopic returns the topic that events are published to.
+	EventsTopic(id *ID, subfolder ...string) string
+
+	// CommandsTopic returns the topic that commands are received on.
+	// Commands are also received on its subtopics, which are passed to the CommandHandler as the subfolder.
+	CommandsTopic(id *ID) string
+
+	// ErrorsTopic returns the topic that errors are received on, or an empty string if the backend doesn't report errors.
+	ErrorsTopic(id *ID) string
+}
+
+// backendFor returns the backend used with the given options.
+// GoogleBackend uses the topic templates from the options, as does GenericBackend if it doesn't have its own.
+func backendFor(options *ThingOptions) Backend {
+	switch b := options.Backend.(type) {
+	case nil, GoogleBackend:
+		return GoogleBackend{topics: options.Topics}
+	case GenericBackend:
+		if b.Topics == (TopicScheme{}) {
+			b.Topics = options.Topics
+		}
+		return b
+	}
+	return options.Backend
+}
+
+// GoogleBackend connects to Google Cloud IoT Core.
+// Devices authenticate using a JWT signed by their credentials and the project ID as the audience.
+// Topics are rendered from ThingOptions.Topics, using GoogleTopicScheme for any templates that are empty.
+type GoogleBackend struct {
+	topics TopicScheme
+}
+
+// Validate checks that credentials were provided and that the topic templates are valid
+func (b GoogleBackend) Validate(options *ThingOptions) error {
+	if !hasCredentials(options) || b.scheme().Validate() != nil {
+		return ErrConfigurationError
+	}
+	return nil
+}
+
+// ClientID returns the full resource name of the device
+func (GoogleBackend) ClientID(id *ID) string {
+	return fmt.Sprintf("projects/%s/locations/%s/registries/%s/devices/%s", id.ProjectID, id.Location, id.Registry, id.DeviceID)
+}
+
+// Credentials returns an auth token signed by the given credentials as the password
+func (GoogleBackend) Credentials(options *ThingOptions, credentials *Credentials) (string, string, time.Time, error) {
+	if credentials == nil {
+		return "", "", time.Time{}, ErrConfigurationError
+	}
+	token, expiry, err := newAuthToken(options, credentials)
+	return "unused", token, expiry, err
+}
+
+// ConfigTopics returns the config topic
+func (b GoogleBackend) ConfigTopics(id *ID) []string {
+	return []string{b.scheme().ConfigTopic(id)}
+}
+
+// ConfigRequest returns an empty topic because the server sends the config after subscribing
+func (GoogleBackend) ConfigRequest(id *ID) (string, []byte) {
+	return "", nil
+}
+
+// DecodeConfig returns the payload
+func (GoogleBackend) DecodeConfig(id *ID, topic string, payload []byte) ([]byte, bool, bool) {
+	return payload, true, false
+}
+
+// StateTopic returns the state topic
+func (b GoogleBackend) StateTopic(id *ID) string {
+	return b.scheme().StateTopic(id)
+}
+
+// EncodeState returns the state
+func (GoogleBackend) EncodeState(state []byte) ([]byte, error) {
+	return state, nil
+}
+
+// EventsTopic returns the events topic followed by the subfolder
+func (b GoogleBackend) EventsTopic(id *ID, subfolder ...string) string {
+	return b.scheme().EventsTopic(id, subfolder...)
+}
+
+// CommandsTopic returns the commands topic
+func (b GoogleBackend) CommandsTopic(id *ID) string {
+	return b.scheme().CommandsTopic(id)
+}
+
+// ErrorsTopic returns the errors topic
+func (b GoogleBackend) ErrorsTopic(id *ID) string {
+	return b.scheme().ErrorsTopic(id)
+}
+
+// scheme returns the topic templates, using GoogleTopicScheme for any that are empty.
+func (b GoogleBackend) scheme() TopicScheme {
+	return b.topics.withDefaults(GoogleTopicScheme)
+}
+
+// AWSBackend connects to AWS IoT Core.
+// The device ID is used as the thing name and devices authenticate using their certificate, so Credentials are required.
+//
+// The config is the desired state of the device's classic shadow and PublishState sets the reported state.
+// Events are published to things/{thing-name}/events and commands are received on things/{thing-name}/commands.
+type AWSBackend struct{}
+
+// Validate checks that credentials were provided and that no topic templates were provided, since AWS defines its own topics
+func (AWSBackend) Validate(options *ThingOptions) error {
+	if !hasCredentials(options) || options.Topics != (TopicScheme{}) {
+		return ErrConfigurationError
+	}
+	return nil
+}
+
+// ClientID returns the thing name
+func (AWSBackend) ClientID(id *ID) string {
+	return id.DeviceID
+}
+
+// Credentials returns no username or password because devices authenticate using their certificate
+func (AWSBackend) Credentials(options *ThingOptions, credentials *Credentials) (string, string, time.Time, error) {
+	return "", "", time.Time{}, nil
+}
+
+// ConfigTopics returns the shadow topics that the full shadow document is received on
+func (AWSBackend) ConfigTopics(id *ID) []string {
+	shadow := awsShadowTopic(id.DeviceID)
+	return []string{shadow + "/get/accepted", shadow + "/update/documents"}
+}
+
+// ConfigRequest requests the shadow document
+func (AWSBackend) ConfigRequest(id *ID) (string, []byte) {
+	return awsShadowTopic(id.DeviceID) + "/get", []byte{}
+}
+
+// DecodeConfig returns the desired state from a shadow document.
+// Updates that don't change the desired state, such as updates to the reported state, are ignored.
+func (AWSBackend) DecodeConfig(id *ID, topic string, payload []byte) ([]byte, bool, bool) {
+	type shadowState struct {
+		State struct {
+			Desired json.RawMessage `json:"desired"`
+		} `json:"state"`
+	}
+	switch strings.TrimPrefix(topic, awsShadowTopic(id.DeviceID)) {
+	case "/get/accepted":
+		document := shadowState{}
+		if json.Unmarshal(payload, &document) != nil || document.State.Desired == nil {
+			return nil, false, false
+		}
+		return document.State.Desired, true, false
+	case "/update/documents":
+		documents := struct {
+			Previous shadowState `json:"previous"`
+			Current  shadowState `json:"current"`
+		}{}
+		if json.Unmarshal(payload, &documents) != nil || documents.Current.State.Desired == nil {
+			return nil, false, false
+		}
+		if bytes.Equal(documents.Previous.State.Desired, documents.Current.State.Desired) {
+			return nil, false, false
+		}
+		return documents.Current.State.Desired, true, false
+	}
+	return nil, false, false
+}
+
+// StateTopic returns the shadow update topic
+func (AWSBackend) StateTopic(id *ID) string {
+	return awsShadowTopic(id.DeviceID) + "/update"
+}
+
+// EncodeState returns a shadow update that sets the reported state
+func (AWSBackend) EncodeState(state []byte) ([]byte, error) {
+	if !isJSONObject(state) {
+		return nil, ErrInvalidState
+	}
+	return []byte(`{"state":{"reported":` + string(state) + `}}`), nil
+}
+
+// EventsTopic returns things/{thing-name}/events followed by the subfolder
+func (AWSBackend) EventsTopic(id *ID, subfolder ...string) string {
+	return strings.Join(append([]string{"things", id.DeviceID, "events"}, subfolder...), "/")
+}
+
+// CommandsTopic returns things/{thing-name}/commands
+func (AWSBackend) CommandsTopic(id *ID) string {
+	return fmt.Sprintf("things/%s/commands", id.DeviceID)
+}
+
+// ErrorsTopic returns an empty string because AWS IoT Core doesn't report errors
+func (AWSBackend) ErrorsTopic(id *ID) string {
+	return ""
+}
+
+// AzureBackend connects to Azure IoT Hub.
+// Devices authenticate using a shared access signature if SharedAccessKey is set, or otherwise using their certificate.
+//
+// The config is the desired properties of the device twin and PublishState sets the reported properties.
+// Events are sent as device-to-cloud messages with the subfolder in the subfolder property.
+// Cloud-to-device messages are received as commands and their subfolder is the URL encoded property bag.
+type AzureBackend struct {
+	// HostName is the host name of the IoT Hub, such as my-hub.azure-devices.net.
+	// This value is required.
+	HostName string
+	// SharedAccessKey is the decoded symmetric key of the device.
+	// If it is set, ThingOptions.AuthTokenExpiration determines how long each signature is valid.
+	SharedAccessKey []byte
+}
+
+// Validate checks that the host name and either a shared access key or credentials were provided,
+// and that no topic templates were provided, since IoT Hub defines its own topics
+func (b AzureBackend) Validate(options *ThingOptions) error {
+	if b.HostName == "" || (len(b.SharedAccessKey) == 0 && !hasCredentials(options)) || options.Topics != (TopicScheme{}) {
+		return ErrConfigurationError
+	}
+	return nil
+}
+
+// ClientID returns the device ID
+func (b AzureBackend) ClientID(id *ID) string {
+	return id.DeviceID
+}
+
+// Credentials returns the username expected by IoT Hub and a shared access signature, if a key was provided
+func (b AzureBackend) Credentials(options *ThingOptions, credentials *Credentials) (string, string, time.Time, error) {
+	username := fmt.Sprintf("%s/%s/?api-version=%s", b.HostName, options.ID.DeviceID, AzureAPIVersion)
+	if len(b.SharedAccessKey) == 0 {
+		return username, "", time.Time{}, nil
+	}
+	expiry := options.Clock.Now().Add(options.AuthTokenExpiration)
+	return username, b.sharedAccessSignature(options.ID.DeviceID, expiry), expiry, nil
+}
+
+// sharedAccessSignature returns a shared access signature for the device that expires at the given time.
+func (b AzureBackend) sharedAccessSignature(deviceID string, expiry time.Time) string {
+	resource := url.QueryEscape(b.HostName + "/devices/" + deviceID)
+	se := strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, b.SharedAccessKey)
+	mac.Write([]byte(resource + "\n" + se))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s", resource, url.QueryEscape(sig), se)
+}
+
+// ConfigTopics returns the twin response topic and the desired properties topic
+func (b AzureBackend) ConfigTopics(id *ID) []string {
+	return []string{"$iothub/twin/res/#", "$iothub/twin/PATCH/properties/desired/#"}
+}
+
+// ConfigRequest requests the device twin
+func (b AzureBackend) ConfigRequest(id *ID) (string, []byte) {
+	return "$iothub/twin/GET/?$rid=config", []byte{}
+}
+
+// DecodeConfig returns the desired properties from the device twin.
+// Desired property updates only contain the changes, so the twin is requested again.
+func (b AzureBackend) DecodeConfig(id *ID, topic string, payload []byte) ([]byte, bool, bool) {
+	if strings.HasPrefix(topic, "$iothub/twin/PATCH/properties/desired/") {
+		return nil, false, true
+	}
+	if !strings.HasPrefix(topic, "$iothub/twin/res/200/") {
+		return nil, false, false
+	}
+	twin := struct {
+		Desired json.RawMessage `json:"desired"`
+	}{}
+	if json.Unmarshal(payload, &twin) != nil || twin.Desired == nil {
+		return nil, false, false
+	}
+	return twin.Desired, true, false
+}
+
+// StateTopic returns the reported properties topic
+func (b AzureBackend) StateTopic(id *ID) string {
+	return "$iothub/twin/PATCH/properties/reported/?$rid=state"
+}
+
+// EncodeState returns the state, which is used as the reported properties
+func (b AzureBackend) EncodeState(state []byte) ([]byte, error) {
+	if !isJSONObject(state) {
+		return nil, ErrInvalidState
+	}
+	return state, nil
+}
+
+// EventsTopic returns the device-to-cloud messages topic with the subfolder as a property
+func (b AzureBackend) EventsTopic(id *ID, subfolder ...string) string {
+	topic := fmt.Sprintf("devices/%s/messages/events/", id.DeviceID)
+	if len(subfolder) == 0 {
+		return topic
+	}
+	return topic + url.Values{"subfolder": {strings.Join(subfolder, "/")}}.Encode()
+}
+
+// CommandsTopic returns the cloud-to-device messages topic
+func (b AzureBackend) CommandsTopic(id *ID) string {
+	return fmt.Sprintf("devices/%s/messages/devicebound", id.DeviceID)
+}
+
+// ErrorsTopic returns an empty string because IoT Hub doesn't report errors
+func (b AzureBackend) ErrorsTopic(id *ID) string {
+	return ""
+}
+
+// GenericBackend connects to a self-hosted MQTT broker, such as Mosquitto.
+// The device ID is used as the client ID.
+// Devices authenticate using Username and Password, an auth token, or their certificate if the broker requires one.
+//
+// Configs are delivered as they are received, so they should be published to the config topic as retained messages.
+type GenericBackend struct {
+	// Topics holds the topic templates. If it is empty, ThingOptions.Topics is used instead.
+	// GenericTopicScheme is used for any templates that are empty, except Errors.
+	Topics TopicScheme
+	// Username is the MQTT username.
+	Username string
+	// Password is the MQTT password. It is ignored if AuthToken is true.
+	Password string
+	// AuthToken enables sending a JWT signed by the device's credentials as the password, like Cloud IoT Core.
+	// The audience of the JWT is the project ID and ThingOptions.AuthTokenExpiration determines how long it is valid.
+	AuthToken bool
+}
+
+// Validate checks that the topic templates are valid and that credentials were provided if they are needed to generate auth tokens
+func (b GenericBackend) Validate(options *ThingOptions) error {
+	if (b.AuthToken && !hasCredentials(options)) || b.scheme().Validate() != nil {
+		return ErrConfigurationError
+	}
+	return nil
+}
+
+// ClientID returns the device ID
+func (b GenericBackend) ClientID(id *ID) string {
+	return id.DeviceID
+}
+
+// Credentials returns the username and either the password or an auth token
+func (b GenericBackend) Credentials(options *ThingOptions, credentials *Credentials) (string, string, time.Time, error) {
+	if !b.AuthToken {
+		return b.Username, b.Password, time.Time{}, nil
+	}
+	if credentials == nil {
+		return "", "", time.Time{}, ErrConfigurationError
+	}
+	token, expiry, err := newAuthToken(options, credentials)
+	return b.Username, token, expiry, err
+}
+
+// ConfigTopics returns the config topic
+func (b GenericBackend) ConfigTopics(id *ID) []string {
+	return []string{b.scheme().ConfigTopic(id)}
+}
+
+// ConfigRequest returns an empty topic because configs are expected to be retained messages
+func (b GenericBackend) ConfigRequest(id *ID) (string, []byte) {
+	return "", nil
+}
+
+// DecodeConfig returns the payload
+func (b GenericBackend) DecodeConfig(id *ID, topic string, payload []byte) ([]byte, bool, bool) {
+	return payload, true, false
+}
+
+// StateTopic returns the state topic
+func (b GenericBackend) StateTopic(id *ID) string {
+	return b.scheme().StateTopic(id)
+}
+
+// EncodeState returns the state
+func (b GenericBackend) EncodeState(state []byte) ([]byte, error) {
+	return state, nil
+}
+
+// EventsTopic returns the events topic followed by the subfolder
+func (b GenericBackend) EventsTopic(id *ID, subfolder ...string) string {
+	return b.scheme().EventsTopic(id, subfolder...)
+}
+
+// CommandsTopic returns the commands topic
+func (b GenericBackend) CommandsTopic(id *ID) string {
+	return b.scheme().CommandsTopic(id)
+}
+
+// ErrorsTopic returns the errors topic, which is empty unless a template was provided
+func (b GenericBackend) ErrorsTopic(id *ID) string {
+	return b.scheme().ErrorsTopic(id)
+}
+
+// scheme returns the topic templates, using GenericTopicScheme for any that are empty.
+func (b GenericBackend) scheme() TopicScheme {
+	return b.Topics.withDefaults(GenericTopicScheme)
+}
+
+// newAuthToken returns a Cloud IoT Core auth token signed by the given credentials and its expiration time.
+func newAuthToken(options *ThingOptions, credentials *Credentials) (string, time.Time, error) {
+	signer, err := credentials.signer()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var signingMethod jwt.SigningMethod
+	switch credentials.Type {
+	case CredentialTypeEC:
+		signingMethod = signingMethodES256
+	case CredentialTypeRSA:
+		fallthrough
+	default:
+		signingMethod = signingMethodRS256
+	}
+
+	wt := jwt.New(signingMethod)
+
+	expirationInterval := options.AuthTokenExpiration
+	if expirationInterval == 0 {
+		expirationInterval = time.Hour
+	}
+
+	now := options.Clock.Now()
+	expiry := now.Add(expirationInterval)
+
+	wt.Claims = &jwt.StandardClaims{
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiry.Unix(),
+		Audience:  options.ID.ProjectID,
+	}
+
+	token, err := wt.SignedString(signer)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiry, nil
+}
+
+func awsShadowTopic(deviceID string) string {
+	return fmt.Sprintf("$aws/things/%s/shadow", deviceID)
+}
+
+// isJSONObject returns true if b contains a JSON object
+func isJSONObject(b []byte) bool {
+	var object map[string]json.RawMessage
+	return json.Unmarshal(b, &object) == nil && object != nil
+}
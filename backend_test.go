@@ -0,0 +1,265 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/vaelen/iot"
+)
+
+func TestAWSBackend(t *testing.T) {
+	ctx := context.Background()
+	initMockClient()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.Backend = iot.AWSBackend{}
+	options.StateRateLimit = iot.RateLimit{}
+	var received []string
+	options.ConfigHandler = func(thing iot.Thing, config []byte) {
+		received = append(received, string(config))
+		thing.PublishState(ctx, []byte(`{"config":`+string(config)+`}`))
+	}
+	options.CommandHandler = func(thing iot.Thing, subfolder string, command []byte) {
+		received = append(received, "command "+subfolder)
+	}
+
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://example.iot.us-east-1.amazonaws.com:8883")
+	defer doDisconnectTest(t, thing)
+
+	if mockClient.ClientID != TestID.DeviceID {
+		t.Fatalf("Wrong client ID: %s", mockClient.ClientID)
+	}
+	// Devices authenticate using their certificate
+	username, password := mockClient.CredentialsProvider()
+	if username != "" || password != "" || !thing.AuthTokenExpiry().IsZero() {
+		t.Fatalf("Wrong credentials: %s, %s, %v", username, password, thing.AuthTokenExpiry())
+	}
+	if len(mockClient.Messages["$aws/things/test-device/shadow/get"]) != 1 {
+		t.Fatalf("Shadow wasn't requested: %v", mockClient.Messages)
+	}
+
+	mockClient.Receive("$aws/things/test-device/shadow/get/accepted", []byte(`{"state":{"desired":{"a":1}},"version":1}`))
+	l := mockClient.Messages["$aws/things/test-device/shadow/update"]
+	if len(l) != 1 || string(l[0].([]byte)) != `{"state":{"reported":{"config":{"a":1}}}}` {
+		t.Fatalf("Wrong shadow update: %v", l)
+	}
+
+	// Updates to the reported state don't change the config
+	mockClient.Receive("$aws/things/test-device/shadow/update/documents", []byte(
+		`{"previous":{"state":{"desired":{"a":1}}},"current":{"state":{"desired":{"a":1},"reported":{"config":{"a":1}}}}}`))
+	mockClient.Receive("$aws/things/test-device/shadow/update/documents", []byte(
+		`{"previous":{"state":{"desired":{"a":1}}},"current":{"state":{"desired":{"a":2}}}}`))
+	mockClient.Receive("things/test-device/commands/reboot", []byte("now"))
+	expected := []string{`{"a":1}`, `{"a":2}`, "command reboot"}
+	if strings.Join(received, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Wrong configs and commands: %v", received)
+	}
+
+	if err := thing.PublishState(ctx, []byte("ok")); err != iot.ErrInvalidState {
+		t.Fatalf("Wrong error publishing invalid state: %v", err)
+	}
+	if err := thing.PublishEvent(ctx, []byte("event"), "a", "b"); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	if len(mockClient.Messages["things/test-device/events/a/b"]) != 1 {
+		t.Fatalf("Event wasn't published: %v", mockClient.Messages)
+	}
+
+	gateway := iot.NewGateway(options)
+	if _, err := gateway.Attach(ctx, &iot.BoundDeviceOptions{DeviceID: "bound"}); err != iot.ErrUnsupportedBackend {
+		t.Fatalf("Wrong error attaching a device: %v", err)
+	}
+}
+
+func TestAzureBackend(t *testing.T) {
+	ctx := context.Background()
+	initMockClient()
+	options, configReceived := getOptions(t, nil)
+	options.Backend = iot.AzureBackend{}
+	thing := getThing(t, options)
+	if err := thing.Connect(ctx, "ssl://hub.example.com:8883"); err != iot.ErrConfigurationError {
+		t.Fatalf("Connected without a host name: %v", err)
+	}
+
+	backend := iot.AzureBackend{HostName: "hub.example.com", SharedAccessKey: []byte("secret")}
+	options.Backend = backend
+	options.ConfigHandler = func(thing iot.Thing, config []byte) {
+		configReceived.Write(config)
+	}
+	thing = getThing(t, options)
+	doConnectionTest(t, thing, "ssl://hub.example.com:8883")
+	defer doDisconnectTest(t, thing)
+
+	if mockClient.ClientID != TestID.DeviceID {
+		t.Fatalf("Wrong client ID: %s", mockClient.ClientID)
+	}
+	username, password := mockClient.CredentialsProvider()
+	if username != "hub.example.com/test-device/?api-version="+iot.AzureAPIVersion {
+		t.Fatalf("Wrong username: %s", username)
+	}
+	verifySharedAccessSignature(t, password, "hub.example.com/devices/test-device", []byte("secret"), thing.AuthTokenExpiry())
+
+	if len(mockClient.Messages["$iothub/twin/GET/?$rid=config"]) != 1 {
+		t.Fatalf("Twin wasn't requested: %v", mockClient.Messages)
+	}
+	mockClient.Receive("$iothub/twin/res/200/?$rid=config", []byte(`{"desired":{"a":1,"$version":1},"reported":{}}`))
+	mockClient.Receive("$iothub/twin/res/204/?$rid=state&$version=2", []byte{})
+	if configReceived.String() != `{"a":1,"$version":1}` {
+		t.Fatalf("Wrong config: %s", configReceived.String())
+	}
+
+	if err := thing.PublishState(ctx, []byte(`{"b":2}`)); err != nil {
+		t.Fatalf("Couldn't publish state: %v", err)
+	}
+	if len(mockClient.Messages["$iothub/twin/PATCH/properties/reported/?$rid=state"]) != 1 {
+		t.Fatalf("State wasn't published: %v", mockClient.Messages)
+	}
+	if err := thing.PublishEvent(ctx, []byte("event"), "a", "b"); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	if len(mockClient.Messages["devices/test-device/messages/events/subfolder=a%2Fb"]) != 1 {
+		t.Fatalf("Event wasn't published: %v", mockClient.Messages)
+	}
+}
+
+func TestGenericBackend(t *testing.T) {
+	ctx := context.Background()
+	initMockClient()
+	options, configReceived := getOptions(t, nil)
+	options.Backend = iot.GenericBackend{
+		Topics: iot.TopicScheme{
+			Config: "lab/{registry}/{device}/config",
+			State:  "lab/{registry}/{device}/state",
+		},
+		Username: "user",
+		Password: "pass",
+	}
+	options.ConfigHandler = func(thing iot.Thing, config []byte) {
+		configReceived.Write(config)
+	}
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "tcp://broker.example.com:1883")
+
+	if mockClient.ClientID != TestID.DeviceID {
+		t.Fatalf("Wrong client ID: %s", mockClient.ClientID)
+	}
+	username, password := mockClient.CredentialsProvider()
+	if username != "user" || password != "pass" || !thing.AuthTokenExpiry().IsZero() {
+		t.Fatalf("Wrong credentials: %s, %s, %v", username, password, thing.AuthTokenExpiry())
+	}
+	mockClient.Receive("lab/test-registry/test-device/config", []byte("config"))
+	if configReceived.String() != "config" {
+		t.Fatalf("Wrong config: %s", configReceived.String())
+	}
+	if err := thing.PublishState(ctx, []byte("state")); err != nil {
+		t.Fatalf("Couldn't publish state: %v", err)
+	}
+	if len(mockClient.Messages["lab/test-registry/test-device/state"]) != 1 {
+		t.Fatalf("State wasn't published: %v", mockClient.Messages)
+	}
+	// Templates that aren't set use GenericTopicScheme
+	if err := thing.PublishEvent(ctx, []byte("event"), "a", "b"); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	if len(mockClient.Messages["devices/test-device/events/a/b"]) != 1 {
+		t.Fatalf("Event wasn't published: %v", mockClient.Messages)
+	}
+	doDisconnectTest(t, thing)
+
+	// Auth tokens require credentials
+	options.Backend = iot.GenericBackend{AuthToken: true}
+	thing = getThing(t, options)
+	if err := thing.Connect(ctx, "tcp://broker.example.com:1883"); err != iot.ErrConfigurationError {
+		t.Fatalf("Connected without credentials: %v", err)
+	}
+
+	credentials := getCredentials(t, iot.CredentialTypeRSA)
+	options, _ = getOptions(t, credentials)
+	options.Backend = iot.GenericBackend{Username: "user", AuthToken: true}
+	options.CleanSession = true
+	thing = getThing(t, options)
+	doConnectionTest(t, thing, "tcp://broker.example.com:1883")
+	defer doDisconnectTest(t, thing)
+	username, password = mockClient.CredentialsProvider()
+	token, err := jwt.Parse(password, func(token *jwt.Token) (interface{}, error) {
+		return credentials.PrivateKey.(crypto.Signer).Public(), nil
+	})
+	if username != "user" || err != nil || !token.Valid || thing.AuthTokenExpiry().IsZero() {
+		t.Fatalf("Wrong credentials: %s, %s, %v", username, password, err)
+	}
+}
+
+func TestBackendTopics(t *testing.T) {
+	ctx := context.Background()
+	initMockClient()
+
+	// GenericBackend uses ThingOptions.Topics if it doesn't have its own
+	options, _ := getOptions(t, nil)
+	options.Backend = iot.GenericBackend{}
+	options.Topics = iot.TopicScheme{State: "lab/{device}/state"}
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "tcp://broker.example.com:1883")
+	if err := thing.PublishState(ctx, []byte("state")); err != nil {
+		t.Fatalf("Couldn't publish state: %v", err)
+	}
+	if len(mockClient.Messages["lab/test-device/state"]) != 1 {
+		t.Fatalf("State wasn't published: %v", mockClient.Messages)
+	}
+	doDisconnectTest(t, thing)
+
+	// Its own topics take precedence
+	options.Backend = iot.GenericBackend{Topics: iot.TopicScheme{State: "own/{device}/state"}}
+	thing = getThing(t, options)
+	doConnectionTest(t, thing, "tcp://broker.example.com:1883")
+	if err := thing.PublishState(ctx, []byte("state")); err != nil {
+		t.Fatalf("Couldn't publish state: %v", err)
+	}
+	if len(mockClient.Messages["own/test-device/state"]) != 1 {
+		t.Fatalf("State wasn't published: %v", mockClient.Messages)
+	}
+	doDisconnectTest(t, thing)
+
+	// Backends that define their own topics reject topic templates
+	backends := []iot.Backend{
+		iot.AWSBackend{},
+		iot.AzureBackend{HostName: "hub.example.com", SharedAccessKey: []byte("secret")},
+	}
+	for _, backend := range backends {
+		options, _ = getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+		options.Backend = backend
+		options.Topics = iot.TopicScheme{State: "lab/{device}/state"}
+		thing = getThing(t, options)
+		if err := thing.Connect(ctx, "ssl://example.com:8883"); err != iot.ErrConfigurationError {
+			t.Fatalf("Connected with topic templates using %T: %v", backend, err)
+		}
+	}
+}
+
+// verifySharedAccessSignature checks that a shared access signature was signed by the key and expires at the given time.
+func verifySharedAccessSignature(t *testing.T, signature string, resource string, key []byte, expiry time.Time) {
+	t.Helper()
+	values, err := url.ParseQuery(strings.TrimPrefix(signature, "SharedAccessSignature "))
+	if err != nil || !strings.HasPrefix(signature, "SharedAccessSignature ") {
+		t.Fatalf("Invalid shared access signature: %s", signature)
+	}
+	if values.Get("sr") != resource || values.Get("se") != strconv.FormatInt(expiry.Unix(), 10) {
+		t.Fatalf("Wrong resource or expiry: %s", signature)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(url.QueryEscape(resource) + "\n" + values.Get("se")))
+	if values.Get("sig") != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("Wrong signature: %s", signature)
+	}
+}
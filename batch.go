@@ -0,0 +1,457 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// MaxPayloadSize is the largest MQTT payload accepted by Cloud IoT Core.
+const MaxPayloadSize = 256 * 1024
+
+// DefaultBatchWindow is the longest time an event waits to be published if BatchOptions.Window is not set.
+const DefaultBatchWindow = time.Second
+
+// ErrEventTooLarge is returned for an event that exceeds the maximum batch size on its own.
+var ErrEventTooLarge = fmt.Errorf("event is larger than the maximum batch size")
+
+// ErrInvalidEvent is returned for an event that can't be encoded, such as an event that isn't valid JSON when using BatchJSON.
+var ErrInvalidEvent = fmt.Errorf("event can't be encoded in the batch")
+
+// ErrInvalidBatch is returned by DecodeBatch if a payload isn't a valid batch.
+var ErrInvalidBatch = fmt.Errorf("invalid batch")
+
+// ErrBatcherClosed is returned for events that are added after an EventBatcher is closed.
+var ErrBatcherClosed = fmt.Errorf("batcher is closed")
+
+// BatchEncoding determines how the events in a batch are encoded.
+type BatchEncoding uint8
+
+const (
+	// BatchJSON encodes a batch as a JSON array. Each event must be a valid JSON value.
+	BatchJSON BatchEncoding = iota
+	// BatchCBOR encodes a batch as a CBOR array of byte strings.
+	BatchCBOR
+	// BatchProtobuf encodes a batch as a sequence of events that are each prefixed by their length as a varint.
+	// This is the delimited format used to stream protocol buffer messages.
+	BatchProtobuf
+)
+
+// BatchOptions holds the options used to create an EventBatcher.
+type BatchOptions struct {
+	// Encoding determines how the events in a batch are encoded.
+	Encoding BatchEncoding
+	// Gzip enables compressing each batch.
+	// Batches are closed based on their uncompressed size, so compression reduces the amount of data that is sent.
+	Gzip bool
+	// MaxSize is the largest payload that will be published, in bytes.
+	// If it is zero or larger than MaxPayloadSize, MaxPayloadSize is used.
+	MaxSize int
+	// Window is the longest time an event waits to be published. If it is zero, DefaultBatchWindow is used.
+	Window time.Duration
+	// Clock represents the system clock. If it is nil, the system clock is used.
+	Clock clock.Clock
+}
+
+// EventBatcher combines events that are published to the same subfolder into a single message.
+// A batch is published when it reaches the maximum size or when its oldest event has waited for the batch window.
+// The result of publishing each event is reported separately.
+type EventBatcher struct {
+	thing   Thing
+	options BatchOptions
+
+	mu         sync.Mutex
+	batches    map[string]*eventBatch
+	queue      []*eventBatch
+	publishing bool
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// eventBatch holds the events waiting to be published to a subfolder.
+type eventBatch struct {
+	subfolder []string
+	events    []*batchedEvent
+	size      int
+	timer     *clock.Timer
+}
+
+// batchedEvent is an event and the channel its result is sent on.
+type batchedEvent struct {
+	payload []byte
+	result  chan error
+}
+
+// NewEventBatcher returns an EventBatcher that publishes batches using the given Thing.
+func NewEventBatcher(thing Thing, options *BatchOptions) *EventBatcher {
+	b := &EventBatcher{
+		thing:   thing,
+		batches: make(map[string]*eventBatch),
+	}
+	if options != nil {
+		b.options = *options
+	}
+	if b.options.MaxSize <= 0 || b.options.MaxSize > MaxPayloadSize {
+		b.options.MaxSize = MaxPayloadSize
+	}
+	if b.options.Window <= 0 {
+		b.options.Window = DefaultBatchWindow
+	}
+	if b.options.Clock == nil {
+		b.options.Clock = clock.New()
+	}
+	return b
+}
+
+// Add adds an event to the batch for the given subfolder.
+// The returned channel receives the result of publishing the batch that contains the event,
+// or an error if the event can't be batched, such as ErrEventTooLarge or ErrInvalidSubfolder.
+func (b *EventBatcher) Add(message []byte, subfolder ...string) <-chan error {
+	result := make(chan error, 1)
+	if err := b.validate(message, subfolder); err != nil {
+		result <- err
+		return result
+	}
+	event := &batchedEvent{payload: append([]byte{}, message...), result: result}
+	size := b.options.Encoding.eventSize(len(message))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		result <- ErrBatcherClosed
+		return result
+	}
+	key := strings.Join(subfolder, "/")
+	batch := b.batches[key]
+	if batch != nil && b.options.Encoding.batchSize(len(batch.events)+1, batch.size+size) > b.options.MaxSize {
+		b.closeBatch(key, batch)
+		batch = nil
+	}
+	if batch == nil {
+		batch = &eventBatch{subfolder: append([]string{}, subfolder...)}
+		batch.timer = b.options.Clock.AfterFunc(b.options.Window, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.batches[key] == batch {
+				b.closeBatch(key, batch)
+			}
+		})
+		b.batches[key] = batch
+	}
+	batch.events = append(batch.events, event)
+	batch.size += size
+	return result
+}
+
+// Flush publishes all of the waiting events and returns when they have been published.
+func (b *EventBatcher) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	for key, batch := range b.batches {
+		b.closeBatch(key, batch)
+	}
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close publishes all of the waiting events and stops accepting new events.
+func (b *EventBatcher) Close(ctx context.Context) error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	return b.Flush(ctx)
+}
+
+// validate returns an error if the event can't be added to a batch.
+func (b *EventBatcher) validate(message []byte, subfolder []string) error {
+	if err := ValidateSubfolder(subfolder...); err != nil {
+		return err
+	}
+	if b.options.Encoding == BatchJSON && !json.Valid(message) {
+		return ErrInvalidEvent
+	}
+	// Compressed events are checked when they are encoded
+	if !b.options.Gzip && b.options.Encoding.batchSize(1, b.options.Encoding.eventSize(len(message))) > b.options.MaxSize {
+		return ErrEventTooLarge
+	}
+	return nil
+}
+
+// closeBatch stops accepting events for a batch and queues it to be published in the background.
+// Batches are published in the order they are closed, so events are published in the order they were added.
+// The caller must hold the lock.
+func (b *EventBatcher) closeBatch(key string, batch *eventBatch) {
+	batch.timer.Stop()
+	delete(b.batches, key)
+	b.wg.Add(1)
+	b.queue = append(b.queue, batch)
+	if !b.publishing {
+		b.publishing = true
+		go b.publishQueue()
+	}
+}
+
+// publishQueue publishes the queued batches until the queue is empty.
+func (b *EventBatcher) publishQueue() {
+	for {
+		b.mu.Lock()
+		if len(b.queue) == 0 {
+			b.publishing = false
+			b.mu.Unlock()
+			return
+		}
+		batch := b.queue[0]
+		b.queue = b.queue[1:]
+		b.mu.Unlock()
+
+		b.publish(context.Background(), batch.subfolder, batch.events)
+		b.wg.Done()
+	}
+}
+
+// publish encodes and publishes the events, splitting them into smaller batches if the payload is too large.
+func (b *EventBatcher) publish(ctx context.Context, subfolder []string, events []*batchedEvent) {
+	payloads := make([][]byte, len(events))
+	for i, event := range events {
+		payloads[i] = event.payload
+	}
+	payload, err := EncodeBatch(payloads, b.options.Encoding, b.options.Gzip)
+	if err == nil && len(payload) > b.options.MaxSize {
+		if len(events) == 1 {
+			err = ErrEventTooLarge
+		} else {
+			b.publish(ctx, subfolder, events[:len(events)/2])
+			b.publish(ctx, subfolder, events[len(events)/2:])
+			return
+		}
+	}
+	if err == nil {
+		err = b.thing.PublishEvent(ctx, payload, subfolder...)
+	}
+	for _, event := range events {
+		event.result <- err
+	}
+}
+
+// EncodeBatch encodes events using the given encoding and optionally compresses the result.
+// Events encoded as JSON must be valid JSON values.
+func EncodeBatch(events [][]byte, encoding BatchEncoding, compress bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	var w io.Writer = buf
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(buf)
+		w = zw
+	}
+	if err := encoding.encode(w, events); err != nil {
+		return nil, err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeBatch returns the events in a batch that was encoded by EncodeBatch.
+// It can be used by the services that receive the batches.
+func DecodeBatch(payload []byte, encoding BatchEncoding, compressed bool) ([][]byte, error) {
+	if compressed {
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, ErrInvalidBatch
+		}
+		if payload, err = ioutil.ReadAll(r); err != nil {
+			return nil, ErrInvalidBatch
+		}
+	}
+	return encoding.decode(payload)
+}
+
+func (e BatchEncoding) encode(w io.Writer, events [][]byte) error {
+	switch e {
+	case BatchJSON:
+		// The events are written as they are so that the size of the batch is predictable
+		_, err := w.Write(append(append([]byte{'['}, bytes.Join(events, []byte{','})...), ']'))
+		return err
+	case BatchCBOR:
+		if _, err := w.Write(cborHeader(cborArray, uint64(len(events)))); err != nil {
+			return err
+		}
+		for _, event := range events {
+			if _, err := w.Write(cborHeader(cborByteString, uint64(len(event)))); err != nil {
+				return err
+			}
+			if _, err := w.Write(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	case BatchProtobuf:
+		prefix := make([]byte, binary.MaxVarintLen64)
+		for _, event := range events {
+			n := binary.PutUvarint(prefix, uint64(len(event)))
+			if _, err := w.Write(prefix[:n]); err != nil {
+				return err
+			}
+			if _, err := w.Write(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown batch encoding: %d", e)
+}
+
+func (e BatchEncoding) decode(payload []byte) ([][]byte, error) {
+	var events [][]byte
+	switch e {
+	case BatchJSON:
+		var raw []json.RawMessage
+		if err := json.Unmarshal(payload, &raw); err != nil {
+			return nil, ErrInvalidBatch
+		}
+		for _, event := range raw {
+			events = append(events, event)
+		}
+	case BatchCBOR:
+		r := bytes.NewReader(payload)
+		count, err := readCBORHeader(r, cborArray)
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < count; i++ {
+			size, err := readCBORHeader(r, cborByteString)
+			if err != nil || size > uint64(r.Len()) {
+				return nil, ErrInvalidBatch
+			}
+			event := make([]byte, size)
+			if _, err = io.ReadFull(r, event); err != nil {
+				return nil, ErrInvalidBatch
+			}
+			events = append(events, event)
+		}
+		if r.Len() != 0 {
+			return nil, ErrInvalidBatch
+		}
+	case BatchProtobuf:
+		r := bytes.NewReader(payload)
+		for {
+			size, err := binary.ReadUvarint(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil || size > uint64(r.Len()) {
+				return nil, ErrInvalidBatch
+			}
+			event := make([]byte, size)
+			if _, err = io.ReadFull(r, event); err != nil {
+				return nil, ErrInvalidBatch
+			}
+			events = append(events, event)
+		}
+	default:
+		return nil, fmt.Errorf("unknown batch encoding: %d", e)
+	}
+	return events, nil
+}
+
+// eventSize returns the number of bytes an event of the given length adds to a batch.
+func (e BatchEncoding) eventSize(length int) int {
+	switch e {
+	case BatchCBOR:
+		return len(cborHeader(cborByteString, uint64(length))) + length
+	case BatchProtobuf:
+		return binary.PutUvarint(make([]byte, binary.MaxVarintLen64), uint64(length)) + length
+	}
+	// Each event is followed by a comma
+	return length + 1
+}
+
+// batchSize returns the size of a batch of count events whose eventSizes add up to size.
+func (e BatchEncoding) batchSize(count int, size int) int {
+	switch e {
+	case BatchCBOR:
+		return len(cborHeader(cborArray, uint64(count))) + size
+	case BatchProtobuf:
+		return size
+	}
+	// The brackets replace the last comma
+	return size + 1
+}
+
+// CBOR major types
+const (
+	cborByteString = 2
+	cborArray      = 4
+)
+
+// cborHeader returns the header of a CBOR data item with the given major type and length.
+func cborHeader(majorType byte, length uint64) []byte {
+	t := majorType << 5
+	switch {
+	case length < 24:
+		return []byte{t | byte(length)}
+	case length <= 0xff:
+		return []byte{t | 24, byte(length)}
+	case length <= 0xffff:
+		b := []byte{t | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(length))
+		return b
+	case length <= 0xffffffff:
+		b := []byte{t | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(length))
+		return b
+	}
+	b := []byte{t | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[1:], length)
+	return b
+}
+
+// readCBORHeader reads the header of a CBOR data item with the given major type and returns its length.
+func readCBORHeader(r *bytes.Reader, majorType byte) (uint64, error) {
+	initial, err := r.ReadByte()
+	if err != nil || initial>>5 != majorType {
+		return 0, ErrInvalidBatch
+	}
+	info := initial & 0x1f
+	if info < 24 {
+		return uint64(info), nil
+	}
+	if info > 27 {
+		return 0, ErrInvalidBatch
+	}
+	b := make([]byte, 1<<(info-24))
+	if _, err = io.ReadFull(r, b); err != nil {
+		return 0, ErrInvalidBatch
+	}
+	length := uint64(0)
+	for _, c := range b {
+		length = length<<8 | uint64(c)
+	}
+	return length, nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/vaelen/iot"
+)
+
+func TestEventBatcher(t *testing.T) {
+	initMockClient()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.EventRateLimit = iot.RateLimit{}
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+
+	mockClock := clock.NewMock()
+	batcher := iot.NewEventBatcher(thing, &iot.BatchOptions{Window: time.Second * 10, Clock: mockClock})
+	results := []<-chan error{
+		batcher.Add([]byte(`{"t":1}`), "a"),
+		batcher.Add([]byte(`{"t":2}`), "a"),
+		batcher.Add([]byte(`{"t":3}`), "b"),
+	}
+	if err := <-batcher.Add([]byte("not json"), "a"); err != iot.ErrInvalidEvent {
+		t.Fatalf("Wrong error for an invalid event: %v", err)
+	}
+	if err := <-batcher.Add([]byte("{}"), "a/#"); err != iot.ErrInvalidSubfolder {
+		t.Fatalf("Wrong error for an invalid subfolder: %v", err)
+	}
+
+	// Batches are published after the window
+	mockClock.Add(time.Second * 10)
+	for _, result := range results {
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Fatalf("Couldn't publish batch: %v", err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Batch wasn't published")
+		}
+	}
+	checkBatches(t, "/devices/test-device/events/a", iot.BatchJSON, false, `{"t":1}`, `{"t":2}`)
+	checkBatches(t, "/devices/test-device/events/b", iot.BatchJSON, false, `{"t":3}`)
+}
+
+func TestEventBatcherSplit(t *testing.T) {
+	ctx := context.Background()
+	initMockClient()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.EventRateLimit = iot.RateLimit{}
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+
+	// A batch is closed when the next event would make it larger than the maximum size
+	batcher := iot.NewEventBatcher(thing, &iot.BatchOptions{Encoding: iot.BatchCBOR, MaxSize: 100})
+	var events []string
+	var results []<-chan error
+	for i := 0; i < 5; i++ {
+		event := fmt.Sprintf("event %d %s", i, bytes.Repeat([]byte("x"), 30))
+		events = append(events, event)
+		results = append(results, batcher.Add([]byte(event), "a"))
+	}
+	if err := <-batcher.Add(bytes.Repeat([]byte("x"), 100), "a"); err != iot.ErrEventTooLarge {
+		t.Fatalf("Wrong error for a large event: %v", err)
+	}
+	if err := batcher.Close(ctx); err != nil {
+		t.Fatalf("Couldn't flush batches: %v", err)
+	}
+	for _, result := range results {
+		if err := <-result; err != nil {
+			t.Fatalf("Couldn't publish batch: %v", err)
+		}
+	}
+	checkBatches(t, "/devices/test-device/events/a", iot.BatchCBOR, false, events...)
+	if n := len(mockClient.Messages["/devices/test-device/events/a"]); n != 3 {
+		t.Fatalf("Wrong number of batches: %d", n)
+	}
+	if err := <-batcher.Add([]byte("event"), "a"); err != iot.ErrBatcherClosed {
+		t.Fatalf("Wrong error after closing: %v", err)
+	}
+
+	// Compressed batches that are too large are split
+	initMockClient()
+	thing = getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+	batcher = iot.NewEventBatcher(thing, &iot.BatchOptions{Encoding: iot.BatchProtobuf, Gzip: true, MaxSize: 980})
+	events = nil
+	results = nil
+	for i := 0; i < 3; i++ {
+		// Random data can't be compressed, so the compressed batch is larger than the events
+		event := make([]byte, 320)
+		rand.Read(event)
+		events = append(events, string(event))
+		results = append(results, batcher.Add(event, "b"))
+	}
+	large := make([]byte, 990)
+	rand.Read(large)
+	tooLarge := batcher.Add(large, "c")
+	if err := batcher.Flush(ctx); err != nil {
+		t.Fatalf("Couldn't flush batches: %v", err)
+	}
+	for _, result := range results {
+		if err := <-result; err != nil {
+			t.Fatalf("Couldn't publish batch: %v", err)
+		}
+	}
+	if err := <-tooLarge; err != iot.ErrEventTooLarge {
+		t.Fatalf("Wrong error for a large compressed event: %v", err)
+	}
+	checkBatches(t, "/devices/test-device/events/b", iot.BatchProtobuf, true, events...)
+	if n := len(mockClient.Messages["/devices/test-device/events/b"]); n != 2 {
+		t.Fatalf("Wrong number of batches: %d", n)
+	}
+}
+
+func TestEventBatcherNotConnected(t *testing.T) {
+	ctx := context.Background()
+	initMockClient()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	thing := getThing(t, options)
+
+	batcher := iot.NewEventBatcher(thing, nil)
+	result := batcher.Add([]byte("1"))
+	if err := batcher.Flush(ctx); err != nil {
+		t.Fatalf("Couldn't flush batches: %v", err)
+	}
+	if err := <-result; err != iot.ErrNotConnected {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestDecodeInvalidBatch(t *testing.T) {
+	for _, test := range []struct {
+		encoding iot.BatchEncoding
+		payload  string
+	}{
+		{iot.BatchJSON, "[1,"},
+		{iot.BatchCBOR, "\x81\x5a\xff\xff\xff\xff"},
+		{iot.BatchCBOR, "\x82\x41a"},
+		{iot.BatchCBOR, "\x81\x41ab"},
+		{iot.BatchProtobuf, "\xff\xff\xff\xff\xff\xff\xff\xff\x7f"},
+		{iot.BatchProtobuf, "\x01a\x02b"},
+		{iot.BatchProtobuf, "\x80"},
+	} {
+		if _, err := iot.DecodeBatch([]byte(test.payload), test.encoding, false); err != iot.ErrInvalidBatch {
+			t.Fatalf("Wrong error for invalid batch %q: %v", test.payload, err)
+		}
+	}
+}
+
+// checkBatches checks that the batches published to the topic contain the events and are no larger than MaxPayloadSize.
+func checkBatches(t *testing.T, topic string, encoding iot.BatchEncoding, compressed bool, expected ...string) {
+	t.Helper()
+	var events []string
+	for _, message := range mockClient.Messages[topic] {
+		payload := message.([]byte)
+		if len(payload) > iot.MaxPayloadSize {
+			t.Fatalf("Batch is too large: %d bytes", len(payload))
+		}
+		batch, err := iot.DecodeBatch(payload, encoding, compressed)
+		if err != nil {
+			t.Fatalf("Couldn't decode batch: %v", err)
+		}
+		for _, event := range batch {
+			events = append(events, string(event))
+		}
+	}
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Fatalf("Wrong events published to %s: %q", topic, events)
+	}
+}
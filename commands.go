@@ -0,0 +1,77 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"strings"
+	"sync"
+)
+
+// CommandMux routes commands to handlers based on their subfolder.
+// Its HandleCommand method can be used as ThingOptions.CommandHandler.
+type CommandMux struct {
+	mu             sync.RWMutex
+	handlers       map[string]CommandHandler
+	defaultHandler CommandHandler
+}
+
+// NewCommandMux returns a new, empty CommandMux.
+func NewCommandMux() *CommandMux {
+	return &CommandMux{handlers: make(map[string]CommandHandler)}
+}
+
+// Handle registers the handler for the given subfolder.
+// Nested subfolders are separated by slashes, for example "a/b".
+// An empty subfolder matches commands that were sent without a subfolder.
+// Registering a nil handler removes the existing handler for the subfolder.
+func (m *CommandMux) Handle(subfolder string, handler CommandHandler) {
+	subfolder = strings.Trim(subfolder, "/")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if handler == nil {
+		delete(m.handlers, subfolder)
+		return
+	}
+	m.handlers[subfolder] = handler
+}
+
+// HandleDefault registers the handler that is called when no other handler matches.
+func (m *CommandMux) HandleDefault(handler CommandHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.defaultHandler = handler
+}
+
+// HandleCommand dispatches the command to the handler registered for its subfolder.
+// If no handler is registered for the subfolder, the handler registered for the closest
+// parent subfolder will be used, followed by the default handler.
+func (m *CommandMux) HandleCommand(thing Thing, subfolder string, command []byte) {
+	handler := m.handler(subfolder)
+	if handler != nil {
+		handler(thing, subfolder, command)
+	}
+}
+
+func (m *CommandMux) handler(subfolder string) CommandHandler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key := strings.Trim(subfolder, "/")
+	if key == "" {
+		if handler, ok := m.handlers[key]; ok {
+			return handler
+		}
+		return m.defaultHandler
+	}
+	for key != "" {
+		if handler, ok := m.handlers[key]; ok {
+			return handler
+		}
+		i := strings.LastIndex(key, "/")
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return m.defaultHandler
+}
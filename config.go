@@ -0,0 +1,169 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// ConfigUnmarshaler decodes a configuration payload into v.
+type ConfigUnmarshaler func(data []byte, v interface{}) error
+
+// JSONConfig decodes JSON configurations.
+// YAML and protocol buffer configurations are supported by the yamlconfig and protoconfig packages,
+// which are separate so that devices only include the parsers they use.
+var JSONConfig ConfigUnmarshaler = json.Unmarshal
+
+// ConfigValidator can be implemented by configuration types to validate a decoded configuration.
+// Configurations that fail validation are rejected in the same way as configurations that can't be decoded.
+type ConfigValidator interface {
+	Validate() error
+}
+
+// TypedConfigHandler is called when a new configuration has been decoded and validated.
+// The version starts at 1 and increases each time the configuration changes.
+type TypedConfigHandler func(thing Thing, config interface{}, version int)
+
+// ConfigErrorHandler is called when a configuration is rejected.
+type ConfigErrorHandler func(thing Thing, err *ConfigError)
+
+// ConfigError describes a configuration that couldn't be decoded or validated.
+type ConfigError struct {
+	// Version is the version of the last good configuration, which is still in use.
+	Version int
+	// Payload is the rejected configuration.
+	Payload []byte
+	// Err is the error returned while decoding or validating the configuration.
+	Err error
+}
+
+// Error returns a description of the error.
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid configuration (keeping version %d): %v", e.Version, e.Err)
+}
+
+// TypedConfig decodes configurations into a user provided type.
+// Its HandleConfig method can be used as ThingOptions.ConfigHandler.
+//
+// The handler is only called when the decoded configuration changes, as determined by Equal.
+// If a configuration can't be decoded or validated, the last good configuration is kept
+// and the error is passed to the error handler.
+type TypedConfig struct {
+	// Equal compares two decoded configurations. If it is nil, reflect.DeepEqual is used.
+	// Protocol buffer configurations should be compared using protoconfig.Equal.
+	Equal func(a, b interface{}) bool
+
+	mu           sync.Mutex
+	newConfig    func() interface{}
+	unmarshal    ConfigUnmarshaler
+	handler      TypedConfigHandler
+	errorHandler ConfigErrorHandler
+	current      interface{}
+	version      int
+}
+
+// NewTypedConfig returns a TypedConfig that decodes configurations using the given unmarshaler.
+// The newConfig function must return a pointer to a new, empty configuration value, such as &MyConfig{}.
+// The errorHandler can report the error in the device's state or as an event, but because PublishState
+// replaces the whole state, it should include the rest of the application's state.
+// If errorHandler is nil, errors are logged using the Thing's ErrorLogger.
+func NewTypedConfig(newConfig func() interface{}, unmarshal ConfigUnmarshaler, handler TypedConfigHandler, errorHandler ConfigErrorHandler) *TypedConfig {
+	return &TypedConfig{
+		newConfig:    newConfig,
+		unmarshal:    unmarshal,
+		handler:      handler,
+		errorHandler: errorHandler,
+	}
+}
+
+// Current returns the last good configuration and its version.
+// It returns nil and 0 if no configuration has been accepted.
+func (c *TypedConfig) Current() (config interface{}, version int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current, c.version
+}
+
+// HandleConfig decodes and validates the configuration and calls the handler if it has changed.
+// Empty configurations are ignored because they mean that no configuration has been set.
+func (c *TypedConfig) HandleConfig(thing Thing, payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+	config, err := c.decode(payload)
+
+	c.mu.Lock()
+	if err != nil {
+		configErr := &ConfigError{Version: c.version, Payload: payload, Err: err}
+		c.mu.Unlock()
+		c.reportError(thing, configErr)
+		return
+	}
+	equal := c.Equal
+	if equal == nil {
+		equal = reflect.DeepEqual
+	}
+	if c.current != nil && equal(c.current, config) {
+		c.mu.Unlock()
+		return
+	}
+	c.current = config
+	c.version++
+	version := c.version
+	c.mu.Unlock()
+
+	if c.handler != nil {
+		c.handler(thing, config, version)
+	}
+}
+
+// Validate decodes and validates the configuration without handling it. Rejected configurations
+// are passed to the error handler, and the error is returned. It can be used as ThingOptions.ValidateConfig,
+// so that only configurations that are valid are persisted.
+func (c *TypedConfig) Validate(thing Thing, payload []byte) error {
+	if len(payload) == 0 {
+		return nil
+	}
+	_, err := c.decode(payload)
+	if err != nil {
+		c.mu.Lock()
+		configErr := &ConfigError{Version: c.version, Payload: payload, Err: err}
+		c.mu.Unlock()
+		c.reportError(thing, configErr)
+		return configErr
+	}
+	return nil
+}
+
+func (c *TypedConfig) decode(payload []byte) (interface{}, error) {
+	config := c.newConfig()
+	if err := c.unmarshal(payload, config); err != nil {
+		return nil, err
+	}
+	if validator, ok := config.(ConfigValidator); ok {
+		if err := validator.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// errorLogger is implemented by Things that can log errors using ThingOptions.ErrorLogger.
+type errorLogger interface {
+	errorf(format string, v ...interface{})
+}
+
+// reportError passes a rejected configuration to the error handler, or logs it if there isn't one.
+func (c *TypedConfig) reportError(thing Thing, err *ConfigError) {
+	if c.errorHandler != nil {
+		c.errorHandler(thing, err)
+		return
+	}
+	if logger, ok := thing.(errorLogger); ok {
+		logger.errorf("Rejected config: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vaelen/iot"
+)
+
+type testConfig struct {
+	Interval int    `json:"interval"`
+	Name     string `json:"name"`
+}
+
+func (c *testConfig) Validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	return nil
+}
+
+func TestTypedConfig(t *testing.T) {
+	var received []int
+	var configErr *iot.ConfigError
+	config := iot.NewTypedConfig(func() interface{} { return &testConfig{} }, iot.JSONConfig,
+		func(thing iot.Thing, config interface{}, version int) {
+			received = append(received, config.(*testConfig).Interval)
+			if version != len(received) {
+				t.Fatalf("Wrong config version: %v", version)
+			}
+		},
+		func(thing iot.Thing, err *iot.ConfigError) {
+			configErr = err
+		})
+
+	initMockClient()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.ConfigHandler = config.HandleConfig
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+
+	mockClient.Receive(ConfigTopic, []byte(`{"interval": 5}`))
+	mockClient.Receive(ConfigTopic, []byte(`{ "interval" : 5 }`))
+	if len(received) != 1 || received[0] != 5 {
+		t.Fatalf("Wrong configs received: %v", received)
+	}
+
+	// Errors are passed to the error handler instead of being published as the device state
+	mockClient.Receive(ConfigTopic, []byte(`{"interval":`))
+	if configErr == nil || configErr.Version != 1 || string(configErr.Payload) != `{"interval":` {
+		t.Fatalf("Decoding error not reported: %v", configErr)
+	}
+	if l := mockClient.Messages[StateTopic]; len(l) != 0 {
+		t.Fatalf("Config error published as state: %v", l)
+	}
+
+	// Validate rejects configurations without handling them
+	configErr = nil
+	if err := config.Validate(thing, []byte(`{"interval": -2}`)); err == nil || configErr == nil {
+		t.Fatalf("Invalid config not rejected. Error: %v, Reported: %v", err, configErr)
+	}
+	if err := config.Validate(thing, []byte(`{"interval": 20}`)); err != nil {
+		t.Fatalf("Valid config rejected: %v", err)
+	}
+	if len(received) != 1 {
+		t.Fatalf("Validated config was handled: %v", received)
+	}
+
+	configErr = nil
+	mockClient.Receive(ConfigTopic, []byte(`{"interval": -1}`))
+	if configErr == nil || configErr.Version != 1 {
+		t.Fatalf("Validation error not reported: %v", configErr)
+	}
+	if current, version := config.Current(); version != 1 || current.(*testConfig).Interval != 5 {
+		t.Fatalf("Last good config not kept. Version: %v, Config: %+v", version, current)
+	}
+
+	mockClient.Receive(ConfigTopic, []byte(`{"interval": 10}`))
+	if len(received) != 2 || received[1] != 10 {
+		t.Fatalf("Wrong configs received: %v", received)
+	}
+}
+
+func TestTypedConfigDefaultErrors(t *testing.T) {
+	config := iot.NewTypedConfig(func() interface{} { return &testConfig{} }, iot.JSONConfig, nil, nil)
+
+	// Without an error handler, errors are logged using the Thing's ErrorLogger
+	var logged []string
+	initMockClient()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.ErrorLogger = func(a ...interface{}) { logged = append(logged, fmt.Sprint(a...)) }
+	options.ConfigHandler = config.HandleConfig
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+
+	mockClient.Receive(ConfigTopic, []byte(`{"interval": -1}`))
+	if len(logged) != 1 || !strings.Contains(logged[0], "interval must not be negative") {
+		t.Fatalf("Config error not logged: %v", logged)
+	}
+	if l := mockClient.Messages[StateTopic]; len(l) != 0 {
+		t.Fatalf("Config error published as state: %v", l)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// configFileName is the name of the file used to persist the last configuration received from the server.
+const configFileName = "config.dat"
+
+// ErrConfigChecksum is returned if a persisted configuration doesn't match its checksum.
+var ErrConfigChecksum = fmt.Errorf("persisted configuration is corrupt")
+
+// configHeader is stored on the first line of the persisted configuration file.
+type configHeader struct {
+	Checksum string    `json:"checksum"`
+	Time     time.Time `json:"time"`
+}
+
+// configStore persists the last configuration received from the server.
+type configStore struct {
+	mu   sync.Mutex
+	path string
+	last []byte
+}
+
+// newConfigStore returns a configStore that stores its file in dir, or nil if dir is empty.
+func newConfigStore(dir string) (*configStore, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &configStore{path: filepath.Join(dir, configFileName)}, nil
+}
+
+// save atomically writes the configuration to disk if it has changed.
+func (s *configStore) save(config []byte, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last != nil && bytes.Equal(s.last, config) {
+		return nil
+	}
+
+	header, err := json.Marshal(configHeader{Checksum: configChecksum(config), Time: now})
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(header)
+	buf.WriteByte('\n')
+	buf.Write(config)
+
+	// Write to a temporary file first so that a partially written configuration is never loaded
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.last = append([]byte{}, config...)
+	return nil
+}
+
+// load reads the persisted configuration. It returns nil if no configuration has been persisted.
+func (s *configStore) load() ([]byte, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return nil, ErrConfigChecksum
+	}
+	header := configHeader{}
+	if err = json.Unmarshal(b[:i], &header); err != nil {
+		return nil, ErrConfigChecksum
+	}
+	config := b[i+1:]
+	if header.Checksum != configChecksum(config) {
+		return nil, ErrConfigChecksum
+	}
+
+	s.mu.Lock()
+	s.last = config
+	s.mu.Unlock()
+	return config, nil
+}
+
+func configChecksum(config []byte) string {
+	sum := sha256.Sum256(config)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,87 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/vaelen/iot"
+)
+
+func TestPersistedConfig(t *testing.T) {
+	directory := t.TempDir()
+	initMockClient()
+	options, configReceived := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.QueueDirectory = directory
+	options.ValidateConfig = func(thing iot.Thing, config []byte) error {
+		if string(config) == "invalid config" {
+			return fmt.Errorf("invalid config")
+		}
+		return nil
+	}
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	if configReceived.Len() != 0 {
+		t.Fatalf("Config received before one was persisted: %v", configReceived.String())
+	}
+	mockClient.Receive(ConfigTopic, []byte("persisted config"))
+	// Rejected configs are neither handled nor persisted
+	mockClient.Receive(ConfigTopic, []byte("invalid config"))
+	if configReceived.String() != "persisted config" {
+		t.Fatalf("Rejected config delivered: %v", configReceived.String())
+	}
+	doDisconnectTest(t, thing)
+
+	// The persisted config is only delivered to CachedConfigHandler
+	options, configReceived = getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.QueueDirectory = directory
+	thing = getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	if configReceived.Len() != 0 {
+		t.Fatalf("Cached config delivered to ConfigHandler: %v", configReceived.String())
+	}
+	doDisconnectTest(t, thing)
+
+	// The persisted config is delivered before connecting
+	var cached []byte
+	options, configReceived = getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.QueueDirectory = directory
+	options.CachedConfigHandler = func(thing iot.Thing, config []byte) {
+		if thing.IsConnected() {
+			t.Fatal("Cached config delivered after connecting")
+		}
+		cached = config
+	}
+	thing = getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	if string(cached) != "persisted config" {
+		t.Fatalf("Wrong cached config: %v", string(cached))
+	}
+	if configReceived.Len() != 0 {
+		t.Fatalf("Cached config delivered to ConfigHandler: %v", configReceived.String())
+	}
+	doDisconnectTest(t, thing)
+
+	// A corrupt config is ignored
+	path := filepath.Join(directory, "config.dat")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Couldn't read persisted config: %v", err)
+	}
+	b[len(b)-1] = 'X'
+	if err = ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatalf("Couldn't write persisted config: %v", err)
+	}
+	options, configReceived = getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.ConfigDirectory = directory
+	thing = getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+	if configReceived.Len() != 0 {
+		t.Fatalf("Corrupt config delivered: %v", configReceived.String())
+	}
+}
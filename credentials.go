@@ -0,0 +1,132 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"sync"
+	"time"
+)
+
+// CredentialSet holds an ordered list of credentials for a device.
+// Google allows up to three public keys to be registered for each device.
+//
+// The first credentials that have not expired are the primary credentials and are used to authenticate.
+// If the server rejects them, the Thing falls back to the next credentials in the list.
+// The credentials can be replaced while the Thing is running to rotate keys.
+type CredentialSet struct {
+	mu          sync.Mutex
+	credentials []*Credentials
+	current     int
+	onChange    func()
+	clock       func() time.Time
+}
+
+// NewCredentialSet returns a CredentialSet containing the given credentials in order of preference.
+func NewCredentialSet(credentials ...*Credentials) *CredentialSet {
+	s := &CredentialSet{}
+	s.credentials = nonNilCredentials(credentials)
+	return s
+}
+
+// Credentials returns all of the credentials in the set in order of preference.
+func (s *CredentialSet) Credentials() []*Credentials {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Credentials{}, s.credentials...)
+}
+
+// Current returns the credentials that are currently being used to authenticate.
+// It returns nil if the set is empty.
+func (s *CredentialSet) Current() *Credentials {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.credentials) == 0 {
+		return nil
+	}
+	s.skipExpired()
+	return s.credentials[s.current]
+}
+
+// Replace replaces the credentials in the set and switches back to the primary credentials.
+// If the set is being used by a connected Thing, the Thing will reconnect using the new credentials.
+func (s *CredentialSet) Replace(credentials ...*Credentials) {
+	s.mu.Lock()
+	s.credentials = nonNilCredentials(credentials)
+	s.current = 0
+	onChange := s.onChange
+	s.mu.Unlock()
+	if onChange != nil {
+		onChange()
+	}
+}
+
+// Reset switches back to the primary credentials.
+func (s *CredentialSet) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = 0
+}
+
+// fallback switches to the next credentials in the set.
+// It returns false if there are no more credentials to try.
+func (s *CredentialSet) fallback() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current+1 >= len(s.credentials) {
+		return false
+	}
+	s.current++
+	s.skipExpired()
+	return true
+}
+
+// skipExpired moves past expired credentials, unless they are the last ones available.
+// The caller must hold the lock.
+func (s *CredentialSet) skipExpired() {
+	if s.clock == nil {
+		return
+	}
+	now := s.clock()
+	for s.current+1 < len(s.credentials) {
+		expiration := s.credentials[s.current].Expiration
+		if expiration.IsZero() || now.Before(expiration) {
+			return
+		}
+		s.current++
+	}
+}
+
+func (s *CredentialSet) empty() bool {
+	return s == nil || len(s.Credentials()) == 0
+}
+
+// hasCredentials returns true if the options provide credentials, either in CredentialSet or Credentials.
+func hasCredentials(options *ThingOptions) bool {
+	if options.CredentialSet != nil {
+		return !options.CredentialSet.empty()
+	}
+	return options.Credentials != nil
+}
+
+func (s *CredentialSet) setOnChange(onChange func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = onChange
+}
+
+func (s *CredentialSet) setClock(clock func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = clock
+}
+
+func nonNilCredentials(credentials []*Credentials) []*Credentials {
+	l := make([]*Credentials, 0, len(credentials))
+	for _, c := range credentials {
+		if c != nil {
+			l = append(l, c)
+		}
+	}
+	return l
+}
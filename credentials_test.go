@@ -0,0 +1,130 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"crypto"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/vaelen/iot"
+)
+
+func TestCredentialSetFallback(t *testing.T) {
+	rsaCredentials := getCredentials(t, iot.CredentialTypeRSA)
+	ecCredentials := getCredentials(t, iot.CredentialTypeEC)
+
+	// The server only accepts the key stored in accepted
+	var accepted atomic.Value
+	accepted.Store(ecCredentials)
+	var connections int32
+	iot.NewClient = func(t iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
+		mockClient = iot.NewMockClient(t, o)
+		mockClient.Authenticate = func(username string, password string) error {
+			credentials := accepted.Load().(*iot.Credentials)
+			_, err := jwt.Parse(password, func(token *jwt.Token) (interface{}, error) {
+				return publicKey(credentials), nil
+			})
+			if err != nil {
+				return iot.ErrNotAuthorized
+			}
+			return nil
+		}
+		return &countingClient{mockClient, &connections}
+	}
+
+	options, _ := getOptions(t, nil)
+	options.CredentialSet = iot.NewCredentialSet(rsaCredentials, ecCredentials)
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+
+	if options.CredentialSet.Current() != ecCredentials {
+		t.Fatal("Didn't fall back to the secondary credentials")
+	}
+	if atomic.LoadInt32(&connections) != 2 {
+		t.Fatalf("Wrong number of connection attempts: %v", atomic.LoadInt32(&connections))
+	}
+
+	// Rotate to a new key while connected
+	accepted.Store(rsaCredentials)
+	options.CredentialSet.Replace(rsaCredentials)
+	waitFor(t, func() bool { return atomic.LoadInt32(&connections) == 3 })
+	if !thing.IsConnected() {
+		t.Fatal("Not connected after replacing credentials")
+	}
+	if options.CredentialSet.Current() != rsaCredentials {
+		t.Fatal("Replaced credentials not used")
+	}
+
+	// Without a ReconnectPolicy, the Thing reconnects by itself so that it can fall back to other credentials
+	options.CredentialSet.Replace(rsaCredentials, ecCredentials)
+	waitFor(t, func() bool { return atomic.LoadInt32(&connections) == 4 })
+	if iot.ClientReconnects(options) {
+		t.Fatal("MQTT client reconnects by itself even though there are fallback credentials")
+	}
+	accepted.Store(ecCredentials)
+	mockClient.LoseConnection(nil)
+	waitFor(t, func() bool { return thing.IsConnected() })
+	if options.CredentialSet.Current() != ecCredentials {
+		t.Fatal("Didn't fall back to the secondary credentials after reconnecting")
+	}
+
+	doDisconnectTest(t, thing)
+
+	// No credentials are accepted
+	accepted.Store(&iot.Credentials{})
+	options.CredentialSet.Replace(rsaCredentials, ecCredentials)
+	thing = getThing(t, options)
+	if err := thing.Connect(context.Background(), "ssl://mqtt.example.com:443"); err != iot.ErrNotAuthorized {
+		t.Fatalf("Wrong error returned when all credentials were rejected: %v", err)
+	}
+}
+
+func TestCredentialSetExpiration(t *testing.T) {
+	expired := *getCredentials(t, iot.CredentialTypeRSA)
+	expired.Expiration = time.Now().Add(-time.Hour)
+	current := getCredentials(t, iot.CredentialTypeEC)
+	current.Expiration = time.Now().Add(time.Hour)
+
+	initMockClient()
+	options, _ := getOptions(t, nil)
+	options.CredentialSet = iot.NewCredentialSet(&expired, current)
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+
+	if options.CredentialSet.Current() != current {
+		t.Fatal("Expired credentials were not skipped")
+	}
+	if len(options.CredentialSet.Credentials()) != 2 {
+		t.Fatalf("Wrong number of credentials: %v", len(options.CredentialSet.Credentials()))
+	}
+}
+
+func TestCredentialSetNotStored(t *testing.T) {
+	initMockClient()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+
+	// Connecting doesn't modify the options
+	if options.CredentialSet != nil {
+		t.Fatal("CredentialSet was stored in the options")
+	}
+	if !iot.ClientReconnects(options) {
+		t.Fatal("MQTT client doesn't reconnect by itself")
+	}
+}
+
+func publicKey(credentials *iot.Credentials) interface{} {
+	signer, ok := credentials.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil
+	}
+	return signer.Public()
+}
@@ -0,0 +1,149 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrorQOS is the QoS level used when subscribing to the errors topic.
+// Google only delivers messages on the errors topic with QoS 0.
+const ErrorQOS = 0
+
+// These are the error types that Google reports on the errors topic.
+const (
+	ErrorTypeGatewayAttachment       = "GATEWAY_ATTACHMENT_ERROR"
+	ErrorTypeGatewayDetachment       = "GATEWAY_DETACHMENT_DEVICE_ERROR"
+	ErrorTypeGatewayDeviceNotFound   = "GATEWAY_DEVICE_NOT_FOUND"
+	ErrorTypeGatewayInvalidTopic     = "GATEWAY_INVALID_MQTT_TOPIC"
+	ErrorTypeGatewayUnexpectedPacket = "GATEWAY_UNEXPECTED_PACKET_ID"
+	ErrorTypeGatewayWrongMessageType = "GATEWAY_WRONG_MESSAGE_TYPE"
+	ErrorTypeGatewayUnknown          = "GATEWAY_UNKNOWN_ERROR"
+)
+
+// publishLogSize is the number of recently published messages that are remembered for correlating errors.
+const publishLogSize = 32
+
+// ErrorHandler handles errors reported by the server on the errors topic.
+type ErrorHandler func(thing Thing, err *DeviceError)
+
+// DeviceError is an error reported by the server on the errors topic.
+type DeviceError struct {
+	// ErrorType is the type of error, such as GATEWAY_ATTACHMENT_ERROR.
+	ErrorType string `json:"error_type"`
+	// DeviceID is the ID of the device the failed operation was performed for.
+	DeviceID string `json:"device_id"`
+	// Description is a human readable description of the error.
+	Description string `json:"description"`
+	// MessageID is the MQTT message ID of the message that caused the error, if known.
+	MessageID int `json:"message_id"`
+	// Publish is the published message that caused the error.
+	// If the client reports message IDs (see MQTTMessageIDPublisher), it is the message with MessageID.
+	// Otherwise, or if the error doesn't include a message ID, it is the most recent message published for DeviceID.
+	// That is only a guess, because errors are reported asynchronously and later messages may have been published in the meantime.
+	// It is nil if no matching message was published since the Thing last connected.
+	Publish *PublishRecord `json:"-"`
+	// Payload is the raw error message received from the server.
+	Payload []byte `json:"-"`
+}
+
+// Error returns a description of the error
+func (e *DeviceError) Error() string {
+	if e.DeviceID == "" {
+		return fmt.Sprintf("%s: %s", e.ErrorType, e.Description)
+	}
+	return fmt.Sprintf("%s: %s (device: %s)", e.ErrorType, e.Description, e.DeviceID)
+}
+
+// PublishRecord describes a message that was published by a Thing.
+type PublishRecord struct {
+	// Topic is the topic the message was published to.
+	Topic string
+	// DeviceID is the ID of the device the message was published for.
+	DeviceID string
+	// MessageID is the MQTT message ID of the message.
+	// It is 0 for messages published with QoS 0 or if the client doesn't report message IDs.
+	MessageID int
+	// Length is the length of the message in bytes.
+	Length int
+	// Time is the time the message was published.
+	Time time.Time
+}
+
+// ParseDeviceError parses an error message received on the errors topic.
+// If the message is not valid JSON, the returned error will contain the message as its description.
+func ParseDeviceError(payload []byte) *DeviceError {
+	e := &DeviceError{}
+	if err := json.Unmarshal(payload, e); err != nil {
+		e.Description = string(payload)
+	}
+	e.Payload = payload
+	return e
+}
+
+// publishLog remembers recently published messages so that errors can be correlated with them.
+type publishLog struct {
+	mu      sync.Mutex
+	records []PublishRecord
+}
+
+func (l *publishLog) add(r PublishRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.records) >= publishLogSize {
+		l.records = l.records[1:]
+	}
+	l.records = append(l.records, r)
+}
+
+// reset forgets all of the records. Message IDs are only unique within a connection.
+func (l *publishLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = nil
+}
+
+// find returns the record of the message that caused an error for the given device or nil if there is none.
+// If messageID is not 0, the record with that message ID is returned.
+// Otherwise, or if no record has that message ID, the most recent record for the device without a message ID is returned as a best guess.
+// Records with a different message ID are never returned.
+func (l *publishLog) find(deviceID string, messageID int) *PublishRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if messageID != 0 {
+		for i := len(l.records) - 1; i >= 0; i-- {
+			if l.records[i].MessageID == messageID && l.records[i].DeviceID == deviceID {
+				r := l.records[i]
+				return &r
+			}
+		}
+	}
+	for i := len(l.records) - 1; i >= 0; i-- {
+		if l.records[i].DeviceID == deviceID && (messageID == 0 || l.records[i].MessageID == 0) {
+			r := l.records[i]
+			return &r
+		}
+	}
+	return nil
+}
+
+// topicID returns the ID of the device that a topic such as /devices/{device-id}/state belongs to,
+// which may be a device bound to a gateway.
+// Topics of other backends always belong to the device identified by the options.
+func topicID(topic string, options *ThingOptions) *ID {
+	backend, ok := backendFor(options).(GoogleBackend)
+	if !ok {
+		return options.ID
+	}
+	deviceID, ok := backend.scheme().deviceID(topic, options.ID)
+	if !ok {
+		return options.ID
+	}
+	id := *options.ID
+	id.DeviceID = deviceID
+	return &id
+}
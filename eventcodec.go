@@ -0,0 +1,601 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// ErrInvalidEncoding is returned when an event payload can't be decoded by its codec or doesn't have a valid envelope.
+var ErrInvalidEncoding = fmt.Errorf("invalid event encoding")
+
+// EventCodec encodes and decodes the values published by PublishEventValue.
+type EventCodec interface {
+	// ContentType returns the MIME type of the encoded events, which is recorded in the event envelope.
+	ContentType() string
+	// Marshal encodes v.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into v, which must be a pointer.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONEvents encodes events as JSON.
+// Protocol buffer events are supported by the protoevents package, so that devices only include the protobuf runtime if they use it.
+var JSONEvents EventCodec = jsonCodec{}
+
+// CBOREvents encodes events as CBOR (RFC 7049).
+// Values are converted using the same rules as JSON, so struct fields use their json tags.
+var CBOREvents EventCodec = cborCodec{}
+
+// MessagePackEvents encodes events as MessagePack.
+// Values are converted using the same rules as JSON, so struct fields use their json tags.
+var MessagePackEvents EventCodec = msgpackCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) ContentType() string {
+	return "application/cbor"
+}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	value, err := toGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	writeCBOR(buf, value)
+	return buf.Bytes(), nil
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	r := bytes.NewReader(data)
+	value, err := readCBOR(r)
+	if err != nil || r.Len() != 0 {
+		return ErrInvalidEncoding
+	}
+	return fromGeneric(value, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	value, err := toGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	writeMsgPack(buf, value)
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	r := bytes.NewReader(data)
+	value, err := readMsgPack(r)
+	if err != nil || r.Len() != 0 {
+		return ErrInvalidEncoding
+	}
+	return fromGeneric(value, v)
+}
+
+// toGeneric converts v into nil, bool, int64, uint64, float64, string, []interface{} and map[string]interface{} values
+// by encoding it as JSON, so that the binary codecs use the same field names and omitempty rules as JSONEvents.
+func toGeneric(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var value interface{}
+	if err = decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return convertNumbers(value), nil
+}
+
+// convertNumbers replaces the json.Number values in a decoded JSON value with integers where possible.
+func convertNumbers(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			return u
+		}
+		f, _ := value.Float64()
+		return f
+	case []interface{}:
+		for i := range value {
+			value[i] = convertNumbers(value[i])
+		}
+	case map[string]interface{}:
+		for k := range value {
+			value[k] = convertNumbers(value[k])
+		}
+	}
+	return value
+}
+
+// fromGeneric decodes a value returned by readCBOR or readMsgPack into v using the same rules as JSONEvents.
+// Byte strings are decoded in the same way as base64 encoded JSON strings.
+func fromGeneric(value interface{}, v interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return ErrInvalidEncoding
+	}
+	return json.Unmarshal(b, v)
+}
+
+// sortedKeys returns the keys of m in order so that maps are always encoded in the same way.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readUint reads a big endian unsigned integer that is size bytes long.
+func readUint(r *bytes.Reader, size int) (uint64, error) {
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, ErrInvalidEncoding
+	}
+	n := uint64(0)
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+// readBytes reads a string or byte string of the given length.
+func readBytes(r *bytes.Reader, length uint64) ([]byte, error) {
+	if length > uint64(r.Len()) {
+		return nil, ErrInvalidEncoding
+	}
+	b := make([]byte, length)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// checkCount returns an error if an array or map has more items than could be held in the rest of the payload.
+func checkCount(r *bytes.Reader, count uint64) error {
+	if count > uint64(r.Len()) {
+		return ErrInvalidEncoding
+	}
+	return nil
+}
+
+// Additional CBOR major types
+const (
+	cborUnsigned   = 0
+	cborNegative   = 1
+	cborTextString = 3
+	cborMap        = 5
+	cborTag        = 6
+	cborSimple     = 7
+)
+
+// CBOR simple values
+const (
+	cborFalse   = 0xf4
+	cborTrue    = 0xf5
+	cborNull    = 0xf6
+	cborFloat64 = 0xfb
+)
+
+func writeCBOR(buf *bytes.Buffer, value interface{}) {
+	switch value := value.(type) {
+	case bool:
+		if value {
+			buf.WriteByte(cborTrue)
+		} else {
+			buf.WriteByte(cborFalse)
+		}
+	case int64:
+		if value < 0 {
+			buf.Write(cborHeader(cborNegative, uint64(-1-value)))
+		} else {
+			buf.Write(cborHeader(cborUnsigned, uint64(value)))
+		}
+	case uint64:
+		buf.Write(cborHeader(cborUnsigned, value))
+	case float64:
+		buf.WriteByte(cborFloat64)
+		binary.Write(buf, binary.BigEndian, value)
+	case string:
+		buf.Write(cborHeader(cborTextString, uint64(len(value))))
+		buf.WriteString(value)
+	case []interface{}:
+		buf.Write(cborHeader(cborArray, uint64(len(value))))
+		for _, item := range value {
+			writeCBOR(buf, item)
+		}
+	case map[string]interface{}:
+		buf.Write(cborHeader(cborMap, uint64(len(value))))
+		for _, k := range sortedKeys(value) {
+			writeCBOR(buf, k)
+			writeCBOR(buf, value[k])
+		}
+	default:
+		buf.WriteByte(cborNull)
+	}
+}
+
+// readCBOR reads a CBOR data item. Indefinite length items are not supported.
+func readCBOR(r *bytes.Reader) (interface{}, error) {
+	initial, err := r.ReadByte()
+	if err != nil {
+		return nil, ErrInvalidEncoding
+	}
+	majorType, info := initial>>5, initial&0x1f
+	if majorType == cborSimple {
+		return readCBORSimple(r, info)
+	}
+	if info > 27 {
+		return nil, ErrInvalidEncoding
+	}
+	n := uint64(info)
+	if info >= 24 {
+		if n, err = readUint(r, 1<<(info-24)); err != nil {
+			return nil, err
+		}
+	}
+
+	switch majorType {
+	case cborUnsigned:
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case cborNegative:
+		if n > math.MaxInt64 {
+			return nil, ErrInvalidEncoding
+		}
+		return -1 - int64(n), nil
+	case cborByteString:
+		return readBytes(r, n)
+	case cborTextString:
+		b, err := readBytes(r, n)
+		return string(b), err
+	case cborArray:
+		if err = checkCount(r, n); err != nil {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readCBOR(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case cborMap:
+		if err = checkCount(r, n); err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			k, err := readCBOR(r)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, ErrInvalidEncoding
+			}
+			if m[key], err = readCBOR(r); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborTag:
+		// Tags, such as date/time tags, are ignored
+		return readCBOR(r)
+	}
+	return nil, ErrInvalidEncoding
+}
+
+func readCBORSimple(r *bytes.Reader, info byte) (interface{}, error) {
+	switch info {
+	case cborFalse & 0x1f:
+		return false, nil
+	case cborTrue & 0x1f:
+		return true, nil
+	case cborNull & 0x1f, cborNull&0x1f + 1:
+		// null and undefined
+		return nil, nil
+	case 25:
+		half, err := readUint(r, 2)
+		return halfToFloat(uint16(half)), err
+	case 26:
+		bits, err := readUint(r, 4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case cborFloat64 & 0x1f:
+		bits, err := readUint(r, 8)
+		return math.Float64frombits(bits), err
+	}
+	return nil, ErrInvalidEncoding
+}
+
+// halfToFloat converts an IEEE 754 half precision float.
+func halfToFloat(half uint16) float64 {
+	exponent := int(half>>10) & 0x1f
+	mantissa := float64(half & 0x3ff)
+	var f float64
+	switch exponent {
+	case 0:
+		f = math.Ldexp(mantissa, -24)
+	case 0x1f:
+		if mantissa == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if half&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
+
+// MessagePack formats
+const (
+	msgpackNil     = 0xc0
+	msgpackFalse   = 0xc2
+	msgpackTrue    = 0xc3
+	msgpackBin8    = 0xc4
+	msgpackBin16   = 0xc5
+	msgpackBin32   = 0xc6
+	msgpackFloat32 = 0xca
+	msgpackFloat64 = 0xcb
+	msgpackUint8   = 0xcc
+	msgpackUint64  = 0xcf
+	msgpackInt8    = 0xd0
+	msgpackInt64   = 0xd3
+	msgpackStr8    = 0xd9
+	msgpackStr16   = 0xda
+	msgpackStr32   = 0xdb
+	msgpackArray16 = 0xdc
+	msgpackArray32 = 0xdd
+	msgpackMap16   = 0xde
+	msgpackMap32   = 0xdf
+)
+
+func writeMsgPack(buf *bytes.Buffer, value interface{}) {
+	switch value := value.(type) {
+	case bool:
+		if value {
+			buf.WriteByte(msgpackTrue)
+		} else {
+			buf.WriteByte(msgpackFalse)
+		}
+	case int64:
+		switch {
+		case value >= 0:
+			writeMsgPackUint(buf, uint64(value))
+		case value >= -32:
+			// Negative fixint
+			buf.WriteByte(byte(value))
+		case value >= math.MinInt8:
+			buf.Write([]byte{msgpackInt8, byte(value)})
+		case value >= math.MinInt16:
+			buf.WriteByte(msgpackInt8 + 1)
+			binary.Write(buf, binary.BigEndian, int16(value))
+		case value >= math.MinInt32:
+			buf.WriteByte(msgpackInt8 + 2)
+			binary.Write(buf, binary.BigEndian, int32(value))
+		default:
+			buf.WriteByte(msgpackInt64)
+			binary.Write(buf, binary.BigEndian, value)
+		}
+	case uint64:
+		writeMsgPackUint(buf, value)
+	case float64:
+		buf.WriteByte(msgpackFloat64)
+		binary.Write(buf, binary.BigEndian, value)
+	case string:
+		n := len(value)
+		switch {
+		case n < 32:
+			// fixstr
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.Write([]byte{msgpackStr8, byte(n)})
+		default:
+			writeMsgPackLength(buf, msgpackStr16, msgpackStr32, n)
+		}
+		buf.WriteString(value)
+	case []interface{}:
+		if len(value) < 16 {
+			// fixarray
+			buf.WriteByte(0x90 | byte(len(value)))
+		} else {
+			writeMsgPackLength(buf, msgpackArray16, msgpackArray32, len(value))
+		}
+		for _, item := range value {
+			writeMsgPack(buf, item)
+		}
+	case map[string]interface{}:
+		if len(value) < 16 {
+			// fixmap
+			buf.WriteByte(0x80 | byte(len(value)))
+		} else {
+			writeMsgPackLength(buf, msgpackMap16, msgpackMap32, len(value))
+		}
+		for _, k := range sortedKeys(value) {
+			writeMsgPack(buf, k)
+			writeMsgPack(buf, value[k])
+		}
+	default:
+		buf.WriteByte(msgpackNil)
+	}
+}
+
+func writeMsgPackUint(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n < 128:
+		// Positive fixint
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{msgpackUint8, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(msgpackUint8 + 1)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(msgpackUint8 + 2)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(msgpackUint64)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// writeMsgPackLength writes the 16 or 32 bit header of a string, array or map.
+func writeMsgPackLength(buf *bytes.Buffer, format16 byte, format32 byte, n int) {
+	if n <= math.MaxUint16 {
+		buf.WriteByte(format16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+		return
+	}
+	buf.WriteByte(format32)
+	binary.Write(buf, binary.BigEndian, uint32(n))
+}
+
+// readMsgPack reads a MessagePack value. Extension types are not supported.
+func readMsgPack(r *bytes.Reader) (interface{}, error) {
+	format, err := r.ReadByte()
+	if err != nil {
+		return nil, ErrInvalidEncoding
+	}
+	switch {
+	case format < 0x80:
+		return int64(format), nil
+	case format < 0x90:
+		return readMsgPackMap(r, uint64(format&0x0f))
+	case format < 0xa0:
+		return readMsgPackArray(r, uint64(format&0x0f))
+	case format < 0xc0:
+		b, err := readBytes(r, uint64(format&0x1f))
+		return string(b), err
+	case format >= 0xe0:
+		return int64(int8(format)), nil
+	}
+
+	switch format {
+	case msgpackNil:
+		return nil, nil
+	case msgpackFalse:
+		return false, nil
+	case msgpackTrue:
+		return true, nil
+	case msgpackBin8, msgpackBin16, msgpackBin32:
+		n, err := readUint(r, 1<<(format-msgpackBin8))
+		if err != nil {
+			return nil, err
+		}
+		return readBytes(r, n)
+	case msgpackFloat32:
+		bits, err := readUint(r, 4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case msgpackFloat64:
+		bits, err := readUint(r, 8)
+		return math.Float64frombits(bits), err
+	case msgpackUint8, msgpackUint8 + 1, msgpackUint8 + 2, msgpackUint64:
+		n, err := readUint(r, 1<<(format-msgpackUint8))
+		if err != nil || n > math.MaxInt64 {
+			return n, err
+		}
+		return int64(n), nil
+	case msgpackInt8, msgpackInt8 + 1, msgpackInt8 + 2, msgpackInt64:
+		size := 1 << (format - msgpackInt8)
+		n, err := readUint(r, size)
+		// Sign extend the value
+		shift := uint(64 - 8*size)
+		return int64(n<<shift) >> shift, err
+	case msgpackStr8, msgpackStr16, msgpackStr32:
+		n, err := readUint(r, 1<<(format-msgpackStr8))
+		if err != nil {
+			return nil, err
+		}
+		b, err := readBytes(r, n)
+		return string(b), err
+	case msgpackArray16, msgpackArray32:
+		n, err := readUint(r, 2<<(format-msgpackArray16))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgPackArray(r, n)
+	case msgpackMap16, msgpackMap32:
+		n, err := readUint(r, 2<<(format-msgpackMap16))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgPackMap(r, n)
+	}
+	return nil, ErrInvalidEncoding
+}
+
+func readMsgPackArray(r *bytes.Reader, n uint64) (interface{}, error) {
+	if err := checkCount(r, n); err != nil {
+		return nil, err
+	}
+	items := make([]interface{}, n)
+	for i := range items {
+		var err error
+		if items[i], err = readMsgPack(r); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+func readMsgPackMap(r *bytes.Reader, n uint64) (interface{}, error) {
+	if err := checkCount(r, n); err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := readMsgPack(r)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, ErrInvalidEncoding
+		}
+		if m[key], err = readMsgPack(r); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/vaelen/iot"
+)
+
+type testReading struct {
+	Sensor  string            `json:"sensor"`
+	Value   float64           `json:"value"`
+	Count   int64             `json:"count"`
+	Total   uint64            `json:"total"`
+	OK      bool              `json:"ok"`
+	Samples []int             `json:"samples"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Raw     []byte            `json:"raw"`
+	Skipped string            `json:"-"`
+}
+
+func TestEventCodecs(t *testing.T) {
+	reading := &testReading{
+		Sensor:  "temperature",
+		Value:   21.5,
+		Count:   -100000,
+		Total:   math.MaxUint64,
+		OK:      true,
+		Samples: []int{1, -1, 200, -200, 70000, -70000, 5000000000},
+		Tags:    map[string]string{"room": "kitchen"},
+		Raw:     []byte{1, 2, 3},
+		Skipped: "skipped",
+	}
+	expected := *reading
+	expected.Skipped = ""
+
+	for _, codec := range []iot.EventCodec{iot.JSONEvents, iot.CBOREvents, iot.MessagePackEvents} {
+		b, err := codec.Marshal(reading)
+		if err != nil {
+			t.Fatalf("Couldn't encode %s: %v", codec.ContentType(), err)
+		}
+		decoded := &testReading{}
+		if err = codec.Unmarshal(b, decoded); err != nil {
+			t.Fatalf("Couldn't decode %s: %v", codec.ContentType(), err)
+		}
+		if !reflect.DeepEqual(decoded, &expected) {
+			t.Fatalf("Wrong %s value decoded: %+v", codec.ContentType(), decoded)
+		}
+	}
+}
+
+func TestBinaryEventEncodings(t *testing.T) {
+	// Maps are encoded with their keys in order
+	value := map[string]interface{}{"b": []interface{}{-1, "x"}, "a": 1.5, "c": nil}
+	tests := []struct {
+		codec   iot.EventCodec
+		encoded string
+	}{
+		{iot.CBOREvents, "a36161fb3ff80000000000006162822061786163f6"},
+		{iot.MessagePackEvents, "83a161cb3ff8000000000000a16292ffa178a163c0"},
+	}
+	for _, test := range tests {
+		b, err := test.codec.Marshal(value)
+		if err != nil {
+			t.Fatalf("Couldn't encode %s: %v", test.codec.ContentType(), err)
+		}
+		if hex.EncodeToString(b) != test.encoded {
+			t.Fatalf("Wrong %s encoding: %x", test.codec.ContentType(), b)
+		}
+	}
+
+	// Values encoded by other implementations, such as byte strings and smaller floats, can be decoded
+	decoded := map[string]interface{}{}
+	cbor, _ := hex.DecodeString("a36161430102036162f93e006163c11a514b67b0")
+	if err := iot.CBOREvents.Unmarshal(cbor, &decoded); err != nil {
+		t.Fatalf("Couldn't decode CBOR: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, map[string]interface{}{"a": "AQID", "b": 1.5, "c": float64(1363896240)}) {
+		t.Fatalf("Wrong CBOR value decoded: %v", decoded)
+	}
+	decoded = map[string]interface{}{}
+	msgpack, _ := hex.DecodeString("83a161c403010203a162ca3fc00000a163d1ff00")
+	if err := iot.MessagePackEvents.Unmarshal(msgpack, &decoded); err != nil {
+		t.Fatalf("Couldn't decode MessagePack: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, map[string]interface{}{"a": "AQID", "b": 1.5, "c": float64(-256)}) {
+		t.Fatalf("Wrong MessagePack value decoded: %v", decoded)
+	}
+
+	// Truncated payloads, trailing data and maps with non-string keys are rejected
+	for _, test := range []struct {
+		codec   iot.EventCodec
+		encoded string
+	}{
+		{iot.CBOREvents, "a16161"},
+		{iot.CBOREvents, "7a00010000"},
+		{iot.CBOREvents, "0101"},
+		{iot.CBOREvents, "a10101"},
+		{iot.MessagePackEvents, "81a161"},
+		{iot.MessagePackEvents, "dbffffffff"},
+		{iot.MessagePackEvents, "0101"},
+		{iot.MessagePackEvents, "810101"},
+	} {
+		b, _ := hex.DecodeString(test.encoded)
+		var v interface{}
+		if err := test.codec.Unmarshal(b, &v); err != iot.ErrInvalidEncoding {
+			t.Fatalf("Wrong error for invalid %s payload %s: %v", test.codec.ContentType(), test.encoded, err)
+		}
+	}
+}
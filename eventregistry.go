@@ -0,0 +1,248 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownEventType is returned by EventRegistry.Decode when no event type is registered for a subfolder.
+var ErrUnknownEventType = fmt.Errorf("no event type is registered for the subfolder")
+
+// ErrEventTypeRegistered is returned by EventRegistry.Register when a type or subfolder is already registered.
+var ErrEventTypeRegistered = fmt.Errorf("event type is already registered")
+
+// ErrEventSubfolderMismatch is returned by PublishEventValue if a value of a registered type is published to
+// a different subfolder, because the server wouldn't be able to decode it.
+var ErrEventSubfolderMismatch = fmt.Errorf("event type is registered for a different subfolder")
+
+// ErrEventSchemaMismatch is returned by EventRegistry.Decode when an event's envelope doesn't match the registered event type,
+// such as an event encoded with a different codec or a newer schema version.
+var ErrEventSchemaMismatch = fmt.Errorf("event doesn't match the registered schema")
+
+// EventHeader describes the encoding of an event published by PublishEventValue.
+// Unless the registry omits envelopes, it is published as a JSON line in front of the encoded event.
+type EventHeader struct {
+	ContentType string `json:"contentType"`
+	Schema      string `json:"schema"`
+	Version     int    `json:"version"`
+}
+
+// EventType describes how values of a Go type are published.
+type EventType struct {
+	// Subfolder is the subfolder that the events are published to, such as "sensors/temperature".
+	// If it is empty, the events are published to the top level events topic.
+	Subfolder string
+	// Schema names the event type in the envelope. If it is empty, the name of the Go type is used.
+	Schema string
+	// Version is the schema version. If it is zero, 1 is used.
+	// Events with a newer version than the registered version are rejected when they are decoded.
+	Version int
+	// Codec encodes the events. If it is nil, the registry's codec is used.
+	Codec EventCodec
+}
+
+// EventRegistry maps Go types to the subfolders, schemas and codecs used to publish them,
+// so that the server can decode events based on their subfolder and envelope.
+// The same registry should be used on devices and servers.
+//
+// Values of types that haven't been registered are encoded using the registry's codec,
+// with the name of their Go type as the schema.
+type EventRegistry struct {
+	// OmitEnvelope publishes events without an EventHeader.
+	// This is useful when the server expects the encoded events on their own,
+	// in which case the subfolder is the only way to identify the event type.
+	OmitEnvelope bool
+
+	codec      EventCodec
+	mu         sync.RWMutex
+	types      map[reflect.Type]*EventType
+	subfolders map[string]reflect.Type
+}
+
+// defaultEventRegistry is used by things that don't have an EventRegistry.
+// It omits envelopes so that the events are plain JSON, which can be batched using BatchJSON.
+var defaultEventRegistry = &EventRegistry{
+	OmitEnvelope: true,
+	codec:        JSONEvents,
+	types:        make(map[reflect.Type]*EventType),
+	subfolders:   make(map[string]reflect.Type),
+}
+
+// eventRegistryFor returns the EventRegistry used by things with the given options.
+func eventRegistryFor(options *ThingOptions) *EventRegistry {
+	if options.Events == nil {
+		return defaultEventRegistry
+	}
+	return options.Events
+}
+
+// NewEventRegistry returns an EventRegistry that encodes events with the given codec by default.
+// If codec is nil, JSONEvents is used.
+func NewEventRegistry(codec EventCodec) *EventRegistry {
+	if codec == nil {
+		codec = JSONEvents
+	}
+	return &EventRegistry{
+		codec:      codec,
+		types:      make(map[reflect.Type]*EventType),
+		subfolders: make(map[string]reflect.Type),
+	}
+}
+
+// typeOfEvent returns the type of v, without any pointers.
+func typeOfEvent(v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// Register registers the type of v, which may be a value or a pointer.
+// ErrEventTypeRegistered is returned if the type or the subfolder has already been registered,
+// and ErrInvalidSubfolder is returned if the subfolder contains empty levels or MQTT wildcards.
+func (r *EventRegistry) Register(v interface{}, eventType EventType) error {
+	t := typeOfEvent(v)
+	if t == nil {
+		return fmt.Errorf("can't register an event type for nil")
+	}
+	if eventType.Subfolder != "" {
+		if err := ValidateSubfolder(strings.Split(eventType.Subfolder, "/")...); err != nil {
+			return err
+		}
+	}
+	if eventType.Schema == "" {
+		eventType.Schema = t.Name()
+	}
+	if eventType.Version == 0 {
+		eventType.Version = 1
+	}
+	if eventType.Codec == nil {
+		eventType.Codec = r.codec
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.types[t]; ok {
+		return ErrEventTypeRegistered
+	}
+	if _, ok := r.subfolders[eventType.Subfolder]; ok {
+		return ErrEventTypeRegistered
+	}
+	r.types[t] = &eventType
+	r.subfolders[eventType.Subfolder] = t
+	return nil
+}
+
+// lookup returns the registered EventType for t, or the default EventType if t isn't registered.
+func (r *EventRegistry) lookup(t reflect.Type) *EventType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if eventType, ok := r.types[t]; ok {
+		return eventType
+	}
+	return &EventType{Schema: t.Name(), Version: 1, Codec: r.codec}
+}
+
+// encodeEvent encodes v for PublishEventValue and returns the subfolder it should be published to,
+// which is the given event names if there are any. Values of registered types can only be published
+// to their registered subfolder, because the server decodes events based on their subfolder.
+func (r *EventRegistry) encodeEvent(v interface{}, event []string) ([]byte, []string, error) {
+	payload, subfolder, err := r.Encode(v)
+	if err != nil || len(event) == 0 {
+		return payload, subfolder, err
+	}
+	r.mu.RLock()
+	_, registered := r.types[typeOfEvent(v)]
+	r.mu.RUnlock()
+	if registered && strings.Join(event, "/") != strings.Join(subfolder, "/") {
+		return nil, nil, ErrEventSubfolderMismatch
+	}
+	return payload, event, nil
+}
+
+// Encode encodes v and returns the payload and the subfolder that it should be published to.
+func (r *EventRegistry) Encode(v interface{}) (payload []byte, subfolder []string, err error) {
+	t := typeOfEvent(v)
+	if t == nil {
+		return nil, nil, fmt.Errorf("can't encode a nil event")
+	}
+	eventType := r.lookup(t)
+	encoded, err := eventType.Codec.Marshal(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	if eventType.Subfolder != "" {
+		subfolder = strings.Split(eventType.Subfolder, "/")
+	}
+	if r.OmitEnvelope {
+		return encoded, subfolder, nil
+	}
+
+	header, err := json.Marshal(&EventHeader{
+		ContentType: eventType.Codec.ContentType(),
+		Schema:      eventType.Schema,
+		Version:     eventType.Version,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	buf := bytes.NewBuffer(header)
+	buf.WriteByte('\n')
+	buf.Write(encoded)
+	return buf.Bytes(), subfolder, nil
+}
+
+// Decode decodes an event that was published to the subfolder, such as the subFolder attribute of a
+// Cloud Pub/Sub message from Cloud IoT Core. It returns a pointer to a new value of the registered type
+// and the event's header. If the registry omits envelopes, the header is nil.
+func (r *EventRegistry) Decode(subfolder string, payload []byte) (interface{}, *EventHeader, error) {
+	r.mu.RLock()
+	t, ok := r.subfolders[subfolder]
+	var eventType *EventType
+	if ok {
+		eventType = r.types[t]
+	}
+	r.mu.RUnlock()
+	if !ok {
+		return nil, nil, ErrUnknownEventType
+	}
+
+	var header *EventHeader
+	if !r.OmitEnvelope {
+		var err error
+		if header, payload, err = ParseEventEnvelope(payload); err != nil {
+			return nil, nil, err
+		}
+		if header.Schema != eventType.Schema || header.ContentType != eventType.Codec.ContentType() || header.Version > eventType.Version {
+			return nil, header, ErrEventSchemaMismatch
+		}
+	}
+
+	v := reflect.New(t).Interface()
+	if err := eventType.Codec.Unmarshal(payload, v); err != nil {
+		return nil, header, err
+	}
+	return v, header, nil
+}
+
+// ParseEventEnvelope splits an event published by PublishEventValue into its header and the encoded event.
+// ErrInvalidEncoding is returned if the payload doesn't start with a valid header.
+func ParseEventEnvelope(payload []byte) (*EventHeader, []byte, error) {
+	i := bytes.IndexByte(payload, '\n')
+	if i < 0 {
+		return nil, nil, ErrInvalidEncoding
+	}
+	header := &EventHeader{}
+	if err := json.Unmarshal(payload[:i], header); err != nil || header.ContentType == "" {
+		return nil, nil, ErrInvalidEncoding
+	}
+	return header, payload[i+1:], nil
+}
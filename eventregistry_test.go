@@ -0,0 +1,151 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/vaelen/iot"
+)
+
+type testTemperature struct {
+	Celsius float64 `json:"celsius"`
+}
+
+type testDoor struct {
+	Open bool `json:"open"`
+}
+
+func TestPublishEventValue(t *testing.T) {
+	ctx := context.Background()
+	registry := iot.NewEventRegistry(iot.CBOREvents)
+	if err := registry.Register(testTemperature{}, iot.EventType{Subfolder: "sensors/temperature", Version: 2}); err != nil {
+		t.Fatalf("Couldn't register event type: %v", err)
+	}
+	if err := registry.Register(&testDoor{}, iot.EventType{Subfolder: "door", Schema: "door", Codec: iot.MessagePackEvents}); err != nil {
+		t.Fatalf("Couldn't register event type: %v", err)
+	}
+	if err := registry.Register(&testTemperature{}, iot.EventType{Subfolder: "other"}); err != iot.ErrEventTypeRegistered {
+		t.Fatalf("Wrong error for a type that is already registered: %v", err)
+	}
+	if err := registry.Register(testReading{}, iot.EventType{Subfolder: "door"}); err != iot.ErrEventTypeRegistered {
+		t.Fatalf("Wrong error for a subfolder that is already registered: %v", err)
+	}
+	if err := registry.Register(testReading{}, iot.EventType{Subfolder: "sensors/+"}); err != iot.ErrInvalidSubfolder {
+		t.Fatalf("Wrong error for an invalid subfolder: %v", err)
+	}
+
+	initMockClient()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.Events = registry
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+
+	// Values are published to the subfolder registered for their type
+	if err := thing.PublishEventValue(ctx, &testTemperature{Celsius: 21.5}); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	if err := thing.PublishEventValue(ctx, testDoor{Open: true}, "door"); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	if err := thing.PublishEventValue(ctx, testDoor{Open: false}, "sensors", "temperature"); err != iot.ErrEventSubfolderMismatch {
+		t.Fatalf("Wrong error for a registered type published to another subfolder: %v", err)
+	}
+	if l := mockClient.Messages[EventsTopic+"/sensors/temperature"]; len(l) != 1 {
+		t.Fatalf("Event published to another type's subfolder: %v", l)
+	}
+
+	temperature := decodeEvent(t, registry, "sensors/temperature", 0, &iot.EventHeader{ContentType: "application/cbor", Schema: "testTemperature", Version: 2})
+	if !reflect.DeepEqual(temperature, &testTemperature{Celsius: 21.5}) {
+		t.Fatalf("Wrong event decoded: %+v", temperature)
+	}
+	door := decodeEvent(t, registry, "door", 0, &iot.EventHeader{ContentType: "application/msgpack", Schema: "door", Version: 1})
+	if !reflect.DeepEqual(door, &testDoor{Open: true}) {
+		t.Fatalf("Wrong event decoded: %+v", door)
+	}
+
+	// The envelope identifies events that were published to another type's subfolder
+	payload, _, err := registry.Encode(testDoor{Open: false})
+	if err != nil {
+		t.Fatalf("Couldn't encode event: %v", err)
+	}
+	if _, header, err := registry.Decode("sensors/temperature", payload); err != iot.ErrEventSchemaMismatch || header.Schema != "door" {
+		t.Fatalf("Wrong error for an event with another schema: %v", err)
+	}
+	if _, _, err := registry.Decode("unknown", payload); err != iot.ErrUnknownEventType {
+		t.Fatalf("Wrong error for an unknown subfolder: %v", err)
+	}
+	if _, _, err := registry.Decode("door", []byte("no envelope")); err != iot.ErrInvalidEncoding {
+		t.Fatalf("Wrong error for an event without an envelope: %v", err)
+	}
+
+	// Events with a newer schema version are rejected
+	older := iot.NewEventRegistry(iot.CBOREvents)
+	older.Register(testTemperature{}, iot.EventType{Subfolder: "sensors/temperature"})
+	payload = mockClient.Messages[EventsTopic+"/sensors/temperature"][0].([]byte)
+	if _, _, err := older.Decode("sensors/temperature", payload); err != iot.ErrEventSchemaMismatch {
+		t.Fatalf("Wrong error for a newer schema version: %v", err)
+	}
+}
+
+func TestPublishEventValueDefaults(t *testing.T) {
+	ctx := context.Background()
+	initMockClient()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+
+	// Without a registry, values are encoded as JSON without an envelope and published to the given subfolder
+	if err := thing.PublishEventValue(ctx, &testTemperature{Celsius: 10}, "a"); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	payload := mockClient.Messages[EventsTopic+"/a"][0].([]byte)
+	if string(payload) != `{"celsius":10}` {
+		t.Fatalf("Wrong event published: %s", payload)
+	}
+	if err := thing.PublishEventValue(ctx, &testTemperature{}, "a/#"); err != iot.ErrInvalidSubfolder {
+		t.Fatalf("Wrong error for an invalid subfolder: %v", err)
+	}
+
+	// Envelopes can be omitted by other registries too
+	registry := iot.NewEventRegistry(nil)
+	registry.OmitEnvelope = true
+	registry.Register(testTemperature{}, iot.EventType{})
+	if err := registry.Register(testDoor{}, iot.EventType{}); err != iot.ErrEventTypeRegistered {
+		t.Fatalf("Wrong error for a second top level event type: %v", err)
+	}
+	options.Events = registry
+	if err := thing.PublishEventValue(ctx, testTemperature{Celsius: 5}); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	payload = mockClient.Messages[EventsTopic][0].([]byte)
+	if string(payload) != `{"celsius":5}` {
+		t.Fatalf("Wrong event published: %s", payload)
+	}
+	v, header, err := registry.Decode("", payload)
+	if err != nil || header != nil || !reflect.DeepEqual(v, &testTemperature{Celsius: 5}) {
+		t.Fatalf("Couldn't decode event. Value: %+v, Header: %v, Error: %v", v, header, err)
+	}
+}
+
+// decodeEvent decodes the event published to the subfolder at the given index and checks its header.
+func decodeEvent(t *testing.T, registry *iot.EventRegistry, subfolder string, index int, expected *iot.EventHeader) interface{} {
+	t.Helper()
+	messages := mockClient.Messages[EventsTopic+"/"+subfolder]
+	if len(messages) <= index {
+		t.Fatalf("Event wasn't published to %s", subfolder)
+	}
+	v, header, err := registry.Decode(subfolder, messages[index].([]byte))
+	if err != nil {
+		t.Fatalf("Couldn't decode event: %v", err)
+	}
+	if *header != *expected {
+		t.Fatalf("Wrong event header: %+v", header)
+	}
+	return v
+}
@@ -0,0 +1,79 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import "time"
+
+// ConnectionEventType identifies a change in the state of a Thing's connection.
+type ConnectionEventType uint8
+
+const (
+	// ConnectionConnecting is emitted when the client starts connecting to the server.
+	ConnectionConnecting ConnectionEventType = iota
+	// ConnectionConnected is emitted when the client has connected to the server.
+	ConnectionConnected
+	// ConnectionLost is emitted when an established connection is lost unexpectedly.
+	// The Err field of the event contains the reason, if known.
+	ConnectionLost
+	// ConnectionReconnecting is emitted when the client starts reconnecting after the connection was lost
+	// or to refresh its auth token.
+	ConnectionReconnecting
+	// ConnectionAuthFailed is emitted when the server rejects the client's credentials.
+	ConnectionAuthFailed
+	// ConnectionDisconnected is emitted when the client disconnects or fails to connect.
+	// The Err field of the event is set if connecting failed.
+	ConnectionDisconnected
+)
+
+var connectionEventNames = map[ConnectionEventType]string{
+	ConnectionConnecting:   "connecting",
+	ConnectionConnected:    "connected",
+	ConnectionLost:         "connection lost",
+	ConnectionReconnecting: "reconnecting",
+	ConnectionAuthFailed:   "auth failed",
+	ConnectionDisconnected: "disconnected",
+}
+
+// String returns the name of the event type.
+func (t ConnectionEventType) String() string {
+	name, ok := connectionEventNames[t]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+// ConnectionEvent describes a change in the state of a Thing's connection.
+type ConnectionEvent struct {
+	Type ConnectionEventType
+	// Err is the error that caused the event, if any.
+	Err error
+	// Time is the time the event occurred according to ThingOptions.Clock.
+	Time time.Time
+}
+
+// ConnectionEventHandler is called when the state of a Thing's connection changes.
+// It can be used to drive status LEDs, collect metrics or trigger fallback logic.
+type ConnectionEventHandler func(thing Thing, event ConnectionEvent)
+
+// MQTTConnectionEventHandler will be called by the MQTTClient when the state of its connection changes.
+type MQTTConnectionEventHandler func(event ConnectionEvent)
+
+// handleConnectionEvent timestamps a connection event and passes it to the ConnectionEventHandler.
+func (t *thing) handleConnectionEvent(event ConnectionEvent) {
+	if event.Time.IsZero() {
+		event.Time = t.options.Clock.Now()
+	}
+	if event.Err != nil {
+		t.debugf("Connection %s: %v", event.Type, event.Err)
+	} else {
+		t.debugf("Connection %s", event.Type)
+	}
+	if t.options.ConnectionEventHandler != nil {
+		t.options.ConnectionEventHandler(t.self(), event)
+	}
+	if event.Type == ConnectionLost && t.reconnectPolicy() != nil {
+		t.reconnects.start(t)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/vaelen/iot"
+)
+
+func TestConnectionEvents(t *testing.T) {
+	var events []iot.ConnectionEvent
+	initMockClient()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.ConnectionEventHandler = func(thing iot.Thing, event iot.ConnectionEvent) {
+		events = append(events, event)
+	}
+	thing := getThing(t, options)
+
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	lost := fmt.Errorf("connection reset")
+	mockClient.LoseConnection(lost)
+	if thing.IsConnected() {
+		t.Fatal("Thing thinks it is connected after the connection was lost")
+	}
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	doDisconnectTest(t, thing)
+	checkConnectionEvents(t, events, iot.ConnectionConnecting, iot.ConnectionConnected, iot.ConnectionLost,
+		iot.ConnectionConnecting, iot.ConnectionConnected, iot.ConnectionDisconnected)
+	if events[2].Err != lost {
+		t.Fatalf("Wrong error for lost connection: %v", events[2].Err)
+	}
+	if events[0].Time.IsZero() {
+		t.Fatal("Event time not set")
+	}
+
+	// Rejected credentials
+	events = nil
+	iot.NewClient = func(t iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
+		mockClient = iot.NewMockClient(t, o)
+		mockClient.Authenticate = func(username string, password string) error {
+			return iot.ErrNotAuthorized
+		}
+		return mockClient
+	}
+	thing = getThing(t, options)
+	if err := thing.Connect(context.Background(), "ssl://mqtt.example.com:443"); err != iot.ErrNotAuthorized {
+		t.Fatalf("Wrong error returned when credentials were rejected: %v", err)
+	}
+	checkConnectionEvents(t, events, iot.ConnectionConnecting, iot.ConnectionAuthFailed, iot.ConnectionDisconnected)
+}
+
+func checkConnectionEvents(t *testing.T, events []iot.ConnectionEvent, expected ...iot.ConnectionEventType) {
+	if len(events) != len(expected) {
+		t.Fatalf("Wrong connection events. Expected: %v, Actual: %v", expected, events)
+	}
+	for i, eventType := range expected {
+		if events[i].Type != eventType {
+			t.Fatalf("Wrong connection event. Expected: %v, Actual: %v", eventType, events[i].Type)
+		}
+	}
+}
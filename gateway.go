@@ -0,0 +1,349 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GatewayControlQOS is the QoS level used for attach and detach messages.
+// Google recommends using QoS 1 so that the gateway knows the message was received.
+const GatewayControlQOS = 1
+
+// BoundDeviceOptions holds the options used to attach a bound device to a Gateway
+type BoundDeviceOptions struct {
+	// DeviceID is the ID of the bound device.
+	// This value is required.
+	DeviceID string
+	// Credentials are used to generate the auth token sent when attaching the device.
+	// If not provided, no auth token will be sent.
+	// This is only valid if the gateway uses the ASSOCIATION_ONLY or DEVICE_AUTH_TOKEN_ONLY auth methods.
+	Credentials *Credentials
+	// ConfigHandler will be called when a new configuration document is received for the device.
+	// The Thing passed to the handler represents the bound device.
+	ConfigHandler ConfigHandler
+	// CommandHandler will be called when a command is received for the device.
+	// If no CommandHandler is provided, the device's commands topic will not be subscribed to.
+	// The Thing passed to the handler represents the bound device.
+	CommandHandler CommandHandler
+}
+
+// Gateway represents a Google IoT Core gateway.
+// Gateways are only supported by GoogleBackend.
+// A Gateway is a Thing that can also communicate on behalf of devices that are bound to it.
+// Attached devices are automatically reattached when the gateway reconnects.
+type Gateway interface {
+	Thing
+
+	// Attach attaches a bound device to the gateway and returns a Thing that represents it.
+	// If the gateway is not connected, the device will be attached when it connects.
+	// Calling Connect or Disconnect on the returned Thing attaches or detaches the device.
+	Attach(ctx context.Context, options *BoundDeviceOptions) (Thing, error)
+
+	// Detach detaches a bound device from the gateway.
+	Detach(ctx context.Context, deviceID string) error
+
+	// Device returns the Thing representing a bound device or nil if the device has not been attached.
+	Device(deviceID string) Thing
+
+	// AttachedDevices returns the IDs of the bound devices that are currently attached.
+	AttachedDevices() []string
+}
+
+// NewGateway returns a new Gateway using the given options.
+func NewGateway(options *ThingOptions) Gateway {
+	g := &gateway{
+		thing:   &thing{options: options},
+		devices: make(map[string]*boundDevice),
+	}
+	g.thing.wrapper = g
+	g.thing.onConnect = g.reattach
+	g.thing.onDisconnect = g.detachAll
+	return g
+}
+
+type gateway struct {
+	*thing
+	mu      sync.Mutex
+	devices map[string]*boundDevice
+}
+
+type attachMessage struct {
+	Authorization string `json:"authorization,omitempty"`
+}
+
+// Attach attaches a bound device to the gateway and returns a Thing that represents it.
+func (g *gateway) Attach(ctx context.Context, options *BoundDeviceOptions) (Thing, error) {
+	if options == nil || options.DeviceID == "" {
+		return nil, ErrConfigurationError
+	}
+	if _, ok := g.backend().(GoogleBackend); !ok {
+		return nil, ErrUnsupportedBackend
+	}
+	g.mu.Lock()
+	d, ok := g.devices[options.DeviceID]
+	if !ok {
+		d = &boundDevice{gateway: g}
+	}
+	d.options = options
+	g.mu.Unlock()
+	return d, d.Connect(ctx)
+}
+
+// Detach detaches a bound device from the gateway.
+func (g *gateway) Detach(ctx context.Context, deviceID string) error {
+	g.mu.Lock()
+	d, ok := g.devices[deviceID]
+	delete(g.devices, deviceID)
+	g.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return g.detach(ctx, d)
+}
+
+// Device returns the Thing representing a bound device or nil if the device has not been attached.
+func (g *gateway) Device(deviceID string) Thing {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	d, ok := g.devices[deviceID]
+	if !ok {
+		return nil
+	}
+	return d
+}
+
+// AttachedDevices returns the IDs of the bound devices that are currently attached.
+func (g *gateway) AttachedDevices() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ids := make([]string, 0, len(g.devices))
+	for id, d := range g.devices {
+		if d.attached {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (g *gateway) attach(ctx context.Context, d *boundDevice) error {
+	if !g.thing.IsConnected() {
+		return ErrNotConnected
+	}
+	id := d.options.DeviceID
+	topics := g.topics()
+	boundID := g.boundID(id)
+
+	msg := attachMessage{}
+	if d.options.Credentials != nil {
+		token, _, err := newAuthToken(g.options, d.options.Credentials)
+		if err != nil {
+			return err
+		}
+		msg.Authorization = token
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	err = g.thing.send(ctx, topics.AttachTopic(boundID), payload, GatewayControlQOS)
+	if err != nil {
+		g.errorf("Couldn't attach device %s: %v", id, err)
+		return err
+	}
+
+	err = g.thing.client.Subscribe(ctx, topics.ConfigTopic(boundID), g.options.ConfigQOS, d.handleConfig)
+	if err != nil {
+		g.errorf("Couldn't subscribe to config topic for device %s: %v", id, err)
+		return err
+	}
+	if d.options.CommandHandler != nil {
+		err = g.thing.client.Subscribe(ctx, topics.CommandsTopic(boundID)+"/#", g.options.CommandQOS, d.handleCommand)
+		if err != nil {
+			g.errorf("Couldn't subscribe to commands topic for device %s: %v", id, err)
+			return err
+		}
+	}
+
+	g.mu.Lock()
+	d.attached = true
+	g.mu.Unlock()
+	g.infof("Attached device %s", id)
+	g.republishState(&d.state, topics.StateTopic(boundID))
+	return nil
+}
+
+func (g *gateway) detach(ctx context.Context, d *boundDevice) error {
+	g.mu.Lock()
+	attached := d.attached
+	d.attached = false
+	g.mu.Unlock()
+	if !attached || !g.thing.IsConnected() {
+		return nil
+	}
+	id := d.options.DeviceID
+	topics := g.topics()
+	boundID := g.boundID(id)
+
+	g.thing.client.Unsubscribe(ctx, topics.ConfigTopic(boundID))
+	if d.options.CommandHandler != nil {
+		g.thing.client.Unsubscribe(ctx, topics.CommandsTopic(boundID)+"/#")
+	}
+
+	err := g.thing.send(ctx, topics.DetachTopic(boundID), []byte{}, GatewayControlQOS)
+	if err != nil {
+		g.errorf("Couldn't detach device %s: %v", id, err)
+		return err
+	}
+	g.infof("Detached device %s", id)
+	return nil
+}
+
+// topics returns the topic templates used by the gateway and its bound devices.
+func (g *gateway) topics() TopicScheme {
+	return GoogleBackend{topics: g.options.Topics}.scheme()
+}
+
+// boundID returns the ID of a bound device, which is in the same registry as the gateway.
+func (g *gateway) boundID(deviceID string) *ID {
+	id := *g.options.ID
+	id.DeviceID = deviceID
+	return &id
+}
+
+// reattach attaches all known devices after the gateway (re)connects.
+func (g *gateway) reattach(client MQTTClient) {
+	ctx := context.Background()
+	for _, d := range g.boundDevices() {
+		g.mu.Lock()
+		d.attached = false
+		g.mu.Unlock()
+		g.attach(ctx, d)
+	}
+}
+
+// detachAll detaches all devices before the gateway disconnects.
+// The devices are remembered so that they will be reattached if the gateway connects again.
+func (g *gateway) detachAll(ctx context.Context) {
+	for _, d := range g.boundDevices() {
+		g.detach(ctx, d)
+	}
+}
+
+func (g *gateway) boundDevices() []*boundDevice {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	devices := make([]*boundDevice, 0, len(g.devices))
+	for _, d := range g.devices {
+		devices = append(devices, d)
+	}
+	return devices
+}
+
+// boundDevice represents a device that communicates through a gateway.
+type boundDevice struct {
+	gateway  *gateway
+	options  *BoundDeviceOptions
+	attached bool
+	state    stateManager
+}
+
+// id returns the ID of the device.
+func (d *boundDevice) id() *ID {
+	return d.gateway.boundID(d.options.DeviceID)
+}
+
+// errorf logs an error about the device using the gateway's ErrorLogger.
+func (d *boundDevice) errorf(format string, v ...interface{}) {
+	d.gateway.errorf("Device %s: %s", d.options.DeviceID, fmt.Sprintf(format, v...))
+}
+
+// PublishState publishes the current device state
+func (d *boundDevice) PublishState(ctx context.Context, message []byte) error {
+	if !d.IsConnected() {
+		return ErrNotConnected
+	}
+	if !d.state.update(message) {
+		return nil
+	}
+	return d.gateway.publishState(ctx, &d.state, d.gateway.topics().StateTopic(d.id()))
+}
+
+// PublishEvent publishes an event. An optional hierarchy of event names can be provided.
+func (d *boundDevice) PublishEvent(ctx context.Context, message []byte, event ...string) error {
+	if !d.IsConnected() {
+		return ErrNotConnected
+	}
+	if err := ValidateSubfolder(event...); err != nil {
+		return err
+	}
+	return d.gateway.publish(ctx, d.gateway.topics().EventsTopic(d.id(), event...), message, d.gateway.options.EventQOS)
+}
+
+// PublishEventValue encodes v using the gateway's EventRegistry and publishes it as an event.
+func (d *boundDevice) PublishEventValue(ctx context.Context, v interface{}, event ...string) error {
+	payload, subfolder, err := eventRegistryFor(d.gateway.options).encodeEvent(v, event)
+	if err != nil {
+		return err
+	}
+	return d.PublishEvent(ctx, payload, subfolder...)
+}
+
+// Connect attaches the device to the gateway. The servers are ignored.
+// If the gateway is not connected, the device will be attached when it connects.
+func (d *boundDevice) Connect(ctx context.Context, servers ...string) error {
+	d.gateway.mu.Lock()
+	d.gateway.devices[d.options.DeviceID] = d
+	d.gateway.mu.Unlock()
+	if !d.gateway.thing.IsConnected() {
+		return nil
+	}
+	return d.gateway.attach(ctx, d)
+}
+
+// IsConnected returns true if the device is attached and the gateway is connected
+func (d *boundDevice) IsConnected() bool {
+	d.gateway.mu.Lock()
+	attached := d.attached
+	d.gateway.mu.Unlock()
+	return attached && d.gateway.IsConnected()
+}
+
+// Disconnect detaches the device from the gateway
+func (d *boundDevice) Disconnect(ctx context.Context) {
+	d.gateway.Detach(ctx, d.options.DeviceID)
+}
+
+// AuthTokenExpiry returns the time that the gateway's current auth token expires.
+// Bound devices communicate using the gateway's connection.
+func (d *boundDevice) AuthTokenExpiry() time.Time {
+	return d.gateway.AuthTokenExpiry()
+}
+
+// OutboxStats returns statistics about the gateway's outbox.
+// Messages for bound devices are not buffered while the device is detached.
+func (d *boundDevice) OutboxStats() OutboxStats {
+	return d.gateway.OutboxStats()
+}
+
+func (d *boundDevice) handleConfig(thing Thing, topic string, config []byte) {
+	if d.options.ConfigHandler != nil {
+		d.options.ConfigHandler(d, config)
+	}
+}
+
+func (d *boundDevice) handleCommand(thing Thing, topic string, command []byte) {
+	if d.options.CommandHandler != nil {
+		subfolder := strings.TrimPrefix(strings.TrimPrefix(topic, d.gateway.topics().CommandsTopic(d.id())), "/")
+		d.options.CommandHandler(d, subfolder, command)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/vaelen/iot"
+)
+
+const BoundDeviceID = "bound-device"
+
+var BoundConfigTopic = "/devices/bound-device/config"
+var BoundStateTopic = "/devices/bound-device/state"
+var BoundCommandsTopic = "/devices/bound-device/commands"
+var BoundAttachTopic = "/devices/bound-device/attach"
+var BoundDetachTopic = "/devices/bound-device/detach"
+
+func TestGateway(t *testing.T) {
+	ctx := context.Background()
+	initMockClient()
+	credentials := getCredentials(t, iot.CredentialTypeRSA)
+	options, _ := getOptions(t, credentials)
+
+	gateway := iot.NewGateway(options)
+
+	var configThing iot.Thing
+	var configReceived, commandReceived string
+	device, err := gateway.Attach(ctx, &iot.BoundDeviceOptions{
+		DeviceID:    BoundDeviceID,
+		Credentials: getCredentials(t, iot.CredentialTypeEC),
+		ConfigHandler: func(thing iot.Thing, config []byte) {
+			configThing = thing
+			configReceived = string(config)
+		},
+		CommandHandler: func(thing iot.Thing, subfolder string, command []byte) {
+			commandReceived = subfolder + ":" + string(command)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't attach device before connecting: %v", err)
+	}
+	if device.IsConnected() {
+		t.Fatal("Device attached before gateway connected")
+	}
+
+	doConnectionTest(t, gateway, "ssl://mqtt.example.com:443")
+
+	if !device.IsConnected() {
+		t.Fatal("Device not attached after gateway connected")
+	}
+	if ids := gateway.AttachedDevices(); len(ids) != 1 || ids[0] != BoundDeviceID {
+		t.Fatalf("Wrong attached devices: %v", ids)
+	}
+	if gateway.Device(BoundDeviceID) != device {
+		t.Fatal("Device() returned the wrong Thing")
+	}
+	checkAttachMessage(t)
+
+	mockClient.Receive(BoundConfigTopic, []byte("bound config"))
+	if configReceived != "bound config" {
+		t.Fatalf("Wrong config received: %v", configReceived)
+	}
+	if configThing != device {
+		t.Fatal("Config handler was not passed the bound device")
+	}
+
+	mockClient.Receive(BoundCommandsTopic+"/a", []byte("bound command"))
+	if commandReceived != "a:bound command" {
+		t.Fatalf("Wrong command received: %v", commandReceived)
+	}
+
+	err = device.PublishState(ctx, []byte("bound state"))
+	if err != nil {
+		t.Fatalf("Couldn't publish state: %v", err)
+	}
+	l := mockClient.Messages[BoundStateTopic]
+	if len(l) != 1 || string(l[0].([]byte)) != "bound state" {
+		t.Fatalf("Wrong state published: %v", l)
+	}
+
+	// Devices should be reattached after a reconnect
+	mockClient.Messages = make(map[string][]interface{})
+	mockClient.Subscriptions = make(map[string]iot.MQTTMessageHandler)
+	mockClient.Connect(ctx, "ssl://mqtt.example.com:443")
+	checkAttachMessage(t)
+	if _, ok := mockClient.Subscriptions[BoundConfigTopic]; !ok {
+		t.Fatal("Bound device config not resubscribed after reconnect")
+	}
+
+	err = gateway.Detach(ctx, BoundDeviceID)
+	if err != nil {
+		t.Fatalf("Couldn't detach device: %v", err)
+	}
+	if len(mockClient.Messages[BoundDetachTopic]) != 1 {
+		t.Fatal("Detach message not published")
+	}
+	if device.IsConnected() || len(gateway.AttachedDevices()) != 0 || gateway.Device(BoundDeviceID) != nil {
+		t.Fatal("Device still attached after detaching")
+	}
+	if err = device.PublishState(ctx, []byte("detached")); err != iot.ErrNotConnected {
+		t.Fatalf("Publishing for a detached device returned the wrong error: %v", err)
+	}
+
+	doDisconnectTest(t, gateway)
+}
+
+func TestGatewayErrors(t *testing.T) {
+	ctx := context.Background()
+	initMockClient()
+	credentials := getCredentials(t, iot.CredentialTypeRSA)
+	options, _ := getOptions(t, credentials)
+
+	var received *iot.DeviceError
+	options.ErrorHandler = func(thing iot.Thing, err *iot.DeviceError) {
+		received = err
+	}
+
+	gateway := iot.NewGateway(options)
+	doConnectionTest(t, gateway, "ssl://mqtt.example.com:443")
+
+	if _, ok := mockClient.Subscriptions[ErrorsTopic]; !ok {
+		t.Fatal("Errors topic not subscribed")
+	}
+
+	device, err := gateway.Attach(ctx, &iot.BoundDeviceOptions{DeviceID: BoundDeviceID})
+	if err != nil {
+		t.Fatalf("Couldn't attach device: %v", err)
+	}
+	attachID := mockClient.MessageID
+	if err = device.PublishEvent(ctx, []byte("event")); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+
+	// Errors are matched with the message that caused them, even if other messages were published afterwards
+	mockClient.Receive(ErrorsTopic, []byte(fmt.Sprintf(`{"error_type":"GATEWAY_ATTACHMENT_ERROR","device_id":"bound-device","description":"not bound","message_id":%d}`, attachID)))
+	if received == nil {
+		t.Fatal("Error not received")
+	}
+	if received.ErrorType != iot.ErrorTypeGatewayAttachment || received.DeviceID != BoundDeviceID || received.MessageID != int(attachID) {
+		t.Fatalf("Error not parsed correctly: %+v", received)
+	}
+	if received.Publish == nil || received.Publish.Topic != BoundAttachTopic || received.Publish.MessageID != int(attachID) {
+		t.Fatalf("Error not correlated with the attach message: %+v", received.Publish)
+	}
+
+	// Messages with other IDs are never blamed for an error
+	mockClient.Receive(ErrorsTopic, []byte(`{"error_type":"GATEWAY_UNKNOWN_ERROR","device_id":"bound-device","message_id":1000}`))
+	if received.Publish != nil {
+		t.Fatalf("Error correlated with the wrong message: %+v", received.Publish)
+	}
+
+	// Without a message ID, the most recent message for the device is used
+	mockClient.Receive(ErrorsTopic, []byte(`{"error_type":"GATEWAY_UNKNOWN_ERROR","device_id":"bound-device"}`))
+	if received.Publish == nil || received.Publish.Topic != "/devices/bound-device/events" {
+		t.Fatalf("Error not correlated with the latest message: %+v", received.Publish)
+	}
+
+	received = nil
+	mockClient.Receive(ErrorsTopic, []byte("not json"))
+	if received == nil || received.Description != "not json" || received.Publish != nil {
+		t.Fatalf("Invalid error message not handled correctly: %+v", received)
+	}
+
+	// Message IDs are reused by new connections, so published messages are forgotten when reconnecting
+	mockClient.LoseConnection(nil)
+	doConnectionTest(t, gateway, "ssl://mqtt.example.com:443")
+	mockClient.Receive(ErrorsTopic, []byte(`{"error_type":"GATEWAY_UNKNOWN_ERROR","device_id":"bound-device"}`))
+	if received.Publish == nil || received.Publish.Topic != BoundAttachTopic {
+		t.Fatalf("Error correlated with a message from the previous connection: %+v", received.Publish)
+	}
+
+	doDisconnectTest(t, gateway)
+	if _, ok := mockClient.Subscriptions[ErrorsTopic]; ok {
+		t.Fatal("Errors topic not unsubscribed")
+	}
+}
+
+func checkAttachMessage(t *testing.T) {
+	l := mockClient.Messages[BoundAttachTopic]
+	if len(l) != 1 {
+		t.Fatalf("Wrong number of attach messages: %v", len(l))
+	}
+	msg := make(map[string]string)
+	if err := json.Unmarshal(l[0].([]byte), &msg); err != nil {
+		t.Fatalf("Couldn't parse attach message: %v", err)
+	}
+	if msg["authorization"] == "" {
+		t.Fatalf("Attach message didn't contain an auth token: %v", msg)
+	}
+}
@@ -0,0 +1,415 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+// Package httpbridge provides an iot.MQTTClient implementation that uses the Cloud IoT Core HTTP bridge instead of MQTT.
+// Devices behind proxies that block the MQTT ports can use it to publish events and state and to receive configs.
+//
+// The HTTP bridge doesn't deliver commands or errors, so subscribing to those topics returns ErrNotSupported.
+// Configs are received by polling. Each request waits for a new config version, so changes are usually received immediately.
+//
+// Use New to create a Thing that uses the HTTP bridge. Other Things can continue to use MQTT.
+package httpbridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vaelen/iot"
+)
+
+// DefaultURL is the URL of the Cloud IoT Core HTTP bridge.
+// It is used if no servers are passed to Connect.
+const DefaultURL = "https://cloudiotdevice.googleapis.com"
+
+// DefaultPollInterval is the default interval between config requests when the config hasn't changed.
+var DefaultPollInterval = time.Minute
+
+// ErrNotSupported is returned when subscribing or publishing to a topic that the HTTP bridge doesn't support.
+var ErrNotSupported = fmt.Errorf("not supported by the HTTP bridge")
+
+// New creates a Thing that communicates with the server using the HTTP bridge.
+// The servers passed to Connect are base URLs, such as DefaultURL.
+func New(options *iot.ThingOptions) iot.Thing {
+	options.NewClient = NewClient
+	return iot.New(options)
+}
+
+// HTTPClient is an implementation of iot.MQTTClient that uses the Cloud IoT Core HTTP bridge.
+type HTTPClient struct {
+	// PollInterval is the interval between config requests when the config hasn't changed.
+	PollInterval time.Duration
+
+	thing                  iot.Thing
+	options                *iot.ThingOptions
+	credentialsProvider    iot.MQTTCredentialsProvider
+	onConnectHandler       iot.MQTTOnConnectHandler
+	connectionEventHandler iot.MQTTConnectionEventHandler
+	debugLogger            iot.Logger
+	infoLogger             iot.Logger
+	errorLogger            iot.Logger
+	httpClient             *http.Client
+
+	mu        sync.Mutex
+	connected bool
+	server    string
+	token     string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	pollers   map[string]context.CancelFunc
+}
+
+// deviceConfig is the config returned by the HTTP bridge.
+type deviceConfig struct {
+	Version    int64  `json:"version,string"`
+	BinaryData []byte `json:"binaryData"`
+}
+
+// apiError is the error returned by the HTTP bridge.
+type apiError struct {
+	Error struct {
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+// NewClient creates an HTTPClient instance.
+// Set ThingOptions.NewClient to NewClient, or use New, to use the HTTP bridge.
+func NewClient(thing iot.Thing, options *iot.ThingOptions) iot.MQTTClient {
+	return &HTTPClient{
+		PollInterval: DefaultPollInterval,
+		thing:        thing,
+		options:      options,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: iot.NewTLSConfig(options),
+			},
+		},
+		pollers: make(map[string]context.CancelFunc),
+	}
+}
+
+// IsConnected returns true after the client has connected and until the connection is lost or the client disconnects
+func (c *HTTPClient) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+// Connect checks that the client can authenticate with the first of the given servers that is reachable.
+// The HTTP bridge doesn't use persistent connections, so later requests may still fail.
+func (c *HTTPClient) Connect(ctx context.Context, servers ...string) error {
+	c.emit(iot.ConnectionConnecting, nil)
+	if len(servers) == 0 {
+		servers = []string{DefaultURL}
+	}
+	token := ""
+	if c.credentialsProvider != nil {
+		_, token = c.credentialsProvider()
+	}
+
+	var err error
+	var server string
+	for _, server = range servers {
+		server = strings.TrimSuffix(server, "/")
+		_, err = c.getConfig(ctx, server, token, c.options.ID.DeviceID, 0)
+		if err == nil || err == iot.ErrNotAuthorized || err == iot.ErrCancelled {
+			break
+		}
+		c.logf(c.errorLogger, "Couldn't connect to %s: %v", server, err)
+	}
+	if err != nil {
+		if err == iot.ErrNotAuthorized {
+			c.emit(iot.ConnectionAuthFailed, err)
+		}
+		c.emit(iot.ConnectionDisconnected, err)
+		return err
+	}
+
+	c.mu.Lock()
+	c.connected = true
+	c.server = server
+	c.token = token
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.mu.Unlock()
+
+	c.logf(c.infoLogger, "Connected")
+	c.emit(iot.ConnectionConnected, nil)
+	if c.onConnectHandler != nil {
+		c.onConnectHandler(c)
+	}
+	return nil
+}
+
+// Disconnect stops polling for configs
+func (c *HTTPClient) Disconnect(ctx context.Context) error {
+	if !c.disconnect() {
+		return nil
+	}
+	c.logf(c.infoLogger, "Disconnected")
+	c.emit(iot.ConnectionDisconnected, nil)
+	return nil
+}
+
+// disconnect marks the client as disconnected and stops polling.
+// It returns false if the client was not connected.
+func (c *HTTPClient) disconnect() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return false
+	}
+	c.connected = false
+	c.cancel()
+	c.pollers = make(map[string]context.CancelFunc)
+	return true
+}
+
+// Publish publishes to an events or state topic.
+// The payload must be a []byte or a string. The QoS level is ignored because every request is acknowledged.
+func (c *HTTPClient) Publish(ctx context.Context, topic string, qos uint8, payload interface{}) error {
+	var b []byte
+	switch p := payload.(type) {
+	case []byte:
+		b = p
+	case string:
+		b = []byte(p)
+	default:
+		return fmt.Errorf("unsupported payload type: %T", payload)
+	}
+	deviceID, kind, subFolder, ok := parseTopic(topic)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	var method string
+	var request interface{}
+	switch kind {
+	case "events":
+		method = ":publishEvent"
+		request = struct {
+			BinaryData []byte `json:"binaryData"`
+			SubFolder  string `json:"subFolder,omitempty"`
+		}{b, subFolder}
+	case "state":
+		method = ":setState"
+		request = struct {
+			State struct {
+				BinaryData []byte `json:"binaryData"`
+			} `json:"state"`
+		}{struct {
+			BinaryData []byte `json:"binaryData"`
+		}{b}}
+	default:
+		return ErrNotSupported
+	}
+
+	c.mu.Lock()
+	server, token, connected := c.server, c.token, c.connected
+	c.mu.Unlock()
+	if !connected {
+		return iot.ErrNotConnected
+	}
+	err := c.do(ctx, http.MethodPost, server+devicePath(c.options.ID, deviceID)+method, token, request, nil)
+	if err == nil {
+		c.logf(c.debugLogger, "PUBLISHED - Topic: %s, Message Length: %d bytes", topic, len(b))
+	}
+	return err
+}
+
+// Subscribe starts polling for configs if the topic is a config topic.
+// Other topics are not supported by the HTTP bridge.
+func (c *HTTPClient) Subscribe(ctx context.Context, topic string, qos uint8, callback iot.MQTTMessageHandler) error {
+	deviceID, kind, _, ok := parseTopic(topic)
+	if !ok || kind != "config" {
+		return ErrNotSupported
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return iot.ErrNotConnected
+	}
+	if cancel, ok := c.pollers[topic]; ok {
+		cancel()
+	}
+	pollCtx, cancel := context.WithCancel(c.ctx)
+	c.pollers[topic] = cancel
+	go c.poll(pollCtx, c.server, c.token, deviceID, topic, callback)
+	return nil
+}
+
+// Unsubscribe stops polling for configs
+func (c *HTTPClient) Unsubscribe(ctx context.Context, topic string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cancel, ok := c.pollers[topic]; ok {
+		cancel()
+		delete(c.pollers, topic)
+	}
+	return nil
+}
+
+// SetDebugLogger sets the logger to use for logging debug messages
+func (c *HTTPClient) SetDebugLogger(logger iot.Logger) {
+	c.debugLogger = logger
+}
+
+// SetInfoLogger sets the logger to use for logging information or warning messages
+func (c *HTTPClient) SetInfoLogger(logger iot.Logger) {
+	c.infoLogger = logger
+}
+
+// SetErrorLogger sets the logger to use for logging error or critical messages
+func (c *HTTPClient) SetErrorLogger(logger iot.Logger) {
+	c.errorLogger = logger
+}
+
+// SetClientID is ignored because the HTTP bridge identifies devices by their URL
+func (c *HTTPClient) SetClientID(clientID string) {}
+
+// SetCredentialsProvider sets the CredentialsProvider used to generate auth tokens
+func (c *HTTPClient) SetCredentialsProvider(credentialsProvider iot.MQTTCredentialsProvider) {
+	c.credentialsProvider = credentialsProvider
+}
+
+// SetOnConnectHandler sets the method that is called after the client connects to the server
+func (c *HTTPClient) SetOnConnectHandler(handler iot.MQTTOnConnectHandler) {
+	c.onConnectHandler = handler
+}
+
+// SetConnectionEventHandler sets the method that is called when the state of the connection changes
+func (c *HTTPClient) SetConnectionEventHandler(handler iot.MQTTConnectionEventHandler) {
+	c.connectionEventHandler = handler
+}
+
+// poll requests the config until the context is cancelled and passes new versions to the callback.
+func (c *HTTPClient) poll(ctx context.Context, server string, token string, deviceID string, topic string, callback iot.MQTTMessageHandler) {
+	var version int64
+	for {
+		config, err := c.getConfig(ctx, server, token, deviceID, version)
+		if ctx.Err() != nil || err == iot.ErrNotConnected {
+			return
+		}
+		if err == nil && config.Version != version {
+			version = config.Version
+			c.logf(c.debugLogger, "RECEIVED - Topic: %s, Message Length: %d bytes", topic, len(config.BinaryData))
+			if callback != nil {
+				callback(c.thing, topic, config.BinaryData)
+			}
+			continue
+		}
+		if err != nil {
+			c.logf(c.errorLogger, "Couldn't get config: %v", err)
+		}
+		timer := time.NewTimer(c.PollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// getConfig requests the config of a device.
+// If localVersion is not 0, the server waits for a newer version before responding.
+func (c *HTTPClient) getConfig(ctx context.Context, server string, token string, deviceID string, localVersion int64) (*deviceConfig, error) {
+	config := &deviceConfig{}
+	u := server + devicePath(c.options.ID, deviceID) + "/config?local_version=" + strconv.FormatInt(localVersion, 10)
+	err := c.do(ctx, http.MethodGet, u, token, nil, config)
+	return config, err
+}
+
+// do sends a request to the HTTP bridge and decodes the response into response, if it is not nil.
+func (c *HTTPClient) do(ctx context.Context, method string, u string, token string, request interface{}, response interface{}) error {
+	var body bytes.Buffer
+	if request != nil {
+		if err := json.NewEncoder(&body).Encode(request); err != nil {
+			return err
+		}
+	}
+	r, err := http.NewRequest(method, u, &body)
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if request != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(r)
+	if err != nil {
+		if ctx.Err() != nil {
+			return iot.ErrCancelled
+		}
+		c.lost(err)
+		return iot.ErrNotConnected
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return iot.ErrNotAuthorized
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return iot.ErrRateLimited
+	case resp.StatusCode != http.StatusOK:
+		e := apiError{}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("HTTP bridge returned %s: %s", resp.Status, e.Error.Message)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// lost marks the client as disconnected after a request fails and emits a connection lost event.
+func (c *HTTPClient) lost(err error) {
+	if !c.disconnect() {
+		return
+	}
+	c.logf(c.errorLogger, "Connection Lost. Error: %v", err)
+	c.emit(iot.ConnectionLost, err)
+}
+
+func (c *HTTPClient) emit(eventType iot.ConnectionEventType, err error) {
+	if c.connectionEventHandler != nil {
+		c.connectionEventHandler(iot.ConnectionEvent{Type: eventType, Err: err})
+	}
+}
+
+func (c *HTTPClient) logf(logger iot.Logger, format string, v ...interface{}) {
+	if logger != nil {
+		logger(fmt.Sprintf(format, v...))
+	}
+}
+
+// devicePath returns the path of a device in the HTTP bridge API.
+func devicePath(id *iot.ID, deviceID string) string {
+	return fmt.Sprintf("/v1/projects/%s/locations/%s/registries/%s/devices/%s",
+		url.PathEscape(id.ProjectID), url.PathEscape(id.Location), url.PathEscape(id.Registry), url.PathEscape(deviceID))
+}
+
+// parseTopic splits a topic of the form /devices/{device-id}/{kind}/{sub-folder} into its parts.
+func parseTopic(topic string) (string, string, string, bool) {
+	parts := strings.SplitN(topic, "/", 5)
+	if len(parts) < 4 || parts[0] != "" || parts[1] != "devices" || parts[2] == "" {
+		return "", "", "", false
+	}
+	subFolder := ""
+	if len(parts) == 5 {
+		if parts[3] != "events" {
+			return "", "", "", false
+		}
+		subFolder = parts[4]
+	}
+	return parts[2], parts[3], subFolder, true
+}
@@ -0,0 +1,166 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package httpbridge
+
+import (
+	"context"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vaelen/iot"
+	"github.com/vaelen/iot/iottest"
+)
+
+var ID = &iot.ID{
+	DeviceID:  "vaelen_iot_test",
+	Registry:  "x",
+	Location:  "y",
+	ProjectID: "z",
+}
+
+const (
+	ConfigTopic   = "/devices/vaelen_iot_test/config"
+	EventsTopic   = "/devices/vaelen_iot_test/events"
+	StateTopic    = "/devices/vaelen_iot_test/state"
+	CommandsTopic = "/devices/vaelen_iot_test/commands/#"
+)
+
+func TestHTTPBridge(t *testing.T) {
+	ctx := context.Background()
+
+	server, bridge := startServer(t)
+	server.AddDevice(ID.DeviceID, getOptions(t).Credentials)
+	server.SetConfig(ID.DeviceID, []byte("config 1"))
+
+	thing := New(getOptions(t))
+	err := thing.Connect(ctx, bridge.URL)
+	if err != nil {
+		t.Fatalf("Couldn't connect to server: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+	if !thing.IsConnected() {
+		t.Fatal("Thing isn't connected")
+	}
+
+	// The config handler publishes the config as the state
+	waitForState(t, server, "config 1")
+
+	err = thing.PublishEvent(ctx, []byte("telemetry event"), "a", "b")
+	if err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	messages := waitFor(t, server, EventsTopic+"/a/b")
+	if string(messages[0].Payload) != "telemetry event" {
+		t.Fatalf("Wrong event: %s", messages[0].Payload)
+	}
+
+	// New configs are received by long polling
+	server.SetConfig(ID.DeviceID, []byte("config 2"))
+	waitForState(t, server, "config 2")
+}
+
+func TestHTTPBridgeNotAuthorized(t *testing.T) {
+	ctx := context.Background()
+
+	// The device is not registered, so the server rejects its credentials
+	_, bridge := startServer(t)
+
+	var events []iot.ConnectionEventType
+	options := getOptions(t)
+	options.ConnectionEventHandler = func(thing iot.Thing, event iot.ConnectionEvent) {
+		events = append(events, event.Type)
+	}
+	thing := New(options)
+	err := thing.Connect(ctx, bridge.URL)
+	if err != iot.ErrNotAuthorized {
+		t.Fatalf("Wrong error: %v", err)
+	}
+	expected := []iot.ConnectionEventType{iot.ConnectionConnecting, iot.ConnectionAuthFailed, iot.ConnectionDisconnected}
+	if len(events) != len(expected) {
+		t.Fatalf("Wrong connection events: %v", events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("Wrong connection events: %v", events)
+		}
+	}
+}
+
+func TestHTTPBridgeNotSupported(t *testing.T) {
+	ctx := context.Background()
+
+	server, bridge := startServer(t)
+	options := getOptions(t)
+	server.AddDevice(ID.DeviceID, options.Credentials)
+
+	client := NewClient(nil, options)
+	client.SetCredentialsProvider(func() (string, string) {
+		return "unused", ""
+	})
+	if err := client.Connect(ctx, bridge.URL); err != iot.ErrNotAuthorized {
+		t.Fatalf("Connected without an auth token: %v", err)
+	}
+
+	// The HTTP bridge only supports events, state and configs
+	client = NewClient(nil, options)
+	err := client.Subscribe(ctx, CommandsTopic, 1, nil)
+	if err != ErrNotSupported {
+		t.Fatalf("Subscribing to commands didn't fail: %v", err)
+	}
+	err = client.Publish(ctx, ConfigTopic, 1, []byte("config"))
+	if err != ErrNotSupported {
+		t.Fatalf("Publishing a config didn't fail: %v", err)
+	}
+}
+
+// startServer starts a server and an HTTP bridge for it.
+func startServer(t *testing.T) (*iottest.Server, *httptest.Server) {
+	server := iottest.NewServer(ID.ProjectID, ID.Location, ID.Registry)
+	t.Cleanup(server.Close)
+	bridge := httptest.NewServer(server.BridgeHandler())
+	t.Cleanup(bridge.Close)
+	return server, bridge
+}
+
+func waitFor(t *testing.T, server *iottest.Server, topic string) []iottest.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	messages, err := server.WaitForMessages(ctx, topic, 1)
+	if err != nil {
+		t.Fatalf("Server didn't receive a message on %s", topic)
+	}
+	return messages
+}
+
+func waitForState(t *testing.T, server *iottest.Server, state string) {
+	for i := 0; string(server.State(ID.DeviceID)) != state; i++ {
+		if i == 500 {
+			t.Fatalf("Wrong state: %s", server.State(ID.DeviceID))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func getOptions(t *testing.T) *iot.ThingOptions {
+	ctx := context.Background()
+
+	credentials, err := iot.LoadRSACredentials("../test_keys/rsa_cert.pem", "../test_keys/rsa_private.pem")
+	if err != nil {
+		t.Fatal("Couldn't load credentials")
+	}
+
+	options := iot.DefaultOptions(ID, credentials)
+	options.StateRateLimit = iot.RateLimit{}
+	options.LogMQTT = true
+	options.DebugLogger = log.Println
+	options.InfoLogger = log.Println
+	options.ErrorLogger = log.Println
+	options.ConfigHandler = func(thing iot.Thing, config []byte) {
+		thing.PublishState(ctx, config)
+	}
+
+	return options
+}
@@ -8,13 +8,13 @@ package iot
 
 import (
 	"context"
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"io/ioutil"
 	"time"
 
 	"github.com/benbjohnson/clock"
-	"github.com/dgrijalva/jwt-go"
 )
 
 // DefaultAuthTokenExpiration is the default value for Thing.AuthTokenExpiration
@@ -26,12 +26,36 @@ var ErrNotConnected = fmt.Errorf("not connected")
 // ErrPublishFailed is returned if the client was unable to send the message
 var ErrPublishFailed = fmt.Errorf("could not publish message")
 
+// ErrOutboxFull is returned if an event or state is published while offline and the outbox is full.
+// This is only returned when ThingOptions.OutboxDropPolicy is DropNewest.
+var ErrOutboxFull = fmt.Errorf("outbox is full")
+
+// ErrRateLimited is returned if a message is published faster than the configured rate limit allows.
+// This is only returned when ThingOptions.RateLimitNoWait is true.
+var ErrRateLimited = fmt.Errorf("rate limited")
+
 // ErrConfigurationError is returned from Connect() if either the ID or Credentials have not been set.
 var ErrConfigurationError = fmt.Errorf("required configuration values are mising")
 
 // ErrCancelled is returned when a context is canceled or times out.
 var ErrCancelled = fmt.Errorf("operation was cancelled or timed out")
 
+// ErrNotAuthorized is returned from Connect() if the server rejected the client's credentials.
+// MQTTClient implementations should return this error when authentication fails.
+var ErrNotAuthorized = fmt.Errorf("not authorized")
+
+// ErrCertificateMismatch is returned when loading credentials if the certificate does not match the private key.
+var ErrCertificateMismatch = fmt.Errorf("certificate does not match private key")
+
+// ErrPasswordRequired is returned when loading an encrypted private key without a password.
+var ErrPasswordRequired = fmt.Errorf("private key is encrypted but no password was provided")
+
+// ErrIncorrectPassword is returned when an encrypted private key can't be decrypted using the given password.
+var ErrIncorrectPassword = fmt.Errorf("incorrect password for private key")
+
+// ErrCertificateNotPinned is returned when none of the server's certificates match ThingOptions.ServerCertificateFingerprints.
+var ErrCertificateNotPinned = fmt.Errorf("server certificate does not match any pinned fingerprint")
+
 // ClientConstructor defines a function for creating an MQTT client instance
 type ClientConstructor func(thing Thing, options *ThingOptions) MQTTClient
 
@@ -42,6 +66,10 @@ var NewClient ClientConstructor
 // ConfigHandler handles configuration updates received from the server.
 type ConfigHandler func(thing Thing, config []byte)
 
+// CommandHandler handles commands received from the server.
+// The subfolder will be empty if the command was sent without a subfolder.
+type CommandHandler func(thing Thing, subfolder string, command []byte)
+
 // Logger is used to write log output.  If no Logger is provided, no logging will be performed.
 type Logger func(args ...interface{})
 
@@ -68,54 +96,38 @@ type Credentials struct {
 	Type        CredentialType
 	Certificate tls.Certificate
 	PrivateKey  interface{}
+	// Signer signs auth tokens and TLS handshakes.
+	// It allows the private key to be held in hardware or by another process.
+	// If Signer is nil, PrivateKey is used instead.
+	Signer crypto.Signer
+	// Expiration is the time the public key registered with the server expires.
+	// Expired credentials are skipped when they are part of a CredentialSet.
+	// The zero value means the credentials do not expire.
+	Expiration time.Time
 }
 
 // LoadRSACredentials creates a Credentials struct from the given RSA private key and certificate
 func LoadRSACredentials(certificatePath string, privateKeyPath string) (*Credentials, error) {
-	signBytes, err := ioutil.ReadFile(privateKeyPath)
-	if err != nil {
-		return nil, err
-	}
-
-	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(signBytes)
-	if err != nil {
-		return nil, err
-	}
-
-	certificate, err := tls.LoadX509KeyPair(certificatePath, privateKeyPath)
-	if err != nil {
-		return nil, err
-	}
-
-	return &Credentials{
-		Type:        CredentialTypeRSA,
-		Certificate: certificate,
-		PrivateKey:  privateKey,
-	}, nil
+	return loadTypedCredentials(certificatePath, privateKeyPath, CredentialTypeRSA)
 }
 
 // LoadECCredentials creates a Credentials struct from the given EC private key and certificate
 func LoadECCredentials(certificatePath string, privateKeyPath string) (*Credentials, error) {
-	signBytes, err := ioutil.ReadFile(privateKeyPath)
-	if err != nil {
-		return nil, err
-	}
+	return loadTypedCredentials(certificatePath, privateKeyPath, CredentialTypeEC)
+}
 
-	privateKey, err := jwt.ParseECPrivateKeyFromPEM(signBytes)
-	if err != nil {
-		return nil, err
+func loadTypedCredentials(certificatePath string, privateKeyPath string, credentialType CredentialType) (*Credentials, error) {
+	if certificatePath == "" {
+		return nil, ErrConfigurationError
 	}
-
-	certificate, err := tls.LoadX509KeyPair(certificatePath, privateKeyPath)
+	credentials, err := LoadCredentials(certificatePath, privateKeyPath, nil)
 	if err != nil {
 		return nil, err
 	}
-
-	return &Credentials{
-		Type:        CredentialTypeEC,
-		Certificate: certificate,
-		PrivateKey:  privateKey,
-	}, nil
+	if credentials.Type != credentialType {
+		return nil, ErrUnsupportedKey
+	}
+	return credentials, nil
 }
 
 // ThingOptions holds the options that are used to create a Thing
@@ -124,8 +136,34 @@ type ThingOptions struct {
 	// This value is required.
 	ID *ID
 	// Credentials are used to authenticate with the server.
-	// This value is required.
+	// Either this value or CredentialSet is required, unless the Backend authenticates in another way.
 	Credentials *Credentials
+	// Backend determines the client ID, topics and authentication used to communicate with the server.
+	// If not provided, GoogleBackend is used.
+	Backend Backend
+	// Topics holds the topic templates used with GoogleBackend, such as when connecting to a server
+	// that emulates Cloud IoT Core using different topics. GoogleTopicScheme is used for any templates that are empty.
+	// GenericBackend uses these templates if its own Topics are empty.
+	// AWSBackend and AzureBackend define their own topics, so setting Topics with them is a configuration error.
+	Topics TopicScheme
+	// CredentialSet holds multiple credentials in order of preference.
+	// If the server rejects the current credentials, the next credentials in the set will be tried.
+	// If not provided, a CredentialSet containing only Credentials will be used.
+	CredentialSet *CredentialSet
+	// RootCAs is the set of root certificate authorities used to verify the server's certificate.
+	// If not provided, the host's root certificate authorities will be used.
+	// Use GoogleRootCAs to only trust the root certificate authorities used by Google.
+	RootCAs *x509.CertPool
+	// ServerName overrides the host name used to verify the server's certificate.
+	// If not provided, the host name of the server being connected to will be used.
+	ServerName string
+	// ServerCertificateFingerprints pins the certificate presented by the server.
+	// If provided, the connection will fail unless the SHA-256 fingerprint of one of the
+	// server's certificates is in this list. See CertificateFingerprint.
+	ServerCertificateFingerprints [][]byte
+	// InsecureSkipVerify disables verification of the server's certificate chain and host name.
+	// This should only be used for testing. Pinned fingerprints are still checked.
+	InsecureSkipVerify bool
 	// DebugLogger is used to print debug level log output.
 	// If no Logger is provided, no logging will occur.
 	DebugLogger Logger
@@ -138,15 +176,62 @@ type ThingOptions struct {
 	// LogMQTT enables logging of the underlying MQTT client.
 	// If enabled, the underlying MQTT client will log at the same level as the Thing itself (WARN, DEBUG, etc).
 	LogMQTT bool
+	// CleanSession asks the server to discard the MQTT session when the client disconnects.
+	// If false, servers that support persistent sessions keep the client's subscriptions and queue messages while it is offline.
+	// Cloud IoT Core doesn't support persistent sessions.
+	CleanSession bool
+	// NewClient overrides the package level NewClient for this Thing.
+	// It can be used to select a different transport, such as the HTTP bridge, for some Things.
+	NewClient ClientConstructor
 	// QueueDirectory should be a directory writable by the process.
 	// If not provided, message queues will not be persisted between restarts.
 	QueueDirectory string
+	// OutboxSize is the maximum number of state and event messages that will be buffered while offline.
+	// Buffered events are sent in order after the Thing reconnects.
+	// Only the most recent state is buffered, replacing any state that is waiting, and it is published after reconnecting.
+	// If QueueDirectory is set, buffered messages are persisted between restarts.
+	// The default value of 0 disables buffering, in which case publishing while offline returns ErrNotConnected.
+	OutboxSize int
+	// OutboxMaxAge is the maximum amount of time a message will stay in the outbox before it is dropped.
+	// The default value of 0 means messages will not be dropped based on their age.
+	OutboxMaxAge time.Duration
+	// OutboxDropPolicy determines which message is dropped when the outbox is full.
+	// The default is to drop the oldest message.
+	OutboxDropPolicy DropPolicy
 	// ConfigHandler will be called when a new configuration document is received from the server.
 	ConfigHandler ConfigHandler
+	// ValidateConfig will be called when a new configuration document is received from the server,
+	// before it is passed to ConfigHandler. If it returns an error, the configuration is rejected:
+	// it isn't passed to ConfigHandler and it isn't persisted. TypedConfig.Validate can be used here.
+	ValidateConfig func(thing Thing, config []byte) error
+	// ConfigDirectory should be a directory writable by the process.
+	// The last configuration accepted by ConfigHandler is persisted there so that it is available after a restart.
+	// If not provided, QueueDirectory will be used. If neither is provided, the configuration will not be persisted.
+	ConfigDirectory string
+	// CachedConfigHandler will be called by Connect with the persisted configuration before connecting to the server.
+	// This lets devices that restart without connectivity use their last known configuration.
+	// The persisted configuration is only delivered to CachedConfigHandler, so ConfigHandler only receives
+	// configurations from the server. To handle both in the same way, set both options to the same handler.
+	CachedConfigHandler ConfigHandler
+	// CommandHandler will be called when a command is received from the server.
+	// If no CommandHandler is provided, the commands topic will not be subscribed to.
+	// Use a CommandMux to route commands to different handlers based on their subfolder.
+	CommandHandler CommandHandler
+	// ConnectionEventHandler will be called when the state of the connection changes,
+	// such as when the Thing connects, loses its connection or fails to authenticate.
+	ConnectionEventHandler ConnectionEventHandler
+	// ErrorHandler will be called when the server reports an error on the errors topic.
+	// If no ErrorHandler is provided, the errors topic will not be subscribed to.
+	ErrorHandler ErrorHandler
 	// ConfigQOS sets the QoS level for receiving config updates.
 	// The default value will only perform best effort delivery.
 	// The suggested value is 2.
 	ConfigQOS uint8
+	// CommandQOS sets the QoS level for receiving commands.
+	// The default value will only perform best effort delivery.
+	// The suggested value is 1.
+	// Google does not allow a value of 2 here.
+	CommandQOS uint8
 	// StateQOS sets the QoS level for sending state updates.
 	// The default value will only perform best effort delivery.
 	// The suggested value is 1.
@@ -157,10 +242,35 @@ type ThingOptions struct {
 	// The suggested value is 1.
 	// Google does not allow a value of 2 here.
 	EventQOS uint8
+	// Events determines how values published by PublishEventValue are encoded.
+	// If not provided, values are encoded as JSON without an envelope and published to the subfolder passed to PublishEventValue.
+	Events *EventRegistry
+	// StateRateLimit limits how often state updates can be published.
+	// Google only allows one state update per second for each device.
+	// DefaultOptions sets this to DefaultStateRateLimit.
+	// The zero value does not limit state updates.
+	StateRateLimit RateLimit
+	// EventRateLimit limits how often events can be published.
+	// The default value does not limit events.
+	EventRateLimit RateLimit
+	// RateLimitNoWait determines what happens when a message is published faster than the rate limit allows.
+	// If false, publishing waits until the message can be sent or the context is cancelled.
+	// If true, publishing returns ErrRateLimited immediately.
+	RateLimitNoWait bool
 	// AuthTokenExpiration determines how often a new auth token must be generated.
 	// The minimum value is 10 minutes and the maximum value is 24 hours.
 	// The default value is 1 hour.
 	AuthTokenExpiration time.Duration
+	// AuthTokenRefreshMargin determines how long before the auth token expires the Thing
+	// will gracefully reconnect to the server using a new auth token.
+	// The default value is 1 minute.
+	AuthTokenRefreshMargin time.Duration
+	// ReconnectPolicy determines how connecting is retried, both when Connect is called and after the connection is lost.
+	// If not provided, Connect returns the first error and the MQTT client reconnects using its own defaults,
+	// unless the CredentialSet holds more than one set of credentials. MQTT clients can't fall back to other credentials
+	// by themselves, so in that case the Thing reconnects using DefaultReconnectPolicy. See ClientReconnects.
+	// DefaultReconnectPolicy returns the recommended policy.
+	ReconnectPolicy *ReconnectPolicy
 	// Clock represents the system clock.
 	// This value can be overridden for testing purposes.
 	// If not provided, this will default to the regular system clock.
@@ -169,12 +279,21 @@ type ThingOptions struct {
 
 // Thing represents an IoT device
 type Thing interface {
-	// PublishState publishes the current device state
+	// PublishState publishes the current device state.
+	// If a state update is already being published, the new state replaces it and is published afterwards.
+	// State that is identical to the last published state is not published again.
+	// The last state is published again automatically after reconnecting.
 	PublishState(ctx context.Context, message []byte) error
 
 	// PublishEvent publishes an event. An optional hierarchy of event names can be provided.
+	// ErrInvalidSubfolder is returned if an event name is empty or contains MQTT wildcards.
 	PublishEvent(ctx context.Context, message []byte, event ...string) error
 
+	// PublishEventValue encodes v using the EventRegistry in ThingOptions.Events and publishes it as an event.
+	// The event is published to the subfolder registered for the type of v. Event names can only be provided for types
+	// that aren't registered, and ErrEventSubfolderMismatch is returned if they don't match the registered subfolder.
+	PublishEventValue(ctx context.Context, v interface{}, event ...string) error
+
 	// Connect to the given MQTT server(s)
 	Connect(ctx context.Context, servers ...string) error
 
@@ -183,17 +302,27 @@ type Thing interface {
 
 	// Disconnect from the MQTT server(s)
 	Disconnect(ctx context.Context)
+
+	// AuthTokenExpiry returns the time that the current auth token expires.
+	// The Thing reconnects with a new auth token shortly before this time.
+	AuthTokenExpiry() time.Time
+
+	// OutboxStats returns statistics about messages that are buffered while offline.
+	OutboxStats() OutboxStats
 }
 
 // DefaultOptions returns the default set of options.
 func DefaultOptions(id *ID, credentials *Credentials) *ThingOptions {
 	return &ThingOptions{
-		ID:                  id,
-		Credentials:         credentials,
-		ConfigQOS:           2,
-		StateQOS:            1,
-		EventQOS:            1,
-		AuthTokenExpiration: DefaultAuthTokenExpiration,
+		ID:                     id,
+		Credentials:            credentials,
+		ConfigQOS:              2,
+		CommandQOS:             1,
+		StateQOS:               1,
+		EventQOS:               1,
+		StateRateLimit:         DefaultStateRateLimit,
+		AuthTokenExpiration:    DefaultAuthTokenExpiration,
+		AuthTokenRefreshMargin: DefaultAuthTokenRefreshMargin,
 	}
 }
 
@@ -205,6 +334,11 @@ func New(options *ThingOptions) Thing {
 // MQTTCredentialsProvider should return the current username and password for the MQTT client to use.
 type MQTTCredentialsProvider func() (username string, password string)
 
+// MQTTMessageHandler will be called when a message is received on a subscribed topic.
+// The topic is the actual topic the message was published to, which may differ from the
+// subscribed topic if the subscription contains wildcards.
+type MQTTMessageHandler func(thing Thing, topic string, payload []byte)
+
 // MQTTOnConnectHandler will be called after the client connects.
 // It should be used to resubscribe to topics and perform other connection related tasks.
 type MQTTOnConnectHandler func(client MQTTClient)
@@ -224,7 +358,7 @@ type MQTTClient interface {
 	Publish(ctx context.Context, topic string, qos uint8, payload interface{}) error
 
 	// Subscribe should subscribe to the given topic with the given quality of service level and message handler
-	Subscribe(ctx context.Context, topic string, qos uint8, callback ConfigHandler) error
+	Subscribe(ctx context.Context, topic string, qos uint8, callback MQTTMessageHandler) error
 
 	// Unsubscribe should unsubscribe from the given topic
 	Unsubscribe(ctx context.Context, topic string) error
@@ -246,4 +380,15 @@ type MQTTClient interface {
 
 	// SetOnConnectHandler provides a callback that should be called after the client connects to the server
 	SetOnConnectHandler(handler MQTTOnConnectHandler)
+
+	// SetConnectionEventHandler provides a callback that should be called when the state of the connection changes
+	SetConnectionEventHandler(handler MQTTConnectionEventHandler)
+}
+
+// MQTTMessageIDPublisher can optionally be implemented by an MQTTClient to report the MQTT message ID of published messages.
+// The message ID is used to match errors reported on the errors topic with the message that caused them.
+type MQTTMessageIDPublisher interface {
+	// PublishWithID should publish the payload in the same way as Publish and return the message ID that was used.
+	// The message ID is 0 for messages published with QoS 0.
+	PublishWithID(ctx context.Context, topic string, qos uint8, payload interface{}) (uint16, error)
 }
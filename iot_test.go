@@ -8,8 +8,10 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/vaelen/iot"
 )
 
@@ -30,6 +32,8 @@ var ClientID = "projects/test-project/locations/test-location/registries/test-re
 var ConfigTopic = "/devices/test-device/config"
 var StateTopic = "/devices/test-device/state"
 var EventsTopic = "/devices/test-device/events"
+var CommandsTopic = "/devices/test-device/commands"
+var ErrorsTopic = "/devices/test-device/errors"
 
 var mockClient *iot.MockMQTTClient
 
@@ -59,6 +63,53 @@ func TestLoadECCredentials(t *testing.T) {
 	}
 }
 
+func TestSignerCredentials(t *testing.T) {
+	tests := []struct {
+		certificatePath string
+		privateKeyPath  string
+		credentialType  iot.CredentialType
+	}{
+		{RSACertificatePath, RSAPrivateKeyPath, iot.CredentialTypeRSA},
+		{ECCertificatePath, ECPrivateKeyPath, iot.CredentialTypeEC},
+	}
+	for _, test := range tests {
+		signer, err := iot.LoadSigner(test.privateKeyPath)
+		if err != nil {
+			t.Fatalf("Couldn't load signer: %v", err)
+		}
+		credentials, err := iot.LoadSignerCredentials(test.certificatePath, signer)
+		if err != nil {
+			t.Fatalf("Couldn't load credentials: %v", err)
+		}
+		if credentials.Type != test.credentialType {
+			t.Fatalf("Wrong credential type: %v", credentials.Type)
+		}
+		if credentials.Certificate.PrivateKey != signer {
+			t.Fatal("Signer not used for TLS certificate")
+		}
+		verifyAuthToken(t, credentials, signer.Public())
+	}
+}
+
+func verifyAuthToken(t *testing.T, credentials *iot.Credentials, publicKey interface{}) {
+	initMockClient()
+	options, _ := getOptions(t, credentials)
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer thing.Disconnect(context.Background())
+
+	_, password := mockClient.CredentialsProvider()
+	token, err := jwt.Parse(password, func(token *jwt.Token) (interface{}, error) {
+		return publicKey, nil
+	})
+	if err != nil {
+		t.Fatalf("Couldn't verify auth token: %v", err)
+	}
+	if !token.Valid {
+		t.Fatal("Auth token is not valid")
+	}
+}
+
 func TestDefaultOptions(t *testing.T) {
 	credentials, err := iot.LoadRSACredentials(RSACertificatePath, RSAPrivateKeyPath)
 	if err != nil {
@@ -134,6 +185,62 @@ func TestECThingConnectOnly(t *testing.T) {
 	doDisconnectTest(t, thing)
 }
 
+func TestCommands(t *testing.T) {
+	initMockClient()
+	credentials := getCredentials(t, iot.CredentialTypeRSA)
+	options, _ := getOptions(t, credentials)
+
+	received := make(map[string]string)
+	mux := iot.NewCommandMux()
+	mux.Handle("", func(thing iot.Thing, subfolder string, command []byte) {
+		received["root"] = string(command)
+	})
+	mux.Handle("reboot", func(thing iot.Thing, subfolder string, command []byte) {
+		received["reboot"] = subfolder + ":" + string(command)
+	})
+	mux.HandleDefault(func(thing iot.Thing, subfolder string, command []byte) {
+		received["default"] = subfolder + ":" + string(command)
+	})
+	options.CommandHandler = mux.HandleCommand
+
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+
+	if len(mockClient.Subscriptions) != 2 {
+		t.Fatalf("Wrong number of subscriptions: %v", len(mockClient.Subscriptions))
+	}
+
+	mockClient.Receive(CommandsTopic, []byte("a"))
+	mockClient.Receive(CommandsTopic+"/reboot", []byte("b"))
+	mockClient.Receive(CommandsTopic+"/reboot/now", []byte("c"))
+	mockClient.Receive(CommandsTopic+"/other", []byte("d"))
+
+	expected := map[string]string{
+		"root":    "a",
+		"reboot":  "reboot/now:c",
+		"default": "other:d",
+	}
+	for k, v := range expected {
+		if received[k] != v {
+			t.Fatalf("Wrong command received. Handler: %v, Expected: %v, Actual: %v", k, v, received[k])
+		}
+	}
+
+	// Commands should be resubscribed after a reconnect
+	mockClient.Subscriptions = make(map[string]iot.MQTTMessageHandler)
+	mockClient.Connect(context.Background(), "ssl://mqtt.example.com:443")
+	delete(received, "root")
+	mockClient.Receive(CommandsTopic, []byte("e"))
+	if received["root"] != "e" {
+		t.Fatalf("Command not received after reconnect: %v", received["root"])
+	}
+
+	doDisconnectTest(t, thing)
+	if len(mockClient.Subscriptions) != 0 {
+		t.Fatalf("Subscriptions not removed: %v", len(mockClient.Subscriptions))
+	}
+}
+
 func initMockClient() {
 	iot.NewClient = func(t iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
 		mockClient = iot.NewMockClient(t, o)
@@ -183,9 +290,18 @@ func getOptions(t *testing.T, credentials *iot.Credentials) (*iot.ThingOptions,
 	configReceived := &bytes.Buffer{}
 
 	options.AuthTokenExpiration = 0
-	options.DebugLogger = func(a ...interface{}) { fmt.Fprint(debugWriter, a...) }
-	options.InfoLogger = func(a ...interface{}) { fmt.Fprint(infoWriter, a...) }
-	options.ErrorLogger = func(a ...interface{}) { fmt.Fprint(errorWriter, a...) }
+	// Messages may be logged by background goroutines, such as those replaying the outbox
+	var logMutex sync.Mutex
+	logger := func(w *bytes.Buffer) iot.Logger {
+		return func(a ...interface{}) {
+			logMutex.Lock()
+			defer logMutex.Unlock()
+			fmt.Fprint(w, a...)
+		}
+	}
+	options.DebugLogger = logger(debugWriter)
+	options.InfoLogger = logger(infoWriter)
+	options.ErrorLogger = logger(errorWriter)
 	options.LogMQTT = true
 	options.ConfigHandler = func(thing iot.Thing, config []byte) {
 		ctx := context.Background()
@@ -0,0 +1,193 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iottest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AdminHandler returns an HTTP handler that emulates the Cloud IoT Core device manager REST API for the server's registry.
+// It can be served with net/http/httptest and used with AdminClient.
+//
+// These methods are supported, relative to /v1/projects/{project}/locations/{location}/registries/{registry}:
+//
+//	GET    /devices                                     lists the devices
+//	POST   /devices                                     creates a device
+//	GET    /devices/{device}                            gets a device
+//	DELETE /devices/{device}                            deletes a device
+//	POST   /devices/{device}:modifyCloudToDeviceConfig  sets the config of a device
+//	GET    /devices/{device}/configVersions             lists the recent config versions of a device
+//	GET    /devices/{device}/states                     lists the recent states of a device
+//	POST   /devices/{device}:sendCommandToDevice        sends a command to a device
+//	POST   :bindDeviceToGateway                         binds a device to a gateway
+func (s *Server) AdminHandler() http.Handler {
+	return http.HandlerFunc(s.serveAdmin)
+}
+
+// APIError is the error returned by the admin API.
+// It has the same JSON representation as the errors returned by Google APIs.
+type APIError struct {
+	// Code is the HTTP status code.
+	Code int `json:"code"`
+	// Message describes the error.
+	Message string `json:"message"`
+	// Status is the canonical error code, such as NOT_FOUND.
+	Status string `json:"status"`
+}
+
+// Error returns a description of the error
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Status, e.Code, e.Message)
+}
+
+// modifyConfigRequest is the body of a modifyCloudToDeviceConfig request.
+type modifyConfigRequest struct {
+	VersionToUpdate int64  `json:"versionToUpdate,string"`
+	BinaryData      []byte `json:"binaryData"`
+}
+
+// sendCommandRequest is the body of a sendCommandToDevice request.
+type sendCommandRequest struct {
+	BinaryData []byte `json:"binaryData"`
+	Subfolder  string `json:"subfolder,omitempty"`
+}
+
+// bindRequest is the body of a bindDeviceToGateway request.
+type bindRequest struct {
+	GatewayID string `json:"gatewayId"`
+	DeviceID  string `json:"deviceId"`
+}
+
+// registryPath returns the path of the server's registry in the admin API.
+func registryPath(projectID string, location string, registry string) string {
+	return fmt.Sprintf("/v1/projects/%s/locations/%s/registries/%s", projectID, location, registry)
+}
+
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	prefix := registryPath(s.projectID, s.location, s.registry)
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "registry not found")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+
+	var response interface{}
+	var err error
+	switch {
+	case path == ":bindDeviceToGateway" && r.Method == http.MethodPost:
+		request := bindRequest{}
+		if err = decodeRequest(r, &request); err == nil {
+			err = s.BindDevice(request.GatewayID, request.DeviceID)
+			response = struct{}{}
+		}
+	case path == "/devices" && r.Method == http.MethodGet:
+		response = struct {
+			Devices []Device `json:"devices"`
+		}{s.ListDevices()}
+	case path == "/devices" && r.Method == http.MethodPost:
+		device := Device{}
+		if err = decodeRequest(r, &device); err == nil {
+			response, err = s.CreateDevice(device)
+		}
+	case strings.HasPrefix(path, "/devices/"):
+		response, err = s.serveDevice(r, strings.TrimPrefix(path, "/devices/"))
+	default:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "unknown method: "+r.Method+" "+r.URL.Path)
+		return
+	}
+
+	if err != nil {
+		code, status := errorStatus(err)
+		writeError(w, code, status, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// serveDevice handles the requests for a single device.
+func (s *Server) serveDevice(r *http.Request, path string) (interface{}, error) {
+	deviceID, method := path, ""
+	if i := strings.IndexAny(path, ":/"); i >= 0 {
+		deviceID, method = path[:i], path[i:]
+	}
+	switch {
+	case method == "" && r.Method == http.MethodGet:
+		return s.GetDevice(deviceID)
+	case method == "" && r.Method == http.MethodDelete:
+		return struct{}{}, s.DeleteDevice(deviceID)
+	case method == ":modifyCloudToDeviceConfig" && r.Method == http.MethodPost:
+		request := modifyConfigRequest{}
+		if err := decodeRequest(r, &request); err != nil {
+			return nil, err
+		}
+		return s.ModifyConfig(deviceID, request.VersionToUpdate, request.BinaryData)
+	case method == "/configVersions" && r.Method == http.MethodGet:
+		configs, err := s.ConfigVersions(deviceID)
+		return struct {
+			DeviceConfigs []DeviceConfig `json:"deviceConfigs"`
+		}{configs}, err
+	case method == "/states" && r.Method == http.MethodGet:
+		states, err := s.States(deviceID)
+		return struct {
+			DeviceStates []DeviceState `json:"deviceStates"`
+		}{states}, err
+	case method == ":sendCommandToDevice" && r.Method == http.MethodPost:
+		request := sendCommandRequest{}
+		if err := decodeRequest(r, &request); err != nil {
+			return nil, err
+		}
+		return struct{}{}, s.SendCommand(deviceID, request.Subfolder, request.BinaryData)
+	}
+	return nil, errUnknownMethod
+}
+
+// errUnknownMethod is returned for requests that don't match an admin API method.
+var errUnknownMethod = fmt.Errorf("unknown method")
+
+// errInvalidRequest wraps errors decoding a request body.
+type errInvalidRequest struct {
+	err error
+}
+
+func (e errInvalidRequest) Error() string {
+	return "invalid request: " + e.err.Error()
+}
+
+func decodeRequest(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errInvalidRequest{err}
+	}
+	return nil
+}
+
+// errorStatus returns the HTTP status code and canonical error code for an error.
+func errorStatus(err error) (int, string) {
+	switch err.(type) {
+	case errInvalidRequest:
+		return http.StatusBadRequest, "INVALID_ARGUMENT"
+	}
+	switch err {
+	case ErrDeviceNotFound, errUnknownMethod:
+		return http.StatusNotFound, "NOT_FOUND"
+	case ErrDeviceExists:
+		return http.StatusConflict, "ALREADY_EXISTS"
+	case ErrVersionMismatch, ErrNotSubscribed:
+		return http.StatusBadRequest, "FAILED_PRECONDITION"
+	case ErrInvalidDeviceID, ErrInvalidPublicKey:
+		return http.StatusBadRequest, "INVALID_ARGUMENT"
+	}
+	return http.StatusInternalServerError, "INTERNAL"
+}
+
+func writeError(w http.ResponseWriter, code int, status string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error *APIError `json:"error"`
+	}{&APIError{Code: code, Message: message, Status: status}})
+}
@@ -0,0 +1,155 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iottest_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vaelen/iot"
+	"github.com/vaelen/iot/iottest"
+)
+
+func TestAdminAPI(t *testing.T) {
+	ctx := context.Background()
+	server := newServer(t)
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+	client := iottest.NewAdminClient(admin.URL, ID.ProjectID, ID.Location, ID.Registry)
+
+	certificate, err := ioutil.ReadFile("../test_keys/rsa_cert.pem")
+	if err != nil {
+		t.Fatalf("Couldn't read certificate: %v", err)
+	}
+	device, err := client.CreateDevice(ctx, iottest.Device{
+		ID: ID.DeviceID,
+		Credentials: []iottest.DeviceCredential{
+			{PublicKey: iottest.PublicKeyCredential{Format: iottest.RSAX509PEM, Key: string(certificate)}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't create device: %v", err)
+	}
+	if device.ID != ID.DeviceID || len(device.Credentials) != 1 {
+		t.Fatalf("Wrong device: %+v", device)
+	}
+	_, err = client.CreateDevice(ctx, iottest.Device{ID: ID.DeviceID})
+	checkAPIError(t, err, http.StatusConflict, "ALREADY_EXISTS")
+	_, err = client.CreateDevice(ctx, iottest.Device{
+		ID: "invalid",
+		Credentials: []iottest.DeviceCredential{
+			{PublicKey: iottest.PublicKeyCredential{Format: iottest.ES256X509PEM, Key: string(certificate)}},
+		},
+	})
+	checkAPIError(t, err, http.StatusBadRequest, "INVALID_ARGUMENT")
+
+	config, err := client.ModifyConfig(ctx, ID.DeviceID, 0, []byte("config 1"))
+	if err != nil || config.Version != 1 {
+		t.Fatalf("Couldn't modify config: %+v, %v", config, err)
+	}
+
+	rsa, _ := loadCredentials(t)
+	commands := make(chan string, 10)
+	options := getOptions(t, ID, rsa)
+	options.ConfigHandler = func(thing iot.Thing, config []byte) {
+		thing.PublishState(ctx, append([]byte("received "), config...))
+	}
+	options.CommandHandler = func(thing iot.Thing, subfolder string, command []byte) {
+		commands <- subfolder + ":" + string(command)
+	}
+	thing := iot.New(options)
+	if err = thing.Connect(ctx, server.URL); err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+	waitForState(t, server, "received config 1")
+
+	// Updating an old version fails so that concurrent rollouts are detected
+	_, err = client.ModifyConfig(ctx, ID.DeviceID, 5, []byte("config 2"))
+	checkAPIError(t, err, http.StatusBadRequest, "FAILED_PRECONDITION")
+	config, err = client.ModifyConfig(ctx, ID.DeviceID, 1, []byte("config 2"))
+	if err != nil || config.Version != 2 {
+		t.Fatalf("Couldn't modify config: %+v, %v", config, err)
+	}
+	waitForState(t, server, "received config 2")
+
+	// The device acknowledges configs delivered with QoS 1
+	var configs []iottest.DeviceConfig
+	for i := 0; ; i++ {
+		configs, err = client.ConfigVersions(ctx, ID.DeviceID)
+		if err != nil {
+			t.Fatalf("Couldn't get config versions: %v", err)
+		}
+		if len(configs) == 2 && !configs[0].DeviceAckTime.IsZero() {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Wrong config versions: %+v", configs)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if configs[0].Version != 2 || string(configs[0].BinaryData) != "config 2" || configs[1].Version != 1 {
+		t.Fatalf("Wrong config versions: %+v", configs)
+	}
+
+	states, err := client.States(ctx, ID.DeviceID)
+	if err != nil || len(states) == 0 || string(states[0].BinaryData) != "received config 2" {
+		t.Fatalf("Wrong states: %+v, %v", states, err)
+	}
+
+	if err = client.SendCommand(ctx, ID.DeviceID, "a", []byte("command")); err != nil {
+		t.Fatalf("Couldn't send command: %v", err)
+	}
+	select {
+	case command := <-commands:
+		if command != "a:command" {
+			t.Fatalf("Wrong command: %s", command)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Command wasn't delivered")
+	}
+
+	device, err = client.GetDevice(ctx, ID.DeviceID)
+	if err != nil {
+		t.Fatalf("Couldn't get device: %v", err)
+	}
+	if device.Config.Version != 2 || string(device.State.BinaryData) != "received config 2" || device.LastStateTime.IsZero() || device.LastConfigAckTime.IsZero() {
+		t.Fatalf("Wrong device: %+v", device)
+	}
+	devices, err := client.ListDevices(ctx)
+	if err != nil || len(devices) != 1 || devices[0].ID != ID.DeviceID {
+		t.Fatalf("Wrong devices: %+v, %v", devices, err)
+	}
+
+	// Deleting the device disconnects it
+	if err = client.DeleteDevice(ctx, ID.DeviceID); err != nil {
+		t.Fatalf("Couldn't delete device: %v", err)
+	}
+	for i := 0; server.IsConnected(ID.DeviceID); i++ {
+		if i == 100 {
+			t.Fatal("Deleted device is still connected")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_, err = client.GetDevice(ctx, ID.DeviceID)
+	checkAPIError(t, err, http.StatusNotFound, "NOT_FOUND")
+	err = client.SendCommand(ctx, ID.DeviceID, "", []byte("command"))
+	checkAPIError(t, err, http.StatusNotFound, "NOT_FOUND")
+
+	wrongRegistry := iottest.NewAdminClient(admin.URL, ID.ProjectID, ID.Location, "other")
+	_, err = wrongRegistry.ListDevices(ctx)
+	checkAPIError(t, err, http.StatusNotFound, "NOT_FOUND")
+}
+
+func checkAPIError(t *testing.T, err error, code int, status string) {
+	t.Helper()
+	e, ok := err.(*iottest.APIError)
+	if !ok || e.Code != code || e.Status != status {
+		t.Fatalf("Expected %s (%d), got %v", status, code, err)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iottest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// AdminClient is a client for the admin API served by Server.AdminHandler.
+// Errors returned by the API are returned as *APIError.
+type AdminClient struct {
+	// HTTPClient is used to send requests. If it is nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	url string
+}
+
+// NewAdminClient returns a client for the registry with the given ID served at baseURL, such as http://127.0.0.1:8080.
+func NewAdminClient(baseURL string, projectID string, location string, registry string) *AdminClient {
+	return &AdminClient{
+		url: strings.TrimSuffix(baseURL, "/") + registryPath(projectID, location, registry),
+	}
+}
+
+// ListDevices returns all of the devices in the registry.
+func (c *AdminClient) ListDevices(ctx context.Context) ([]Device, error) {
+	response := struct {
+		Devices []Device `json:"devices"`
+	}{}
+	err := c.do(ctx, http.MethodGet, "/devices", nil, &response)
+	return response.Devices, err
+}
+
+// CreateDevice registers a new device with the given ID and credentials.
+func (c *AdminClient) CreateDevice(ctx context.Context, device Device) (Device, error) {
+	created := Device{}
+	err := c.do(ctx, http.MethodPost, "/devices", device, &created)
+	return created, err
+}
+
+// GetDevice returns a device.
+func (c *AdminClient) GetDevice(ctx context.Context, deviceID string) (Device, error) {
+	device := Device{}
+	err := c.do(ctx, http.MethodGet, "/devices/"+deviceID, nil, &device)
+	return device, err
+}
+
+// DeleteDevice removes a device from the registry.
+func (c *AdminClient) DeleteDevice(ctx context.Context, deviceID string) error {
+	return c.do(ctx, http.MethodDelete, "/devices/"+deviceID, nil, nil)
+}
+
+// ModifyConfig sets the config of a device.
+// If versionToUpdate is not 0, it must match the current version of the config.
+func (c *AdminClient) ModifyConfig(ctx context.Context, deviceID string, versionToUpdate int64, config []byte) (DeviceConfig, error) {
+	request := modifyConfigRequest{VersionToUpdate: versionToUpdate, BinaryData: config}
+	response := DeviceConfig{}
+	err := c.do(ctx, http.MethodPost, "/devices/"+deviceID+":modifyCloudToDeviceConfig", request, &response)
+	return response, err
+}
+
+// ConfigVersions returns the recent config versions of a device, newest first.
+func (c *AdminClient) ConfigVersions(ctx context.Context, deviceID string) ([]DeviceConfig, error) {
+	response := struct {
+		DeviceConfigs []DeviceConfig `json:"deviceConfigs"`
+	}{}
+	err := c.do(ctx, http.MethodGet, "/devices/"+deviceID+"/configVersions", nil, &response)
+	return response.DeviceConfigs, err
+}
+
+// States returns the recent states of a device, newest first.
+func (c *AdminClient) States(ctx context.Context, deviceID string) ([]DeviceState, error) {
+	response := struct {
+		DeviceStates []DeviceState `json:"deviceStates"`
+	}{}
+	err := c.do(ctx, http.MethodGet, "/devices/"+deviceID+"/states", nil, &response)
+	return response.DeviceStates, err
+}
+
+// SendCommand sends a command to a device.
+// The subfolder may be empty.
+func (c *AdminClient) SendCommand(ctx context.Context, deviceID string, subfolder string, command []byte) error {
+	request := sendCommandRequest{BinaryData: command, Subfolder: subfolder}
+	return c.do(ctx, http.MethodPost, "/devices/"+deviceID+":sendCommandToDevice", request, nil)
+}
+
+// BindDevice binds a device to a gateway.
+func (c *AdminClient) BindDevice(ctx context.Context, gatewayID string, deviceID string) error {
+	request := bindRequest{GatewayID: gatewayID, DeviceID: deviceID}
+	return c.do(ctx, http.MethodPost, ":bindDeviceToGateway", request, nil)
+}
+
+// do sends a request and decodes the response into response, if it is not nil.
+func (c *AdminClient) do(ctx context.Context, method string, path string, request interface{}, response interface{}) error {
+	var body bytes.Buffer
+	if request != nil {
+		if err := json.NewEncoder(&body).Encode(request); err != nil {
+			return err
+		}
+	}
+	r, err := http.NewRequest(method, c.url+path, &body)
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(ctx)
+	if request != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		e := struct {
+			Error *APIError `json:"error"`
+		}{}
+		if err = json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == nil {
+			return &APIError{Code: resp.StatusCode, Status: http.StatusText(resp.StatusCode)}
+		}
+		return e.Error
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
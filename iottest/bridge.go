@@ -0,0 +1,166 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iottest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vaelen/iot/mqtt/packets"
+)
+
+// LongPollTimeout is the longest time the HTTP bridge waits for a new config before responding with the current one.
+const LongPollTimeout = time.Second * 30
+
+// publishEventRequest is the body of a publishEvent request.
+type publishEventRequest struct {
+	BinaryData []byte `json:"binaryData"`
+	SubFolder  string `json:"subFolder,omitempty"`
+}
+
+// setStateRequest is the body of a setState request.
+type setStateRequest struct {
+	State struct {
+		BinaryData []byte `json:"binaryData"`
+	} `json:"state"`
+}
+
+// BridgeHandler returns an HTTP handler that emulates the Cloud IoT Core HTTP bridge for the server's registry.
+// Devices authenticate using an auth token in the Authorization header, like they do when connecting over MQTT.
+//
+// These methods are supported, relative to /v1/projects/{project}/locations/{location}/registries/{registry}:
+//
+//	POST /devices/{device}:publishEvent  publishes an event
+//	POST /devices/{device}:setState      sets the state of the device
+//	GET  /devices/{device}/config        gets the current config
+//
+// If the local_version parameter of a config request is the current config version,
+// the request waits until the config changes or LongPollTimeout passes.
+func (s *Server) BridgeHandler() http.Handler {
+	return http.HandlerFunc(s.serveBridge)
+}
+
+func (s *Server) serveBridge(w http.ResponseWriter, r *http.Request) {
+	prefix := registryPath(s.projectID, s.location, s.registry) + "/devices/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "registry not found")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	deviceID, method := path, ""
+	if i := strings.IndexAny(path, ":/"); i >= 0 {
+		deviceID, method = path[:i], path[i:]
+	}
+
+	if code, status, message := s.authorize(r, deviceID); code != http.StatusOK {
+		writeError(w, code, status, message)
+		return
+	}
+
+	var response interface{}
+	var err error
+	switch {
+	case method == ":publishEvent" && r.Method == http.MethodPost:
+		request := publishEventRequest{}
+		if err = decodeRequest(r, &request); err == nil {
+			topic := eventsTopic(deviceID, request.SubFolder)
+			s.bridgePublish(deviceID, topic, request.BinaryData)
+			response = struct{}{}
+		}
+	case method == ":setState" && r.Method == http.MethodPost:
+		request := setStateRequest{}
+		if err = decodeRequest(r, &request); err == nil {
+			s.bridgePublish(deviceID, stateTopic(deviceID), request.State.BinaryData)
+			response = struct{}{}
+		}
+	case method == "/config" && r.Method == http.MethodGet:
+		var localVersion int64
+		if v := r.URL.Query().Get("local_version"); v != "" {
+			localVersion, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				err = errInvalidRequest{err}
+			}
+		}
+		if err == nil {
+			response, err = s.waitForConfig(r.Context(), deviceID, localVersion)
+		}
+	default:
+		err = errUnknownMethod
+	}
+
+	if err != nil {
+		code, status := errorStatus(err)
+		writeError(w, code, status, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// authorize checks the auth token of a bridge request.
+// It returns http.StatusOK if the request is authorized.
+func (s *Server) authorize(r *http.Request, deviceID string) (int, string, string) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[deviceID]
+	if !ok {
+		return http.StatusForbidden, "PERMISSION_DENIED", "device not found"
+	}
+	if err := s.verifyToken(d, token); err != nil {
+		return http.StatusUnauthorized, "UNAUTHENTICATED", err.Error()
+	}
+	return http.StatusOK, "", ""
+}
+
+// bridgePublish records a message published through the HTTP bridge.
+func (s *Server) bridgePublish(deviceID string, topic string, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[deviceID]
+	if !ok {
+		return
+	}
+	if topic == stateTopic(deviceID) {
+		d.updateState(payload, s.now())
+	} else {
+		d.lastEventTime = s.now()
+	}
+	s.record(deviceID, &packets.PublishPacket{Topic: topic, QOS: 1, Payload: payload})
+}
+
+// waitForConfig returns the current config of a device.
+// If localVersion is the current version, it waits until the config changes, the context is done or LongPollTimeout passes.
+func (s *Server) waitForConfig(ctx context.Context, deviceID string, localVersion int64) (DeviceConfig, error) {
+	timer := time.NewTimer(LongPollTimeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		d, ok := s.devices[deviceID]
+		if !ok {
+			s.mu.Unlock()
+			return DeviceConfig{}, ErrDeviceNotFound
+		}
+		config := DeviceConfig{}
+		if len(d.configs) > 0 {
+			config = d.configs[len(d.configs)-1]
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		if localVersion == 0 || config.Version != localVersion {
+			return config, nil
+		}
+		select {
+		case <-ctx.Done():
+			return config, nil
+		case <-timer.C:
+			return config, nil
+		case <-changed:
+		}
+	}
+}
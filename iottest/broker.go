@@ -0,0 +1,415 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iottest
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vaelen/iot/mqtt/packets"
+)
+
+// ConnectInfo describes a client that is connecting to a Broker.
+type ConnectInfo struct {
+	ClientID     string
+	Username     string
+	Password     string
+	CleanSession bool
+	// Certificates are the verified certificates presented by the client during the TLS handshake, if any.
+	Certificates []*x509.Certificate
+}
+
+// MessageHandler handles a message published to a Broker.
+type MessageHandler func(broker *Broker, message Message)
+
+// Broker is an in-process MQTT broker for testing Things that don't use Google Cloud IoT Core,
+// such as Things that use the AWS or Azure backends.
+//
+// Unlike Server, it allows clients to publish and subscribe to any topic.
+// Platform services, such as AWS device shadows, can be emulated by handling the messages that devices publish
+// and publishing responses. QoS levels 0 and 1 are supported. Subscriptions with QoS 2 are granted QoS 1.
+//
+// Retained messages are delivered when a client subscribes.
+// The subscriptions of clients that connect without a clean session are kept after they disconnect,
+// but messages are not queued while they are offline.
+type Broker struct {
+	// URL is the address that clients should connect to, such as tcp://127.0.0.1:43210.
+	URL string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu            sync.Mutex
+	authenticator func(ConnectInfo) bool
+	handlers      map[string]MessageHandler
+	sessions      map[*session]bool
+	persisted     map[string]map[string]byte
+	retained      map[string][]byte
+	messages      []Message
+	changed       chan struct{}
+}
+
+// NewBroker starts a broker that accepts plain TCP connections.
+// The broker should be closed when it is no longer needed.
+func NewBroker() *Broker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("iottest: couldn't listen: %v", err))
+	}
+	return newBroker(listener, "tcp")
+}
+
+// NewTLSBroker starts a broker that accepts TLS connections using the given certificate.
+// If clientCAs is not nil, clients must present a certificate signed by one of them.
+// The broker should be closed when it is no longer needed.
+func NewTLSBroker(certificate tls.Certificate, clientCAs *x509.CertPool) *Broker {
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		panic(fmt.Sprintf("iottest: couldn't listen: %v", err))
+	}
+	return newBroker(listener, "ssl")
+}
+
+func newBroker(listener net.Listener, scheme string) *Broker {
+	b := &Broker{
+		URL:       scheme + "://" + listener.Addr().String(),
+		listener:  listener,
+		handlers:  make(map[string]MessageHandler),
+		sessions:  make(map[*session]bool),
+		persisted: make(map[string]map[string]byte),
+		retained:  make(map[string][]byte),
+		changed:   make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.wg.Add(1)
+			go func() {
+				defer b.wg.Done()
+				b.serve(conn)
+			}()
+		}
+	}()
+	return b
+}
+
+// Close stops the broker and closes all client connections.
+func (b *Broker) Close() {
+	b.listener.Close()
+	b.mu.Lock()
+	for session := range b.sessions {
+		session.conn.Close()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+// SetAuthenticator sets the function that decides whether a client is allowed to connect.
+// By default, all clients are allowed to connect.
+func (b *Broker) SetAuthenticator(authenticator func(ConnectInfo) bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.authenticator = authenticator
+}
+
+// Handle calls the handler for messages published by clients on topics matching the given filter.
+// The handler is called after the message has been delivered to subscribers and may publish responses.
+func (b *Broker) Handle(filter string, handler MessageHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[filter] = handler
+}
+
+// Publish sends a message to the clients subscribed to the topic and returns the number of clients.
+func (b *Broker) Publish(topic string, payload []byte) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.deliver(&packets.PublishPacket{Topic: topic, QOS: 1, Payload: payload})
+}
+
+// Retain sets the retained message for a topic and sends it to the clients subscribed to the topic.
+// An empty payload removes the retained message.
+func (b *Broker) Retain(topic string, payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.retain(topic, payload)
+	b.deliver(&packets.PublishPacket{Topic: topic, QOS: 1, Payload: payload})
+}
+
+// retain sets or removes the retained message for a topic.
+// The caller must hold the lock.
+func (b *Broker) retain(topic string, payload []byte) {
+	if len(payload) == 0 {
+		delete(b.retained, topic)
+		return
+	}
+	b.retained[topic] = payload
+}
+
+// IsConnected returns true if a client with the given ID is connected.
+func (b *Broker) IsConnected(clientID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for session := range b.sessions {
+		if session.deviceID == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// Disconnect closes the connection of a client to simulate a network failure.
+func (b *Broker) Disconnect(clientID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for session := range b.sessions {
+		if session.deviceID == clientID {
+			session.conn.Close()
+		}
+	}
+}
+
+// Messages returns the messages that clients published on topics matching the given MQTT topic filter.
+// The DeviceID of each message is the ID of the client that published it.
+func (b *Broker) Messages(filter string) []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return matchMessages(b.messages, filter)
+}
+
+// WaitForMessages waits until at least count messages have been published on topics matching the given filter.
+// It returns all of the matching messages or an error if the context is done first.
+func (b *Broker) WaitForMessages(ctx context.Context, filter string, count int) ([]Message, error) {
+	for {
+		b.mu.Lock()
+		messages := matchMessages(b.messages, filter)
+		changed := b.changed
+		b.mu.Unlock()
+		if len(messages) >= count {
+			return messages, nil
+		}
+		select {
+		case <-ctx.Done():
+			return messages, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// deliver sends a message to all sessions subscribed to its topic and returns the number of sessions.
+// The caller must hold the lock.
+func (b *Broker) deliver(p *packets.PublishPacket) int {
+	delivered := 0
+	for session := range b.sessions {
+		for filter, qos := range session.subscriptions {
+			if packets.TopicMatches(filter, p.Topic) {
+				if p.QOS < qos {
+					qos = p.QOS
+				}
+				session.publish(p.Topic, qos, p.Payload)
+				delivered++
+				break
+			}
+		}
+	}
+	return delivered
+}
+
+func (b *Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	p, err := packets.ReadPacket(r)
+	if err != nil || p.Type != packets.Connect {
+		return
+	}
+	c := newSession(conn)
+	defer c.close()
+	sessionPresent, returnCode := b.authenticate(c, p.Body)
+	c.write(packets.ConnAck, 0, packets.EncodeConnAck(sessionPresent, returnCode))
+	if returnCode != packets.Accepted {
+		return
+	}
+	defer func() {
+		b.mu.Lock()
+		// Sessions that were replaced by a new connection aren't persisted
+		if b.sessions[c] && !c.clean {
+			b.persisted[c.deviceID] = c.subscriptions
+		}
+		delete(b.sessions, c)
+		b.mu.Unlock()
+	}()
+
+	for {
+		p, err = packets.ReadPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.Type {
+		case packets.Publish:
+			err = b.handlePublish(c, p)
+		case packets.Subscribe:
+			err = b.handleSubscribe(c, p)
+		case packets.Unsubscribe:
+			err = b.handleUnsubscribe(c, p)
+		case packets.PingReq:
+			err = c.write(packets.PingResp, 0, nil)
+		case packets.PubAck:
+		default:
+			// Disconnect, QoS 2 and unexpected packets close the connection
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// authenticate validates the CONNECT packet and registers the session.
+// It returns whether a persisted session was restored and the CONNACK return code.
+func (b *Broker) authenticate(c *session, body []byte) (bool, byte) {
+	connect, err := packets.DecodeConnect(body)
+	if err != nil {
+		return false, packets.RefusedProtocolVersion
+	}
+	if connect.ClientID == "" {
+		return false, packets.RefusedIdentifierRejected
+	}
+	info := ConnectInfo{
+		ClientID:     connect.ClientID,
+		Username:     connect.Username,
+		Password:     connect.Password,
+		CleanSession: connect.CleanSession,
+	}
+	if conn, ok := c.conn.(*tls.Conn); ok {
+		info.Certificates = conn.ConnectionState().PeerCertificates
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.authenticator != nil && !b.authenticator(info) {
+		return false, packets.RefusedNotAuthorized
+	}
+	// A client that connects again replaces its existing connection
+	for session := range b.sessions {
+		if session.deviceID == connect.ClientID {
+			session.conn.Close()
+			delete(b.sessions, session)
+		}
+	}
+	c.deviceID = connect.ClientID
+	c.clean = connect.CleanSession
+	b.sessions[c] = true
+	subscriptions, sessionPresent := b.persisted[c.deviceID]
+	delete(b.persisted, c.deviceID)
+	if sessionPresent && !c.clean {
+		c.subscriptions = subscriptions
+		return true, packets.Accepted
+	}
+	return false, packets.Accepted
+}
+
+func (b *Broker) handlePublish(c *session, p *packets.Packet) error {
+	publish, err := packets.DecodePublish(p.Flags, p.Body)
+	if err != nil {
+		return err
+	}
+	if publish.QOS > 1 {
+		return fmt.Errorf("QoS 2 is not supported")
+	}
+	m := Message{
+		DeviceID: c.deviceID,
+		Topic:    publish.Topic,
+		QOS:      publish.QOS,
+		Payload:  publish.Payload,
+		Time:     time.Now(),
+	}
+
+	b.mu.Lock()
+	if publish.Retain {
+		b.retain(publish.Topic, publish.Payload)
+	}
+	b.messages = append(b.messages, m)
+	close(b.changed)
+	b.changed = make(chan struct{})
+	b.deliver(publish)
+	var handlers []MessageHandler
+	for filter, handler := range b.handlers {
+		if packets.TopicMatches(filter, publish.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	b.mu.Unlock()
+
+	if publish.QOS > 0 {
+		if err = c.write(packets.PubAck, 0, packets.EncodePacketID(publish.PacketID)); err != nil {
+			return err
+		}
+	}
+	for _, handler := range handlers {
+		handler(b, m)
+	}
+	return nil
+}
+
+func (b *Broker) handleSubscribe(c *session, p *packets.Packet) error {
+	id, subscriptions, err := packets.DecodeSubscribe(p.Body)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	returnCodes := make([]byte, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		if subscription.Filter == "" {
+			returnCodes = append(returnCodes, packets.SubAckFailure)
+			continue
+		}
+		qos := subscription.QOS
+		if qos > 1 {
+			qos = 1
+		}
+		c.subscriptions[subscription.Filter] = qos
+		returnCodes = append(returnCodes, qos)
+	}
+	if err = c.write(packets.SubAck, 0, packets.EncodeSubAck(id, returnCodes...)); err != nil {
+		return err
+	}
+	for _, subscription := range subscriptions {
+		for topic, payload := range b.retained {
+			if subscription.Filter != "" && packets.TopicMatches(subscription.Filter, topic) {
+				c.publish(topic, c.subscriptions[subscription.Filter], payload)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Broker) handleUnsubscribe(c *session, p *packets.Packet) error {
+	id, filters, err := packets.DecodeUnsubscribe(p.Body)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	for _, filter := range filters {
+		delete(c.subscriptions, filter)
+	}
+	b.mu.Unlock()
+	return c.write(packets.UnsubAck, 0, packets.EncodePacketID(id))
+}
@@ -0,0 +1,248 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iottest_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vaelen/iot"
+	"github.com/vaelen/iot/iottest"
+	"github.com/vaelen/iot/mqtt/packets"
+)
+
+func TestBrokerAWS(t *testing.T) {
+	ctx := context.Background()
+	certificate, err := tls.LoadX509KeyPair("../test_keys/server_cert.pem", "../test_keys/server_private.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load server certificate: %v", err)
+	}
+	// The test certificate is self-signed, so it is trusted directly
+	clientCAs, err := iot.LoadRootCAs("../test_keys/rsa_cert.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load client CAs: %v", err)
+	}
+	broker := iottest.NewTLSBroker(certificate, clientCAs)
+	defer broker.Close()
+	broker.SetAuthenticator(func(info iottest.ConnectInfo) bool {
+		return info.ClientID == ID.DeviceID && len(info.Certificates) > 0
+	})
+
+	// Emulate the device shadow
+	shadow := "$aws/things/" + ID.DeviceID + "/shadow"
+	var mu sync.Mutex
+	desired := json.RawMessage(`{"interval":10}`)
+	broker.Handle(shadow+"/get", func(b *iottest.Broker, m iottest.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		b.Publish(shadow+"/get/accepted", []byte(`{"state":{"desired":`+string(desired)+`}}`))
+	})
+	setDesired := func(state string) {
+		mu.Lock()
+		defer mu.Unlock()
+		documents := `{"previous":{"state":{"desired":` + string(desired) + `}},"current":{"state":{"desired":` + state + `}}}`
+		desired = json.RawMessage(state)
+		broker.Publish(shadow+"/update/documents", []byte(documents))
+	}
+
+	rsa, _ := loadCredentials(t)
+	options := getOptions(t, ID, rsa)
+	options.Backend = iot.AWSBackend{}
+	options.RootCAs, err = iot.LoadRootCAs("../test_keys/ca_cert.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load root CAs: %v", err)
+	}
+	options.ConfigHandler = func(thing iot.Thing, config []byte) {
+		thing.PublishState(ctx, []byte(`{"received":`+string(config)+`}`))
+	}
+	thing := iot.New(options)
+	if err = thing.Connect(ctx, broker.URL); err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+	waitForBrokerMessage(t, broker, shadow+"/update", `{"state":{"reported":{"received":{"interval":10}}}}`)
+
+	setDesired(`{"interval":20}`)
+	waitForBrokerMessage(t, broker, shadow+"/update", `{"state":{"reported":{"received":{"interval":20}}}}`)
+
+	if err = thing.PublishEvent(ctx, []byte("event"), "a"); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	waitForBrokerMessage(t, broker, "things/"+ID.DeviceID+"/events/a", "event")
+}
+
+func TestBrokerAzure(t *testing.T) {
+	ctx := context.Background()
+	broker := iottest.NewBroker()
+	defer broker.Close()
+	backend := iot.AzureBackend{HostName: "hub.example.com", SharedAccessKey: []byte("secret")}
+	broker.SetAuthenticator(func(info iottest.ConnectInfo) bool {
+		return info.ClientID == ID.DeviceID &&
+			strings.HasPrefix(info.Username, "hub.example.com/"+ID.DeviceID+"/") &&
+			strings.HasPrefix(info.Password, "SharedAccessSignature sr=hub.example.com%2Fdevices%2F"+ID.DeviceID+"&")
+	})
+
+	// Emulate the device twin
+	var mu sync.Mutex
+	desired := `{"interval":10,"$version":1}`
+	broker.Handle("$iothub/twin/GET/#", func(b *iottest.Broker, m iottest.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		b.Publish("$iothub/twin/res/200/?$rid=config", []byte(`{"desired":`+desired+`,"reported":{}}`))
+	})
+	broker.Handle("$iothub/twin/PATCH/properties/reported/#", func(b *iottest.Broker, m iottest.Message) {
+		b.Publish("$iothub/twin/res/204/?$rid=state&$version=2", []byte{})
+	})
+
+	commands := make(chan string, 10)
+	options := getOptions(t, ID, nil)
+	options.Backend = backend
+	options.ConfigHandler = func(thing iot.Thing, config []byte) {
+		thing.PublishState(ctx, config)
+	}
+	options.CommandHandler = func(thing iot.Thing, subfolder string, command []byte) {
+		commands <- subfolder + ":" + string(command)
+	}
+	thing := iot.New(options)
+	if err := thing.Connect(ctx, broker.URL); err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+	reported := "$iothub/twin/PATCH/properties/reported/?$rid=state"
+	waitForBrokerMessage(t, broker, reported, `{"interval":10,"$version":1}`)
+
+	// Desired property updates only contain the changes, so the whole twin is requested again
+	mu.Lock()
+	desired = `{"interval":20,"$version":2}`
+	mu.Unlock()
+	broker.Publish("$iothub/twin/PATCH/properties/desired/?$version=2", []byte(`{"interval":20,"$version":2}`))
+	waitForBrokerMessage(t, broker, reported, `{"interval":20,"$version":2}`)
+
+	broker.Publish("devices/"+ID.DeviceID+"/messages/devicebound/name=reboot", []byte("now"))
+	select {
+	case command := <-commands:
+		if command != "name=reboot:now" {
+			t.Fatalf("Wrong command: %s", command)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Command wasn't delivered")
+	}
+
+	if err := thing.PublishEvent(ctx, []byte("event"), "a"); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	waitForBrokerMessage(t, broker, "devices/"+ID.DeviceID+"/messages/events/subfolder=a", "event")
+}
+
+func TestBrokerGeneric(t *testing.T) {
+	ctx := context.Background()
+	broker := iottest.NewBroker()
+	defer broker.Close()
+	broker.SetAuthenticator(func(info iottest.ConnectInfo) bool {
+		return info.ClientID == ID.DeviceID && info.Username == "user" && info.Password == "pass" && !info.CleanSession
+	})
+	// Configs are retained, so they are delivered when the device subscribes
+	broker.Retain("lab/"+ID.DeviceID+"/config", []byte("config 1"))
+
+	commands := make(chan string, 10)
+	options := getOptions(t, ID, nil)
+	options.Backend = iot.GenericBackend{
+		Topics:   iot.TopicScheme{Config: "lab/{device}/config", State: "lab/{device}/state"},
+		Username: "user",
+		Password: "pass",
+	}
+	options.ConfigHandler = func(thing iot.Thing, config []byte) {
+		thing.PublishState(ctx, config)
+	}
+	options.CommandHandler = func(thing iot.Thing, subfolder string, command []byte) {
+		commands <- subfolder + ":" + string(command)
+	}
+	thing := iot.New(options)
+	if err := thing.Connect(ctx, broker.URL); err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+	waitForBrokerMessage(t, broker, "lab/"+ID.DeviceID+"/state", "config 1")
+
+	broker.Retain("lab/"+ID.DeviceID+"/config", []byte("config 2"))
+	waitForBrokerMessage(t, broker, "lab/"+ID.DeviceID+"/state", "config 2")
+
+	broker.Publish("devices/"+ID.DeviceID+"/commands/reboot", []byte("now"))
+	select {
+	case command := <-commands:
+		if command != "reboot:now" {
+			t.Fatalf("Wrong command: %s", command)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Command wasn't delivered")
+	}
+
+	if err := thing.PublishEvent(ctx, []byte("event"), "a"); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	waitForBrokerMessage(t, broker, "devices/"+ID.DeviceID+"/events/a", "event")
+}
+
+func TestBrokerClientNotReading(t *testing.T) {
+	broker := iottest.NewBroker()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(broker.URL, "tcp://"))
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	connect := &packets.ConnectPacket{ClientID: "slow", CleanSession: true}
+	if err = packets.WritePacket(conn, packets.Connect, 0, connect.Encode()); err != nil {
+		t.Fatalf("Couldn't write CONNECT: %v", err)
+	}
+	if p, err := packets.ReadPacket(r); err != nil || p.Type != packets.ConnAck {
+		t.Fatalf("Didn't receive CONNACK: %v", err)
+	}
+	subscribe := packets.EncodeSubscribe(1, packets.Subscription{Filter: "#"})
+	if err = packets.WritePacket(conn, packets.Subscribe, 0x02, subscribe); err != nil {
+		t.Fatalf("Couldn't write SUBSCRIBE: %v", err)
+	}
+	if p, err := packets.ReadPacket(r); err != nil || p.Type != packets.SubAck {
+		t.Fatalf("Didn't receive SUBACK: %v", err)
+	}
+
+	// The client stops reading, so the messages fill the connection's buffers
+	closed := make(chan struct{})
+	go func() {
+		payload := make([]byte, 64*1024)
+		for i := 0; i < 400; i++ {
+			broker.Publish("slow/messages", payload)
+		}
+		broker.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 10):
+		t.Fatal("Broker was blocked by a client that isn't reading")
+	}
+}
+
+// waitForBrokerMessage waits until a message with the given payload has been published to the topic.
+func waitForBrokerMessage(t *testing.T, broker *iottest.Broker, topic string, payload string) {
+	t.Helper()
+	for i := 0; ; i++ {
+		for _, m := range broker.Messages(topic) {
+			if string(m.Payload) == payload {
+				return
+			}
+		}
+		if i == 500 {
+			t.Fatalf("Message wasn't published to %s: %s", topic, payload)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
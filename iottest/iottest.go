@@ -0,0 +1,727 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+// Package iottest provides an in-process MQTT server that emulates Google Cloud IoT Core for integration tests.
+//
+// The server listens on the loopback interface, so the full stack, including the MQTT client, TLS and auth tokens,
+// can be tested without network access.
+// It emulates the parts of Cloud IoT Core that devices interact with:
+//
+//   - Devices authenticate with a JWT signed by one of their registered keys.
+//   - Devices can publish to their events and state topics and subscribe to their config, commands and errors topics.
+//   - The latest config is delivered when a device subscribes to its config topic.
+//   - QoS levels 0 and 1 are supported. Subscriptions with QoS 2 are granted QoS 1.
+//   - Gateways can attach and detach bound devices and publish on their behalf.
+//
+// Publishing to a topic that the device isn't allowed to use closes the connection, as Cloud IoT Core does.
+//
+// Broker is a plain MQTT broker for testing Things that use other backends, such as AWS IoT Core or Azure IoT Hub.
+package iottest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/vaelen/iot"
+	"github.com/vaelen/iot/mqtt/packets"
+)
+
+// MaxTokenLifetime is the longest lifetime of an auth token that the server accepts.
+const MaxTokenLifetime = time.Hour * 24
+
+// flushTimeout is how long a client has to read the packets that are still queued when its connection is closed.
+const flushTimeout = time.Second * 5
+
+// TokenClockSkew is the amount of clock skew that is allowed when checking the issue time of an auth token.
+const TokenClockSkew = time.Minute * 10
+
+// ErrDeviceNotFound is returned when a device is not registered with the server.
+var ErrDeviceNotFound = fmt.Errorf("device not found")
+
+// ErrNotSubscribed is returned when a command is sent to a device that isn't subscribed to its commands topic.
+var ErrNotSubscribed = fmt.Errorf("device is not subscribed to commands")
+
+// ErrNoPublicKey is returned when a device is added using credentials that don't contain a public key.
+var ErrNoPublicKey = fmt.Errorf("credentials don't contain a public key")
+
+// Message is a message that was published to the server by a device.
+type Message struct {
+	// DeviceID is the ID of the device the message was published for.
+	// For messages published by a gateway on behalf of a bound device, this is the bound device's ID.
+	// For messages published to a Broker, this is the client ID.
+	DeviceID string
+	Topic    string
+	QOS      byte
+	Payload  []byte
+	Time     time.Time
+}
+
+// Server is an in-process MQTT server that emulates Google Cloud IoT Core.
+type Server struct {
+	// URL is the address that clients should connect to, such as tcp://127.0.0.1:43210.
+	URL string
+
+	projectID string
+	location  string
+	registry  string
+	listener  net.Listener
+	wg        sync.WaitGroup
+
+	mu       sync.Mutex
+	now      func() time.Time
+	devices  map[string]*device
+	sessions map[*session]bool
+	messages []Message
+	changed  chan struct{}
+}
+
+// session holds the state of a client connection.
+type session struct {
+	conn          net.Conn
+	deviceID      string
+	subscriptions map[string]byte
+	attached      map[string]bool
+	configAcks    map[uint16]configAck
+	nextID        uint16
+	// clean is true if the client connected to a Broker with a clean session.
+	clean bool
+
+	// Packets are queued and sent by writeLoop, so a client that stops reading can't block the server while it holds its lock.
+	queueLock sync.Mutex
+	queue     [][]byte
+	wake      chan struct{}
+	closed    chan struct{}
+	flushed   chan struct{}
+}
+
+// newSession returns a session for the connection and starts sending its packets.
+// The session must be closed when the connection ends.
+func newSession(conn net.Conn) *session {
+	c := &session{
+		conn:          conn,
+		subscriptions: make(map[string]byte),
+		attached:      make(map[string]bool),
+		configAcks:    make(map[uint16]configAck),
+		wake:          make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+		flushed:       make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+// configAck identifies a config version that was delivered with QoS 1 and hasn't been acknowledged yet.
+type configAck struct {
+	deviceID string
+	version  int64
+}
+
+// NewServer starts a server for the given registry that accepts plain TCP connections.
+// The server should be closed when it is no longer needed.
+func NewServer(projectID string, location string, registry string) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("iottest: couldn't listen: %v", err))
+	}
+	return newServer(projectID, location, registry, listener, "tcp")
+}
+
+// NewTLSServer starts a server for the given registry that accepts TLS connections using the given certificate.
+// The server should be closed when it is no longer needed.
+func NewTLSServer(projectID string, location string, registry string, certificate tls.Certificate) *Server {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		panic(fmt.Sprintf("iottest: couldn't listen: %v", err))
+	}
+	return newServer(projectID, location, registry, listener, "ssl")
+}
+
+func newServer(projectID string, location string, registry string, listener net.Listener, scheme string) *Server {
+	s := &Server{
+		URL:       scheme + "://" + listener.Addr().String(),
+		projectID: projectID,
+		location:  location,
+		registry:  registry,
+		listener:  listener,
+		now:       time.Now,
+		devices:   make(map[string]*device),
+		sessions:  make(map[*session]bool),
+		changed:   make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+	return s
+}
+
+// Close stops the server and closes all client connections.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for session := range s.sessions {
+		session.conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// SetClock sets the function used to get the current time when validating auth tokens.
+// It is useful when the devices use a mock clock.
+func (s *Server) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// SendCommand sends a command to a device.
+// Like Cloud IoT Core, it returns ErrNotSubscribed if the device isn't subscribed to its commands topic.
+func (s *Server) SendCommand(deviceID string, subfolder string, command []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.devices[deviceID]; !ok {
+		return ErrDeviceNotFound
+	}
+	topic := commandsTopic(deviceID)
+	if subfolder != "" {
+		topic += "/" + subfolder
+	}
+	if s.deliver(topic, command) == 0 {
+		return ErrNotSubscribed
+	}
+	return nil
+}
+
+// IsConnected returns true if a device is connected directly or attached to a connected gateway.
+func (s *Server) IsConnected(deviceID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for session := range s.sessions {
+		if session.deviceID == deviceID || session.attached[deviceID] {
+			return true
+		}
+	}
+	return false
+}
+
+// Disconnect closes the connection of a device to simulate a network failure.
+func (s *Server) Disconnect(deviceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for session := range s.sessions {
+		if session.deviceID == deviceID {
+			session.conn.Close()
+		}
+	}
+}
+
+// Messages returns the messages that were published on topics matching the given MQTT topic filter.
+// For example, /devices/my-device/events/# returns all of the events published by my-device.
+func (s *Server) Messages(filter string) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return matchMessages(s.messages, filter)
+}
+
+// WaitForMessages waits until at least count messages have been published on topics matching the given filter.
+// It returns all of the matching messages or an error if the context is done first.
+func (s *Server) WaitForMessages(ctx context.Context, filter string, count int) ([]Message, error) {
+	for {
+		s.mu.Lock()
+		messages := matchMessages(s.messages, filter)
+		changed := s.changed
+		s.mu.Unlock()
+		if len(messages) >= count {
+			return messages, nil
+		}
+		select {
+		case <-ctx.Done():
+			return messages, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// matchMessages returns the messages published on topics matching the given filter.
+func matchMessages(messages []Message, filter string) []Message {
+	var matching []Message
+	for _, m := range messages {
+		if packets.TopicMatches(filter, m.Topic) {
+			matching = append(matching, m)
+		}
+	}
+	return matching
+}
+
+// deliver sends a message to all sessions subscribed to the topic and returns the number of sessions.
+// The caller must hold the lock.
+func (s *Server) deliver(topic string, payload []byte) int {
+	delivered := 0
+	for session := range s.sessions {
+		for filter, qos := range session.subscriptions {
+			if packets.TopicMatches(filter, topic) {
+				session.publish(topic, qos, payload)
+				delivered++
+				break
+			}
+		}
+	}
+	return delivered
+}
+
+// record stores a message published by a device.
+// The caller must hold the lock.
+func (s *Server) record(deviceID string, p *packets.PublishPacket) {
+	s.messages = append(s.messages, Message{
+		DeviceID: deviceID,
+		Topic:    p.Topic,
+		QOS:      p.QOS,
+		Payload:  p.Payload,
+		Time:     s.now(),
+	})
+	s.notify()
+}
+
+// notify wakes up anyone waiting for messages or config changes.
+// The caller must hold the lock.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	p, err := packets.ReadPacket(r)
+	if err != nil || p.Type != packets.Connect {
+		return
+	}
+	c := newSession(conn)
+	defer c.close()
+	returnCode := s.authenticate(c, p.Body)
+	c.write(packets.ConnAck, 0, packets.EncodeConnAck(false, returnCode))
+	if returnCode != packets.Accepted {
+		return
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, c)
+		s.mu.Unlock()
+	}()
+
+	for {
+		p, err = packets.ReadPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.Type {
+		case packets.Publish:
+			err = s.handlePublish(c, p)
+		case packets.Subscribe:
+			err = s.handleSubscribe(c, p)
+		case packets.Unsubscribe:
+			err = s.handleUnsubscribe(c, p)
+		case packets.PingReq:
+			err = c.write(packets.PingResp, 0, nil)
+		case packets.PubAck:
+			err = s.handlePubAck(c, p)
+		default:
+			// Disconnect, QoS 2 and unexpected packets close the connection
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// authenticate validates the CONNECT packet and registers the session.
+// It returns the CONNACK return code.
+func (s *Server) authenticate(c *session, body []byte) byte {
+	connect, err := packets.DecodeConnect(body)
+	if err != nil {
+		return packets.RefusedProtocolVersion
+	}
+	parts := strings.Split(connect.ClientID, "/")
+	if len(parts) != 8 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "registries" || parts[6] != "devices" {
+		return packets.RefusedIdentifierRejected
+	}
+	if parts[1] != s.projectID || parts[3] != s.location || parts[5] != s.registry {
+		return packets.RefusedNotAuthorized
+	}
+	deviceID := parts[7]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[deviceID]
+	if !ok || s.verifyToken(d, connect.Password) != nil {
+		return packets.RefusedNotAuthorized
+	}
+	// Cloud IoT Core closes the existing connection when a device connects again
+	for session := range s.sessions {
+		if session.deviceID == deviceID {
+			session.conn.Close()
+			delete(s.sessions, session)
+		}
+	}
+	c.deviceID = deviceID
+	s.sessions[c] = true
+	return packets.Accepted
+}
+
+// verifyToken checks that the auth token was signed by one of the device's keys and that its claims are valid.
+// The caller must hold the lock.
+func (s *Server) verifyToken(d *device, token string) error {
+	err := fmt.Errorf("no public keys registered")
+	parser := &jwt.Parser{
+		ValidMethods:         []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()},
+		SkipClaimsValidation: true,
+	}
+	for _, key := range d.activeKeys(s.now()) {
+		claims := &jwt.StandardClaims{}
+		_, err = parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+			return key, nil
+		})
+		if err == nil {
+			return s.verifyClaims(claims)
+		}
+	}
+	return err
+}
+
+// verifyClaims checks the claims of an auth token.
+// The caller must hold the lock.
+func (s *Server) verifyClaims(claims *jwt.StandardClaims) error {
+	now := s.now()
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	switch {
+	case claims.Audience != s.projectID:
+		return fmt.Errorf("wrong audience: %s", claims.Audience)
+	case claims.IssuedAt == 0 || claims.ExpiresAt == 0:
+		return fmt.Errorf("missing iat or exp claim")
+	case issuedAt.After(now.Add(TokenClockSkew)):
+		return fmt.Errorf("token issued in the future")
+	case !now.Before(expiresAt):
+		return fmt.Errorf("token expired")
+	case expiresAt.Sub(issuedAt) > MaxTokenLifetime:
+		return fmt.Errorf("token lifetime is too long")
+	}
+	return nil
+}
+
+func (s *Server) handlePublish(c *session, p *packets.Packet) error {
+	publish, err := packets.DecodePublish(p.Flags, p.Body)
+	if err != nil {
+		return err
+	}
+	if publish.QOS > 1 {
+		return fmt.Errorf("QoS 2 is not supported")
+	}
+	deviceID, kind, ok := parseTopic(publish.Topic)
+	if !ok {
+		return fmt.Errorf("invalid topic: %s", publish.Topic)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deviceError *iot.DeviceError
+	switch {
+	case kind == "attach" && deviceID != c.deviceID:
+		deviceError = s.attach(c, deviceID, publish.Payload)
+	case kind == "detach" && deviceID != c.deviceID:
+		deviceError = s.detach(c, deviceID)
+	case kind != "events" && kind != "state":
+		return fmt.Errorf("invalid topic: %s", publish.Topic)
+	case deviceID != c.deviceID && !c.attached[deviceID]:
+		deviceError = &iot.DeviceError{
+			ErrorType:   iot.ErrorTypeGatewayDeviceNotFound,
+			Description: "device is not attached",
+		}
+	case kind == "state":
+		if d, ok := s.devices[deviceID]; ok {
+			d.updateState(publish.Payload, s.now())
+		}
+	case kind == "events":
+		if d, ok := s.devices[deviceID]; ok {
+			d.lastEventTime = s.now()
+		}
+	}
+	if deviceError == nil {
+		s.record(deviceID, publish)
+	} else {
+		deviceError.DeviceID = deviceID
+		deviceError.MessageID = int(publish.PacketID)
+		payload, _ := json.Marshal(deviceError)
+		s.deliver(errorsTopic(c.deviceID), payload)
+	}
+	if publish.QOS > 0 {
+		return c.write(packets.PubAck, 0, packets.EncodePacketID(publish.PacketID))
+	}
+	return nil
+}
+
+// attach attaches a device to a gateway session.
+// It returns the error that is reported to the gateway if the device can't be attached.
+// The caller must hold the lock.
+func (s *Server) attach(c *session, deviceID string, payload []byte) *iot.DeviceError {
+	gateway := s.devices[c.deviceID]
+	d, ok := s.devices[deviceID]
+	if !ok || !gateway.bound[deviceID] {
+		return &iot.DeviceError{
+			ErrorType:   iot.ErrorTypeGatewayAttachment,
+			Description: "device is not bound to the gateway",
+		}
+	}
+	msg := struct {
+		Authorization string `json:"authorization"`
+	}{}
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return &iot.DeviceError{ErrorType: iot.ErrorTypeGatewayAttachment, Description: err.Error()}
+		}
+	}
+	// Without an authorization token, the gateway's association with the device is enough
+	if msg.Authorization != "" {
+		if err := s.verifyToken(d, msg.Authorization); err != nil {
+			return &iot.DeviceError{ErrorType: iot.ErrorTypeGatewayAttachment, Description: err.Error()}
+		}
+	}
+	c.attached[deviceID] = true
+	return nil
+}
+
+// detach detaches a device from a gateway session and removes its subscriptions.
+// It returns the error that is reported to the gateway if the device isn't attached.
+// The caller must hold the lock.
+func (s *Server) detach(c *session, deviceID string) *iot.DeviceError {
+	if !c.attached[deviceID] {
+		return &iot.DeviceError{
+			ErrorType:   iot.ErrorTypeGatewayDetachment,
+			Description: "device is not attached",
+		}
+	}
+	delete(c.attached, deviceID)
+	for filter := range c.subscriptions {
+		if id, _, _ := parseTopic(filter); id == deviceID {
+			delete(c.subscriptions, filter)
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleSubscribe(c *session, p *packets.Packet) error {
+	id, subscriptions, err := packets.DecodeSubscribe(p.Body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	returnCodes := make([]byte, 0, len(subscriptions))
+	var configs []string
+	for _, subscription := range subscriptions {
+		deviceID, kind, ok := parseTopic(subscription.Filter)
+		allowed := ok && (deviceID == c.deviceID || c.attached[deviceID])
+		switch {
+		case allowed && kind == "config" && subscription.Filter == configTopic(deviceID):
+			configs = append(configs, deviceID)
+		case allowed && kind == "commands" && subscription.Filter == commandsTopic(deviceID)+"/#":
+		case allowed && kind == "errors" && subscription.Filter == errorsTopic(deviceID):
+		default:
+			allowed = false
+		}
+		if !allowed {
+			returnCodes = append(returnCodes, packets.SubAckFailure)
+			continue
+		}
+		qos := subscription.QOS
+		if qos > 1 {
+			qos = 1
+		}
+		c.subscriptions[subscription.Filter] = qos
+		returnCodes = append(returnCodes, qos)
+	}
+	if err = c.write(packets.SubAck, 0, packets.EncodeSubAck(id, returnCodes...)); err != nil {
+		return err
+	}
+	// The latest config is delivered after subscribing, like a retained message
+	for _, deviceID := range configs {
+		if len(s.devices[deviceID].configs) > 0 {
+			s.sendConfig(c, deviceID, c.subscriptions[configTopic(deviceID)])
+		}
+	}
+	return nil
+}
+
+// sendConfig sends the current config of a device to a session.
+// Configs sent with QoS 1 are recorded so that the acknowledgement can be tracked.
+// The caller must hold the lock.
+func (s *Server) sendConfig(c *session, deviceID string, qos byte) {
+	d := s.devices[deviceID]
+	config := d.configs[len(d.configs)-1]
+	id := c.publish(configTopic(deviceID), qos, config.BinaryData)
+	if qos > 0 {
+		c.configAcks[id] = configAck{deviceID: deviceID, version: config.Version}
+	}
+}
+
+func (s *Server) handlePubAck(c *session, p *packets.Packet) error {
+	id, err := packets.DecodePacketID(p.Body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Other messages are not redelivered, so their acknowledgements are ignored
+	if ack, ok := c.configAcks[id]; ok {
+		delete(c.configAcks, id)
+		if d, ok := s.devices[ack.deviceID]; ok {
+			d.ackConfig(ack.version, s.now())
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleUnsubscribe(c *session, p *packets.Packet) error {
+	id, filters, err := packets.DecodeUnsubscribe(p.Body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for _, filter := range filters {
+		delete(c.subscriptions, filter)
+	}
+	s.mu.Unlock()
+	return c.write(packets.UnsubAck, 0, packets.EncodePacketID(id))
+}
+
+// publish sends a message to the client and returns its packet ID.
+// The caller must hold the server lock.
+func (c *session) publish(topic string, qos byte, payload []byte) uint16 {
+	p := &packets.PublishPacket{Topic: topic, QOS: qos, Payload: payload}
+	if qos > 0 {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		p.PacketID = c.nextID
+	}
+	if err := c.write(packets.Publish, p.Flags(), p.Encode()); err != nil {
+		c.conn.Close()
+	}
+	return p.PacketID
+}
+
+// write queues a packet to be sent to the client.
+func (c *session) write(packetType byte, flags byte, body []byte) error {
+	buf := &bytes.Buffer{}
+	if err := packets.WritePacket(buf, packetType, flags, body); err != nil {
+		return err
+	}
+	c.queueLock.Lock()
+	c.queue = append(c.queue, buf.Bytes())
+	c.queueLock.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeLoop sends queued packets to the client until the session is closed.
+// If a write fails, the connection is closed.
+func (c *session) writeLoop() {
+	defer close(c.flushed)
+	for {
+		select {
+		case <-c.wake:
+		case <-c.closed:
+			// Packets queued before the session was closed, such as a CONNACK that refuses the connection, are still sent
+			c.flush()
+			return
+		}
+		if !c.flush() {
+			return
+		}
+	}
+}
+
+// flush sends the queued packets and returns false if a write failed.
+func (c *session) flush() bool {
+	c.queueLock.Lock()
+	queue := c.queue
+	c.queue = nil
+	c.queueLock.Unlock()
+	for _, b := range queue {
+		if _, err := c.conn.Write(b); err != nil {
+			c.conn.Close()
+			return false
+		}
+	}
+	return true
+}
+
+// close waits up to flushTimeout for the queued packets to be sent, then closes the connection.
+func (c *session) close() {
+	c.conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+	close(c.closed)
+	<-c.flushed
+	c.conn.Close()
+}
+
+// parseTopic splits a topic of the form /devices/{device-id}/{kind}/... into the device ID and kind.
+func parseTopic(topic string) (string, string, bool) {
+	parts := strings.SplitN(topic, "/", 5)
+	if len(parts) < 4 || parts[0] != "" || parts[1] != "devices" || parts[2] == "" {
+		return "", "", false
+	}
+	if len(parts) == 5 && parts[3] != "events" && parts[3] != "commands" {
+		return "", "", false
+	}
+	return parts[2], parts[3], true
+}
+
+// configTopic returns the config topic of a device.
+// The topic helpers use GoogleTopicScheme, so the server uses the same topics as Things.
+func configTopic(deviceID string) string {
+	return iot.GoogleTopicScheme.ConfigTopic(&iot.ID{DeviceID: deviceID})
+}
+
+func stateTopic(deviceID string) string {
+	return iot.GoogleTopicScheme.StateTopic(&iot.ID{DeviceID: deviceID})
+}
+
+func eventsTopic(deviceID string, subFolder string) string {
+	if subFolder == "" {
+		return iot.GoogleTopicScheme.EventsTopic(&iot.ID{DeviceID: deviceID})
+	}
+	return iot.GoogleTopicScheme.EventsTopic(&iot.ID{DeviceID: deviceID}, subFolder)
+}
+
+func commandsTopic(deviceID string) string {
+	return iot.GoogleTopicScheme.CommandsTopic(&iot.ID{DeviceID: deviceID})
+}
+
+func errorsTopic(deviceID string) string {
+	return iot.GoogleTopicScheme.ErrorsTopic(&iot.ID{DeviceID: deviceID})
+}
@@ -0,0 +1,322 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iottest_test
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vaelen/iot"
+	"github.com/vaelen/iot/iottest"
+	"github.com/vaelen/iot/mqtt"
+)
+
+var ID = &iot.ID{
+	DeviceID:  "device",
+	Registry:  "registry",
+	Location:  "location",
+	ProjectID: "project",
+}
+
+func newServer(t *testing.T) *iottest.Server {
+	server := iottest.NewServer(ID.ProjectID, ID.Location, ID.Registry)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func getOptions(t *testing.T, id *iot.ID, credentials *iot.Credentials) *iot.ThingOptions {
+	iot.NewClient = mqtt.NewClient
+	options := iot.DefaultOptions(id, credentials)
+	options.StateRateLimit = iot.RateLimit{}
+	return options
+}
+
+func loadCredentials(t *testing.T) (*iot.Credentials, *iot.Credentials) {
+	rsa, err := iot.LoadRSACredentials("../test_keys/rsa_cert.pem", "../test_keys/rsa_private.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load RSA credentials: %v", err)
+	}
+	ec, err := iot.LoadECCredentials("../test_keys/ec_cert.pem", "../test_keys/ec_private.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load EC credentials: %v", err)
+	}
+	return rsa, ec
+}
+
+func waitFor(t *testing.T, server *iottest.Server, filter string, count int) []iottest.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	messages, err := server.WaitForMessages(ctx, filter, count)
+	if err != nil {
+		t.Fatalf("Received %d messages on %s, expected %d", len(messages), filter, count)
+	}
+	return messages
+}
+
+// waitForState waits until the server has received the given state, since the state may be republished.
+func waitForState(t *testing.T, server *iottest.Server, state string) {
+	for i := 0; string(server.State(ID.DeviceID)) != state; i++ {
+		if i == 500 {
+			t.Fatalf("Wrong state: %s", server.State(ID.DeviceID))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	server := newServer(t)
+	rsa, ec := loadCredentials(t)
+	if err := server.AddDevice(ID.DeviceID, ec, rsa); err != nil {
+		t.Fatalf("Couldn't add device: %v", err)
+	}
+	if _, err := server.SetConfig(ID.DeviceID, []byte("config 1")); err != nil {
+		t.Fatalf("Couldn't set config: %v", err)
+	}
+
+	var mu sync.Mutex
+	var commands []string
+	options := getOptions(t, ID, rsa)
+	options.ConfigHandler = func(thing iot.Thing, config []byte) {
+		thing.PublishState(ctx, append([]byte("received "), config...))
+	}
+	options.CommandHandler = func(thing iot.Thing, subfolder string, command []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		commands = append(commands, subfolder+":"+string(command))
+	}
+	thing := iot.New(options)
+	if err := thing.Connect(ctx, server.URL); err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+	if !server.IsConnected(ID.DeviceID) {
+		t.Fatal("Server doesn't show the device as connected")
+	}
+
+	// The retained config is delivered when the device subscribes
+	waitForState(t, server, "received config 1")
+
+	// Config updates are delivered while the device is connected
+	version, err := server.SetConfig(ID.DeviceID, []byte("config 2"))
+	if err != nil || version != 2 {
+		t.Fatalf("Wrong config version: %v, %v", version, err)
+	}
+	waitForState(t, server, "received config 2")
+
+	if err = thing.PublishEvent(ctx, []byte("event 1")); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	if err = thing.PublishEvent(ctx, []byte("event 2"), "a", "b"); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	messages := waitFor(t, server, "/devices/device/events/#", 2)
+	if messages[0].Topic != "/devices/device/events" || string(messages[0].Payload) != "event 1" {
+		t.Fatalf("Wrong message: %+v", messages[0])
+	}
+	if messages[1].Topic != "/devices/device/events/a/b" || string(messages[1].Payload) != "event 2" || messages[1].DeviceID != ID.DeviceID {
+		t.Fatalf("Wrong message: %+v", messages[1])
+	}
+
+	if err = server.SendCommand(ID.DeviceID, "x", []byte("command")); err != nil {
+		t.Fatalf("Couldn't send command: %v", err)
+	}
+	for i := 0; ; i++ {
+		mu.Lock()
+		received := append([]string{}, commands...)
+		mu.Unlock()
+		if len(received) == 1 && received[0] == "x:command" {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Wrong commands: %v", received)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err = server.SendCommand("unknown", "", []byte("command")); err != iottest.ErrDeviceNotFound {
+		t.Fatalf("Wrong error: %v", err)
+	}
+
+	thing.Disconnect(ctx)
+	if err = server.SendCommand(ID.DeviceID, "", []byte("command")); err != iottest.ErrNotSubscribed {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestServerAuthentication(t *testing.T) {
+	ctx := context.Background()
+	server := newServer(t)
+	rsa, ec := loadCredentials(t)
+	if err := server.AddDevice(ID.DeviceID, ec); err != nil {
+		t.Fatalf("Couldn't add device: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		id          *iot.ID
+		credentials *iot.Credentials
+		now         time.Time
+		err         error
+	}{
+		{"valid", ID, ec, time.Now(), nil},
+		{"wrong key", ID, rsa, time.Now(), iot.ErrNotAuthorized},
+		{"unknown device", &iot.ID{DeviceID: "unknown", Registry: ID.Registry, Location: ID.Location, ProjectID: ID.ProjectID}, ec, time.Now(), iot.ErrNotAuthorized},
+		{"wrong project", &iot.ID{DeviceID: ID.DeviceID, Registry: ID.Registry, Location: ID.Location, ProjectID: "other"}, ec, time.Now(), iot.ErrNotAuthorized},
+		{"expired", ID, ec, time.Now().Add(time.Hour * 2), iot.ErrNotAuthorized},
+		{"issued in the future", ID, ec, time.Now().Add(-time.Hour), iot.ErrNotAuthorized},
+	}
+	for _, test := range tests {
+		now := test.now
+		server.SetClock(func() time.Time { return now })
+		thing := iot.New(getOptions(t, test.id, test.credentials))
+		err := thing.Connect(ctx, server.URL)
+		thing.Disconnect(ctx)
+		if err != test.err {
+			t.Fatalf("%s: Expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	ctx := context.Background()
+	certificate, err := tls.LoadX509KeyPair("../test_keys/server_cert.pem", "../test_keys/server_private.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load server certificate: %v", err)
+	}
+	server := iottest.NewTLSServer(ID.ProjectID, ID.Location, ID.Registry, certificate)
+	defer server.Close()
+	rsa, _ := loadCredentials(t)
+	server.AddDevice(ID.DeviceID, rsa)
+
+	rootCAs, err := iot.LoadRootCAs("../test_keys/ca_cert.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load root CAs: %v", err)
+	}
+	options := getOptions(t, ID, rsa)
+	options.RootCAs = rootCAs
+	thing := iot.New(options)
+	if err = thing.Connect(ctx, server.URL); err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+	if err = thing.PublishEvent(ctx, []byte("TLS event")); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	waitFor(t, server, "/devices/device/events", 1)
+}
+
+func TestServerGateway(t *testing.T) {
+	ctx := context.Background()
+	server := newServer(t)
+	rsa, ec := loadCredentials(t)
+	gatewayID := &iot.ID{DeviceID: "gateway", Registry: ID.Registry, Location: ID.Location, ProjectID: ID.ProjectID}
+	server.AddDevice(gatewayID.DeviceID, rsa)
+	server.AddDevice("bound", ec)
+	server.AddDevice("unbound")
+	if err := server.BindDevice(gatewayID.DeviceID, "bound"); err != nil {
+		t.Fatalf("Couldn't bind device: %v", err)
+	}
+	server.SetConfig("bound", []byte("bound config"))
+
+	deviceErrors := make(chan *iot.DeviceError, 10)
+	options := getOptions(t, gatewayID, rsa)
+	options.ErrorHandler = func(thing iot.Thing, err *iot.DeviceError) {
+		deviceErrors <- err
+	}
+	gateway := iot.NewGateway(options)
+	if err := gateway.Connect(ctx, server.URL); err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer gateway.Disconnect(ctx)
+
+	configs := make(chan string, 10)
+	bound, err := gateway.Attach(ctx, &iot.BoundDeviceOptions{
+		DeviceID:    "bound",
+		Credentials: ec,
+		ConfigHandler: func(thing iot.Thing, config []byte) {
+			configs <- string(config)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't attach device: %v", err)
+	}
+	select {
+	case config := <-configs:
+		if config != "bound config" {
+			t.Fatalf("Wrong config: %s", config)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Config wasn't delivered to the bound device")
+	}
+	if !server.IsConnected("bound") {
+		t.Fatal("Server doesn't show the bound device as attached")
+	}
+	if err = bound.PublishEvent(ctx, []byte("bound event")); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	messages := waitFor(t, server, "/devices/bound/events", 1)
+	if messages[0].DeviceID != "bound" {
+		t.Fatalf("Wrong device ID: %s", messages[0].DeviceID)
+	}
+
+	// Attaching a device that isn't bound to the gateway reports an error on the errors topic
+	gateway.Attach(ctx, &iot.BoundDeviceOptions{DeviceID: "unbound"})
+	select {
+	case e := <-deviceErrors:
+		if e.ErrorType != iot.ErrorTypeGatewayAttachment || e.DeviceID != "unbound" {
+			t.Fatalf("Wrong error: %v", e)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Attachment error wasn't reported")
+	}
+	if server.IsConnected("unbound") {
+		t.Fatal("Unbound device was attached")
+	}
+
+	if err = gateway.Detach(ctx, "bound"); err != nil {
+		t.Fatalf("Couldn't detach device: %v", err)
+	}
+	for i := 0; server.IsConnected("bound"); i++ {
+		if i == 100 {
+			t.Fatal("Bound device wasn't detached")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestServerDisconnect(t *testing.T) {
+	ctx := context.Background()
+	server := newServer(t)
+	rsa, _ := loadCredentials(t)
+	server.AddDevice(ID.DeviceID, rsa)
+
+	lost := make(chan struct{}, 1)
+	options := getOptions(t, ID, rsa)
+	options.ConnectionEventHandler = func(thing iot.Thing, event iot.ConnectionEvent) {
+		if event.Type == iot.ConnectionLost {
+			lost <- struct{}{}
+		}
+	}
+	thing := iot.New(options)
+	if err := thing.Connect(ctx, server.URL); err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+
+	server.Disconnect(ID.DeviceID)
+	select {
+	case <-lost:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Connection lost event wasn't emitted")
+	}
+	for i := 0; server.IsConnected(ID.DeviceID); i++ {
+		if i == 100 {
+			t.Fatal("Server still shows the device as connected")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,450 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iottest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/vaelen/iot"
+)
+
+// MaxHistory is the number of config versions and states that are kept for each device, like Cloud IoT Core.
+const MaxHistory = 10
+
+// These are the public key formats supported by Cloud IoT Core.
+const (
+	RSAX509PEM   = "RSA_X509_PEM"
+	RSAPEM       = "RSA_PEM"
+	ES256X509PEM = "ES256_X509_PEM"
+	ES256PEM     = "ES256_PEM"
+)
+
+// ErrInvalidDeviceID is returned when creating a device without an ID.
+var ErrInvalidDeviceID = fmt.Errorf("invalid device ID")
+
+// ErrDeviceExists is returned when creating a device that is already registered.
+var ErrDeviceExists = fmt.Errorf("device already exists")
+
+// ErrInvalidPublicKey is returned when a device credential can't be parsed.
+var ErrInvalidPublicKey = fmt.Errorf("invalid public key")
+
+// ErrVersionMismatch is returned when a config is modified using a version that isn't the current version.
+var ErrVersionMismatch = fmt.Errorf("config version doesn't match the current version")
+
+// Device describes a device in the registry.
+// It has the same JSON representation as the Cloud IoT Core device resource.
+type Device struct {
+	ID          string             `json:"id"`
+	Credentials []DeviceCredential `json:"credentials,omitempty"`
+	// LastEventTime is the last time the device published an event.
+	LastEventTime time.Time `json:"lastEventTime"`
+	// LastStateTime is the last time the device published its state.
+	LastStateTime time.Time `json:"lastStateTime"`
+	// LastConfigAckTime is the last time the device acknowledged a config delivered with QoS 1.
+	LastConfigAckTime time.Time `json:"lastConfigAckTime"`
+	// Config is the current config. Its version is 0 if no config has been set.
+	Config DeviceConfig `json:"config"`
+	// State is the latest state published by the device.
+	State DeviceState `json:"state"`
+}
+
+// DeviceCredential is a public key registered for a device.
+type DeviceCredential struct {
+	PublicKey PublicKeyCredential `json:"publicKey"`
+	// ExpirationTime is the time the key expires. The zero value means the key doesn't expire.
+	ExpirationTime time.Time `json:"expirationTime"`
+}
+
+// PublicKeyCredential is a PEM encoded public key or certificate.
+type PublicKeyCredential struct {
+	// Format is one of RSAX509PEM, RSAPEM, ES256X509PEM or ES256PEM.
+	Format string `json:"format"`
+	Key    string `json:"key"`
+}
+
+// DeviceConfig is a version of a device's config.
+type DeviceConfig struct {
+	Version int64 `json:"version,string"`
+	// CloudUpdateTime is the time the config was set.
+	CloudUpdateTime time.Time `json:"cloudUpdateTime"`
+	// DeviceAckTime is the time the device acknowledged the config. It is only set for configs delivered with QoS 1.
+	DeviceAckTime time.Time `json:"deviceAckTime"`
+	BinaryData    []byte    `json:"binaryData"`
+}
+
+// DeviceState is a state published by a device.
+type DeviceState struct {
+	UpdateTime time.Time `json:"updateTime"`
+	BinaryData []byte    `json:"binaryData"`
+}
+
+// device holds the server side state of a registered device.
+type device struct {
+	credentials       []DeviceCredential
+	keys              []crypto.PublicKey
+	bound             map[string]bool
+	configs           []DeviceConfig
+	configVersion     int64
+	states            []DeviceState
+	lastEventTime     time.Time
+	lastStateTime     time.Time
+	lastConfigAckTime time.Time
+}
+
+// CreateDevice registers a new device with the given ID and credentials.
+// Any other fields of the device are ignored.
+func (s *Server) CreateDevice(d Device) (Device, error) {
+	if d.ID == "" {
+		return Device{}, ErrInvalidDeviceID
+	}
+	keys := make([]crypto.PublicKey, 0, len(d.Credentials))
+	for _, c := range d.Credentials {
+		key, err := parsePublicKey(c.PublicKey)
+		if err != nil {
+			return Device{}, err
+		}
+		keys = append(keys, key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.devices[d.ID]; ok {
+		return Device{}, ErrDeviceExists
+	}
+	s.devices[d.ID] = &device{
+		credentials: append([]DeviceCredential{}, d.Credentials...),
+		keys:        keys,
+		bound:       make(map[string]bool),
+	}
+	return s.deviceResource(d.ID), nil
+}
+
+// AddDevice registers a device with the public keys of the given credentials.
+// A device without credentials can only be used through a gateway.
+// Adding a device that is already registered replaces its keys.
+func (s *Server) AddDevice(deviceID string, credentials ...*iot.Credentials) error {
+	var deviceCredentials []DeviceCredential
+	var keys []crypto.PublicKey
+	for _, c := range credentials {
+		credential, key, err := deviceCredential(c)
+		if err != nil {
+			return err
+		}
+		deviceCredentials = append(deviceCredentials, credential)
+		keys = append(keys, key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[deviceID]
+	if !ok {
+		d = &device{bound: make(map[string]bool)}
+		s.devices[deviceID] = d
+	}
+	d.credentials = deviceCredentials
+	d.keys = keys
+	return nil
+}
+
+// GetDevice returns a registered device.
+func (s *Server) GetDevice(deviceID string) (Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.devices[deviceID]; !ok {
+		return Device{}, ErrDeviceNotFound
+	}
+	return s.deviceResource(deviceID), nil
+}
+
+// ListDevices returns all of the registered devices ordered by ID.
+func (s *Server) ListDevices() []Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.devices))
+	for id := range s.devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	devices := make([]Device, 0, len(ids))
+	for _, id := range ids {
+		devices = append(devices, s.deviceResource(id))
+	}
+	return devices
+}
+
+// DeleteDevice removes a device from the registry and closes its connection.
+func (s *Server) DeleteDevice(deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.devices[deviceID]; !ok {
+		return ErrDeviceNotFound
+	}
+	delete(s.devices, deviceID)
+	for _, d := range s.devices {
+		delete(d.bound, deviceID)
+	}
+	for session := range s.sessions {
+		if session.deviceID == deviceID {
+			session.conn.Close()
+		}
+		s.detach(session, deviceID)
+	}
+	return nil
+}
+
+// BindDevice binds a device to a gateway so that the gateway can attach it.
+func (s *Server) BindDevice(gatewayID string, deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gateway, ok := s.devices[gatewayID]
+	if !ok {
+		return ErrDeviceNotFound
+	}
+	if _, ok = s.devices[deviceID]; !ok {
+		return ErrDeviceNotFound
+	}
+	gateway.bound[deviceID] = true
+	return nil
+}
+
+// SetConfig sets the config of a device and delivers it to the device if it is subscribed to its config topic.
+// It returns the new config version.
+func (s *Server) SetConfig(deviceID string, config []byte) (int64, error) {
+	c, err := s.ModifyConfig(deviceID, 0, config)
+	return c.Version, err
+}
+
+// ModifyConfig sets the config of a device and delivers it to the device if it is subscribed to its config topic.
+// If versionToUpdate is not 0, it must match the current version or ErrVersionMismatch is returned.
+// This allows a config rollout to detect concurrent changes.
+func (s *Server) ModifyConfig(deviceID string, versionToUpdate int64, config []byte) (DeviceConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[deviceID]
+	if !ok {
+		return DeviceConfig{}, ErrDeviceNotFound
+	}
+	if versionToUpdate != 0 && versionToUpdate != d.configVersion {
+		return DeviceConfig{}, ErrVersionMismatch
+	}
+	d.configVersion++
+	c := DeviceConfig{
+		Version:         d.configVersion,
+		CloudUpdateTime: s.now(),
+		BinaryData:      append([]byte{}, config...),
+	}
+	d.configs = append(d.configs, c)
+	if len(d.configs) > MaxHistory {
+		d.configs = d.configs[len(d.configs)-MaxHistory:]
+	}
+	s.notify()
+	for session := range s.sessions {
+		if qos, ok := session.subscriptions[configTopic(deviceID)]; ok {
+			s.sendConfig(session, deviceID, qos)
+		}
+	}
+	return c, nil
+}
+
+// Config returns the current config of a device and its version.
+// The version is 0 if no config has been set.
+func (s *Server) Config(deviceID string) ([]byte, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[deviceID]
+	if !ok || len(d.configs) == 0 {
+		return nil, 0
+	}
+	c := d.configs[len(d.configs)-1]
+	return c.BinaryData, c.Version
+}
+
+// ConfigVersions returns the most recent config versions of a device, newest first.
+func (s *Server) ConfigVersions(deviceID string) ([]DeviceConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[deviceID]
+	if !ok {
+		return nil, ErrDeviceNotFound
+	}
+	configs := make([]DeviceConfig, len(d.configs))
+	for i, c := range d.configs {
+		configs[len(configs)-1-i] = c
+	}
+	return configs, nil
+}
+
+// State returns the latest state published by a device.
+func (s *Server) State(deviceID string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[deviceID]
+	if !ok || len(d.states) == 0 {
+		return nil
+	}
+	return d.states[len(d.states)-1].BinaryData
+}
+
+// States returns the most recent states published by a device, newest first.
+func (s *Server) States(deviceID string) ([]DeviceState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[deviceID]
+	if !ok {
+		return nil, ErrDeviceNotFound
+	}
+	states := make([]DeviceState, len(d.states))
+	for i, state := range d.states {
+		states[len(states)-1-i] = state
+	}
+	return states, nil
+}
+
+// deviceResource returns the public representation of a device.
+// The caller must hold the lock.
+func (s *Server) deviceResource(deviceID string) Device {
+	d := s.devices[deviceID]
+	r := Device{
+		ID:                deviceID,
+		Credentials:       append([]DeviceCredential{}, d.credentials...),
+		LastEventTime:     d.lastEventTime,
+		LastStateTime:     d.lastStateTime,
+		LastConfigAckTime: d.lastConfigAckTime,
+	}
+	if len(d.configs) > 0 {
+		r.Config = d.configs[len(d.configs)-1]
+	}
+	if len(d.states) > 0 {
+		r.State = d.states[len(d.states)-1]
+	}
+	return r
+}
+
+// updateState stores a state published by a device.
+// The caller must hold the lock.
+func (d *device) updateState(state []byte, now time.Time) {
+	d.lastStateTime = now
+	d.states = append(d.states, DeviceState{UpdateTime: now, BinaryData: state})
+	if len(d.states) > MaxHistory {
+		d.states = d.states[len(d.states)-MaxHistory:]
+	}
+}
+
+// ackConfig records that the device acknowledged a config version.
+// The caller must hold the lock.
+func (d *device) ackConfig(version int64, now time.Time) {
+	d.lastConfigAckTime = now
+	for i := range d.configs {
+		if d.configs[i].Version == version {
+			d.configs[i].DeviceAckTime = now
+		}
+	}
+}
+
+// activeKeys returns the keys of the device that have not expired.
+// The caller must hold the lock.
+func (d *device) activeKeys(now time.Time) []crypto.PublicKey {
+	keys := make([]crypto.PublicKey, 0, len(d.keys))
+	for i, key := range d.keys {
+		if i < len(d.credentials) {
+			expiration := d.credentials[i].ExpirationTime
+			if !expiration.IsZero() && !now.Before(expiration) {
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// deviceCredential returns the credential that is registered for the given credentials and its public key.
+func deviceCredential(credentials *iot.Credentials) (DeviceCredential, crypto.PublicKey, error) {
+	key, err := publicKey(credentials)
+	if err != nil {
+		return DeviceCredential{}, nil, err
+	}
+	_, isEC := key.(*ecdsa.PublicKey)
+	c := DeviceCredential{ExpirationTime: credentials.Expiration}
+	if len(credentials.Certificate.Certificate) > 0 {
+		c.PublicKey.Format = RSAX509PEM
+		if isEC {
+			c.PublicKey.Format = ES256X509PEM
+		}
+		c.PublicKey.Key = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: credentials.Certificate.Certificate[0]}))
+		return c, key, nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return DeviceCredential{}, nil, err
+	}
+	c.PublicKey.Format = RSAPEM
+	if isEC {
+		c.PublicKey.Format = ES256PEM
+	}
+	c.PublicKey.Key = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	return c, key, nil
+}
+
+func publicKey(credentials *iot.Credentials) (crypto.PublicKey, error) {
+	if credentials == nil {
+		return nil, ErrNoPublicKey
+	}
+	if len(credentials.Certificate.Certificate) > 0 {
+		certificate, err := x509.ParseCertificate(credentials.Certificate.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		return certificate.PublicKey, nil
+	}
+	if credentials.Signer != nil {
+		return credentials.Signer.Public(), nil
+	}
+	if signer, ok := credentials.PrivateKey.(crypto.Signer); ok {
+		return signer.Public(), nil
+	}
+	return nil, ErrNoPublicKey
+}
+
+// parsePublicKey parses a public key in one of the formats supported by Cloud IoT Core.
+func parsePublicKey(c PublicKeyCredential) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(c.Key))
+	if block == nil {
+		return nil, ErrInvalidPublicKey
+	}
+	var key crypto.PublicKey
+	switch c.Format {
+	case RSAX509PEM, ES256X509PEM:
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, ErrInvalidPublicKey
+		}
+		key = certificate.PublicKey
+	case RSAPEM, ES256PEM:
+		var err error
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, ErrInvalidPublicKey
+		}
+	default:
+		return nil, ErrInvalidPublicKey
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if c.Format != RSAX509PEM && c.Format != RSAPEM {
+			return nil, ErrInvalidPublicKey
+		}
+	case *ecdsa.PublicKey:
+		if c.Format != ES256X509PEM && c.Format != ES256PEM {
+			return nil, ErrInvalidPublicKey
+		}
+	default:
+		return nil, ErrInvalidPublicKey
+	}
+	return key, nil
+}
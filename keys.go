@@ -0,0 +1,384 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// DefaultEnvPrefix is the default prefix used by LoadCredentialsFromEnv.
+const DefaultEnvPrefix = "IOT_"
+
+// These suffixes are appended to the prefix passed to LoadCredentialsFromEnv to get the names of environment variables.
+const (
+	EnvCertificate        = "CERTIFICATE"
+	EnvPrivateKey         = "PRIVATE_KEY"
+	EnvPrivateKeyPassword = "PRIVATE_KEY_PASSWORD"
+)
+
+// ParseCredentials creates a Credentials struct from PEM encoded data.
+//
+// The private key may be an RSA or P-256 EC key in PKCS#1, PKCS#8, or SEC1 format.
+// The key type is detected automatically.
+// If the private key is encrypted, password must be provided.
+// Both legacy encrypted PEM blocks and encrypted PKCS#8 (PBES2) keys are supported.
+//
+// The certificate is optional. If it is provided, it must match the private key.
+func ParseCredentials(certificatePEM []byte, privateKeyPEM []byte, password []byte) (*Credentials, error) {
+	signer, err := ParsePrivateKey(privateKeyPEM, password)
+	if err != nil {
+		return nil, err
+	}
+
+	credentialType, err := signerCredentialType(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := &Credentials{
+		Type:       credentialType,
+		PrivateKey: signer,
+	}
+
+	if len(certificatePEM) > 0 {
+		credentials.Certificate, err = parseCertificate(certificatePEM, signer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return credentials, nil
+}
+
+// ReadCredentials creates a Credentials struct by reading PEM encoded data from the given readers.
+// The certificate reader may be nil. See ParseCredentials for the supported formats.
+func ReadCredentials(certificate io.Reader, privateKey io.Reader, password []byte) (*Credentials, error) {
+	var certificatePEM []byte
+	var err error
+	if certificate != nil {
+		certificatePEM, err = ioutil.ReadAll(certificate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	privateKeyPEM, err := ioutil.ReadAll(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCredentials(certificatePEM, privateKeyPEM, password)
+}
+
+// LoadCredentials creates a Credentials struct from the given certificate and private key files.
+// The certificate path may be empty. See ParseCredentials for the supported formats.
+func LoadCredentials(certificatePath string, privateKeyPath string, password []byte) (*Credentials, error) {
+	var certificatePEM []byte
+	var err error
+	if certificatePath != "" {
+		certificatePEM, err = ioutil.ReadFile(certificatePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	privateKeyPEM, err := ioutil.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCredentials(certificatePEM, privateKeyPEM, password)
+}
+
+// LoadCredentialsFromEnv creates a Credentials struct from environment variables.
+//
+// The variables are named by appending EnvCertificate, EnvPrivateKey, and EnvPrivateKeyPassword to the prefix.
+// If the prefix is empty, DefaultEnvPrefix will be used, so the variables will be IOT_CERTIFICATE, etc.
+// The certificate and private key variables can either contain PEM encoded data or the path to a file.
+// Only the private key variable is required. See ParseCredentials for the supported formats.
+func LoadCredentialsFromEnv(prefix string) (*Credentials, error) {
+	if prefix == "" {
+		prefix = DefaultEnvPrefix
+	}
+
+	privateKeyPEM, err := envPEM(prefix + EnvPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(privateKeyPEM) == 0 {
+		return nil, fmt.Errorf("environment variable %s is not set", prefix+EnvPrivateKey)
+	}
+
+	certificatePEM, err := envPEM(prefix + EnvCertificate)
+	if err != nil {
+		return nil, err
+	}
+
+	var password []byte
+	if p, ok := os.LookupEnv(prefix + EnvPrivateKeyPassword); ok {
+		password = []byte(p)
+	}
+
+	return ParseCredentials(certificatePEM, privateKeyPEM, password)
+}
+
+// envPEM returns the PEM data stored in or referenced by an environment variable.
+func envPEM(name string) ([]byte, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" || strings.HasPrefix(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+// ParsePrivateKey parses a PEM encoded RSA or EC private key and returns it as a crypto.Signer.
+// See ParseCredentials for the supported formats.
+func ParsePrivateKey(privateKeyPEM []byte, password []byte) (crypto.Signer, error) {
+	var block *pem.Block
+	rest := privateKeyPEM
+	for {
+		block, rest = pem.Decode(rest)
+		if block == nil || strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			break
+		}
+	}
+	if block == nil {
+		return nil, fmt.Errorf("no private key found")
+	}
+
+	der := block.Bytes
+	var err error
+	switch {
+	case x509.IsEncryptedPEMBlock(block):
+		if len(password) == 0 {
+			return nil, ErrPasswordRequired
+		}
+		der, err = x509.DecryptPEMBlock(block, password)
+		if err == x509.IncorrectPasswordError {
+			return nil, ErrIncorrectPassword
+		} else if err != nil {
+			return nil, err
+		}
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		if len(password) == 0 {
+			return nil, ErrPasswordRequired
+		}
+		der, err = decryptPKCS8(block.Bytes, password)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			// Decryption with the wrong password usually fails when the padding is checked, but not always
+			return nil, ErrIncorrectPassword
+		}
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+	return signer, nil
+}
+
+// parseCertificate parses a PEM encoded certificate chain and checks that it matches the signer.
+func parseCertificate(certificatePEM []byte, signer crypto.Signer) (tls.Certificate, error) {
+	certificate := tls.Certificate{}
+	for {
+		var block *pem.Block
+		block, certificatePEM = pem.Decode(certificatePEM)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certificate.Certificate = append(certificate.Certificate, block.Bytes)
+		}
+	}
+	if len(certificate.Certificate) == 0 {
+		return certificate, fmt.Errorf("no certificates found")
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return certificate, err
+	}
+	if !publicKeysEqual(leaf.PublicKey, signer.Public()) {
+		return certificate, ErrCertificateMismatch
+	}
+	certificate.PrivateKey = signer
+	certificate.Leaf = leaf
+	return certificate, nil
+}
+
+func publicKeysEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	switch a := a.(type) {
+	case *rsa.PublicKey:
+		b, ok := b.(*rsa.PublicKey)
+		return ok && a.N.Cmp(b.N) == 0 && a.E == b.E
+	case *ecdsa.PublicKey:
+		b, ok := b.(*ecdsa.PublicKey)
+		return ok && a.Curve == b.Curve && a.X.Cmp(b.X) == 0 && a.Y.Cmp(b.Y) == 0
+	default:
+		return false
+	}
+}
+
+// The following implements decryption of PKCS#8 private keys that are encrypted using PBES2 (RFC 8018).
+// This is the format produced by "openssl pkcs8 -topk8" and "openssl genpkey" when a cipher is given.
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+func decryptPKCS8(der []byte, password []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption: %v", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation function: %v", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, err
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case len(kdfParams.PRF.Algorithm) == 0, kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported key derivation hash: %v", kdfParams.PRF.Algorithm)
+	}
+
+	var keyLength int
+	var newCipher func(key []byte) (cipher.Block, error)
+	scheme := params.EncryptionScheme.Algorithm
+	switch {
+	case scheme.Equal(oidAES128CBC):
+		keyLength, newCipher = 16, aes.NewCipher
+	case scheme.Equal(oidAES192CBC):
+		keyLength, newCipher = 24, aes.NewCipher
+	case scheme.Equal(oidAES256CBC):
+		keyLength, newCipher = 32, aes.NewCipher
+	case scheme.Equal(oidDESEDE3CBC):
+		keyLength, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, fmt.Errorf("unsupported private key cipher: %v", scheme)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+
+	key := pbkdf2(prf, password, kdfParams.Salt, kdfParams.IterationCount, keyLength)
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data := info.EncryptedData
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("invalid encrypted private key")
+	}
+	plaintext := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, data)
+
+	// Remove the PKCS#7 padding
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, ErrIncorrectPassword
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, ErrIncorrectPassword
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// pbkdf2 derives a key from a password as described in RFC 8018 section 5.2.
+func pbkdf2(prf func() hash.Hash, password []byte, salt []byte, iterations int, keyLength int) []byte {
+	mac := hmac.New(prf, password)
+	size := mac.Size()
+	blocks := (keyLength + size - 1) / size
+	key := make([]byte, 0, blocks*size)
+	counter := make([]byte, 4)
+	for i := 1; i <= blocks; i++ {
+		binary.BigEndian.PutUint32(counter, uint32(i))
+		mac.Reset()
+		mac.Write(salt)
+		mac.Write(counter)
+		u := mac.Sum(nil)
+		t := append([]byte{}, u...)
+		for n := 1; n < iterations; n++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLength]
+}
@@ -0,0 +1,99 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/vaelen/iot"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	password := []byte("password")
+	tests := []struct {
+		certificatePath string
+		privateKeyPath  string
+		password        []byte
+		credentialType  iot.CredentialType
+		err             error
+	}{
+		{RSACertificatePath, RSAPrivateKeyPath, nil, iot.CredentialTypeRSA, nil},
+		{ECCertificatePath, ECPrivateKeyPath, nil, iot.CredentialTypeEC, nil},
+		{ECCertificatePath, "test_keys/ec_private_pkcs8.pem", nil, iot.CredentialTypeEC, nil},
+		{RSACertificatePath, "test_keys/rsa_private_encrypted.pem", password, iot.CredentialTypeRSA, nil},
+		{ECCertificatePath, "test_keys/ec_private_encrypted.pem", password, iot.CredentialTypeEC, nil},
+		{"", ECPrivateKeyPath, nil, iot.CredentialTypeEC, nil},
+		{RSACertificatePath, "test_keys/rsa_private_encrypted.pem", nil, 0, iot.ErrPasswordRequired},
+		{RSACertificatePath, "test_keys/rsa_private_encrypted.pem", []byte("wrong"), 0, iot.ErrIncorrectPassword},
+		{ECCertificatePath, "test_keys/ec_private_encrypted.pem", nil, 0, iot.ErrPasswordRequired},
+		{ECCertificatePath, "test_keys/ec_private_encrypted.pem", []byte("wrong"), 0, iot.ErrIncorrectPassword},
+		{RSACertificatePath, ECPrivateKeyPath, nil, 0, iot.ErrCertificateMismatch},
+	}
+
+	for _, test := range tests {
+		credentials, err := iot.LoadCredentials(test.certificatePath, test.privateKeyPath, test.password)
+		if err != test.err {
+			t.Fatalf("Wrong error loading %s: %v", test.privateKeyPath, err)
+		}
+		if err != nil {
+			continue
+		}
+		if credentials.Type != test.credentialType {
+			t.Fatalf("Wrong credential type for %s: %v", test.privateKeyPath, credentials.Type)
+		}
+		if credentials.PrivateKey == nil {
+			t.Fatalf("Private key not loaded from %s", test.privateKeyPath)
+		}
+		if test.certificatePath != "" && credentials.Certificate.Leaf == nil {
+			t.Fatalf("Certificate not loaded from %s", test.certificatePath)
+		}
+	}
+}
+
+func TestReadCredentials(t *testing.T) {
+	certificatePEM := readFile(t, ECCertificatePath)
+	privateKeyPEM := readFile(t, ECPrivateKeyPath)
+
+	credentials, err := iot.ReadCredentials(bytes.NewReader(certificatePEM), bytes.NewReader(privateKeyPEM), nil)
+	if err != nil {
+		t.Fatalf("Couldn't read credentials: %v", err)
+	}
+	if credentials.Type != iot.CredentialTypeEC {
+		t.Fatalf("Wrong credential type: %v", credentials.Type)
+	}
+
+	_, err = iot.ParseCredentials(certificatePEM, []byte("not a key"), nil)
+	if err == nil {
+		t.Fatal("Parsing an invalid key didn't return an error")
+	}
+}
+
+func TestLoadCredentialsFromEnv(t *testing.T) {
+	t.Setenv("TEST_IOT_CERTIFICATE", RSACertificatePath)
+	t.Setenv("TEST_IOT_PRIVATE_KEY", string(readFile(t, "test_keys/rsa_private_encrypted.pem")))
+	t.Setenv("TEST_IOT_PRIVATE_KEY_PASSWORD", "password")
+
+	credentials, err := iot.LoadCredentialsFromEnv("TEST_IOT_")
+	if err != nil {
+		t.Fatalf("Couldn't load credentials: %v", err)
+	}
+	if credentials.Type != iot.CredentialTypeRSA || credentials.Certificate.Leaf == nil {
+		t.Fatalf("Credentials not loaded correctly: %+v", credentials)
+	}
+
+	_, err = iot.LoadCredentialsFromEnv("MISSING_IOT_")
+	if err == nil {
+		t.Fatal("Loading credentials from missing environment variables didn't return an error")
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v", path, err)
+	}
+	return b
+}
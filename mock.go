@@ -5,24 +5,34 @@ package iot
 
 import (
 	"context"
+	"strings"
+	"sync"
 )
 
 // MockMQTTClient implements a mock MQTT client for use in testing
 // To use this client, use code like the following:
 // set iot.NewClient = iot.NewMockClient
 type MockMQTTClient struct {
+	// mu guards Connected, ConnectedTo, Messages and MessageID, which may be accessed by background goroutines.
+	mu                  sync.Mutex
 	t                   Thing
 	o                   *ThingOptions
 	Connected           bool
 	ConnectedTo         []string
 	Messages            map[string][]interface{}
-	Subscriptions       map[string]ConfigHandler
+	Subscriptions       map[string]MQTTMessageHandler
 	DebugLogger         Logger
 	InfoLogger          Logger
 	ErrorLogger         Logger
 	ClientID            string
 	CredentialsProvider MQTTCredentialsProvider
 	OnConnectHandler    MQTTOnConnectHandler
+	EventHandler        MQTTConnectionEventHandler
+	// MessageID is the message ID of the last message published with a QoS level above 0.
+	MessageID uint16
+	// Authenticate is optional. If set, Connect will pass the username and password
+	// returned by CredentialsProvider to it and fail with the returned error, if any.
+	Authenticate func(username string, password string) error
 }
 
 // NewMockClient returns an instance of MockMQTTClient
@@ -32,27 +42,49 @@ func NewMockClient(t Thing, o *ThingOptions) *MockMQTTClient {
 		t:             t,
 		o:             o,
 		Messages:      make(map[string][]interface{}),
-		Subscriptions: make(map[string]ConfigHandler),
+		Subscriptions: make(map[string]MQTTMessageHandler),
 	}
 }
 
 // Receive imitates the client receiving a message on the given topic for testing purposes.
+// The message is delivered to every subscription whose topic filter matches the topic.
 func (c *MockMQTTClient) Receive(topic string, message []byte) {
-	handler := c.Subscriptions[topic]
-	if handler != nil {
-		handler(c.t, message)
+	for filter, handler := range c.Subscriptions {
+		if handler != nil && topicMatches(filter, topic) {
+			handler(c.t, topic, message)
+		}
 	}
 }
 
 // IsConnected returns the value of the Connected field
 func (c *MockMQTTClient) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.Connected
 }
 
-// Connect sets the Connected field to true and the ConnectedTo field to the list of servers
+// Connect requests credentials from the CredentialsProvider like a real client would,
+// and then sets the Connected field to true and the ConnectedTo field to the list of servers
 func (c *MockMQTTClient) Connect(ctx context.Context, servers ...string) error {
+	c.emit(ConnectionConnecting, nil)
+	if c.CredentialsProvider != nil {
+		// Request credentials like a real client
+		username, password := c.CredentialsProvider()
+		if c.Authenticate != nil {
+			if err := c.Authenticate(username, password); err != nil {
+				if err == ErrNotAuthorized {
+					c.emit(ConnectionAuthFailed, err)
+				}
+				c.emit(ConnectionDisconnected, err)
+				return err
+			}
+		}
+	}
+	c.mu.Lock()
 	c.Connected = true
 	c.ConnectedTo = servers
+	c.mu.Unlock()
+	c.emit(ConnectionConnected, nil)
 	if c.OnConnectHandler != nil {
 		c.OnConnectHandler(c)
 	}
@@ -61,28 +93,60 @@ func (c *MockMQTTClient) Connect(ctx context.Context, servers ...string) error {
 
 // Disconnect sets the Connected field to false and clears the ConnectedTo field
 func (c *MockMQTTClient) Disconnect(ctx context.Context) error {
+	c.mu.Lock()
 	c.Connected = false
 	c.ConnectedTo = nil
+	c.mu.Unlock()
+	c.emit(ConnectionDisconnected, nil)
 	return nil
 }
 
+// LoseConnection imitates the client losing its connection to the server for testing purposes.
+func (c *MockMQTTClient) LoseConnection(err error) {
+	c.mu.Lock()
+	c.Connected = false
+	c.mu.Unlock()
+	c.emit(ConnectionLost, err)
+}
+
 // Publish adds the given payload to the Messages map under the given topic
+// It returns ErrNotConnected if the client is not connected.
 func (c *MockMQTTClient) Publish(ctx context.Context, topic string, qos uint8, payload interface{}) error {
+	_, err := c.PublishWithID(ctx, topic, qos, payload)
+	return err
+}
+
+// PublishWithID publishes the payload in the same way as Publish.
+// Messages published with a QoS level above 0 are given increasing message IDs.
+func (c *MockMQTTClient) PublishWithID(ctx context.Context, topic string, qos uint8, payload interface{}) (uint16, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.Connected {
+		return 0, ErrNotConnected
+	}
 	l, ok := c.Messages[topic]
 	if !ok {
 		l = make([]interface{}, 0, 1)
 	}
 	c.Messages[topic] = append(l, payload)
-	return nil
+	if qos == 0 {
+		return 0, nil
+	}
+	c.MessageID++
+	if c.MessageID == 0 {
+		// Message ID 0 is not allowed
+		c.MessageID++
+	}
+	return c.MessageID, nil
 }
 
-// Subscribe addes the given ConfigHandler to the Subscriptions map for the given topic
-func (c *MockMQTTClient) Subscribe(ctx context.Context, topic string, qos uint8, callback ConfigHandler) error {
+// Subscribe addes the given MQTTMessageHandler to the Subscriptions map for the given topic
+func (c *MockMQTTClient) Subscribe(ctx context.Context, topic string, qos uint8, callback MQTTMessageHandler) error {
 	c.Subscriptions[topic] = callback
 	return nil
 }
 
-// Unsubscribe removes the ConfigHandler from the Subscriptions map for the given topic
+// Unsubscribe removes the MQTTMessageHandler from the Subscriptions map for the given topic
 func (c *MockMQTTClient) Unsubscribe(ctx context.Context, topic string) error {
 	delete(c.Subscriptions, topic)
 	return nil
@@ -117,3 +181,32 @@ func (c *MockMQTTClient) SetCredentialsProvider(crendentialsProvider MQTTCredent
 func (c *MockMQTTClient) SetOnConnectHandler(handler MQTTOnConnectHandler) {
 	c.OnConnectHandler = handler
 }
+
+// SetConnectionEventHandler sets EventHandler
+func (c *MockMQTTClient) SetConnectionEventHandler(handler MQTTConnectionEventHandler) {
+	c.EventHandler = handler
+}
+
+func (c *MockMQTTClient) emit(eventType ConnectionEventType, err error) {
+	if c.EventHandler != nil {
+		c.EventHandler(ConnectionEvent{Type: eventType, Err: err})
+	}
+}
+
+// topicMatches returns true if the topic matches the given MQTT topic filter.
+func topicMatches(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
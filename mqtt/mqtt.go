@@ -0,0 +1,607 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+// Package mqtt provides a dependency free iot.MQTTClient implementation.
+// It supports MQTT 3.1.1 over TCP or TLS with QoS levels 0 and 1, which is all that Google Cloud IoT Core requires.
+// To use the client, you must import this package.
+//
+// The client does not reconnect automatically. Set ThingOptions.ReconnectPolicy to reconnect after the connection is lost.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/vaelen/iot"
+	"github.com/vaelen/iot/mqtt/packets"
+)
+
+// DefaultKeepAlive is the default interval at which the client pings the server when it is idle.
+var DefaultKeepAlive = time.Minute
+
+// DefaultPorts maps URL schemes to the port that is used if a server address doesn't include one.
+var DefaultPorts = map[string]string{
+	"tcp":   "1883",
+	"mqtt":  "1883",
+	"ssl":   "8883",
+	"tls":   "8883",
+	"mqtts": "8883",
+}
+
+// ErrUnsupportedQOS is returned when publishing with a QoS level higher than 1.
+var ErrUnsupportedQOS = fmt.Errorf("only QoS levels 0 and 1 are supported")
+
+// ErrSubscriptionRejected is returned when the server rejects a subscription.
+var ErrSubscriptionRejected = fmt.Errorf("subscription rejected")
+
+// MQTTClient is an implementation of iot.MQTTClient that doesn't depend on any third party libraries.
+type MQTTClient struct {
+	// KeepAlive is the interval at which the client pings the server when it is idle.
+	KeepAlive time.Duration
+
+	thing                  iot.Thing
+	options                *iot.ThingOptions
+	clientID               string
+	credentialsProvider    iot.MQTTCredentialsProvider
+	onConnectHandler       iot.MQTTOnConnectHandler
+	connectionEventHandler iot.MQTTConnectionEventHandler
+	debugLogger            iot.Logger
+	infoLogger             iot.Logger
+	errorLogger            iot.Logger
+
+	mu        sync.Mutex
+	conn      *connection
+	nextID    uint16
+	handlers  map[string]iot.MQTTMessageHandler
+	writeLock sync.Mutex
+}
+
+// connection holds the state of a single network connection to the server.
+type connection struct {
+	conn    net.Conn
+	pending map[uint16]chan []byte
+	done    chan struct{}
+	closing bool
+
+	// Received messages are queued so that handlers can publish without blocking the reader
+	queue  []*packets.PublishPacket
+	notify chan struct{}
+}
+
+// NewClient creates an MQTTClient instance.
+func NewClient(thing iot.Thing, options *iot.ThingOptions) iot.MQTTClient {
+	return &MQTTClient{
+		KeepAlive: DefaultKeepAlive,
+		thing:     thing,
+		options:   options,
+		handlers:  make(map[string]iot.MQTTMessageHandler),
+	}
+}
+
+// This method is automatically called if the package is included
+func init() {
+	if iot.NewClient == nil {
+		iot.NewClient = NewClient
+	}
+}
+
+// IsConnected returns true when the client is connected to the server
+func (c *MQTTClient) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil && !c.conn.closing
+}
+
+// Connect connects to the first of the given servers that accepts the connection.
+// Server addresses are URLs such as ssl://mqtt.googleapis.com:8883 or tcp://localhost:1883.
+func (c *MQTTClient) Connect(ctx context.Context, servers ...string) error {
+	c.emit(iot.ConnectionConnecting, nil)
+	err := iot.ErrConfigurationError
+	for _, server := range servers {
+		err = c.connect(ctx, server)
+		if err == nil || err == iot.ErrNotAuthorized || err == iot.ErrCancelled {
+			break
+		}
+		c.logf(c.errorLogger, "Couldn't connect to %s: %v", server, err)
+	}
+	if err != nil {
+		if err == iot.ErrNotAuthorized {
+			c.emit(iot.ConnectionAuthFailed, err)
+		}
+		c.emit(iot.ConnectionDisconnected, err)
+		return err
+	}
+
+	c.logf(c.infoLogger, "Connected")
+	c.emit(iot.ConnectionConnected, nil)
+	if c.onConnectHandler != nil {
+		c.onConnectHandler(c)
+	}
+	return nil
+}
+
+func (c *MQTTClient) connect(ctx context.Context, server string) error {
+	network, address, useTLS, err := parseServer(server)
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		if ctx.Err() != nil {
+			return iot.ErrCancelled
+		}
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Unblock the handshake if the context is cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	if useTLS {
+		config := iot.NewTLSConfig(c.options)
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return c.contextError(ctx, err)
+		}
+		conn = tlsConn
+	}
+
+	connect := &packets.ConnectPacket{
+		ClientID:     c.clientID,
+		KeepAlive:    uint16(c.KeepAlive / time.Second),
+		CleanSession: c.options.CleanSession,
+	}
+	if c.credentialsProvider != nil {
+		connect.Username, connect.Password = c.credentialsProvider()
+	}
+	r := bufio.NewReader(conn)
+	if err = packets.WritePacket(conn, packets.Connect, 0, connect.Encode()); err != nil {
+		conn.Close()
+		return c.contextError(ctx, err)
+	}
+	p, err := packets.ReadPacket(r)
+	if err != nil {
+		conn.Close()
+		return c.contextError(ctx, err)
+	}
+	if p.Type != packets.ConnAck {
+		conn.Close()
+		return fmt.Errorf("expected CONNACK, received packet type %d", p.Type)
+	}
+	returnCode, err := packets.DecodeConnAck(p.Body)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	switch returnCode {
+	case packets.Accepted:
+	case packets.RefusedBadUsernameOrPassword, packets.RefusedNotAuthorized:
+		conn.Close()
+		return iot.ErrNotAuthorized
+	default:
+		conn.Close()
+		return fmt.Errorf("connection refused with return code %d", returnCode)
+	}
+	conn.SetDeadline(time.Time{})
+	c.start(conn, r)
+	return nil
+}
+
+// start makes conn the current connection and starts the goroutines that service it.
+func (c *MQTTClient) start(conn net.Conn, r *bufio.Reader) *connection {
+	cn := &connection{
+		conn:    conn,
+		pending: make(map[uint16]chan []byte),
+		done:    make(chan struct{}),
+		notify:  make(chan struct{}, 1),
+	}
+	c.mu.Lock()
+	c.conn = cn
+	c.mu.Unlock()
+	go c.readLoop(cn, r)
+	go c.dispatch(cn)
+	go c.keepAlive(cn)
+	return cn
+}
+
+func (c *MQTTClient) contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return iot.ErrCancelled
+	}
+	return err
+}
+
+// parseServer returns the network, address and whether to use TLS for a server URL.
+func parseServer(server string) (string, string, bool, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", "", false, err
+	}
+	port, ok := DefaultPorts[u.Scheme]
+	if !ok {
+		return "", "", false, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+	useTLS := u.Scheme == "ssl" || u.Scheme == "tls" || u.Scheme == "mqtts"
+	return "tcp", address, useTLS, nil
+}
+
+// Disconnect disconnects from the server.
+// If the DISCONNECT packet can't be written before ctx is done, the connection is closed without it.
+func (c *MQTTClient) Disconnect(ctx context.Context) error {
+	c.mu.Lock()
+	cn := c.conn
+	if cn == nil || cn.closing {
+		c.mu.Unlock()
+		return nil
+	}
+	cn.closing = true
+	c.mu.Unlock()
+
+	// A write that is stalled on a dead connection holds writeLock, so don't wait for it.
+	// Closing the connection unblocks the stalled write.
+	sent := make(chan struct{})
+	go func() {
+		c.write(cn, packets.Disconnect, 0, nil)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-ctx.Done():
+	}
+	cn.conn.Close()
+	<-cn.done
+
+	c.logf(c.infoLogger, "Disconnected")
+	c.emit(iot.ConnectionDisconnected, nil)
+	return nil
+}
+
+// Publish publishes the given payload to the given topic.
+// The payload must be a []byte or a string. QoS levels 0 and 1 are supported.
+func (c *MQTTClient) Publish(ctx context.Context, topic string, qos uint8, payload interface{}) error {
+	_, err := c.PublishWithID(ctx, topic, qos, payload)
+	return err
+}
+
+// PublishWithID publishes the given payload to the given topic and returns the packet ID of the PUBLISH packet.
+// The packet ID is 0 for messages published with QoS 0.
+func (c *MQTTClient) PublishWithID(ctx context.Context, topic string, qos uint8, payload interface{}) (uint16, error) {
+	if qos > 1 {
+		return 0, ErrUnsupportedQOS
+	}
+	var b []byte
+	switch p := payload.(type) {
+	case []byte:
+		b = p
+	case string:
+		b = []byte(p)
+	default:
+		return 0, fmt.Errorf("unsupported payload type: %T", payload)
+	}
+	p := &packets.PublishPacket{Topic: topic, QOS: qos, Payload: b}
+	if qos == 0 {
+		cn, err := c.connection()
+		if err != nil {
+			return 0, err
+		}
+		return 0, c.write(cn, packets.Publish, p.Flags(), p.Encode())
+	}
+	_, err := c.request(ctx, packets.Publish, p.Flags(), func(id uint16) []byte {
+		p.PacketID = id
+		return p.Encode()
+	})
+	return p.PacketID, err
+}
+
+// Subscribe subscribes to the given topic filter.
+// QoS levels higher than 1 are downgraded to 1.
+func (c *MQTTClient) Subscribe(ctx context.Context, topic string, qos uint8, callback iot.MQTTMessageHandler) error {
+	if qos > 1 {
+		qos = 1
+	}
+	c.mu.Lock()
+	c.handlers[topic] = callback
+	c.mu.Unlock()
+	body, err := c.request(ctx, packets.Subscribe, 0x02, func(id uint16) []byte {
+		return packets.EncodeSubscribe(id, packets.Subscription{Filter: topic, QOS: qos})
+	})
+	if err == nil {
+		_, returnCodes, decodeErr := packets.DecodeSubAck(body)
+		if decodeErr != nil {
+			err = decodeErr
+		} else if len(returnCodes) != 1 || returnCodes[0] == packets.SubAckFailure {
+			err = ErrSubscriptionRejected
+		}
+	}
+	if err != nil {
+		c.mu.Lock()
+		delete(c.handlers, topic)
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// Unsubscribe unsubscribes from the given topic filter
+func (c *MQTTClient) Unsubscribe(ctx context.Context, topic string) error {
+	c.mu.Lock()
+	delete(c.handlers, topic)
+	c.mu.Unlock()
+	_, err := c.request(ctx, packets.Unsubscribe, 0x02, func(id uint16) []byte {
+		return packets.EncodeUnsubscribe(id, topic)
+	})
+	return err
+}
+
+// SetDebugLogger sets the logger to use for logging debug messages
+func (c *MQTTClient) SetDebugLogger(logger iot.Logger) {
+	c.debugLogger = logger
+}
+
+// SetInfoLogger sets the logger to use for logging information or warning messages
+func (c *MQTTClient) SetInfoLogger(logger iot.Logger) {
+	c.infoLogger = logger
+}
+
+// SetErrorLogger sets the logger to use for logging error or critical messages
+func (c *MQTTClient) SetErrorLogger(logger iot.Logger) {
+	c.errorLogger = logger
+}
+
+// SetClientID sets the MQTT client id
+func (c *MQTTClient) SetClientID(clientID string) {
+	c.clientID = clientID
+}
+
+// SetCredentialsProvider sets the CredentialsProvider used by the MQTT client
+func (c *MQTTClient) SetCredentialsProvider(credentialsProvider iot.MQTTCredentialsProvider) {
+	c.credentialsProvider = credentialsProvider
+}
+
+// SetOnConnectHandler sets the method that is called after the client connects to the server
+func (c *MQTTClient) SetOnConnectHandler(handler iot.MQTTOnConnectHandler) {
+	c.onConnectHandler = handler
+}
+
+// SetConnectionEventHandler sets the method that is called when the state of the connection changes
+func (c *MQTTClient) SetConnectionEventHandler(handler iot.MQTTConnectionEventHandler) {
+	c.connectionEventHandler = handler
+}
+
+// connection returns the current connection or iot.ErrNotConnected.
+func (c *MQTTClient) connection() (*connection, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil || c.conn.closing {
+		return nil, iot.ErrNotConnected
+	}
+	return c.conn, nil
+}
+
+// request sends a packet with a new packet id and waits for the server to acknowledge it.
+// It returns the body of the acknowledgement.
+func (c *MQTTClient) request(ctx context.Context, packetType byte, flags byte, encode func(id uint16) []byte) ([]byte, error) {
+	c.mu.Lock()
+	cn := c.conn
+	if cn == nil || cn.closing {
+		c.mu.Unlock()
+		return nil, iot.ErrNotConnected
+	}
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	id := c.nextID
+	ack := make(chan []byte, 1)
+	cn.pending[id] = ack
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(cn.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(cn, packetType, flags, encode(id)); err != nil {
+		return nil, err
+	}
+	select {
+	case body, ok := <-ack:
+		if !ok {
+			return nil, iot.ErrNotConnected
+		}
+		return body, nil
+	case <-ctx.Done():
+		return nil, iot.ErrCancelled
+	}
+}
+
+func (c *MQTTClient) write(cn *connection, packetType byte, flags byte, body []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.KeepAlive > 0 {
+		// A write that can't finish within the keepalive interval means the connection is dead
+		cn.conn.SetWriteDeadline(time.Now().Add(c.KeepAlive))
+	}
+	if err := packets.WritePacket(cn.conn, packetType, flags, body); err != nil {
+		cn.conn.Close()
+		return iot.ErrNotConnected
+	}
+	return nil
+}
+
+// readLoop reads packets from the server until the connection is closed.
+func (c *MQTTClient) readLoop(cn *connection, r *bufio.Reader) {
+	var err error
+	for err == nil {
+		if c.KeepAlive > 0 {
+			// The server should respond to pings, so a silent connection is dead
+			cn.conn.SetReadDeadline(time.Now().Add(c.KeepAlive * 3 / 2))
+		}
+		var p *packets.Packet
+		p, err = packets.ReadPacket(r)
+		if err == nil {
+			err = c.handlePacket(cn, p)
+		}
+	}
+	cn.conn.Close()
+
+	c.mu.Lock()
+	closing := cn.closing
+	cn.closing = true
+	if c.conn == cn {
+		c.conn = nil
+	}
+	for id, ack := range cn.pending {
+		close(ack)
+		delete(cn.pending, id)
+	}
+	c.mu.Unlock()
+	close(cn.done)
+
+	if !closing {
+		c.logf(c.errorLogger, "Connection Lost. Error: %v", err)
+		c.emit(iot.ConnectionLost, err)
+	}
+}
+
+func (c *MQTTClient) handlePacket(cn *connection, p *packets.Packet) error {
+	switch p.Type {
+	case packets.Publish:
+		publish, err := packets.DecodePublish(p.Flags, p.Body)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		cn.queue = append(cn.queue, publish)
+		c.mu.Unlock()
+		select {
+		case cn.notify <- struct{}{}:
+		default:
+		}
+		switch publish.QOS {
+		case 1:
+			return c.write(cn, packets.PubAck, 0, packets.EncodePacketID(publish.PacketID))
+		case 2:
+			return c.write(cn, packets.PubRec, 0, packets.EncodePacketID(publish.PacketID))
+		}
+	case packets.PubRel:
+		id, err := packets.DecodePacketID(p.Body)
+		if err != nil {
+			return err
+		}
+		return c.write(cn, packets.PubComp, 0, packets.EncodePacketID(id))
+	case packets.PubAck, packets.SubAck, packets.UnsubAck:
+		id, err := packets.DecodePacketID(p.Body)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		ack, ok := cn.pending[id]
+		c.mu.Unlock()
+		if ok {
+			ack <- p.Body
+		}
+	case packets.PingResp:
+	default:
+		return fmt.Errorf("unexpected packet type %d", p.Type)
+	}
+	return nil
+}
+
+// dispatch delivers queued messages in order until the connection is closed.
+// Messages that are still queued when the connection closes have already been acknowledged, so they are delivered before dispatch returns.
+func (c *MQTTClient) dispatch(cn *connection) {
+	for {
+		select {
+		case <-cn.done:
+			c.drain(cn)
+			return
+		case <-cn.notify:
+			c.drain(cn)
+		}
+	}
+}
+
+// drain delivers queued messages until the queue is empty.
+func (c *MQTTClient) drain(cn *connection) {
+	for {
+		c.mu.Lock()
+		if len(cn.queue) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		p := cn.queue[0]
+		cn.queue = cn.queue[1:]
+		c.mu.Unlock()
+		c.deliver(p)
+	}
+}
+
+// deliver passes a received message to the handlers of all matching subscriptions.
+func (c *MQTTClient) deliver(p *packets.PublishPacket) {
+	c.logf(c.debugLogger, "RECEIVED - Topic: %s, Message Length: %d bytes", p.Topic, len(p.Payload))
+	c.mu.Lock()
+	var handlers []iot.MQTTMessageHandler
+	for filter, handler := range c.handlers {
+		if handler != nil && packets.TopicMatches(filter, p.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.mu.Unlock()
+	for _, handler := range handlers {
+		handler(c.thing, p.Topic, p.Payload)
+	}
+}
+
+// keepAlive pings the server until the connection is closed.
+func (c *MQTTClient) keepAlive(cn *connection) {
+	if c.KeepAlive <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cn.done:
+			return
+		case <-ticker.C:
+			c.write(cn, packets.PingReq, 0, nil)
+		}
+	}
+}
+
+func (c *MQTTClient) emit(eventType iot.ConnectionEventType, err error) {
+	if c.connectionEventHandler != nil {
+		c.connectionEventHandler(iot.ConnectionEvent{Type: eventType, Err: err})
+	}
+}
+
+func (c *MQTTClient) logf(logger iot.Logger, format string, v ...interface{}) {
+	if logger != nil {
+		logger(fmt.Sprintf(format, v...))
+	}
+}
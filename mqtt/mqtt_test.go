@@ -0,0 +1,292 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vaelen/iot"
+	"github.com/vaelen/iot/iottest"
+	"github.com/vaelen/iot/mqtt/packets"
+)
+
+var ID = &iot.ID{
+	DeviceID:  "vaelen_iot_test",
+	Registry:  "x",
+	Location:  "y",
+	ProjectID: "z",
+}
+
+const (
+	ConfigTopic = "/devices/vaelen_iot_test/config"
+	EventsTopic = "/devices/vaelen_iot_test/events"
+	StateTopic  = "/devices/vaelen_iot_test/state"
+)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	iot.NewClient = NewClient
+
+	server := startServer(t)
+	server.SetConfig(ID.DeviceID, []byte("test config"))
+
+	var mu sync.Mutex
+	var commands []string
+	options := getOptions(t)
+	options.CommandHandler = func(thing iot.Thing, subfolder string, command []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		commands = append(commands, subfolder+":"+string(command))
+	}
+	thing := iot.New(options)
+	err := thing.Connect(ctx, server.URL)
+	if err != nil {
+		t.Fatalf("Couldn't connect to server: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+
+	// The config handler publishes the state
+	waitFor(t, server, StateTopic)
+	if string(server.State(ID.DeviceID)) != "ok" {
+		t.Fatalf("Wrong state: %s", server.State(ID.DeviceID))
+	}
+
+	err = thing.PublishEvent(ctx, []byte("telemetry event"))
+	if err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	waitFor(t, server, EventsTopic)
+
+	err = server.SendCommand(ID.DeviceID, "a", []byte("command"))
+	if err != nil {
+		t.Fatalf("Couldn't send command: %v", err)
+	}
+	for i := 0; ; i++ {
+		mu.Lock()
+		received := append([]string{}, commands...)
+		mu.Unlock()
+		if len(received) == 1 && received[0] == "a:command" {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Wrong commands: %v", received)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	client := iot.NewClient(thing, options)
+	if err = client.Publish(ctx, ConfigTopic, 2, []byte("foo")); err != ErrUnsupportedQOS {
+		t.Fatalf("Publishing with QoS 2 didn't fail: %v", err)
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	ctx := context.Background()
+	iot.NewClient = NewClient
+
+	certificate, err := tls.LoadX509KeyPair("../test_keys/server_cert.pem", "../test_keys/server_private.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load server certificate: %v", err)
+	}
+	server := iottest.NewTLSServer(ID.ProjectID, ID.Location, ID.Registry, certificate)
+	defer server.Close()
+
+	options := getOptions(t)
+	server.AddDevice(ID.DeviceID, options.Credentials)
+	thing := iot.New(options)
+	err = thing.Connect(ctx, server.URL)
+	if err == nil {
+		thing.Disconnect(ctx)
+		t.Fatal("Connected to a server with an untrusted certificate")
+	}
+
+	rootCAs, err := iot.LoadRootCAs("../test_keys/ca_cert.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load root CAs: %v", err)
+	}
+	options = getOptions(t)
+	options.RootCAs = rootCAs
+	thing = iot.New(options)
+	err = thing.Connect(ctx, server.URL)
+	if err != nil {
+		t.Fatalf("Couldn't connect to server: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+
+	err = thing.PublishEvent(ctx, []byte("TLS telemetry event"))
+	if err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	waitFor(t, server, EventsTopic)
+}
+
+func TestClientNotAuthorized(t *testing.T) {
+	ctx := context.Background()
+	iot.NewClient = NewClient
+
+	// The device is not registered, so the server rejects its credentials
+	server := iottest.NewServer(ID.ProjectID, ID.Location, ID.Registry)
+	defer server.Close()
+
+	var events []iot.ConnectionEventType
+	options := getOptions(t)
+	options.ConnectionEventHandler = func(thing iot.Thing, event iot.ConnectionEvent) {
+		events = append(events, event.Type)
+	}
+	thing := iot.New(options)
+	err := thing.Connect(ctx, server.URL)
+	if err != iot.ErrNotAuthorized {
+		t.Fatalf("Wrong error: %v", err)
+	}
+	expected := []iot.ConnectionEventType{iot.ConnectionConnecting, iot.ConnectionAuthFailed, iot.ConnectionDisconnected}
+	if len(events) != len(expected) {
+		t.Fatalf("Wrong connection events: %v", events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("Wrong connection events: %v", events)
+		}
+	}
+}
+
+func TestClientConnectionLost(t *testing.T) {
+	ctx := context.Background()
+	iot.NewClient = NewClient
+
+	server := startServer(t)
+
+	lost := make(chan error, 1)
+	options := getOptions(t)
+	options.ConnectionEventHandler = func(thing iot.Thing, event iot.ConnectionEvent) {
+		if event.Type == iot.ConnectionLost {
+			lost <- event.Err
+		}
+	}
+	thing := iot.New(options)
+	err := thing.Connect(ctx, server.URL)
+	if err != nil {
+		t.Fatalf("Couldn't connect to server: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+
+	server.Disconnect(ID.DeviceID)
+	select {
+	case <-lost:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Connection lost event wasn't emitted")
+	}
+	if thing.IsConnected() {
+		t.Fatal("Thing is still connected")
+	}
+	if err = thing.PublishEvent(ctx, []byte("event")); err != iot.ErrNotConnected {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestClientDeliversQueuedMessages(t *testing.T) {
+	client := NewClient(nil, &iot.ThingOptions{}).(*MQTTClient)
+	var received []string
+	client.handlers["#"] = func(thing iot.Thing, topic string, payload []byte) {
+		received = append(received, string(payload))
+	}
+
+	// The messages were acknowledged before the connection closed, so they must still be delivered
+	cn := &connection{done: make(chan struct{}), notify: make(chan struct{}, 1)}
+	expected := []string{"a", "b", "c"}
+	for _, payload := range expected {
+		cn.queue = append(cn.queue, &packets.PublishPacket{Topic: "/t", QOS: 1, Payload: []byte(payload)})
+	}
+	close(cn.done)
+	client.dispatch(cn)
+
+	if len(received) != len(expected) {
+		t.Fatalf("Wrong messages: %v", received)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Fatalf("Wrong messages: %v", received)
+		}
+	}
+}
+
+func TestClientDisconnectStalledWrite(t *testing.T) {
+	client := NewClient(nil, &iot.ThingOptions{}).(*MQTTClient)
+	client.KeepAlive = 0
+	local, remote := net.Pipe()
+	defer remote.Close()
+	client.start(local, bufio.NewReader(local))
+
+	// Nothing reads from the other end of the pipe, so writes never finish
+	published := make(chan error, 1)
+	go func() {
+		published <- client.Publish(context.Background(), "/t", 0, "payload")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	disconnected := make(chan struct{})
+	go func() {
+		client.Disconnect(ctx)
+		close(disconnected)
+	}()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Disconnect was blocked by a stalled write")
+	}
+	select {
+	case err := <-published:
+		if err != iot.ErrNotConnected {
+			t.Fatalf("Wrong error: %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Stalled write wasn't unblocked")
+	}
+}
+
+// startServer starts a server with the test device registered.
+func startServer(t *testing.T) *iottest.Server {
+	server := iottest.NewServer(ID.ProjectID, ID.Location, ID.Registry)
+	t.Cleanup(server.Close)
+	if err := server.AddDevice(ID.DeviceID, getOptions(t).Credentials); err != nil {
+		t.Fatalf("Couldn't add device: %v", err)
+	}
+	return server
+}
+
+func waitFor(t *testing.T, server *iottest.Server, topic string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := server.WaitForMessages(ctx, topic, 1); err != nil {
+		t.Fatalf("Server didn't receive a message on %s", topic)
+	}
+}
+
+func getOptions(t *testing.T) *iot.ThingOptions {
+	ctx := context.Background()
+
+	credentials, err := iot.LoadRSACredentials("../test_keys/rsa_cert.pem", "../test_keys/rsa_private.pem")
+	if err != nil {
+		t.Fatal("Couldn't load credentials")
+	}
+
+	options := iot.DefaultOptions(ID, credentials)
+	options.LogMQTT = true
+	options.DebugLogger = log.Println
+	options.InfoLogger = log.Println
+	options.ErrorLogger = log.Println
+	options.ConfigHandler = func(thing iot.Thing, config []byte) {
+		state := []byte("ok")
+		thing.PublishState(ctx, state)
+	}
+
+	return options
+}
@@ -0,0 +1,384 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+// Package packets encodes and decodes MQTT 3.1.1 control packets.
+// It is used by the native MQTT client and can also be used to implement test servers.
+package packets
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	Connect     byte = 1
+	ConnAck     byte = 2
+	Publish     byte = 3
+	PubAck      byte = 4
+	PubRec      byte = 5
+	PubRel      byte = 6
+	PubComp     byte = 7
+	Subscribe   byte = 8
+	SubAck      byte = 9
+	Unsubscribe byte = 10
+	UnsubAck    byte = 11
+	PingReq     byte = 12
+	PingResp    byte = 13
+	Disconnect  byte = 14
+)
+
+// CONNACK return codes
+const (
+	Accepted                     byte = 0
+	RefusedProtocolVersion       byte = 1
+	RefusedIdentifierRejected    byte = 2
+	RefusedServerUnavailable     byte = 3
+	RefusedBadUsernameOrPassword byte = 4
+	RefusedNotAuthorized         byte = 5
+)
+
+// SubAckFailure is the SUBACK return code for a rejected subscription.
+const SubAckFailure byte = 0x80
+
+// MaxRemainingLength is the largest packet body that can be encoded in an MQTT fixed header.
+const MaxRemainingLength = 268435455
+
+// ErrMalformedPacket is returned when a packet can't be decoded.
+var ErrMalformedPacket = errors.New("malformed MQTT packet")
+
+// Packet is a raw MQTT control packet.
+type Packet struct {
+	// Type is the control packet type, such as Publish.
+	Type byte
+	// Flags are the lower four bits of the fixed header.
+	Flags byte
+	// Body contains the variable header and payload.
+	Body []byte
+}
+
+// ReadPacket reads a single control packet.
+func ReadPacket(r *bufio.Reader) (*Packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return nil, ErrMalformedPacket
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &Packet{Type: header >> 4, Flags: header & 0x0f, Body: body}, nil
+}
+
+// WritePacket writes a single control packet in one call to w.Write.
+func WritePacket(w io.Writer, packetType byte, flags byte, body []byte) error {
+	length := len(body)
+	if length > MaxRemainingLength {
+		return fmt.Errorf("MQTT packet too large: %d bytes", length)
+	}
+	buf := make([]byte, 0, length+5)
+	buf = append(buf, packetType<<4|flags&0x0f)
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+	buf = append(buf, body...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ConnectPacket is the CONNECT packet sent by a client.
+type ConnectPacket struct {
+	ClientID     string
+	Username     string
+	Password     string
+	KeepAlive    uint16
+	CleanSession bool
+}
+
+// Encode returns the body of the packet.
+func (p *ConnectPacket) Encode() []byte {
+	flags := byte(0)
+	if p.Username != "" || p.Password != "" {
+		flags |= 0x80
+	}
+	if p.Password != "" {
+		flags |= 0x40
+	}
+	if p.CleanSession {
+		flags |= 0x02
+	}
+	b := appendString(nil, "MQTT")
+	b = append(b, 4, flags) // protocol level 4 is MQTT 3.1.1
+	b = appendUint16(b, p.KeepAlive)
+	b = appendString(b, p.ClientID)
+	if flags&0x80 != 0 {
+		b = appendString(b, p.Username)
+	}
+	if flags&0x40 != 0 {
+		b = appendString(b, p.Password)
+	}
+	return b
+}
+
+// DecodeConnect decodes the body of a CONNECT packet.
+func DecodeConnect(body []byte) (*ConnectPacket, error) {
+	r := &reader{b: body}
+	if protocol := r.string(); r.err == nil && protocol != "MQTT" {
+		return nil, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+	if level := r.byte(); r.err == nil && level != 4 {
+		return nil, fmt.Errorf("unsupported protocol level: %d", level)
+	}
+	flags := r.byte()
+	p := &ConnectPacket{
+		KeepAlive:    r.uint16(),
+		ClientID:     r.string(),
+		CleanSession: flags&0x02 != 0,
+	}
+	if flags&0x04 != 0 {
+		// Skip the will topic and message
+		r.bytes()
+		r.bytes()
+	}
+	if flags&0x80 != 0 {
+		p.Username = r.string()
+	}
+	if flags&0x40 != 0 {
+		p.Password = r.string()
+	}
+	return p, r.err
+}
+
+// EncodeConnAck returns the body of a CONNACK packet.
+func EncodeConnAck(sessionPresent bool, returnCode byte) []byte {
+	if sessionPresent {
+		return []byte{1, returnCode}
+	}
+	return []byte{0, returnCode}
+}
+
+// DecodeConnAck decodes the body of a CONNACK packet and returns the return code.
+func DecodeConnAck(body []byte) (byte, error) {
+	if len(body) != 2 {
+		return 0, ErrMalformedPacket
+	}
+	return body[1], nil
+}
+
+// PublishPacket is a PUBLISH packet, which can be sent by either the client or the server.
+type PublishPacket struct {
+	Topic    string
+	PacketID uint16
+	QOS      byte
+	Retain   bool
+	Dup      bool
+	Payload  []byte
+}
+
+// Flags returns the fixed header flags of the packet.
+func (p *PublishPacket) Flags() byte {
+	flags := p.QOS << 1
+	if p.Retain {
+		flags |= 0x01
+	}
+	if p.Dup {
+		flags |= 0x08
+	}
+	return flags
+}
+
+// Encode returns the body of the packet.
+func (p *PublishPacket) Encode() []byte {
+	b := appendString(make([]byte, 0, len(p.Topic)+len(p.Payload)+4), p.Topic)
+	if p.QOS > 0 {
+		b = appendUint16(b, p.PacketID)
+	}
+	return append(b, p.Payload...)
+}
+
+// DecodePublish decodes a PUBLISH packet using its fixed header flags and body.
+func DecodePublish(flags byte, body []byte) (*PublishPacket, error) {
+	r := &reader{b: body}
+	p := &PublishPacket{
+		Topic:  r.string(),
+		QOS:    (flags >> 1) & 0x03,
+		Retain: flags&0x01 != 0,
+		Dup:    flags&0x08 != 0,
+	}
+	if p.QOS > 0 {
+		p.PacketID = r.uint16()
+	}
+	if r.err != nil || p.QOS > 2 {
+		return nil, ErrMalformedPacket
+	}
+	p.Payload = r.b
+	return p, nil
+}
+
+// Subscription is a topic filter and the requested QoS level in a SUBSCRIBE packet.
+type Subscription struct {
+	Filter string
+	QOS    byte
+}
+
+// EncodeSubscribe returns the body of a SUBSCRIBE packet.
+func EncodeSubscribe(packetID uint16, subscriptions ...Subscription) []byte {
+	b := appendUint16(nil, packetID)
+	for _, s := range subscriptions {
+		b = appendString(b, s.Filter)
+		b = append(b, s.QOS)
+	}
+	return b
+}
+
+// DecodeSubscribe decodes the body of a SUBSCRIBE packet.
+func DecodeSubscribe(body []byte) (uint16, []Subscription, error) {
+	r := &reader{b: body}
+	packetID := r.uint16()
+	var subscriptions []Subscription
+	for r.err == nil && len(r.b) > 0 {
+		subscriptions = append(subscriptions, Subscription{Filter: r.string(), QOS: r.byte()})
+	}
+	if r.err != nil || len(subscriptions) == 0 {
+		return 0, nil, ErrMalformedPacket
+	}
+	return packetID, subscriptions, nil
+}
+
+// EncodeSubAck returns the body of a SUBACK packet.
+func EncodeSubAck(packetID uint16, returnCodes ...byte) []byte {
+	return append(appendUint16(nil, packetID), returnCodes...)
+}
+
+// DecodeSubAck decodes the body of a SUBACK packet.
+func DecodeSubAck(body []byte) (uint16, []byte, error) {
+	r := &reader{b: body}
+	packetID := r.uint16()
+	return packetID, r.b, r.err
+}
+
+// EncodeUnsubscribe returns the body of an UNSUBSCRIBE packet.
+func EncodeUnsubscribe(packetID uint16, filters ...string) []byte {
+	b := appendUint16(nil, packetID)
+	for _, f := range filters {
+		b = appendString(b, f)
+	}
+	return b
+}
+
+// DecodeUnsubscribe decodes the body of an UNSUBSCRIBE packet.
+func DecodeUnsubscribe(body []byte) (uint16, []string, error) {
+	r := &reader{b: body}
+	packetID := r.uint16()
+	var filters []string
+	for r.err == nil && len(r.b) > 0 {
+		filters = append(filters, r.string())
+	}
+	return packetID, filters, r.err
+}
+
+// EncodePacketID returns the body of PUBACK, PUBREC, PUBREL, PUBCOMP and UNSUBACK packets.
+func EncodePacketID(packetID uint16) []byte {
+	return appendUint16(nil, packetID)
+}
+
+// DecodePacketID decodes the body of PUBACK, PUBREC, PUBREL, PUBCOMP and UNSUBACK packets.
+func DecodePacketID(body []byte) (uint16, error) {
+	r := &reader{b: body}
+	return r.uint16(), r.err
+}
+
+// TopicMatches returns true if the topic matches the MQTT topic filter, which may contain + and # wildcards.
+func TopicMatches(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// reader decodes the fields of a packet body.
+// After the first error, all further reads return zero values.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil || len(r.b) < 2 {
+		r.err = ErrMalformedPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil || len(r.b) < 1 {
+		r.err = ErrMalformedPacket
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) bytes() []byte {
+	n := int(r.uint16())
+	if r.err != nil || len(r.b) < n {
+		r.err = ErrMalformedPacket
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
@@ -0,0 +1,79 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package packets
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	publish := &PublishPacket{Topic: "/devices/a/events", PacketID: 7, QOS: 1, Retain: true, Payload: bytes.Repeat([]byte("x"), 200)}
+	connect := &ConnectPacket{ClientID: "client", Username: "unused", Password: "token", KeepAlive: 60}
+
+	buf := &bytes.Buffer{}
+	WritePacket(buf, Connect, 0, connect.Encode())
+	WritePacket(buf, Publish, publish.Flags(), publish.Encode())
+	WritePacket(buf, Subscribe, 0x02, EncodeSubscribe(8, Subscription{Filter: "/devices/a/config", QOS: 1}))
+	WritePacket(buf, PingReq, 0, nil)
+	r := bufio.NewReader(buf)
+
+	p, err := ReadPacket(r)
+	if err != nil || p.Type != Connect {
+		t.Fatalf("Couldn't read CONNECT: %v", err)
+	}
+	c, err := DecodeConnect(p.Body)
+	if err != nil || *c != *connect {
+		t.Fatalf("Wrong CONNECT: %+v, %v", c, err)
+	}
+
+	p, err = ReadPacket(r)
+	if err != nil || p.Type != Publish {
+		t.Fatalf("Couldn't read PUBLISH: %v", err)
+	}
+	pub, err := DecodePublish(p.Flags, p.Body)
+	if err != nil || pub.Topic != publish.Topic || pub.PacketID != 7 || pub.QOS != 1 || !pub.Retain || pub.Dup || !bytes.Equal(pub.Payload, publish.Payload) {
+		t.Fatalf("Wrong PUBLISH: %+v, %v", pub, err)
+	}
+
+	p, err = ReadPacket(r)
+	if err != nil || p.Type != Subscribe || p.Flags != 0x02 {
+		t.Fatalf("Couldn't read SUBSCRIBE: %v", err)
+	}
+	id, subscriptions, err := DecodeSubscribe(p.Body)
+	if err != nil || id != 8 || len(subscriptions) != 1 || subscriptions[0].Filter != "/devices/a/config" || subscriptions[0].QOS != 1 {
+		t.Fatalf("Wrong SUBSCRIBE: %v, %+v, %v", id, subscriptions, err)
+	}
+
+	p, err = ReadPacket(r)
+	if err != nil || p.Type != PingReq || len(p.Body) != 0 {
+		t.Fatalf("Couldn't read PINGREQ: %v", err)
+	}
+
+	if _, err = DecodePublish(0, []byte{0, 10, 'a'}); err != ErrMalformedPacket {
+		t.Fatalf("Malformed packet was decoded: %v", err)
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter  string
+		topic   string
+		matches bool
+	}{
+		{"/devices/a/config", "/devices/a/config", true},
+		{"/devices/a/config", "/devices/b/config", false},
+		{"/devices/+/config", "/devices/b/config", true},
+		{"/devices/a/commands/#", "/devices/a/commands", true},
+		{"/devices/a/commands/#", "/devices/a/commands/x/y", true},
+		{"/devices/a/commands/+", "/devices/a/commands/x/y", false},
+		{"/devices/a", "/devices/a/config", false},
+	}
+	for _, test := range tests {
+		if matches := TopicMatches(test.filter, test.topic); matches != test.matches {
+			t.Fatalf("%s %s: expected %v, got %v", test.filter, test.topic, test.matches, matches)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package ota
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/vaelen/iot"
+)
+
+// ErrInvalidManifest is returned if a manifest can't be parsed or is missing required fields.
+var ErrInvalidManifest = fmt.Errorf("invalid update manifest")
+
+// ErrInvalidSignature is returned if a manifest wasn't signed by the pinned public key.
+var ErrInvalidSignature = fmt.Errorf("invalid manifest signature")
+
+// Manifest describes an update.
+// The signature covers all of the other fields, and the checksum covers the update itself,
+// so an update is only installed if it was published by the holder of the private key.
+type Manifest struct {
+	// Version is the version of the update.
+	Version string `json:"version"`
+	// URL is the location the update is downloaded from.
+	URL string `json:"url"`
+	// Size is the size of the update in bytes. It is optional, but if it is set, larger downloads are rejected.
+	Size int64 `json:"size,omitempty"`
+	// SHA256 is the hex encoded SHA-256 checksum of the update.
+	SHA256 string `json:"sha256"`
+	// AllowDowngrade allows the update to be installed over a newer version.
+	// Without it, manifests for older versions are rejected so that old manifests can't be replayed.
+	AllowDowngrade bool `json:"allowDowngrade,omitempty"`
+	// Signature is the signature of the manifest, which is base64 encoded in JSON.
+	Signature []byte `json:"signature"`
+}
+
+// ParseManifest parses a JSON encoded manifest.
+// It returns ErrInvalidManifest if the manifest is missing a version, URL, checksum or signature,
+// or if the version or URL contains a newline.
+// The signature is not verified.
+func ParseManifest(data []byte) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, ErrInvalidManifest
+	}
+	if sum, err := hex.DecodeString(m.SHA256); err != nil || len(sum) != sha256.Size {
+		return nil, ErrInvalidManifest
+	}
+	if m.Version == "" || m.URL == "" || m.Size < 0 || len(m.Signature) == 0 || !m.unambiguous() {
+		return nil, ErrInvalidManifest
+	}
+	return m, nil
+}
+
+// Sign sets the signature of the manifest using the publisher's private key.
+// RSA keys produce PKCS #1 v1.5 signatures and EC keys produce ASN.1 encoded ECDSA signatures, both using SHA-256.
+// It returns ErrInvalidManifest if the version, URL or checksum contains a newline.
+func (m *Manifest) Sign(signer crypto.Signer) error {
+	if !m.unambiguous() {
+		return ErrInvalidManifest
+	}
+	digest := m.digest()
+	signature, err := signer.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	m.Signature = signature
+	return nil
+}
+
+// Verify returns ErrInvalidSignature if the manifest wasn't signed by the private key matching the public key.
+// The public key must be an *rsa.PublicKey or an *ecdsa.PublicKey.
+// It returns ErrInvalidManifest if the version, URL or checksum contains a newline.
+func (m *Manifest) Verify(publicKey crypto.PublicKey) error {
+	if !m.unambiguous() {
+		return ErrInvalidManifest
+	}
+	digest := m.digest()
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, m.Signature) != nil {
+			return ErrInvalidSignature
+		}
+	case *ecdsa.PublicKey:
+		signature := struct{ R, S *big.Int }{}
+		if rest, err := asn1.Unmarshal(m.Signature, &signature); err != nil || len(rest) != 0 {
+			return ErrInvalidSignature
+		}
+		if !ecdsa.Verify(key, digest, signature.R, signature.S) {
+			return ErrInvalidSignature
+		}
+	default:
+		return iot.ErrUnsupportedKey
+	}
+	return nil
+}
+
+// unambiguous returns false if one of the signed strings contains a newline.
+// The fields are separated by newlines in the signed data, so a newline could move data from one field to another without changing the signature.
+func (m *Manifest) unambiguous() bool {
+	return !strings.ContainsRune(m.Version+m.URL+m.SHA256, '\n')
+}
+
+// digest returns the SHA-256 digest of the signed fields.
+func (m *Manifest) digest() []byte {
+	data := fmt.Sprintf("%s\n%s\n%d\n%s", m.Version, m.URL, m.Size, m.SHA256)
+	if m.AllowDowngrade {
+		data += "\ndowngrade"
+	}
+	sum := sha256.Sum256([]byte(data))
+	return sum[:]
+}
+
+// ParsePublicKey parses a PEM encoded public key or certificate and returns its public key.
+func ParsePublicKey(publicKeyPEM []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no public key found")
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return certificate.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// LoadPublicKey reads a PEM encoded public key or certificate from a file.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(b)
+}
+
+// compareVersions compares two versions and returns -1, 0 or 1 if a is older than, the same as or newer than b.
+// Versions are split into dot separated parts. Numeric parts are compared as numbers, and other parts are compared as strings.
+func compareVersions(a, b string) int {
+	partsA := strings.Split(a, ".")
+	partsB := strings.Split(b, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		partA, partB := "0", "0"
+		if i < len(partsA) {
+			partA = partsA[i]
+		}
+		if i < len(partsB) {
+			partB = partsB[i]
+		}
+		numberA, errA := strconv.ParseUint(partA, 10, 64)
+		numberB, errB := strconv.ParseUint(partB, 10, 64)
+		switch {
+		case errA == nil && errB == nil && numberA != numberB:
+			if numberA < numberB {
+				return -1
+			}
+			return 1
+		case (errA != nil || errB != nil) && partA != partB:
+			if partA < partB {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
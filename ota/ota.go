@@ -0,0 +1,570 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+// Package ota updates the firmware or software of a device using signed manifests.
+//
+// A Manifest describes an update: its version, the URL it is downloaded from, and its SHA-256 checksum,
+// signed by the publisher's private key. Manifests are usually sent to devices as their config or as a command,
+// so Updater's HandleConfig and HandleCommand methods can be used as a Thing's handlers.
+//
+// Updates are downloaded to a staging directory and interrupted downloads are resumed using HTTP range requests.
+// An update is only installed if the manifest was signed by the pinned public key and the download matches its checksum.
+// It is then installed using the hooks in Options. If the new version fails its health check, the previous version is restored.
+// Versions that fail are remembered in the staging directory and aren't installed again, and manifests for older versions
+// are rejected unless they allow downgrades, so that old manifests can't be replayed.
+//
+// Progress is passed to Options.StatusHandler. Without a StatusHandler, it is published as the device's state,
+// which replaces any state published by the application.
+package ota
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vaelen/iot"
+)
+
+// ErrUpdateInProgress is returned by Update if another update is being installed.
+var ErrUpdateInProgress = fmt.Errorf("an update is already in progress")
+
+// ErrChecksumMismatch is returned if a downloaded update doesn't match the checksum in its manifest.
+var ErrChecksumMismatch = fmt.Errorf("update doesn't match its checksum")
+
+// ErrUpdateTooLarge is returned if a download is larger than the size in its manifest.
+var ErrUpdateTooLarge = fmt.Errorf("update is larger than its manifest allows")
+
+// ErrRolledBack is returned if an update was installed but failed its health check, so the previous version was restored.
+var ErrRolledBack = fmt.Errorf("update failed its health check and was rolled back")
+
+// ErrDowngrade is returned if a manifest is for an older version than the installed version and doesn't allow downgrades.
+var ErrDowngrade = fmt.Errorf("update is older than the installed version")
+
+// ErrVersionFailed is returned if a manifest is for a version that failed to install or was rolled back before.
+var ErrVersionFailed = fmt.Errorf("update failed before and won't be installed again")
+
+// failedVersionsFile is the file in the staging directory that lists the versions that failed.
+const failedVersionsFile = "failed_versions.json"
+
+// Stage is a step in the installation of an update.
+type Stage string
+
+const (
+	// StageDownloading is reported while the update is being downloaded.
+	StageDownloading Stage = "downloading"
+	// StageVerifying is reported while the checksum of the download is being verified.
+	StageVerifying Stage = "verifying"
+	// StageInstalling is reported while the install hooks are running.
+	StageInstalling Stage = "installing"
+	// StageCheckingHealth is reported while the health check is running.
+	StageCheckingHealth Stage = "checking_health"
+	// StageInstalled is reported when the update has been installed.
+	StageInstalled Stage = "installed"
+	// StageRolledBack is reported when the update failed its health check and the previous version was restored.
+	StageRolledBack Stage = "rolled_back"
+	// StageFailed is reported when the update couldn't be installed, or couldn't be rolled back.
+	StageFailed Stage = "failed"
+)
+
+// Status describes the progress of an update.
+type Status struct {
+	// Version is the currently installed version.
+	Version string `json:"version"`
+	// Target is the version being installed.
+	Target string `json:"target,omitempty"`
+	// Stage is the current step of the update.
+	Stage Stage `json:"stage,omitempty"`
+	// Downloaded is the number of bytes that have been downloaded.
+	Downloaded int64 `json:"downloaded,omitempty"`
+	// Size is the size of the update in bytes, if it is known.
+	Size int64 `json:"size,omitempty"`
+	// Error describes why the update failed or was rolled back.
+	Error string `json:"error,omitempty"`
+}
+
+// StatusHandler is called when the status of an update changes.
+type StatusHandler func(thing iot.Thing, status Status)
+
+// InstallHook is called with the path of a downloaded and verified update.
+type InstallHook func(ctx context.Context, manifest *Manifest, path string) error
+
+// CheckHook is called after an update has been installed.
+type CheckHook func(ctx context.Context, manifest *Manifest) error
+
+// RollbackHook restores the previous version after the update described by the manifest failed.
+type RollbackHook func(ctx context.Context, manifest *Manifest, previous string) error
+
+// Options holds the options used to create an Updater.
+type Options struct {
+	// StagingDir is the directory that updates are downloaded to.
+	// It should persist across restarts so that interrupted downloads can be resumed.
+	// This value is required.
+	StagingDir string
+	// PublicKey is the pinned key that manifests must be signed with.
+	// This value is required.
+	PublicKey crypto.PublicKey
+	// Version is the currently installed version. Manifests for this version are ignored,
+	// and manifests for older versions are rejected unless they allow downgrades.
+	Version string
+	// Client is used to download updates. If not provided, http.DefaultClient is used.
+	Client *http.Client
+
+	// PreInstall is called before the update is installed. Returning an error cancels the update.
+	PreInstall InstallHook
+	// Install installs the update from the downloaded file.
+	// This value is required.
+	Install InstallHook
+	// PostInstall is called after the update is installed, such as to restart the application.
+	// If it returns an error, the update is rolled back.
+	PostInstall CheckHook
+	// HealthCheck is called after PostInstall to check that the new version works.
+	// If it returns an error, the update is rolled back.
+	HealthCheck CheckHook
+	// Rollback restores the previous version. If it is nil, failed updates are not rolled back.
+	Rollback RollbackHook
+
+	// StatusHandler is called when the status of an update changes, including each tenth of the download.
+	//
+	// If it is nil, the status is published as the device's state in the form {"ota": status}, except for download progress.
+	// PublishState replaces the whole device state, so this default overwrites any state published by the application,
+	// and the application's state overwrites the status. Applications that publish their own state must provide
+	// a StatusHandler that adds the status to their state.
+	StatusHandler StatusHandler
+}
+
+// Updater downloads, verifies and installs updates.
+// Only one update is installed at a time. If a manifest is received while an update is in progress,
+// the most recent one is installed afterwards.
+type Updater struct {
+	options Options
+
+	mu      sync.Mutex
+	version string
+	failed  map[string]bool
+	busy    bool
+	pending *pendingUpdate
+	// published is the last status published as the device's state when there is no StatusHandler, without its progress.
+	published Status
+}
+
+// pendingUpdate is an update that was received while another update was in progress.
+type pendingUpdate struct {
+	thing    iot.Thing
+	manifest *Manifest
+}
+
+// New returns an Updater using the given options.
+// It returns iot.ErrConfigurationError if a required value is missing.
+func New(options *Options) (*Updater, error) {
+	if options == nil || options.StagingDir == "" || options.PublicKey == nil || options.Install == nil {
+		return nil, iot.ErrConfigurationError
+	}
+	if err := os.MkdirAll(options.StagingDir, 0700); err != nil {
+		return nil, err
+	}
+	u := &Updater{
+		options: *options,
+		version: options.Version,
+		failed:  make(map[string]bool),
+	}
+	b, err := ioutil.ReadFile(filepath.Join(options.StagingDir, failedVersionsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var versions []string
+		if err = json.Unmarshal(b, &versions); err != nil {
+			return nil, err
+		}
+		for _, version := range versions {
+			u.failed[version] = true
+		}
+	}
+	return u, nil
+}
+
+// Version returns the currently installed version.
+func (u *Updater) Version() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.version
+}
+
+// HandleConfig installs the update described by the config, which must be a manifest.
+// It can be used as ThingOptions.ConfigHandler. Empty configs are ignored.
+// The update is installed in the background so that the handler doesn't block the Thing.
+func (u *Updater) HandleConfig(thing iot.Thing, config []byte) {
+	if len(config) == 0 {
+		return
+	}
+	u.handleManifest(thing, config)
+}
+
+// HandleCommand installs the update described by the command, which must be a manifest.
+// It can be used as ThingOptions.CommandHandler or registered with a CommandMux.
+// The update is installed in the background so that the handler doesn't block the Thing.
+func (u *Updater) HandleCommand(thing iot.Thing, subfolder string, command []byte) {
+	u.handleManifest(thing, command)
+}
+
+// handleManifest installs the update described by a manifest in the background.
+// Manifests for the installed version, older versions and versions that failed are ignored,
+// because configs are delivered again each time the Thing connects.
+func (u *Updater) handleManifest(thing iot.Thing, payload []byte) {
+	manifest, err := ParseManifest(payload)
+	if err != nil {
+		u.report(thing, Status{Stage: StageFailed, Error: err.Error()})
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.busy {
+		u.pending = &pendingUpdate{thing: thing, manifest: manifest}
+		return
+	}
+	if install, _ := u.check(manifest); !install {
+		return
+	}
+	u.busy = true
+	go u.run(thing, manifest)
+}
+
+// Update downloads, verifies and installs the update described by the manifest and returns when it is finished.
+// It returns nil if the version is already installed and ErrUpdateInProgress if another update is being installed.
+// It returns ErrDowngrade if the version is older than the installed version and ErrVersionFailed if it failed before.
+func (u *Updater) Update(ctx context.Context, thing iot.Thing, manifest *Manifest) error {
+	u.mu.Lock()
+	if u.busy {
+		u.mu.Unlock()
+		return ErrUpdateInProgress
+	}
+	if install, err := u.check(manifest); !install {
+		u.mu.Unlock()
+		return err
+	}
+	u.busy = true
+	u.mu.Unlock()
+
+	err := u.update(ctx, thing, manifest)
+	u.finish()
+	return err
+}
+
+// run installs an update in the background.
+func (u *Updater) run(thing iot.Thing, manifest *Manifest) {
+	u.update(context.Background(), thing, manifest)
+	u.finish()
+}
+
+// finish marks the current update as finished and starts the pending update, if there is one.
+func (u *Updater) finish() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	pending := u.pending
+	u.pending = nil
+	if pending == nil {
+		u.busy = false
+		return
+	}
+	if install, _ := u.check(pending.manifest); !install {
+		u.busy = false
+		return
+	}
+	go u.run(pending.thing, pending.manifest)
+}
+
+// check returns true if the update described by the manifest should be installed.
+// If it shouldn't, the error explains why. The error is nil if the version is already installed.
+// The manifest's signature is verified later, so AllowDowngrade is only trusted if the signature is valid.
+// The caller must hold the lock.
+func (u *Updater) check(manifest *Manifest) (bool, error) {
+	if manifest.Version == u.version {
+		return false, nil
+	}
+	if u.failed[manifest.Version] {
+		return false, ErrVersionFailed
+	}
+	if !manifest.AllowDowngrade && compareVersions(manifest.Version, u.version) < 0 {
+		return false, ErrDowngrade
+	}
+	return true, nil
+}
+
+// recordFailure remembers that a version failed so that it isn't installed again.
+// The failed versions are persisted in the staging directory. If they can't be written,
+// the version is still ignored until the Updater is recreated.
+func (u *Updater) recordFailure(version string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failed[version] = true
+	versions := make([]string, 0, len(u.failed))
+	for v := range u.failed {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	b, err := json.Marshal(versions)
+	if err != nil {
+		return
+	}
+	path := filepath.Join(u.options.StagingDir, failedVersionsFile)
+	if ioutil.WriteFile(path+".tmp", b, 0600) == nil {
+		os.Rename(path+".tmp", path)
+	}
+}
+
+func (u *Updater) update(ctx context.Context, thing iot.Thing, manifest *Manifest) error {
+	status := Status{Target: manifest.Version, Size: manifest.Size}
+	fail := func(stage Stage, err error) error {
+		status.Stage = stage
+		status.Error = err.Error()
+		u.report(thing, status)
+		return err
+	}
+
+	if err := manifest.Verify(u.options.PublicKey); err != nil {
+		return fail(StageFailed, err)
+	}
+	path, err := u.download(ctx, thing, manifest, &status)
+	if err != nil {
+		return fail(StageFailed, err)
+	}
+	defer os.Remove(path)
+
+	status.Stage = StageInstalling
+	u.report(thing, status)
+	if u.options.PreInstall != nil {
+		if err = u.options.PreInstall(ctx, manifest, path); err != nil {
+			return fail(StageFailed, err)
+		}
+	}
+	if err = u.options.Install(ctx, manifest, path); err != nil {
+		u.recordFailure(manifest.Version)
+		return fail(StageFailed, err)
+	}
+	if u.options.PostInstall != nil {
+		err = u.options.PostInstall(ctx, manifest)
+	}
+	if err == nil && u.options.HealthCheck != nil {
+		status.Stage = StageCheckingHealth
+		u.report(thing, status)
+		err = u.options.HealthCheck(ctx, manifest)
+	}
+	if err != nil {
+		return u.rollback(ctx, thing, manifest, &status, err)
+	}
+
+	u.mu.Lock()
+	u.version = manifest.Version
+	u.mu.Unlock()
+	status.Stage = StageInstalled
+	u.report(thing, status)
+	return nil
+}
+
+// rollback restores the previous version after an installed update failed.
+func (u *Updater) rollback(ctx context.Context, thing iot.Thing, manifest *Manifest, status *Status, cause error) error {
+	u.recordFailure(manifest.Version)
+	status.Error = cause.Error()
+	if u.options.Rollback == nil {
+		status.Stage = StageFailed
+		u.report(thing, *status)
+		return cause
+	}
+	if err := u.options.Rollback(ctx, manifest, u.Version()); err != nil {
+		status.Stage = StageFailed
+		status.Error = fmt.Sprintf("%v (rollback failed: %v)", cause, err)
+		u.report(thing, *status)
+		return err
+	}
+	status.Stage = StageRolledBack
+	u.report(thing, *status)
+	return ErrRolledBack
+}
+
+// download downloads the update to the staging directory and verifies its checksum.
+// It returns the path of the downloaded file. If a previous download was interrupted, it is resumed.
+func (u *Updater) download(ctx context.Context, thing iot.Thing, manifest *Manifest, status *Status) (string, error) {
+	name := strings.ToLower(manifest.SHA256)
+	path := filepath.Join(u.options.StagingDir, name+".update")
+	partial := filepath.Join(u.options.StagingDir, name+".partial")
+	if _, err := os.Stat(path); err == nil {
+		return path, u.verify(thing, manifest, path, status)
+	}
+
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := info.Size()
+	if manifest.Size > 0 && offset > manifest.Size {
+		if err = f.Truncate(0); err != nil {
+			return "", err
+		}
+		offset = 0
+	}
+
+	status.Stage = StageDownloading
+	status.Downloaded = offset
+	u.report(thing, *status)
+	if manifest.Size == 0 || offset < manifest.Size {
+		if err = u.fetch(ctx, thing, manifest, f, offset, status); err != nil {
+			return "", err
+		}
+	}
+	if err = f.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Rename(partial, path); err != nil {
+		return "", err
+	}
+	return path, u.verify(thing, manifest, path, status)
+}
+
+// fetch requests the update starting at the given offset and appends it to the file.
+func (u *Updater) fetch(ctx context.Context, thing iot.Thing, manifest *Manifest, f *os.File, offset int64, status *Status) error {
+	request, err := http.NewRequest(http.MethodGet, manifest.URL, nil)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	if offset > 0 {
+		request.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	client := u.options.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusPartialContent && offset > 0 &&
+		strings.HasPrefix(response.Header.Get("Content-Range"), "bytes "+strconv.FormatInt(offset, 10)+"-"):
+	case response.StatusCode == http.StatusOK:
+		// The server doesn't support resuming, so start again
+		if err = f.Truncate(0); err != nil {
+			return err
+		}
+		offset = 0
+	case offset > 0:
+		// The partial download can't be resumed, such as when the range is past the end of the update, so start again
+		response.Body.Close()
+		if err = f.Truncate(0); err != nil {
+			return err
+		}
+		return u.fetch(ctx, thing, manifest, f, 0, status)
+	default:
+		return fmt.Errorf("couldn't download update: %s", response.Status)
+	}
+	if status.Size == 0 && response.ContentLength > 0 {
+		status.Size = offset + response.ContentLength
+	}
+
+	var body io.Reader = response.Body
+	if manifest.Size > 0 {
+		// Read one byte more than expected so that a larger download is detected without filling the disk
+		body = io.LimitReader(response.Body, manifest.Size-offset+1)
+	}
+	w := &progressWriter{w: f, thing: thing, updater: u, status: status}
+	status.Downloaded = offset
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return err
+	}
+	if manifest.Size > 0 && offset+n > manifest.Size {
+		f.Truncate(0)
+		return ErrUpdateTooLarge
+	}
+	return nil
+}
+
+// verify checks the checksum of a downloaded update. Updates that don't match are deleted.
+func (u *Updater) verify(thing iot.Thing, manifest *Manifest, path string, status *Status) error {
+	status.Stage = StageVerifying
+	u.report(thing, *status)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != strings.ToLower(manifest.SHA256) {
+		os.Remove(path)
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// report passes the status to the StatusHandler, or publishes it as the device's state unless only the progress has changed.
+func (u *Updater) report(thing iot.Thing, status Status) {
+	status.Version = u.Version()
+	if u.options.StatusHandler != nil {
+		u.options.StatusHandler(thing, status)
+		return
+	}
+	if thing == nil {
+		return
+	}
+	// Download progress isn't published, because each state replaces the application's state
+	published := status
+	published.Downloaded = 0
+	u.mu.Lock()
+	changed := published != u.published
+	u.published = published
+	u.mu.Unlock()
+	if !changed {
+		return
+	}
+	state, err := json.Marshal(struct {
+		OTA Status `json:"ota"`
+	}{status})
+	if err != nil {
+		return
+	}
+	thing.PublishState(context.Background(), state)
+}
+
+// progressWriter reports download progress each time another tenth of the update has been written.
+type progressWriter struct {
+	w        io.Writer
+	thing    iot.Thing
+	updater  *Updater
+	status   *Status
+	reported int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.status.Downloaded += int64(n)
+	if p.status.Size > 0 {
+		tenths := p.status.Downloaded * 10 / p.status.Size
+		if tenths > p.reported {
+			p.reported = tenths
+			p.updater.report(p.thing, *p.status)
+		}
+	}
+	return n, err
+}
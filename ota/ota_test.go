@@ -0,0 +1,401 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package ota
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vaelen/iot"
+	"github.com/vaelen/iot/iottest"
+	"github.com/vaelen/iot/mqtt"
+)
+
+var ID = &iot.ID{
+	DeviceID:  "vaelen_iot_test",
+	Registry:  "x",
+	Location:  "y",
+	ProjectID: "z",
+}
+
+var firmware = bytes.Repeat([]byte("firmware"), 10000)
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	firmwareServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "firmware.bin", time.Time{}, bytes.NewReader(firmware))
+	}))
+	defer firmwareServer.Close()
+
+	var installed []byte
+	options := getOptions(t)
+	options.Install = func(ctx context.Context, manifest *Manifest, path string) error {
+		var err error
+		installed, err = ioutil.ReadFile(path)
+		return err
+	}
+	updater, err := New(options)
+	if err != nil {
+		t.Fatalf("Couldn't create updater: %v", err)
+	}
+
+	server := iottest.NewServer(ID.ProjectID, ID.Location, ID.Registry)
+	defer server.Close()
+	credentials, err := iot.LoadRSACredentials("../test_keys/rsa_cert.pem", "../test_keys/rsa_private.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load credentials: %v", err)
+	}
+	server.AddDevice(ID.DeviceID, credentials)
+	manifest, _ := json.Marshal(signedManifest(t, "2.0", firmwareServer.URL+"/firmware.bin", firmware, "../test_keys/rsa_private.pem"))
+	server.SetConfig(ID.DeviceID, manifest)
+
+	thingOptions := iot.DefaultOptions(ID, credentials)
+	thingOptions.NewClient = mqtt.NewClient
+	thingOptions.StateRateLimit = iot.RateLimit{}
+	thingOptions.ConfigHandler = updater.HandleConfig
+	thing := iot.New(thingOptions)
+	if err = thing.Connect(ctx, server.URL); err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+
+	// Progress is published as the device's state
+	for i := 0; !strings.Contains(string(server.State(ID.DeviceID)), `"stage":"installed"`); i++ {
+		if i == 500 {
+			t.Fatalf("Update wasn't installed: %s", server.State(ID.DeviceID))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if state := string(server.State(ID.DeviceID)); !strings.Contains(state, `"version":"2.0"`) {
+		t.Fatalf("Wrong state: %s", state)
+	}
+	if !bytes.Equal(installed, firmware) || updater.Version() != "2.0" {
+		t.Fatalf("Update wasn't installed. Version: %s, Size: %d", updater.Version(), len(installed))
+	}
+	if files, _ := ioutil.ReadDir(options.StagingDir); len(files) != 0 {
+		t.Fatalf("Staging directory wasn't cleaned up: %v", files)
+	}
+}
+
+func TestUpdateResume(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	var ranges []string
+	firmwareServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		first := len(ranges) == 1
+		mu.Unlock()
+		if first {
+			// Simulate a connection that is lost half way through the download
+			w.Header().Set("Content-Length", "80000")
+			w.Write(firmware[:40000])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "firmware.bin", time.Time{}, bytes.NewReader(firmware))
+	}))
+	defer firmwareServer.Close()
+
+	var statuses []Status
+	var installed []byte
+	options := getOptions(t)
+	options.StatusHandler = func(thing iot.Thing, status Status) {
+		statuses = append(statuses, status)
+	}
+	options.Install = func(ctx context.Context, manifest *Manifest, path string) error {
+		var err error
+		installed, err = ioutil.ReadFile(path)
+		return err
+	}
+	updater, err := New(options)
+	if err != nil {
+		t.Fatalf("Couldn't create updater: %v", err)
+	}
+
+	manifest := signedManifest(t, "2.0", firmwareServer.URL, firmware, "../test_keys/rsa_private.pem")
+	if err = updater.Update(ctx, nil, manifest); err == nil {
+		t.Fatal("Interrupted download didn't fail")
+	}
+	partial, err := ioutil.ReadFile(filepath.Join(options.StagingDir, manifest.SHA256+".partial"))
+	if err != nil || len(partial) == 0 {
+		t.Fatalf("Partial download wasn't kept: %v", err)
+	}
+
+	if err = updater.Update(ctx, nil, manifest); err != nil {
+		t.Fatalf("Couldn't resume download: %v", err)
+	}
+	if len(ranges) != 2 || ranges[1] != "bytes="+strconv.Itoa(len(partial))+"-" {
+		t.Fatalf("Download wasn't resumed: %v", ranges)
+	}
+	if !bytes.Equal(installed, firmware) {
+		t.Fatalf("Wrong update installed: %d bytes", len(installed))
+	}
+	last := statuses[len(statuses)-1]
+	if last.Stage != StageInstalled || last.Version != "2.0" || last.Downloaded != int64(len(firmware)) {
+		t.Fatalf("Wrong final status: %+v", last)
+	}
+
+	// Partial downloads that can't be resumed are started again, such as a complete download
+	// that wasn't renamed when the manifest doesn't include the size
+	manifest = signedManifest(t, "3.0", firmwareServer.URL, firmware, "../test_keys/rsa_private.pem")
+	manifest.Size = 0
+	signManifest(t, manifest, "../test_keys/rsa_private.pem")
+	path := filepath.Join(options.StagingDir, manifest.SHA256+".partial")
+	if err = ioutil.WriteFile(path, firmware, 0600); err != nil {
+		t.Fatalf("Couldn't write partial download: %v", err)
+	}
+	if err = updater.Update(ctx, nil, manifest); err != nil {
+		t.Fatalf("Couldn't restart download: %v", err)
+	}
+	if len(ranges) != 4 || ranges[2] != "bytes="+strconv.Itoa(len(firmware))+"-" || ranges[3] != "" {
+		t.Fatalf("Download wasn't restarted: %v", ranges)
+	}
+	if !bytes.Equal(installed, firmware) {
+		t.Fatalf("Wrong update installed: %d bytes", len(installed))
+	}
+}
+
+func TestUpdateRejected(t *testing.T) {
+	ctx := context.Background()
+	firmwareServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(firmware)
+	}))
+	defer firmwareServer.Close()
+
+	installed := false
+	options := getOptions(t)
+	options.Install = func(ctx context.Context, manifest *Manifest, path string) error {
+		installed = true
+		return nil
+	}
+	updater, err := New(options)
+	if err != nil {
+		t.Fatalf("Couldn't create updater: %v", err)
+	}
+
+	// The manifest must be signed by the pinned key
+	manifest := signedManifest(t, "2.0", firmwareServer.URL, firmware, "../test_keys/ec_private.pem")
+	if err = updater.Update(ctx, nil, manifest); err != ErrInvalidSignature {
+		t.Fatalf("Wrong error for a manifest signed by another key: %v", err)
+	}
+	manifest = signedManifest(t, "2.0", firmwareServer.URL, firmware, "../test_keys/rsa_private.pem")
+	manifest.Version = "3.0"
+	if err = updater.Update(ctx, nil, manifest); err != ErrInvalidSignature {
+		t.Fatalf("Wrong error for a modified manifest: %v", err)
+	}
+
+	// The download can't be larger than the size in the manifest
+	manifest = signedManifest(t, "2.0", firmwareServer.URL, []byte("other firmware"), "../test_keys/rsa_private.pem")
+	if err = updater.Update(ctx, nil, manifest); err != ErrUpdateTooLarge {
+		t.Fatalf("Wrong error for a download that is too large: %v", err)
+	}
+
+	// The download must match the checksum
+	manifest.Size = int64(len(firmware))
+	signManifest(t, manifest, "../test_keys/rsa_private.pem")
+	if err = updater.Update(ctx, nil, manifest); err != ErrChecksumMismatch {
+		t.Fatalf("Wrong error for a download that doesn't match the checksum: %v", err)
+	}
+	if installed || updater.Version() != "1.0" {
+		t.Fatal("Rejected update was installed")
+	}
+	if files, _ := ioutil.ReadDir(options.StagingDir); len(files) != 0 {
+		t.Fatalf("Rejected download wasn't deleted: %v", files)
+	}
+
+	if _, err = ParseManifest([]byte(`{"version":"2.0","url":"http://example.com","sha256":"1234","signature":"AA=="}`)); err != ErrInvalidManifest {
+		t.Fatalf("Wrong error for an invalid checksum: %v", err)
+	}
+
+	// Newlines separate the signed fields, so they can't be part of them
+	manifest = signedManifest(t, "2.0", firmwareServer.URL, firmware, "../test_keys/rsa_private.pem")
+	manifest.Version += "\n" + manifest.URL
+	if _, err = ParseManifest(mustMarshal(t, manifest)); err != ErrInvalidManifest {
+		t.Fatalf("Wrong error for a version containing a newline: %v", err)
+	}
+	if err = updater.Update(ctx, nil, manifest); err != ErrInvalidManifest {
+		t.Fatalf("Wrong error for a version containing a newline: %v", err)
+	}
+
+	// Older versions are only installed if the signed manifest allows downgrades
+	manifest = signedManifest(t, "0.9", firmwareServer.URL, firmware, "../test_keys/rsa_private.pem")
+	if err = updater.Update(ctx, nil, manifest); err != ErrDowngrade || installed {
+		t.Fatalf("Wrong error for an older version: %v", err)
+	}
+	manifest.AllowDowngrade = true
+	if err = updater.Update(ctx, nil, manifest); err != ErrInvalidSignature || installed {
+		t.Fatalf("Wrong error for a manifest that was modified to allow downgrades: %v", err)
+	}
+	signManifest(t, manifest, "../test_keys/rsa_private.pem")
+	if err = updater.Update(ctx, nil, manifest); err != nil || !installed || updater.Version() != "0.9" {
+		t.Fatalf("Couldn't downgrade. Version: %s, Error: %v", updater.Version(), err)
+	}
+}
+
+func TestUpdateRollback(t *testing.T) {
+	ctx := context.Background()
+	firmwareServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(firmware)
+	}))
+	defer firmwareServer.Close()
+
+	var hooks []string
+	var statuses []Status
+	options := getOptions(t)
+	options.PreInstall = func(ctx context.Context, manifest *Manifest, path string) error {
+		hooks = append(hooks, "pre-install "+manifest.Version)
+		return nil
+	}
+	options.Install = func(ctx context.Context, manifest *Manifest, path string) error {
+		hooks = append(hooks, "install "+manifest.Version)
+		return nil
+	}
+	options.PostInstall = func(ctx context.Context, manifest *Manifest) error {
+		hooks = append(hooks, "post-install "+manifest.Version)
+		return nil
+	}
+	options.HealthCheck = func(ctx context.Context, manifest *Manifest) error {
+		hooks = append(hooks, "health check "+manifest.Version)
+		return iot.ErrNotConnected
+	}
+	options.Rollback = func(ctx context.Context, manifest *Manifest, previous string) error {
+		hooks = append(hooks, "rollback "+manifest.Version+" to "+previous)
+		return nil
+	}
+	options.StatusHandler = func(thing iot.Thing, status Status) {
+		statuses = append(statuses, status)
+	}
+	updater, err := New(options)
+	if err != nil {
+		t.Fatalf("Couldn't create updater: %v", err)
+	}
+
+	manifest := signedManifest(t, "2.0", firmwareServer.URL, firmware, "../test_keys/rsa_private.pem")
+	if err = updater.Update(ctx, nil, manifest); err != ErrRolledBack {
+		t.Fatalf("Wrong error for an update that failed its health check: %v", err)
+	}
+	expected := []string{"pre-install 2.0", "install 2.0", "post-install 2.0", "health check 2.0", "rollback 2.0 to 1.0"}
+	if strings.Join(hooks, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Wrong hooks called: %v", hooks)
+	}
+	last := statuses[len(statuses)-1]
+	if last.Stage != StageRolledBack || last.Version != "1.0" || last.Error != iot.ErrNotConnected.Error() {
+		t.Fatalf("Wrong final status: %+v", last)
+	}
+
+	// Versions that were rolled back aren't installed again, even after restarting
+	if err = updater.Update(ctx, nil, manifest); err != ErrVersionFailed {
+		t.Fatalf("Wrong error for a version that was rolled back: %v", err)
+	}
+	updater, err = New(options)
+	if err != nil {
+		t.Fatalf("Couldn't create updater: %v", err)
+	}
+	updater.HandleConfig(nil, mustMarshal(t, manifest))
+	if err = updater.Update(ctx, nil, manifest); err != ErrVersionFailed {
+		t.Fatalf("Wrong error for a version that was rolled back before restarting: %v", err)
+	}
+	if len(hooks) != len(expected) {
+		t.Fatalf("Failed update was installed again: %v", hooks)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1", 0},
+		{"1.2", "1.10", -1},
+		{"2.0", "1.10.3", 1},
+		{"1.0.0-rc1", "1.0.0-rc2", -1},
+		{"1.0.a", "1.0.1", 1},
+	} {
+		if result := compareVersions(test.a, test.b); result != test.expected {
+			t.Fatalf("Wrong comparison of %s and %s: %d", test.a, test.b, result)
+		}
+	}
+}
+
+func TestManifestEC(t *testing.T) {
+	manifest := signedManifest(t, "2.0", "http://example.com/firmware.bin", firmware, "../test_keys/ec_private.pem")
+	publicKey, err := LoadPublicKey("../test_keys/ec_cert.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load public key: %v", err)
+	}
+	if err = manifest.Verify(publicKey); err != nil {
+		t.Fatalf("Couldn't verify manifest: %v", err)
+	}
+	b, _ := json.Marshal(manifest)
+	parsed, err := ParseManifest(b)
+	if err != nil {
+		t.Fatalf("Couldn't parse manifest: %v", err)
+	}
+	parsed.URL = "http://example.com/other.bin"
+	if err = parsed.Verify(publicKey); err != ErrInvalidSignature {
+		t.Fatalf("Wrong error for a modified manifest: %v", err)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Couldn't encode value: %v", err)
+	}
+	return b
+}
+
+func getOptions(t *testing.T) *Options {
+	publicKey, err := LoadPublicKey("../test_keys/rsa_cert.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load public key: %v", err)
+	}
+	return &Options{
+		StagingDir: t.TempDir(),
+		PublicKey:  publicKey,
+		Version:    "1.0",
+	}
+}
+
+// signedManifest returns a manifest for the update signed by the private key.
+func signedManifest(t *testing.T, version string, url string, update []byte, privateKeyPath string) *Manifest {
+	sum := sha256.Sum256(update)
+	manifest := &Manifest{
+		Version: version,
+		URL:     url,
+		Size:    int64(len(update)),
+		SHA256:  hex.EncodeToString(sum[:]),
+	}
+	signManifest(t, manifest, privateKeyPath)
+	return manifest
+}
+
+// signManifest signs the manifest again after it has been modified.
+func signManifest(t *testing.T, manifest *Manifest, privateKeyPath string) {
+	b, err := ioutil.ReadFile(privateKeyPath)
+	if err != nil {
+		t.Fatalf("Couldn't read private key: %v", err)
+	}
+	signer, err := iot.ParsePrivateKey(b, nil)
+	if err != nil {
+		t.Fatalf("Couldn't parse private key: %v", err)
+	}
+	if err = manifest.Sign(signer); err != nil {
+		t.Fatalf("Couldn't sign manifest: %v", err)
+	}
+}
@@ -0,0 +1,379 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// outboxDirectory is the subdirectory of ThingOptions.QueueDirectory used to persist the outbox.
+const outboxDirectory = "outbox"
+
+// outboxFileSuffix is the suffix of files that hold outbox messages.
+const outboxFileSuffix = ".msg"
+
+// outboxStateFileSuffix is the suffix of files that hold the latest state for a topic.
+const outboxStateFileSuffix = ".state"
+
+// DropPolicy determines which message is dropped when the outbox is full.
+type DropPolicy uint8
+
+const (
+	// DropOldest drops the oldest message in the outbox to make room for the new message.
+	DropOldest DropPolicy = 0
+	// DropNewest rejects the new message. Publish will return ErrOutboxFull.
+	DropNewest DropPolicy = 1
+)
+
+// OutboxStats describes the state of a Thing's outbox.
+type OutboxStats struct {
+	// Depth is the number of messages waiting to be sent, including state messages.
+	Depth int
+	// Dropped is the number of messages that were dropped because the outbox was full.
+	Dropped uint64
+	// Expired is the number of messages that were dropped because they were older than OutboxMaxAge.
+	Expired uint64
+}
+
+// outboxMessage is a message waiting in the outbox.
+type outboxMessage struct {
+	Topic   string    `json:"topic"`
+	QOS     uint8     `json:"qos"`
+	Time    time.Time `json:"time"`
+	State   bool      `json:"state,omitempty"`
+	Payload []byte    `json:"-"`
+	seq     uint64
+}
+
+// outbox buffers messages that are published while the Thing is offline.
+// If a directory is given, messages are persisted so they survive restarts.
+//
+// Events are kept in order. Only the latest state is kept for each state topic, replacing any
+// state that is already waiting. Queued state isn't replayed by itself. Instead, it is loaded into the
+// stateManager for its topic, which publishes it after reconnecting and then removes it from the outbox.
+type outbox struct {
+	mu          sync.Mutex
+	dir         string
+	maxMessages int
+	maxAge      time.Duration
+	policy      DropPolicy
+	clock       clock.Clock
+	messages    []*outboxMessage
+	states      map[string]*outboxMessage
+	nextSeq     uint64
+	dropped     uint64
+	expired     uint64
+	replaying   bool
+}
+
+// newOutbox creates an outbox and loads any messages that were persisted in dir.
+func newOutbox(dir string, maxMessages int, maxAge time.Duration, policy DropPolicy, c clock.Clock) (*outbox, error) {
+	o := &outbox{
+		dir:         dir,
+		maxMessages: maxMessages,
+		maxAge:      maxAge,
+		policy:      policy,
+		clock:       c,
+		states:      make(map[string]*outboxMessage),
+	}
+	if dir == "" {
+		return o, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return o, o.load()
+}
+
+// push adds a message to the end of the outbox.
+func (o *outbox) push(topic string, qos uint8, payload []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.expire()
+	if err := o.makeRoom(); err != nil {
+		return err
+	}
+	m := &outboxMessage{
+		Topic:   topic,
+		QOS:     qos,
+		Time:    o.clock.Now(),
+		Payload: payload,
+		seq:     o.nextSeq,
+	}
+	if err := o.write(o.filename(m.seq), m); err != nil {
+		return err
+	}
+	o.nextSeq++
+	o.messages = append(o.messages, m)
+	return nil
+}
+
+// pushState stores the latest state for a topic, replacing any state that is already waiting for it.
+func (o *outbox) pushState(topic string, qos uint8, payload []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.expire()
+	if _, ok := o.states[topic]; !ok {
+		if err := o.makeRoom(); err != nil {
+			return err
+		}
+	}
+	m := &outboxMessage{
+		Topic:   topic,
+		QOS:     qos,
+		Time:    o.clock.Now(),
+		State:   true,
+		Payload: payload,
+	}
+	if err := o.write(o.stateFilename(topic), m); err != nil {
+		return err
+	}
+	o.states[topic] = m
+	return nil
+}
+
+// state returns the state waiting to be published to a topic, or nil if there isn't one.
+func (o *outbox) state(topic string) []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.expire()
+	if m, ok := o.states[topic]; ok {
+		return m.Payload
+	}
+	return nil
+}
+
+// removeState removes the state for a topic after it has been published.
+func (o *outbox) removeState(topic string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if m, ok := o.states[topic]; ok {
+		o.removeLocked(m)
+	}
+}
+
+// makeRoom makes room for a new message according to the drop policy. The caller must hold the lock.
+func (o *outbox) makeRoom() error {
+	if len(o.messages)+len(o.states) < o.maxMessages {
+		return nil
+	}
+	if o.policy == DropNewest {
+		o.dropped++
+		return ErrOutboxFull
+	}
+	o.removeLocked(o.oldest())
+	o.dropped++
+	return nil
+}
+
+// next returns the oldest event in the outbox for the replay to send.
+// If there aren't any, it stops the replay and returns nil. Both happen while holding the lock,
+// so a message pushed after the replay found the outbox empty always starts a new replay.
+func (o *outbox) next() *outboxMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.expire()
+	if len(o.messages) == 0 {
+		o.replaying = false
+		return nil
+	}
+	return o.messages[0]
+}
+
+// remove removes a message from the outbox after it has been sent.
+func (o *outbox) remove(m *outboxMessage) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.removeLocked(m)
+}
+
+// len returns the number of events in the outbox.
+func (o *outbox) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.messages)
+}
+
+func (o *outbox) stats() OutboxStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.expire()
+	return OutboxStats{
+		Depth:   len(o.messages) + len(o.states),
+		Dropped: o.dropped,
+		Expired: o.expired,
+	}
+}
+
+// startReplay returns true if the caller should replay the outbox.
+// Only one replay runs at a time.
+func (o *outbox) startReplay() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.replaying {
+		return false
+	}
+	o.replaying = true
+	return true
+}
+
+// stopReplay stops the replay after sending failed.
+func (o *outbox) stopReplay() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.replaying = false
+}
+
+// expire drops messages that are older than maxAge. The caller must hold the lock.
+func (o *outbox) expire() {
+	if o.maxAge <= 0 {
+		return
+	}
+	cutoff := o.clock.Now().Add(-o.maxAge)
+	for m := o.oldest(); m != nil && m.Time.Before(cutoff); m = o.oldest() {
+		o.removeLocked(m)
+		o.expired++
+	}
+}
+
+// oldest returns the oldest message, including state messages, or nil if the outbox is empty.
+// The caller must hold the lock.
+func (o *outbox) oldest() *outboxMessage {
+	var oldest *outboxMessage
+	if len(o.messages) > 0 {
+		oldest = o.messages[0]
+	}
+	for _, m := range o.states {
+		if oldest == nil || m.Time.Before(oldest.Time) {
+			oldest = m
+		}
+	}
+	return oldest
+}
+
+// removeLocked removes a message. The caller must hold the lock.
+func (o *outbox) removeLocked(m *outboxMessage) {
+	if m.State {
+		delete(o.states, m.Topic)
+		if o.dir != "" {
+			os.Remove(o.stateFilename(m.Topic))
+		}
+		return
+	}
+	for i, message := range o.messages {
+		if message == m {
+			o.messages = append(o.messages[:i], o.messages[i+1:]...)
+			break
+		}
+	}
+	if o.dir != "" {
+		os.Remove(o.filename(m.seq))
+	}
+}
+
+func (o *outbox) filename(seq uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d%s", seq, outboxFileSuffix))
+}
+
+// stateFilename returns the name of the file holding the state for a topic.
+func (o *outbox) stateFilename(topic string) string {
+	return filepath.Join(o.dir, hex.EncodeToString([]byte(topic))+outboxStateFileSuffix)
+}
+
+// write persists a message. Each file contains a JSON header line followed by the payload.
+func (o *outbox) write(filename string, m *outboxMessage) error {
+	if o.dir == "" {
+		return nil
+	}
+	header, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(header)
+	buf.WriteByte('\n')
+	buf.Write(m.Payload)
+
+	// Write to a temporary file first so that a partially written message is never loaded
+	tmp := filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// load reads persisted messages in the order they were published.
+func (o *outbox) load() error {
+	files, err := ioutil.ReadDir(o.dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), outboxFileSuffix) {
+			names = append(names, f.Name())
+		}
+		if strings.HasSuffix(f.Name(), outboxStateFileSuffix) {
+			m, err := readOutboxMessage(filepath.Join(o.dir, f.Name()))
+			if err != nil || !m.State {
+				os.Remove(filepath.Join(o.dir, f.Name()))
+				continue
+			}
+			o.states[m.Topic] = m
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, outboxFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		m, err := readOutboxMessage(filepath.Join(o.dir, name))
+		if err != nil {
+			// Skip corrupt messages rather than blocking the queue
+			os.Remove(filepath.Join(o.dir, name))
+			continue
+		}
+		m.seq = seq
+		o.messages = append(o.messages, m)
+		o.nextSeq = seq + 1
+	}
+
+	for len(o.messages)+len(o.states) > o.maxMessages {
+		o.removeLocked(o.oldest())
+		o.dropped++
+	}
+	o.expire()
+	return nil
+}
+
+func readOutboxMessage(filename string) (*outboxMessage, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid outbox message: %s", filename)
+	}
+	m := &outboxMessage{}
+	if err = json.Unmarshal(b[:i], m); err != nil {
+		return nil, err
+	}
+	m.Payload = b[i+1:]
+	return m, nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestOutboxReplayFinishing(t *testing.T) {
+	o, err := newOutbox("", 10, 0, DropOldest, clock.New())
+	if err != nil {
+		t.Fatalf("Couldn't create outbox: %v", err)
+	}
+	o.push("events", 0, []byte("1"))
+	if !o.startReplay() {
+		t.Fatal("Replay didn't start")
+	}
+	m := o.next()
+	if m == nil || string(m.Payload) != "1" {
+		t.Fatalf("Wrong message replayed: %v", m)
+	}
+
+	// A publisher sees the message that is being sent and queues its event behind it,
+	// but the replay finds the outbox empty before the event is pushed
+	if o.len() == 0 {
+		t.Fatal("Message removed before it was sent")
+	}
+	o.remove(m)
+	if m = o.next(); m != nil {
+		t.Fatalf("Message replayed from an empty outbox: %v", m)
+	}
+	o.push("events", 0, []byte("2"))
+	if !o.startReplay() {
+		t.Fatal("Replay didn't start for an event published while the last replay was finishing")
+	}
+	if m = o.next(); m == nil || string(m.Payload) != "2" {
+		t.Fatalf("Wrong message replayed: %v", m)
+	}
+	if o.startReplay() {
+		t.Fatal("Second replay started while the first was running")
+	}
+}
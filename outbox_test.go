@@ -0,0 +1,88 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vaelen/iot"
+)
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	initMockClient()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.QueueDirectory = t.TempDir()
+	options.OutboxSize = 3
+
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	doDisconnectTest(t, thing)
+
+	for _, event := range []string{"1", "2", "3"} {
+		if err := thing.PublishEvent(ctx, []byte(event)); err != nil {
+			t.Fatalf("Couldn't queue event while offline: %v", err)
+		}
+	}
+	// Only the latest state is kept, and it takes the place of the oldest event
+	for _, state := range []string{"a", "b"} {
+		if err := thing.PublishState(ctx, []byte(state)); err != nil {
+			t.Fatalf("Couldn't queue state while offline: %v", err)
+		}
+	}
+	stats := thing.OutboxStats()
+	if stats.Depth != 3 || stats.Dropped != 1 {
+		t.Fatalf("Wrong outbox stats: %+v", stats)
+	}
+	if len(mockClient.Messages[EventsTopic]) != 0 || len(mockClient.Messages[StateTopic]) != 0 {
+		t.Fatalf("Messages published while offline: %v", mockClient.Messages)
+	}
+
+	// The persisted messages are sent when a new Thing connects
+	directory := options.QueueDirectory
+	options, _ = getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.QueueDirectory = directory
+	options.OutboxSize = 3
+	thing = getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+	waitFor(t, func() bool { return thing.OutboxStats().Depth == 0 })
+
+	l := mockClient.Messages[EventsTopic]
+	if len(l) != 2 || string(l[0].([]byte)) != "2" || string(l[1].([]byte)) != "3" {
+		t.Fatalf("Wrong events replayed: %v", l)
+	}
+	l = mockClient.Messages[StateTopic]
+	if len(l) != 1 || string(l[0].([]byte)) != "b" {
+		t.Fatalf("Wrong state replayed: %v", l)
+	}
+}
+
+func TestOutboxDropNewest(t *testing.T) {
+	ctx := context.Background()
+	initMockClient()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeEC))
+	options.OutboxSize = 1
+	options.OutboxDropPolicy = iot.DropNewest
+
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	doDisconnectTest(t, thing)
+
+	if err := thing.PublishState(ctx, []byte("1")); err != nil {
+		t.Fatalf("Couldn't queue state while offline: %v", err)
+	}
+	// A newer state replaces the queued state, so it is never dropped
+	if err := thing.PublishState(ctx, []byte("2")); err != nil {
+		t.Fatalf("Couldn't replace queued state: %v", err)
+	}
+	if err := thing.PublishEvent(ctx, []byte("3")); err != iot.ErrOutboxFull {
+		t.Fatalf("Wrong error returned when the outbox was full: %v", err)
+	}
+	stats := thing.OutboxStats()
+	if stats.Depth != 1 || stats.Dropped != 1 {
+		t.Fatalf("Wrong outbox stats: %+v", stats)
+	}
+}
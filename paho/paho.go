@@ -7,11 +7,12 @@ package paho
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
+	"io"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/vaelen/iot"
 )
 
@@ -26,6 +27,8 @@ type MQTTClient struct {
 	client              mqtt.Client
 	credentialsProvider iot.MQTTCredentialsProvider
 	onConnectHandler    iot.MQTTOnConnectHandler
+	// connectionEventHandler is called when the state of the connection changes
+	connectionEventHandler iot.MQTTConnectionEventHandler
 }
 
 // NewClient creates an MQTTClient instance using Eclipse Paho.
@@ -63,22 +66,23 @@ func (c *MQTTClient) Connect(ctx context.Context, servers ...string) error {
 		store = mqtt.NewFileStore(c.options.QueueDirectory)
 	}
 
-	clientOptions.SetTLSConfig(&tls.Config{
-		Certificates:       []tls.Certificate{c.options.Credentials.Certificate},
-		InsecureSkipVerify: true,
-	})
+	clientOptions.SetTLSConfig(iot.NewTLSConfig(c.options))
 
-	clientOptions.SetCleanSession(false)
-	clientOptions.SetAutoReconnect(true)
+	clientOptions.SetCleanSession(c.options.CleanSession)
+	// If a reconnect policy or fallback credentials are provided, the Thing reconnects after the connection is lost instead of Paho
+	clientOptions.SetAutoReconnect(iot.ClientReconnects(c.options))
 	clientOptions.SetProtocolVersion(4)
 	clientOptions.SetClientID(c.clientID)
-	clientOptions.SetUsername("unused")
 	clientOptions.SetStore(store)
 	clientOptions.SetCredentialsProvider(func() (string, string) { return c.credentialsProvider() })
-	clientOptions.SetOnConnectHandler(func(i mqtt.Client) {
+	clientOptions.SetOnConnectHandler(func(client mqtt.Client) {
 		if c.options.InfoLogger != nil {
 			c.options.InfoLogger("Connected")
 		}
+		c.emit(iot.ConnectionConnected, nil)
+		if c.onConnectHandler != nil {
+			c.onConnectHandler(c)
+		}
 	})
 	clientOptions.SetConnectionLostHandler(func(client mqtt.Client, e error) {
 		if e != io.EOF {
@@ -86,10 +90,10 @@ func (c *MQTTClient) Connect(ctx context.Context, servers ...string) error {
 				c.options.ErrorLogger(fmt.Sprintf("Connection Lost. Error: %v", e))
 			}
 		}
-	})
-	clientOptions.SetOnConnectHandler(func(client mqtt.Client) {
-		if c.onConnectHandler != nil {
-			c.onConnectHandler(c)
+		c.emit(iot.ConnectionLost, e)
+		if iot.ClientReconnects(c.options) {
+			// Paho automatically reconnects after the connection is lost
+			c.emit(iot.ConnectionReconnecting, nil)
 		}
 	})
 
@@ -99,8 +103,20 @@ func (c *MQTTClient) Connect(ctx context.Context, servers ...string) error {
 
 	c.client = mqtt.NewClient(clientOptions)
 
+	c.emit(iot.ConnectionConnecting, nil)
 	token := c.client.Connect()
-	return waitForToken(ctx, token)
+	err := waitForToken(ctx, token)
+	if err != nil && err != iot.ErrCancelled {
+		switch token.(*mqtt.ConnectToken).ReturnCode() {
+		case packets.ErrRefusedBadUsernameOrPassword, packets.ErrRefusedNotAuthorised:
+			err = iot.ErrNotAuthorized
+			c.emit(iot.ConnectionAuthFailed, err)
+		}
+	}
+	if err != nil {
+		c.emit(iot.ConnectionDisconnected, err)
+	}
+	return err
 }
 
 // Disconnect will disconnect from the given MQTT server and clean up all client resources
@@ -108,21 +124,32 @@ func (c *MQTTClient) Disconnect(ctx context.Context) error {
 	if c.IsConnected() {
 		c.client.Disconnect(1000)
 		c.client = nil
+		c.emit(iot.ConnectionDisconnected, nil)
 	}
 	return nil
 }
 
 // Publish will publish the given payload to the given topic with the given quality of service level
 func (c *MQTTClient) Publish(ctx context.Context, topic string, qos uint8, payload interface{}) error {
+	_, err := c.PublishWithID(ctx, topic, qos, payload)
+	return err
+}
+
+// PublishWithID will publish the given payload in the same way as Publish and return the message ID that was used
+func (c *MQTTClient) PublishWithID(ctx context.Context, topic string, qos uint8, payload interface{}) (uint16, error) {
 	if !c.IsConnected() {
-		return iot.ErrNotConnected
+		return 0, iot.ErrNotConnected
 	}
 	token := c.client.Publish(topic, qos, true, payload)
-	return waitForToken(ctx, token)
+	err := waitForToken(ctx, token)
+	if t, ok := token.(*mqtt.PublishToken); ok {
+		return t.MessageID(), err
+	}
+	return 0, err
 }
 
 // Subscribe will subscribe to the given topic with the given quality of service level and message handler
-func (c *MQTTClient) Subscribe(ctx context.Context, topic string, qos uint8, callback iot.ConfigHandler) error {
+func (c *MQTTClient) Subscribe(ctx context.Context, topic string, qos uint8, callback iot.MQTTMessageHandler) error {
 	if !c.IsConnected() {
 		return iot.ErrNotConnected
 	}
@@ -131,7 +158,7 @@ func (c *MQTTClient) Subscribe(ctx context.Context, topic string, qos uint8, cal
 			c.options.DebugLogger(fmt.Sprintf("RECEIVED - Topic: %s, Message Length: %d bytes", message.Topic(), len(message.Payload())))
 		}
 		if callback != nil {
-			callback(c.thing, message.Payload())
+			callback(c.thing, message.Topic(), message.Payload())
 		}
 	}
 	token := c.client.Subscribe(topic, qos, handler)
@@ -178,6 +205,17 @@ func (c *MQTTClient) SetOnConnectHandler(handler iot.MQTTOnConnectHandler) {
 	c.onConnectHandler = handler
 }
 
+// SetConnectionEventHandler sets the method that is called when the state of the connection changes
+func (c *MQTTClient) SetConnectionEventHandler(handler iot.MQTTConnectionEventHandler) {
+	c.connectionEventHandler = handler
+}
+
+func (c *MQTTClient) emit(eventType iot.ConnectionEventType, err error) {
+	if c.connectionEventHandler != nil {
+		c.connectionEventHandler(iot.ConnectionEvent{Type: eventType, Err: err})
+	}
+}
+
 func waitForToken(ctx context.Context, token mqtt.Token) error {
 	result := make(chan error)
 	cancelled := false
@@ -5,11 +5,14 @@ package paho
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/vaelen/iot"
+	"github.com/vaelen/iot/iottest"
 )
 
 var ID = &iot.ID{
@@ -19,7 +22,10 @@ var ID = &iot.ID{
 	ProjectID: "z",
 }
 
-var ConfigTopic = "/devices/vaelen_iot_test/config"
+const (
+	EventsTopic = "/devices/vaelen_iot_test/events"
+	StateTopic  = "/devices/vaelen_iot_test/state"
+)
 
 // This test is here mainly for coverage.
 // The functionality is tested in the main iot package.
@@ -34,16 +40,21 @@ func TestPahoClient(t *testing.T) {
 	}
 
 	options := getOptions(t)
+	server := iottest.NewServer(ID.ProjectID, ID.Location, ID.Registry)
+	defer server.Close()
+	server.AddDevice(ID.DeviceID, options.Credentials)
+	server.SetConfig(ID.DeviceID, []byte("test config"))
 
 	thing := iot.New(options)
 
-	err := thing.Connect(ctx, "tcp://iot.eclipse.org:1883")
+	err := thing.Connect(ctx, server.URL)
 	if err != nil {
-		t.Fatalf("Couldn't connect to server")
+		t.Fatalf("Couldn't connect to server: %v", err)
 	}
 	defer thing.Disconnect(ctx)
 
-	mqttClient.Publish(ctx, ConfigTopic, 0, []byte("test config"))
+	// The config handler publishes the state
+	waitFor(t, server, StateTopic, 1)
 
 	// This publishes to /events
 	thing.PublishEvent(ctx, []byte("Top level telemetry event"))
@@ -51,16 +62,86 @@ func TestPahoClient(t *testing.T) {
 	thing.PublishEvent(ctx, []byte("Sub folder telemetry event"), "a")
 	// This publishes to /events/a/b
 	thing.PublishEvent(ctx, []byte("Sub folder telemetry event"), "a", "b")
+	waitFor(t, server, EventsTopic+"/#", 3)
 
 	ctx2, cancel := context.WithTimeout(ctx, time.Nanosecond)
 	defer cancel()
-	err = mqttClient.Publish(ctx2, ConfigTopic, 2, []byte("foo"))
+	err = mqttClient.Publish(ctx2, EventsTopic, 1, []byte("foo"))
 	if err != iot.ErrCancelled {
 		t.Fatalf("Timeout didn't occur: %v", err)
 	}
 
 }
 
+func TestPahoClientTLS(t *testing.T) {
+	ctx := context.Background()
+	iot.NewClient = NewClient
+
+	certificate, err := tls.LoadX509KeyPair("../test_keys/server_cert.pem", "../test_keys/server_private.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load server certificate: %v", err)
+	}
+	server := iottest.NewTLSServer(ID.ProjectID, ID.Location, ID.Registry, certificate)
+	defer server.Close()
+
+	rootCAs, err := iot.LoadRootCAs("../test_keys/ca_cert.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load root CAs: %v", err)
+	}
+
+	options := getOptions(t)
+	server.AddDevice(ID.DeviceID, options.Credentials)
+	thing := iot.New(options)
+	err = thing.Connect(ctx, server.URL)
+	if err == nil {
+		thing.Disconnect(ctx)
+		t.Fatal("Connected to a server with an untrusted certificate")
+	}
+
+	var mu sync.Mutex
+	var events []iot.ConnectionEventType
+	options = getOptions(t)
+	options.RootCAs = rootCAs
+	options.ConnectionEventHandler = func(thing iot.Thing, event iot.ConnectionEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event.Type)
+	}
+	thing = iot.New(options)
+	err = thing.Connect(ctx, server.URL)
+	if err != nil {
+		t.Fatalf("Couldn't connect to server: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+	// Paho calls the OnConnect handler asynchronously
+	for i := 0; ; i++ {
+		mu.Lock()
+		received := append([]iot.ConnectionEventType{}, events...)
+		mu.Unlock()
+		if len(received) == 2 && received[0] == iot.ConnectionConnecting && received[1] == iot.ConnectionConnected {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Wrong connection events: %v", received)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	err = thing.PublishEvent(ctx, []byte("TLS telemetry event"))
+	if err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	waitFor(t, server, EventsTopic, 1)
+}
+
+func waitFor(t *testing.T, server *iottest.Server, filter string, count int) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if messages, err := server.WaitForMessages(ctx, filter, count); err != nil {
+		t.Fatalf("Server received %d messages on %s, expected %d", len(messages), filter, count)
+	}
+}
+
 func getOptions(t *testing.T) *iot.ThingOptions {
 	ctx := context.Background()
 
@@ -0,0 +1,41 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+// Package protoconfig decodes binary protocol buffer configurations for iot.TypedConfig.
+//
+// It is a separate package so that devices that don't use protocol buffers don't include the protobuf runtime.
+package protoconfig
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/vaelen/iot"
+)
+
+// Unmarshal decodes binary protocol buffer configurations.
+// The configuration type must implement proto.Message.
+var Unmarshal iot.ConfigUnmarshaler = unmarshal
+
+func unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, message)
+}
+
+// Equal compares two configurations using proto.Equal. It can be used as TypedConfig.Equal.
+func Equal(a, b interface{}) bool {
+	messageA, okA := a.(proto.Message)
+	messageB, okB := b.(proto.Message)
+	return okA && okB && proto.Equal(messageA, messageB)
+}
+
+// NewTypedConfig returns a TypedConfig that decodes protocol buffer configurations and compares them using proto.Equal.
+// The newConfig function must return a new, empty message.
+func NewTypedConfig(newConfig func() proto.Message, handler iot.TypedConfigHandler, errorHandler iot.ConfigErrorHandler) *iot.TypedConfig {
+	config := iot.NewTypedConfig(func() interface{} { return newConfig() }, Unmarshal, handler, errorHandler)
+	config.Equal = Equal
+	return config
+}
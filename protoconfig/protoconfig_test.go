@@ -0,0 +1,53 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package protoconfig
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/vaelen/iot"
+)
+
+func TestUnmarshal(t *testing.T) {
+	b, err := proto.Marshal(&wrappers.StringValue{Value: "test"})
+	if err != nil {
+		t.Fatalf("Couldn't encode protobuf: %v", err)
+	}
+	s := &wrappers.StringValue{}
+	if err = Unmarshal(b, s); err != nil || s.Value != "test" {
+		t.Fatalf("Couldn't decode protobuf config. Config: %v, Error: %v", s, err)
+	}
+	if err = Unmarshal(b, &struct{}{}); err == nil {
+		t.Fatal("Decoding protobuf into a non-protobuf type didn't return an error")
+	}
+}
+
+func TestTypedConfig(t *testing.T) {
+	b, err := proto.Marshal(&wrappers.StringValue{Value: "test"})
+	if err != nil {
+		t.Fatalf("Couldn't encode protobuf: %v", err)
+	}
+
+	// Configurations are compared using proto.Equal
+	var versions []int
+	config := NewTypedConfig(func() proto.Message { return &wrappers.StringValue{} },
+		func(thing iot.Thing, config interface{}, version int) {
+			// Encoding the message changes its internal state, which reflect.DeepEqual would compare
+			proto.Marshal(config.(proto.Message))
+			versions = append(versions, version)
+		},
+		func(thing iot.Thing, err *iot.ConfigError) {
+			t.Fatalf("Protobuf config rejected: %v", err)
+		})
+	config.HandleConfig(nil, b)
+	config.HandleConfig(nil, b)
+	if len(versions) != 1 {
+		t.Fatalf("Unchanged protobuf config handled again: %v", versions)
+	}
+	if current, _ := config.Current(); current.(*wrappers.StringValue).Value != "test" {
+		t.Fatalf("Wrong config: %v", current)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+// Package protoevents encodes events as binary protocol buffers for iot.EventRegistry.
+//
+// It is a separate package so that devices that don't use protocol buffers don't include the protobuf runtime.
+package protoevents
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/vaelen/iot"
+)
+
+// Codec encodes events as binary protocol buffers.
+// The event type must implement proto.Message.
+var Codec iot.EventCodec = codec{}
+
+type codec struct{}
+
+func (codec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T does not implement proto.Message", v)
+	}
+	return proto.Marshal(message)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, message)
+}
@@ -0,0 +1,42 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package protoevents
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/vaelen/iot"
+)
+
+func TestCodec(t *testing.T) {
+	b, err := Codec.Marshal(&wrappers.StringValue{Value: "test"})
+	if err != nil {
+		t.Fatalf("Couldn't encode protobuf: %v", err)
+	}
+	s := &wrappers.StringValue{}
+	if err = Codec.Unmarshal(b, s); err != nil || s.Value != "test" {
+		t.Fatalf("Couldn't decode protobuf. Value: %v, Error: %v", s, err)
+	}
+	if _, err = Codec.Marshal(struct{}{}); err == nil {
+		t.Fatal("Encoding a non-protobuf type as protobuf didn't return an error")
+	}
+}
+
+func TestEventRegistry(t *testing.T) {
+	registry := iot.NewEventRegistry(Codec)
+	if err := registry.Register(&wrappers.StringValue{}, iot.EventType{Subfolder: "names", Schema: "name"}); err != nil {
+		t.Fatalf("Couldn't register event type: %v", err)
+	}
+	payload, subfolder, err := registry.Encode(&wrappers.StringValue{Value: "test"})
+	if err != nil || !reflect.DeepEqual(subfolder, []string{"names"}) {
+		t.Fatalf("Couldn't encode event. Subfolder: %v, Error: %v", subfolder, err)
+	}
+	v, header, err := registry.Decode("names", payload)
+	if err != nil || header.ContentType != "application/x-protobuf" || !proto.Equal(v.(proto.Message), &wrappers.StringValue{Value: "test"}) {
+		t.Fatalf("Couldn't decode event. Value: %v, Header: %+v, Error: %v", v, header, err)
+	}
+}
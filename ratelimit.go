@@ -0,0 +1,142 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// RateLimit configures a token bucket rate limiter.
+// A Rate of 0 means messages are not rate limited.
+type RateLimit struct {
+	// Rate is the number of messages per second that can be published.
+	Rate float64
+	// Burst is the number of messages that can be published at once before the rate applies.
+	// Values less than 1 are treated as 1.
+	Burst int
+}
+
+// DefaultStateRateLimit is the default rate limit for state updates.
+// Google limits state updates to one per second per device.
+var DefaultStateRateLimit = RateLimit{Rate: 1, Burst: 1}
+
+// rateLimiter is a token bucket that is refilled using a clock.Clock.
+type rateLimiter struct {
+	mu     sync.Mutex
+	clock  clock.Clock
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rate limiter for the given limit, or nil if the limit is unlimited.
+// A nil rateLimiter never limits.
+func newRateLimiter(limit RateLimit, c clock.Clock) *rateLimiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		clock:  c,
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   c.Now(),
+	}
+}
+
+// wait takes a token from the bucket, waiting until one is available or the context is done.
+// If noWait is true, ErrRateLimited is returned instead of waiting.
+// ErrCancelled is returned if the context is done.
+func (l *rateLimiter) wait(ctx context.Context, noWait bool) error {
+	if ctx.Err() != nil {
+		return ErrCancelled
+	}
+	if l == nil {
+		return nil
+	}
+	for {
+		delay := l.take()
+		if delay == 0 {
+			return nil
+		}
+		if noWait {
+			return ErrRateLimited
+		}
+		timer := l.clock.Timer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ErrCancelled
+		case <-timer.C:
+		}
+	}
+}
+
+// take removes a token from the bucket if one is available.
+// Otherwise it returns how long until the next token is available.
+func (l *rateLimiter) take() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	delay := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if delay <= 0 {
+		delay = time.Nanosecond
+	}
+	return delay
+}
+
+// rateLimiters holds a rate limiter for each kind of message published for each device.
+type rateLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+// get returns the rate limiter for a topic, creating it if needed.
+// State updates and events are limited separately for each device.
+// It returns nil for topics that are not rate limited.
+func (r *rateLimiters) get(topic string, options *ThingOptions) *rateLimiter {
+	id := topicID(topic, options)
+	backend := backendFor(options)
+	var key string
+	var limit RateLimit
+	switch events := backend.EventsTopic(id); {
+	case topic == backend.StateTopic(id):
+		key, limit = topic, options.StateRateLimit
+	case topic == events || strings.HasPrefix(topic, strings.TrimSuffix(events, "/")+"/"):
+		key, limit = events, options.EventRateLimit
+	default:
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limiters == nil {
+		r.limiters = make(map[string]*rateLimiter)
+	}
+	l, ok := r.limiters[key]
+	if !ok {
+		l = newRateLimiter(limit, options.Clock)
+		r.limiters[key] = l
+	}
+	return l
+}
@@ -0,0 +1,75 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/vaelen/iot"
+)
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.Background()
+	initMockClient()
+	mockClock := clock.NewMock()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.Clock = mockClock
+	options.RateLimitNoWait = true
+
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+
+	// Events are not limited by default
+	for i := 0; i < 5; i++ {
+		if err := thing.PublishEvent(ctx, []byte("event")); err != nil {
+			t.Fatalf("Couldn't publish event: %v", err)
+		}
+	}
+
+	// State updates are limited to one per second
+	if err := thing.PublishState(ctx, []byte("1")); err != nil {
+		t.Fatalf("Couldn't publish state: %v", err)
+	}
+	if err := thing.PublishState(ctx, []byte("2")); err != iot.ErrRateLimited {
+		t.Fatalf("Wrong error returned when rate limited: %v", err)
+	}
+	mockClock.Add(time.Second)
+	if err := thing.PublishState(ctx, []byte("3")); err != nil {
+		t.Fatalf("Couldn't publish state after waiting: %v", err)
+	}
+	if l := mockClient.Messages[StateTopic]; len(l) != 2 {
+		t.Fatalf("Wrong number of state updates published: %v", len(l))
+	}
+
+	// A cancelled context is honored instead of waiting
+	options.RateLimitNoWait = false
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer cancel()
+	if err := thing.PublishState(timeoutCtx, []byte("4")); err != iot.ErrCancelled {
+		t.Fatalf("Wrong error returned when the context timed out: %v", err)
+	}
+	if err := thing.PublishEvent(timeoutCtx, []byte("event")); err != iot.ErrCancelled {
+		t.Fatalf("Wrong error returned when publishing with a cancelled context: %v", err)
+	}
+
+	// Waiting publishes are sent once a token is available
+	done := make(chan error, 1)
+	go func() { done <- thing.PublishState(ctx, []byte("5")) }()
+	waitFor(t, func() bool {
+		mockClock.Add(time.Millisecond * 100)
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Couldn't publish state after waiting: %v", err)
+			}
+			return true
+		default:
+			return false
+		}
+	})
+}
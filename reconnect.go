@@ -0,0 +1,180 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ReconnectPolicy determines how a Thing retries connecting to the server.
+// Google recommends exponential backoff with jitter so that devices don't all reconnect at once after an outage.
+//
+// The interval before retry n (starting at 0) is InitialInterval * Multiplier^n, limited to MaxInterval,
+// and then randomly adjusted by up to plus or minus Jitter times the interval.
+type ReconnectPolicy struct {
+	// InitialInterval is the interval before the first retry.
+	// If it is zero, the value from DefaultReconnectPolicy is used.
+	InitialInterval time.Duration
+	// MaxInterval is the maximum interval between retries.
+	// If it is zero, the interval is only limited by the maximum time.Duration.
+	MaxInterval time.Duration
+	// Multiplier is the factor the interval grows by after each failed attempt.
+	// If it is zero, the value from DefaultReconnectPolicy is used. Other values less than 1 are treated as 1.
+	Multiplier float64
+	// Jitter is the fraction of the interval, between 0 and 1, that is randomly added or subtracted.
+	Jitter float64
+	// MaxAttempts is the maximum number of connection attempts before giving up.
+	// The default value of 0 means the Thing retries until the context is cancelled or it is disconnected.
+	MaxAttempts int
+}
+
+// DefaultReconnectPolicy returns the recommended reconnect policy.
+// Retries start after one second and back off to at most one minute, with 20% jitter.
+func DefaultReconnectPolicy() *ReconnectPolicy {
+	return &ReconnectPolicy{
+		InitialInterval: time.Second,
+		MaxInterval:     time.Minute,
+		Multiplier:      2,
+		Jitter:          0.2,
+	}
+}
+
+// Backoff returns the interval to wait before the given retry, starting at 0.
+// The interval is always positive, so that retries never hammer the server.
+func (p *ReconnectPolicy) Backoff(retry int) time.Duration {
+	defaults := DefaultReconnectPolicy()
+	initial := p.InitialInterval
+	if initial <= 0 {
+		initial = defaults.InitialInterval
+	}
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = defaults.Multiplier
+	}
+	multiplier = math.Max(multiplier, 1)
+	// The limit is applied before converting to a Duration, which would otherwise overflow
+	limit := float64(math.MaxInt64)
+	if p.MaxInterval > 0 {
+		limit = float64(p.MaxInterval)
+	}
+
+	interval := math.Min(float64(initial)*math.Pow(multiplier, float64(retry)), limit)
+	jitter := math.Min(math.Max(p.Jitter, 0), 1)
+	interval = math.Min(interval+interval*jitter*(rand.Float64()*2-1), limit)
+	if interval >= float64(math.MaxInt64) {
+		return time.Duration(math.MaxInt64)
+	}
+	if interval < 1 {
+		return initial
+	}
+	return time.Duration(interval)
+}
+
+// reconnector runs the background reconnect loop after the connection is lost.
+type reconnector struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// start begins reconnecting in the background unless a reconnect is already running.
+func (r *reconnector) start(t *thing) {
+	r.run(t, func(ctx context.Context) error {
+		return t.connectWithRetry(ctx, t.reconnectPolicy())
+	}, nil)
+}
+
+// restart gracefully disconnects and then reconnects in the background unless a reconnect is already running.
+// If reconnecting fails, failed is called unless the reconnect was stopped.
+func (r *reconnector) restart(t *thing, failed func()) {
+	r.run(t, t.reconnect, failed)
+}
+
+// run runs connect in the background unless a reconnect is already running.
+func (r *reconnector) run(t *thing, connect func(ctx context.Context) error, failed func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.ctx, r.cancel = ctx, cancel
+	go func() {
+		err := connect(ctx)
+		if err != nil && ctx.Err() == nil {
+			t.errorf("Couldn't reconnect: %v", err)
+			if failed != nil {
+				failed()
+			}
+		}
+		r.mu.Lock()
+		if r.ctx == ctx {
+			r.ctx, r.cancel = nil, nil
+		}
+		r.mu.Unlock()
+		cancel()
+	}()
+}
+
+// stop stops the background reconnect loop, if it is running.
+func (r *reconnector) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+		r.ctx, r.cancel = nil, nil
+	}
+}
+
+// ClientReconnects returns true if an MQTTClient that is able to reconnect automatically should do so
+// after the connection is lost. Otherwise the Thing reconnects, which happens if a ReconnectPolicy is provided
+// or if the CredentialSet holds more than one set of credentials that the Thing may need to fall back to.
+func ClientReconnects(options *ThingOptions) bool {
+	if options.ReconnectPolicy != nil {
+		return false
+	}
+	return options.CredentialSet == nil || len(options.CredentialSet.Credentials()) <= 1
+}
+
+// reconnectPolicy returns the policy used to reconnect after the connection is lost,
+// or nil if the MQTT client reconnects by itself.
+func (t *thing) reconnectPolicy() *ReconnectPolicy {
+	if t.options.ReconnectPolicy != nil || ClientReconnects(t.options) {
+		return t.options.ReconnectPolicy
+	}
+	return DefaultReconnectPolicy()
+}
+
+// connectWithRetry connects to the server, retrying according to the policy.
+// Errors that retrying won't fix, such as rejected credentials, are returned immediately.
+func (t *thing) connectWithRetry(ctx context.Context, policy *ReconnectPolicy) error {
+	var delay time.Duration
+	for attempt := 1; ; attempt++ {
+		if delay > 0 {
+			timer := t.options.Clock.Timer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ErrCancelled
+			case <-timer.C:
+			}
+		}
+		err := t.connect(ctx)
+		if err != nil && ctx.Err() != nil {
+			return ErrCancelled
+		}
+		if err == nil || policy == nil || err == ErrNotAuthorized || err == ErrCancelled {
+			return err
+		}
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return err
+		}
+		delay = policy.Backoff(attempt - 1)
+		t.handleConnectionEvent(ConnectionEvent{Type: ConnectionReconnecting, Err: err})
+	}
+}
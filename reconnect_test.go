@@ -0,0 +1,138 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/vaelen/iot"
+)
+
+func TestReconnectPolicy(t *testing.T) {
+	ctx := context.Background()
+	errUnavailable := fmt.Errorf("server unavailable")
+	var attempts, failUntil int32 = 0, 3
+	iot.NewClient = func(t iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
+		mockClient = iot.NewMockClient(t, o)
+		mockClient.Authenticate = func(username string, password string) error {
+			if atomic.AddInt32(&attempts, 1) < atomic.LoadInt32(&failUntil) {
+				return errUnavailable
+			}
+			return nil
+		}
+		return mockClient
+	}
+
+	mockClock := clock.NewMock()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.Clock = mockClock
+	options.ReconnectPolicy = &iot.ReconnectPolicy{
+		InitialInterval: time.Second,
+		MaxInterval:     time.Second * 4,
+		Multiplier:      2,
+	}
+	thing := getThing(t, options)
+
+	// The initial connection succeeds on the third attempt, after waiting 1s and 2s
+	start := mockClock.Now()
+	done := make(chan error, 1)
+	go func() { done <- thing.Connect(ctx, "ssl://mqtt.example.com:443") }()
+	waitFor(t, func() bool {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Couldn't connect: %v", err)
+			}
+			return true
+		default:
+			mockClock.Add(time.Millisecond * 100)
+			return false
+		}
+	})
+	if elapsed := mockClock.Now().Sub(start); elapsed < time.Second*3 || elapsed > time.Second*4 {
+		t.Fatalf("Wrong backoff before connecting: %v", elapsed)
+	}
+	if atomic.LoadInt32(&attempts) != 3 {
+		t.Fatalf("Wrong number of connection attempts: %v", atomic.LoadInt32(&attempts))
+	}
+
+	// The Thing reconnects after the connection is lost
+	atomic.StoreInt32(&failUntil, 5)
+	mockClient.LoseConnection(errUnavailable)
+	waitFor(t, func() bool {
+		mockClock.Add(time.Millisecond * 100)
+		return thing.IsConnected()
+	})
+	if atomic.LoadInt32(&attempts) != 5 {
+		t.Fatalf("Wrong number of reconnection attempts: %v", atomic.LoadInt32(&attempts))
+	}
+	doDisconnectTest(t, thing)
+
+	// Connecting gives up after MaxAttempts
+	atomic.StoreInt32(&failUntil, 100)
+	options.ReconnectPolicy.MaxAttempts = 2
+	thing = getThing(t, options)
+	go func() { done <- thing.Connect(ctx, "ssl://mqtt.example.com:443") }()
+	waitFor(t, func() bool {
+		select {
+		case err := <-done:
+			if err != errUnavailable {
+				t.Fatalf("Wrong error returned after giving up: %v", err)
+			}
+			return true
+		default:
+			mockClock.Add(time.Millisecond * 100)
+			return false
+		}
+	})
+
+	// Cancelling the context while waiting to retry returns ErrCancelled
+	options.ReconnectPolicy.MaxAttempts = 0
+	thing = getThing(t, options)
+	cancelCtx, cancel := context.WithCancel(ctx)
+	before := atomic.LoadInt32(&attempts)
+	go func() { done <- thing.Connect(cancelCtx, "ssl://mqtt.example.com:443") }()
+	waitFor(t, func() bool { return atomic.LoadInt32(&attempts) > before })
+	cancel()
+	if err := <-done; err != iot.ErrCancelled {
+		t.Fatalf("Wrong error returned after cancelling: %v", err)
+	}
+}
+
+func TestReconnectPolicyBackoff(t *testing.T) {
+	policy := iot.DefaultReconnectPolicy()
+	tests := []struct {
+		retry    int
+		expected time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second * 2},
+		{2, time.Second * 4},
+		{10, time.Minute},
+		{1000, time.Minute},
+	}
+	for _, test := range tests {
+		backoff := policy.Backoff(test.retry)
+		jitter := time.Duration(float64(test.expected) * policy.Jitter)
+		if backoff < test.expected-jitter || backoff > test.expected+jitter {
+			t.Fatalf("Wrong backoff for retry %v: %v", test.retry, backoff)
+		}
+	}
+	// Intervals never overflow or drop to zero, even without a maximum interval or with a zero value policy
+	for _, policy := range []*iot.ReconnectPolicy{{InitialInterval: time.Second, Multiplier: 2}, {}, {Jitter: 1}} {
+		for _, retry := range []int{0, 34, 100, 10000} {
+			if backoff := policy.Backoff(retry); backoff <= 0 {
+				t.Fatalf("Backoff for retry %v of %+v isn't positive: %v", retry, policy, backoff)
+			}
+		}
+	}
+	if backoff := (&iot.ReconnectPolicy{}).Backoff(0); backoff != time.Second {
+		t.Fatalf("Wrong backoff for a zero value policy: %v", backoff)
+	}
+}
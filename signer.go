@@ -0,0 +1,161 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// ErrUnsupportedKey is returned when a key is not an RSA or P-256 EC key.
+var ErrUnsupportedKey = fmt.Errorf("unsupported key type")
+
+// LoadSigner loads a PEM encoded RSA or EC private key from a file and returns it as a crypto.Signer.
+// The key is held in process memory.
+// To use keys that are held in hardware or by another process, provide a different crypto.Signer implementation.
+func LoadSigner(privateKeyPath string) (crypto.Signer, error) {
+	keyBytes, err := ioutil.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(keyBytes, nil)
+}
+
+// LoadSignerCredentials creates a Credentials struct from the given certificate and signer.
+// The signer is used to sign auth tokens and to authenticate TLS connections.
+// If certificatePath is empty, no client certificate will be sent when connecting.
+func LoadSignerCredentials(certificatePath string, signer crypto.Signer) (*Credentials, error) {
+	credentialType, err := signerCredentialType(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := &Credentials{
+		Type:   credentialType,
+		Signer: signer,
+	}
+
+	if certificatePath != "" {
+		certificatePEM, err := ioutil.ReadFile(certificatePath)
+		if err != nil {
+			return nil, err
+		}
+		credentials.Certificate, err = parseCertificate(certificatePEM, signer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return credentials, nil
+}
+
+// signer returns the crypto.Signer that should be used to sign auth tokens.
+func (c *Credentials) signer() (crypto.Signer, error) {
+	if c.Signer != nil {
+		return c.Signer, nil
+	}
+	signer, ok := c.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+	return signer, nil
+}
+
+// tlsCertificate returns the client certificate to use for TLS connections.
+func (c *Credentials) tlsCertificate() tls.Certificate {
+	certificate := c.Certificate
+	if c.Signer != nil && len(certificate.Certificate) > 0 {
+		certificate.PrivateKey = c.Signer
+	}
+	return certificate
+}
+
+func signerCredentialType(signer crypto.Signer) (CredentialType, error) {
+	switch key := signer.Public().(type) {
+	case *rsa.PublicKey:
+		return CredentialTypeRSA, nil
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().BitSize != 256 {
+			return 0, ErrUnsupportedKey
+		}
+		return CredentialTypeEC, nil
+	default:
+		return 0, ErrUnsupportedKey
+	}
+}
+
+// signingMethodRS256 and signingMethodES256 sign auth tokens using a crypto.Signer
+var (
+	signingMethodRS256 = &signerSigningMethod{verifier: jwt.SigningMethodRS256}
+	signingMethodES256 = &signerSigningMethod{verifier: jwt.SigningMethodES256, ecdsaKeySize: 32}
+)
+
+// signerSigningMethod is a jwt.SigningMethod that signs using a crypto.Signer.
+// This allows auth tokens to be signed by keys that are not held in process memory.
+type signerSigningMethod struct {
+	verifier     jwt.SigningMethod
+	ecdsaKeySize int
+}
+
+// Alg returns the name of the signing algorithm
+func (m *signerSigningMethod) Alg() string {
+	return m.verifier.Alg()
+}
+
+// Verify verifies the signature using the given public key
+func (m *signerSigningMethod) Verify(signingString, signature string, key interface{}) error {
+	return m.verifier.Verify(signingString, signature, key)
+}
+
+// Sign signs the signing string using the given crypto.Signer
+func (m *signerSigningMethod) Sign(signingString string, key interface{}) (string, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	digest := sha256.Sum256([]byte(signingString))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	if m.ecdsaKeySize > 0 {
+		// crypto.Signer returns an ASN.1 encoded signature but JWT requires the raw R and S values
+		signature, err = rawECDSASignature(signature, m.ecdsaKeySize)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return jwt.EncodeSegment(signature), nil
+}
+
+func rawECDSASignature(der []byte, keySize int) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, 2*keySize)
+	rBytes := sig.R.Bytes()
+	sBytes := sig.S.Bytes()
+	if len(rBytes) > keySize || len(sBytes) > keySize {
+		return nil, ErrUnsupportedKey
+	}
+	copy(raw[keySize-len(rBytes):keySize], rBytes)
+	copy(raw[2*keySize-len(sBytes):], sBytes)
+	return raw, nil
+}
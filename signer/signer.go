@@ -0,0 +1,185 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+// Package signer provides a crypto.Signer that delegates signing to a separate process over a local socket.
+//
+// This allows a device's private key to be held by a process that has access to a hardware token,
+// such as a PKCS#11 module or a TPM, while the IoT application itself never sees the key.
+// The returned signer can be used with iot.LoadSignerCredentials.
+//
+// The signing process can be implemented using Serve, which answers requests using any crypto.Signer.
+package signer
+
+import (
+	"bufio"
+	"crypto"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is the default value for SocketSigner.Timeout
+const DefaultTimeout = time.Second * 10
+
+const (
+	opPublicKey = "public"
+	opSign      = "sign"
+)
+
+// request is sent by the client to the signing process.
+type request struct {
+	Op     string      `json:"op"`
+	Digest []byte      `json:"digest,omitempty"`
+	Hash   crypto.Hash `json:"hash,omitempty"`
+	// PSSSaltLength is set when RSA-PSS signing is requested
+	PSSSaltLength *int `json:"pss_salt_length,omitempty"`
+}
+
+// response is sent by the signing process to the client.
+type response struct {
+	PublicKey []byte `json:"public_key,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// SocketSigner is a crypto.Signer that sends signing requests to another process over a socket.
+type SocketSigner struct {
+	// Timeout limits how long connecting to the signing process and each request may take,
+	// so that a signing process that hangs doesn't block connecting or refreshing auth tokens.
+	// If it is zero, DefaultTimeout is used.
+	Timeout time.Duration
+
+	network   string
+	address   string
+	publicKey crypto.PublicKey
+}
+
+// NewSocketSigner connects to the signing process listening on the given address and retrieves its public key.
+// The network is usually "unix". Retrieving the public key uses DefaultTimeout.
+func NewSocketSigner(network string, address string) (*SocketSigner, error) {
+	s := &SocketSigner{
+		network: network,
+		address: address,
+	}
+	resp, err := s.call(&request{Op: opPublicKey})
+	if err != nil {
+		return nil, err
+	}
+	s.publicKey, err = x509.ParsePKIXPublicKey(resp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Public returns the public key of the signing process
+func (s *SocketSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign asks the signing process to sign the digest.
+// Both crypto.Hash and *rsa.PSSOptions are supported as SignerOpts.
+// The random source is ignored because the signing process provides its own.
+func (s *SocketSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	req := &request{Op: opSign, Digest: digest, Hash: opts.HashFunc()}
+	switch o := opts.(type) {
+	case crypto.Hash:
+	case *rsa.PSSOptions:
+		saltLength := o.SaltLength
+		req.PSSSaltLength = &saltLength
+	default:
+		return nil, fmt.Errorf("unsupported signer options: %T", opts)
+	}
+	resp, err := s.call(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
+
+func (s *SocketSigner) call(req *request) (*response, error) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	conn, err := net.DialTimeout(s.network, s.address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	resp := &response{}
+	if err = json.NewDecoder(conn).Decode(resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("signing process returned an error: %s", resp.Error)
+	}
+	return resp, nil
+}
+
+// Serve answers signing requests from SocketSigner clients using the given signer.
+// It returns when the listener is closed.
+func Serve(listener net.Listener, signer crypto.Signer) error {
+	publicKey, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveConn(conn, signer, publicKey)
+		}()
+	}
+}
+
+func serveConn(conn net.Conn, signer crypto.Signer, publicKey []byte) {
+	defer conn.Close()
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	encoder := json.NewEncoder(conn)
+	for {
+		req := &request{}
+		if err := decoder.Decode(req); err != nil {
+			return
+		}
+		resp := &response{}
+		switch req.Op {
+		case opPublicKey:
+			resp.PublicKey = publicKey
+		case opSign:
+			var opts crypto.SignerOpts = req.Hash
+			if req.PSSSaltLength != nil {
+				opts = &rsa.PSSOptions{SaltLength: *req.PSSSaltLength, Hash: req.Hash}
+			}
+			signature, err := signer.Sign(crand.Reader, req.Digest, opts)
+			if err != nil {
+				resp.Error = err.Error()
+			}
+			resp.Signature = signature
+		default:
+			resp.Error = fmt.Sprintf("unknown operation: %s", req.Op)
+		}
+		if err := encoder.Encode(resp); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package signer
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vaelen/iot"
+)
+
+func TestSocketSigner(t *testing.T) {
+	tests := []struct {
+		certificatePath string
+		privateKeyPath  string
+	}{
+		{"../test_keys/rsa_cert.pem", "../test_keys/rsa_private.pem"},
+		{"../test_keys/ec_cert.pem", "../test_keys/ec_private.pem"},
+	}
+	for _, test := range tests {
+		address := startSigningProcess(t, test.privateKeyPath)
+
+		signer, err := NewSocketSigner("unix", address)
+		if err != nil {
+			t.Fatalf("Couldn't connect to signing process: %v", err)
+		}
+
+		digest := sha256.Sum256([]byte("test"))
+		signature, err := signer.Sign(nil, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatalf("Couldn't sign: %v", err)
+		}
+		certificate := loadCertificate(t, test.certificatePath)
+		err = certificate.CheckSignature(signatureAlgorithm(certificate), []byte("test"), signature)
+		if err != nil {
+			t.Fatalf("Signature not valid: %v", err)
+		}
+
+		credentials, err := iot.LoadSignerCredentials(test.certificatePath, signer)
+		if err != nil {
+			t.Fatalf("Couldn't load credentials: %v", err)
+		}
+		doTLSTest(t, credentials, certificate)
+	}
+}
+
+func TestSocketSignerWithoutProcess(t *testing.T) {
+	_, err := NewSocketSigner("unix", filepath.Join(tempDir(t), "missing.sock"))
+	if err == nil {
+		t.Fatal("Connecting to a missing signing process didn't return an error")
+	}
+}
+
+func TestSocketSignerTimeout(t *testing.T) {
+	signer, err := NewSocketSigner("unix", startSigningProcess(t, "../test_keys/rsa_private.pem"))
+	if err != nil {
+		t.Fatalf("Couldn't connect to signing process: %v", err)
+	}
+
+	// A signing process that never answers
+	address := filepath.Join(tempDir(t), "hung.sock")
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	signer.address = address
+	signer.Timeout = time.Millisecond * 100
+	digest := sha256.Sum256([]byte("test"))
+	start := time.Now()
+	if _, err = signer.Sign(nil, digest[:], crypto.SHA256); err == nil {
+		t.Fatal("Signing with a hung signing process didn't return an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Fatalf("Signing didn't time out: %v", elapsed)
+	}
+}
+
+// doTLSTest checks that the signer can be used to authenticate a TLS connection using a client certificate
+func doTLSTest(t *testing.T, credentials *iot.Credentials, certificate *x509.Certificate) {
+	serverCertificate, err := tls.LoadX509KeyPair("../test_keys/server_cert.pem", "../test_keys/server_private.pem")
+	if err != nil {
+		t.Fatalf("Couldn't load server certificate: %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't start TLS server: %v", err)
+	}
+	defer listener.Close()
+
+	peer := make(chan []*x509.Certificate, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			peer <- nil
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		tlsConn.Handshake()
+		peer <- tlsConn.ConnectionState().PeerCertificates
+	}()
+
+	options := &iot.ThingOptions{Credentials: credentials, InsecureSkipVerify: true}
+	conn, err := tls.Dial("tcp", listener.Addr().String(), iot.NewTLSConfig(options))
+	if err != nil {
+		t.Fatalf("Couldn't connect using client certificate: %v", err)
+	}
+	conn.Close()
+
+	certificates := <-peer
+	if len(certificates) == 0 || !certificates[0].Equal(certificate) {
+		t.Fatal("Server didn't receive the client certificate")
+	}
+}
+
+func startSigningProcess(t *testing.T, privateKeyPath string) string {
+	signer, err := iot.LoadSigner(privateKeyPath)
+	if err != nil {
+		t.Fatalf("Couldn't load signer: %v", err)
+	}
+	address := filepath.Join(tempDir(t), "signer.sock")
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatalf("Couldn't start signing process: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go Serve(listener, signer)
+	return address
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "signer-")
+	if err != nil {
+		t.Fatalf("Couldn't create temp directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func loadCertificate(t *testing.T, path string) *x509.Certificate {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Couldn't read certificate: %v", err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		t.Fatalf("No certificate found in %s", path)
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Couldn't parse certificate: %v", err)
+	}
+	return certificate
+}
+
+func signatureAlgorithm(certificate *x509.Certificate) x509.SignatureAlgorithm {
+	if certificate.PublicKeyAlgorithm == x509.ECDSA {
+		return x509.ECDSAWithSHA256
+	}
+	return x509.SHA256WithRSA
+}
@@ -0,0 +1,151 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// stateManager keeps track of the desired and published state of a device.
+// Rapid state updates are coalesced so that only the most recent state is published,
+// and state that hasn't changed since it was last published is skipped.
+type stateManager struct {
+	mu sync.Mutex
+	// desired is the most recent state passed to PublishState.
+	desired []byte
+	// published is the state that was last published successfully.
+	published []byte
+	// current is true if published is the state currently known by the server.
+	current bool
+	// sending is true while a goroutine is publishing the desired state.
+	sending bool
+}
+
+// update sets the desired state.
+// It returns true if the caller should publish the state, or false if the state hasn't
+// changed or another goroutine is already publishing and will pick up the new state.
+func (s *stateManager) update(message []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.desired = append([]byte{}, message...)
+	if s.sending || s.upToDate() {
+		return false
+	}
+	s.sending = true
+	return true
+}
+
+// reset marks the published state as unknown to the server, such as after reconnecting.
+// It returns true if the caller should publish the desired state.
+func (s *stateManager) reset() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = false
+	if s.sending || s.desired == nil {
+		return false
+	}
+	s.sending = true
+	return true
+}
+
+// next returns the state that should be published.
+// If the published state is up to date, it returns false and the caller should stop publishing.
+func (s *stateManager) next() ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.desired == nil || s.upToDate() {
+		s.sending = false
+		return nil, false
+	}
+	return s.desired, true
+}
+
+// sent records that the given state was published.
+func (s *stateManager) sent(message []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published = message
+	s.current = true
+}
+
+// restore sets the desired state to a state that was queued while offline,
+// unless a state has been passed to PublishState since.
+func (s *stateManager) restore(message []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if message != nil && s.desired == nil {
+		s.desired = message
+	}
+}
+
+// failed stops publishing after an error. The desired state is kept so that it is published later.
+func (s *stateManager) failed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sending = false
+}
+
+// upToDate returns true if the desired state has been published. The caller must hold the lock.
+func (s *stateManager) upToDate() bool {
+	return s.current && bytes.Equal(s.desired, s.published)
+}
+
+// publishState publishes the desired state until the published state is up to date.
+// The caller must have received true from update or reset.
+func (t *thing) publishState(ctx context.Context, state *stateManager, topic string) error {
+	for {
+		message, ok := state.next()
+		if !ok {
+			return nil
+		}
+		if t.client == nil || !t.client.IsConnected() {
+			// The state will be published after reconnecting
+			state.failed()
+			if t.outbox != nil {
+				return t.outbox.pushState(topic, t.options.StateQOS, message)
+			}
+			return ErrNotConnected
+		}
+		err := t.limiters.get(topic, t.options).wait(ctx, t.options.RateLimitNoWait)
+		if err != nil {
+			state.failed()
+			return err
+		}
+		// The state may have changed while waiting, so publish the most recent state
+		message, ok = state.next()
+		if !ok {
+			return nil
+		}
+		err = t.send(ctx, topic, message, t.options.StateQOS)
+		if err != nil {
+			state.failed()
+			if err == ErrNotConnected && t.outbox != nil {
+				return t.outbox.pushState(topic, t.options.StateQOS, message)
+			}
+			return err
+		}
+		state.sent(message)
+		if t.outbox != nil {
+			t.outbox.removeState(topic)
+		}
+	}
+}
+
+// republishState publishes the desired state again in the background after reconnecting.
+// If the state was queued in the outbox, such as before a restart, the queued state is published.
+func (t *thing) republishState(state *stateManager, topic string) {
+	if t.outbox != nil {
+		state.restore(t.outbox.state(topic))
+	}
+	if !state.reset() {
+		return
+	}
+	go func() {
+		if err := t.publishState(context.Background(), state, topic); err != nil {
+			t.errorf("Couldn't publish state after reconnecting: %v", err)
+		}
+	}()
+}
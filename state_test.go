@@ -0,0 +1,105 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/vaelen/iot"
+)
+
+func TestStateCoalescing(t *testing.T) {
+	ctx := context.Background()
+	published := make(chan string, 10)
+	iot.NewClient = func(t iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
+		mockClient = iot.NewMockClient(t, o)
+		return &notifyingClient{mockClient, published}
+	}
+	mockClock := clock.NewMock()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.Clock = mockClock
+
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+
+	// Unchanged state is not published again
+	for i := 0; i < 2; i++ {
+		if err := thing.PublishState(ctx, []byte("a")); err != nil {
+			t.Fatalf("Couldn't publish state: %v", err)
+		}
+	}
+	checkStates(t, "a")
+
+	// b waits for the rate limit, and is replaced by c and then d while waiting
+	done := make(chan error, 1)
+	go func() { done <- thing.PublishState(ctx, []byte("b")) }()
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	waitFor(t, func() bool { return thing.PublishState(cancelled, []byte("c")) == nil })
+	if err := thing.PublishState(ctx, []byte("d")); err != nil {
+		t.Fatalf("Couldn't publish state: %v", err)
+	}
+	waitFor(t, func() bool {
+		mockClock.Add(time.Millisecond * 100)
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Couldn't publish state: %v", err)
+			}
+			return true
+		default:
+			return false
+		}
+	})
+	checkStates(t, "a", "d")
+	<-published
+	<-published
+
+	// The last state is published again after reconnecting
+	doDisconnectTest(t, thing)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+	waitFor(t, func() bool {
+		mockClock.Add(time.Millisecond * 100)
+		select {
+		case <-published:
+			return true
+		default:
+			return false
+		}
+	})
+	checkStates(t, "d")
+}
+
+// notifyingClient sends the topic of each published message to a channel
+type notifyingClient struct {
+	*iot.MockMQTTClient
+	published chan string
+}
+
+func (c *notifyingClient) Publish(ctx context.Context, topic string, qos uint8, payload interface{}) error {
+	_, err := c.PublishWithID(ctx, topic, qos, payload)
+	return err
+}
+
+func (c *notifyingClient) PublishWithID(ctx context.Context, topic string, qos uint8, payload interface{}) (uint16, error) {
+	id, err := c.MockMQTTClient.PublishWithID(ctx, topic, qos, payload)
+	c.published <- topic
+	return id, err
+}
+
+func checkStates(t *testing.T, states ...string) {
+	l := mockClient.Messages[StateTopic]
+	if len(l) != len(states) {
+		t.Fatalf("Wrong number of states published. Expected: %v, Actual: %v", states, l)
+	}
+	for i, state := range states {
+		if string(l[i].([]byte)) != state {
+			t.Fatalf("Wrong state published. Expected: %v, Actual: %v", state, string(l[i].([]byte)))
+		}
+	}
+}
@@ -6,37 +6,88 @@ package iot
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/benbjohnson/clock"
-	"github.com/dgrijalva/jwt-go"
 )
 
 type thing struct {
-	options       *ThingOptions
-	client        MQTTClient
-	publishTicker *clock.Ticker
+	options *ThingOptions
+	client  MQTTClient
+	// limiters limit how often state updates and events are published.
+	limiters rateLimiters
+	// wrapper is the Thing passed to handlers when thing is embedded in another type, such as a Gateway.
+	wrapper Thing
+	// onConnect is called after the standard subscriptions have been made on each connect.
+	onConnect MQTTOnConnectHandler
+	// onDisconnect is called before the client disconnects.
+	onDisconnect func(ctx context.Context)
+	// publishes remembers recently published messages for correlating errors.
+	publishes publishLog
+	// tokens generates auth tokens and refreshes them before they expire.
+	tokens *tokenManager
+	// credentials is ThingOptions.CredentialSet, or a CredentialSet containing only ThingOptions.Credentials.
+	credentials *CredentialSet
+	// servers are the servers passed to Connect, which are used when reconnecting.
+	servers []string
+	// outbox buffers messages that are published while offline.
+	outbox *outbox
+	// state coalesces state updates and remembers the state to publish after reconnecting.
+	state stateManager
+	// configs persists the last configuration received from the server.
+	configs *configStore
+	// configLoaded is true after the persisted configuration has been delivered.
+	configLoaded bool
+	// reconnects reconnects in the background after the connection is lost.
+	reconnects reconnector
 }
 
 // PublishState publishes the current device state
 func (t *thing) PublishState(ctx context.Context, message []byte) error {
-	return t.publish(ctx, t.stateTopic(), message, t.options.StateQOS)
+	message, err := t.backend().EncodeState(message)
+	if err != nil {
+		return err
+	}
+	if !t.state.update(message) {
+		return nil
+	}
+	return t.publishState(ctx, &t.state, t.stateTopic())
 }
 
 // PublishEvent publishes an event. An optional hierarchy of event names can be provided.
 func (t *thing) PublishEvent(ctx context.Context, message []byte, event ...string) error {
+	if err := ValidateSubfolder(event...); err != nil {
+		return err
+	}
 	return t.publish(ctx, t.eventsTopic(event...), message, t.options.EventQOS)
 }
 
+// PublishEventValue encodes v and publishes it as an event.
+func (t *thing) PublishEventValue(ctx context.Context, v interface{}, event ...string) error {
+	payload, subfolder, err := eventRegistryFor(t.options).encodeEvent(v, event)
+	if err != nil {
+		return err
+	}
+	return t.PublishEvent(ctx, payload, subfolder...)
+}
+
 // Connect to the given MQTT server(s)
 func (t *thing) Connect(ctx context.Context, servers ...string) error {
 	if t.IsConnected() {
 		return nil
 	}
-	if t.options.ID == nil || t.options.Credentials == nil {
+	t.credentials = t.options.CredentialSet
+	if t.credentials == nil {
+		t.credentials = NewCredentialSet(t.options.Credentials)
+	}
+	if t.options.ID == nil {
 		return ErrConfigurationError
 	}
+	if err := t.backend().Validate(t.options); err != nil {
+		return err
+	}
 	if t.options.AuthTokenExpiration == 0 {
 		t.options.AuthTokenExpiration = DefaultAuthTokenExpiration
 	}
@@ -44,10 +95,32 @@ func (t *thing) Connect(ctx context.Context, servers ...string) error {
 		t.options.Clock = clock.New()
 	}
 
-	if NewClient == nil {
+	if t.options.OutboxSize > 0 && t.outbox == nil {
+		dir := ""
+		if t.options.QueueDirectory != "" {
+			dir = filepath.Join(t.options.QueueDirectory, outboxDirectory)
+		}
+		o, err := newOutbox(dir, t.options.OutboxSize, t.options.OutboxMaxAge, t.options.OutboxDropPolicy, t.options.Clock)
+		if err != nil {
+			return err
+		}
+		t.outbox = o
+	}
+
+	if !t.configLoaded {
+		if err := t.loadConfig(); err != nil {
+			return err
+		}
+	}
+
+	newClient := t.options.NewClient
+	if newClient == nil {
+		newClient = NewClient
+	}
+	if newClient == nil {
 		panic("No MQTT client specified. Please import the iot/paho package.")
 	}
-	t.client = NewClient(t, t.options)
+	t.client = newClient(t.self(), t.options)
 
 	if t.options.LogMQTT {
 		t.client.SetDebugLogger(t.options.DebugLogger)
@@ -55,29 +128,57 @@ func (t *thing) Connect(ctx context.Context, servers ...string) error {
 		t.client.SetErrorLogger(t.options.ErrorLogger)
 	}
 
-	t.client.SetClientID(t.clientID())
-
-	t.publishTicker = t.options.Clock.Ticker(time.Second * 2)
+	t.client.SetClientID(t.backend().ClientID(t.options.ID))
 
+	t.servers = servers
+	t.tokens = &tokenManager{t: t}
+	t.credentials.Reset()
+	t.credentials.setClock(t.options.Clock.Now)
+	t.credentials.setOnChange(t.credentialsChanged)
 	t.client.SetCredentialsProvider(func() (username string, password string) {
-		authToken, err := t.authToken()
+		username, password, err := t.tokens.credentials()
 		if err != nil {
 			t.errorf("Error generating auth token: %v", err)
 			return "", ""
 		}
-		return "unused", authToken
+		return username, password
 	})
 
+	t.client.SetConnectionEventHandler(t.handleConnectionEvent)
 	t.client.SetOnConnectHandler(func(client MQTTClient) {
-		client.Subscribe(ctx, t.configTopic(), t.options.ConfigQOS, t.options.ConfigHandler)
+		// This is called on every reconnect, so it must not use the context passed to Connect
+		ctx := context.Background()
+		t.publishes.reset()
+		for _, topic := range t.configTopics() {
+			err := client.Subscribe(ctx, topic, t.options.ConfigQOS, t.handleConfig)
+			if err != nil {
+				t.errorf("Couldn't subscribe to config topic: %v", err)
+			}
+		}
+		t.requestConfig(ctx, client)
+		var err error
+		if t.options.CommandHandler != nil {
+			err = client.Subscribe(ctx, t.commandsTopic()+"/#", t.options.CommandQOS, t.handleCommand)
+			if err != nil {
+				t.errorf("Couldn't subscribe to commands topic: %v", err)
+			}
+		}
+		if t.options.ErrorHandler != nil && t.errorsTopic() != "" {
+			err = client.Subscribe(ctx, t.errorsTopic(), ErrorQOS, t.handleError)
+			if err != nil {
+				t.errorf("Couldn't subscribe to errors topic: %v", err)
+			}
+		}
+		if t.onConnect != nil {
+			t.onConnect(client)
+		}
+		t.republishState(&t.state, t.stateTopic())
+		if t.outbox != nil {
+			go t.replayOutbox()
+		}
 	})
 
-	err := t.client.Connect(ctx, servers...)
-	if err != nil {
-		return err
-	}
-
-	return err
+	return t.connectWithRetry(ctx, t.options.ReconnectPolicy)
 }
 
 // IsConnected returns true of the client is currently connected to MQTT server(s)
@@ -87,81 +188,291 @@ func (t *thing) IsConnected() bool {
 
 // Disconnect from the MQTT server(s)
 func (t *thing) Disconnect(ctx context.Context) {
+	t.reconnects.stop()
 	if t.client != nil {
-		t.client.Unsubscribe(ctx, t.configTopic())
+		if t.onDisconnect != nil {
+			t.onDisconnect(ctx)
+		}
+		for _, topic := range t.configTopics() {
+			t.client.Unsubscribe(ctx, topic)
+		}
+		if t.options.CommandHandler != nil {
+			t.client.Unsubscribe(ctx, t.commandsTopic()+"/#")
+		}
+		if t.options.ErrorHandler != nil && t.errorsTopic() != "" {
+			t.client.Unsubscribe(ctx, t.errorsTopic())
+		}
 		if t.client.IsConnected() {
 			t.infof("Disconnecting")
 			t.client.Disconnect(ctx)
 		}
 	}
+	if t.tokens != nil {
+		t.tokens.stop()
+	}
+	if t.credentials != nil {
+		t.credentials.setOnChange(nil)
+	}
 }
 
-// Internal methods
-
-func (t *thing) clientID() string {
-	return fmt.Sprintf("projects/%s/locations/%s/registries/%s/devices/%s", t.options.ID.ProjectID, t.options.ID.Location, t.options.ID.Registry, t.options.ID.DeviceID)
+// AuthTokenExpiry returns the time that the current auth token expires.
+// The zero time is returned if the Thing is not connected.
+func (t *thing) AuthTokenExpiry() time.Time {
+	if t.tokens == nil {
+		return time.Time{}
+	}
+	return t.tokens.expiresAt()
 }
 
-func (t *thing) authToken() (string, error) {
-	var signingMethod jwt.SigningMethod
-	switch t.options.Credentials.Type {
-	case CredentialTypeEC:
-		signingMethod = jwt.GetSigningMethod("ES256")
-	case CredentialTypeRSA:
-		fallthrough
-	default:
-		signingMethod = jwt.GetSigningMethod("RS256")
+// OutboxStats returns statistics about messages that are buffered while offline.
+func (t *thing) OutboxStats() OutboxStats {
+	if t.outbox == nil {
+		return OutboxStats{}
 	}
+	return t.outbox.stats()
+}
 
-	wt := jwt.New(signingMethod)
+// Internal methods
 
-	expirationInterval := t.options.AuthTokenExpiration
-	if expirationInterval == 0 {
-		expirationInterval = time.Hour
+func (t *thing) self() Thing {
+	if t.wrapper != nil {
+		return t.wrapper
 	}
+	return t
+}
 
-	wt.Claims = &jwt.StandardClaims{
-		IssuedAt:  time.Now().Unix(),
-		ExpiresAt: time.Now().Add(expirationInterval).Unix(),
-		Audience:  t.options.ID.ProjectID,
-	}
+func (t *thing) backend() Backend {
+	return backendFor(t.options)
+}
 
-	t.debugf("Auth Token: %+v", wt.Claims)
+// reconnect gracefully disconnects and reconnects to the servers passed to Connect,
+// retrying in the same way as after the connection is lost.
+func (t *thing) reconnect(ctx context.Context) error {
+	if t.client == nil {
+		return ErrNotConnected
+	}
+	if t.client.IsConnected() {
+		t.client.Disconnect(ctx)
+	}
+	t.handleConnectionEvent(ConnectionEvent{Type: ConnectionReconnecting})
+	return t.connectWithRetry(ctx, t.reconnectPolicy())
+}
 
-	token, err := wt.SignedString(t.options.Credentials.PrivateKey)
-	if err != nil {
-		return "", err
+// connect connects the client, falling back to the next credentials if the server rejects the current ones.
+func (t *thing) connect(ctx context.Context) error {
+	for {
+		err := t.client.Connect(ctx, t.servers...)
+		if err != ErrNotAuthorized || !t.credentials.fallback() {
+			return err
+		}
+		t.errorf("Authentication failed, trying next credentials")
 	}
+}
 
-	return token, nil
+// credentialsChanged reconnects using the new credentials after the credential set is replaced.
+func (t *thing) credentialsChanged() {
+	if !t.IsConnected() {
+		return
+	}
+	t.infof("Credentials changed, reconnecting")
+	t.reconnects.restart(t, nil)
 }
 
-func (t *thing) configTopic() string {
-	return fmt.Sprintf("/devices/%s/config", t.options.ID.DeviceID)
+func (t *thing) configTopics() []string {
+	return t.backend().ConfigTopics(t.options.ID)
 }
 
 func (t *thing) stateTopic() string {
-	return fmt.Sprintf("/devices/%s/state", t.options.ID.DeviceID)
+	return t.backend().StateTopic(t.options.ID)
+}
+
+func (t *thing) commandsTopic() string {
+	return t.backend().CommandsTopic(t.options.ID)
 }
 
 func (t *thing) eventsTopic(subTopic ...string) string {
-	if len(subTopic) == 0 {
-		return fmt.Sprintf("/devices/%s/events", t.options.ID.DeviceID)
-	}
-	return fmt.Sprintf("/devices/%s/events/%s", t.options.ID.DeviceID, strings.Join(subTopic, "/"))
+	return t.backend().EventsTopic(t.options.ID, subTopic...)
+}
+
+func (t *thing) errorsTopic() string {
+	return t.backend().ErrorsTopic(t.options.ID)
 }
 
 func (t *thing) publish(ctx context.Context, topic string, message []byte, qos uint8) error {
-	<-t.publishTicker.C // Don't publish more than once per second
-	err := t.client.Publish(ctx, topic, qos, message)
+	if t.client == nil {
+		return ErrNotConnected
+	}
+	if t.outbox != nil && (!t.client.IsConnected() || t.outbox.len() > 0) {
+		// Queue the message behind any messages that are waiting to be sent
+		return t.enqueue(topic, message, qos)
+	}
+	err := t.limiters.get(topic, t.options).wait(ctx, t.options.RateLimitNoWait)
+	if err != nil {
+		t.debugf("RATE LIMITED - Topic: %s, Message Length: %d bytes, Error: %v", topic, len(message), err)
+		return err
+	}
+	err = t.send(ctx, topic, message, qos)
+	if err == ErrNotConnected && t.outbox != nil {
+		return t.enqueue(topic, message, qos)
+	}
+	return err
+}
+
+func (t *thing) enqueue(topic string, message []byte, qos uint8) error {
+	err := t.outbox.push(topic, qos, message)
+	if err != nil {
+		t.debugf("QUEUE FAILED - Topic: %s, Message Length: %d bytes, Error: %v", topic, len(message), err)
+		return err
+	}
+	t.debugf("QUEUED - Topic: %s, Message Length: %d bytes", topic, len(message))
+	if t.client.IsConnected() {
+		go t.replayOutbox()
+	}
+	return nil
+}
+
+// replayOutbox sends the messages in the outbox in order until it is empty or sending fails.
+func (t *thing) replayOutbox() {
+	if !t.outbox.startReplay() {
+		return
+	}
+	ctx := context.Background()
+	for {
+		m := t.outbox.next()
+		if m == nil {
+			return
+		}
+		err := t.limiters.get(m.Topic, t.options).wait(ctx, false)
+		if err == nil {
+			err = t.send(ctx, m.Topic, m.Payload, m.QOS)
+		}
+		if err != nil {
+			t.outbox.stopReplay()
+			t.errorf("Couldn't send queued message: %v", err)
+			return
+		}
+		t.outbox.remove(m)
+	}
+}
+
+func (t *thing) send(ctx context.Context, topic string, message []byte, qos uint8) error {
+	var messageID uint16
+	var err error
+	if publisher, ok := t.client.(MQTTMessageIDPublisher); ok {
+		messageID, err = publisher.PublishWithID(ctx, topic, qos, message)
+	} else {
+		err = t.client.Publish(ctx, topic, qos, message)
+	}
 	if err != nil {
 		t.debugf("SEND FAILED - Topic: %s, Message Length: %d bytes, Error: %v", topic, len(message), err)
 		return err
 	}
 	t.debugf("SENT - Topic: %s, Message Length: %d bytes", topic, len(message))
+	t.recordPublish(topic, int(messageID), len(message))
 	return nil
 }
 
+func (t *thing) recordPublish(topic string, messageID int, length int) {
+	t.publishes.add(PublishRecord{
+		Topic:     topic,
+		DeviceID:  topicID(topic, t.options).DeviceID,
+		MessageID: messageID,
+		Length:    length,
+		Time:      t.options.Clock.Now(),
+	})
+}
+
+func (t *thing) handleConfig(thing Thing, topic string, payload []byte) {
+	config, ok, refresh := t.backend().DecodeConfig(t.options.ID, topic, payload)
+	if refresh {
+		// Handlers must not block the client, so the config is requested in the background
+		go t.requestConfig(context.Background(), t.client)
+	}
+	if !ok {
+		return
+	}
+	if t.options.ValidateConfig != nil {
+		if err := t.options.ValidateConfig(thing, config); err != nil {
+			t.errorf("Config rejected: %v", err)
+			return
+		}
+	}
+	if t.options.ConfigHandler != nil {
+		t.options.ConfigHandler(thing, config)
+	}
+	// The config is persisted after it has been handled, so that a config that crashes the handler isn't used again after restarting
+	if t.configs != nil {
+		if err := t.configs.save(config, t.options.Clock.Now()); err != nil {
+			t.errorf("Couldn't persist config: %v", err)
+		}
+	}
+}
+
+// requestConfig requests the current config from backends that don't send it automatically.
+func (t *thing) requestConfig(ctx context.Context, client MQTTClient) {
+	topic, payload := t.backend().ConfigRequest(t.options.ID)
+	if topic == "" {
+		return
+	}
+	if err := client.Publish(ctx, topic, ConfigRequestQOS, payload); err != nil {
+		t.errorf("Couldn't request config: %v", err)
+	}
+}
+
+// loadConfig delivers the persisted configuration, if there is one, to the cached config handler.
+func (t *thing) loadConfig() error {
+	dir := t.options.ConfigDirectory
+	if dir == "" {
+		dir = t.options.QueueDirectory
+	}
+	configs, err := newConfigStore(dir)
+	if err != nil {
+		return err
+	}
+	t.configs = configs
+	t.configLoaded = true
+	if configs == nil {
+		return nil
+	}
+
+	config, err := configs.load()
+	if err != nil {
+		// A corrupt config shouldn't prevent the device from connecting and receiving a new one
+		t.errorf("Couldn't load persisted config: %v", err)
+		return nil
+	}
+	if len(config) == 0 {
+		return nil
+	}
+	if t.options.CachedConfigHandler == nil {
+		return nil
+	}
+	t.debugf("Using persisted config - Message Length: %d bytes", len(config))
+	t.options.CachedConfigHandler(t.self(), config)
+	return nil
+}
+
+func (t *thing) handleCommand(thing Thing, topic string, command []byte) {
+	subfolder := strings.TrimPrefix(strings.TrimPrefix(topic, t.commandsTopic()), "/")
+	t.debugf("Command Received - Subfolder: %s, Message Length: %d bytes", subfolder, len(command))
+	if t.options.CommandHandler != nil {
+		t.options.CommandHandler(thing, subfolder, command)
+	}
+}
+
+func (t *thing) handleError(thing Thing, topic string, payload []byte) {
+	e := ParseDeviceError(payload)
+	deviceID := e.DeviceID
+	if deviceID == "" {
+		deviceID = t.options.ID.DeviceID
+	}
+	e.Publish = t.publishes.find(deviceID, e.MessageID)
+	t.errorf("Error Received: %v", e)
+	if t.options.ErrorHandler != nil {
+		t.options.ErrorHandler(thing, e)
+	}
+}
+
 func (t *thing) log(logger Logger, format string, v ...interface{}) {
 	if logger != nil {
 		msg := fmt.Sprintf(format, v...)
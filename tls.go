@@ -0,0 +1,83 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// GoogleRootCAs returns a certificate pool containing the root certificates in GoogleRootCertificatesPEM.
+func GoogleRootCAs() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(GoogleRootCertificatesPEM))
+	return pool
+}
+
+// LoadRootCAs creates a certificate pool from the given PEM encoded certificate files.
+func LoadRootCAs(certificatePaths ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, path := range certificatePaths {
+		pemBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("no certificates found in %s", path)
+		}
+	}
+	return pool, nil
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of the given DER encoded certificate.
+// The result can be used in ThingOptions.ServerCertificateFingerprints.
+func CertificateFingerprint(certificate []byte) []byte {
+	fingerprint := sha256.Sum256(certificate)
+	return fingerprint[:]
+}
+
+// NewTLSConfig returns the TLS configuration that MQTT clients should use when connecting with the given options.
+func NewTLSConfig(options *ThingOptions) *tls.Config {
+	config := &tls.Config{
+		RootCAs:            options.RootCAs,
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+	if options.CredentialSet != nil {
+		credentialSet := options.CredentialSet
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certificate := tls.Certificate{}
+			if credentials := credentialSet.Current(); credentials != nil {
+				certificate = credentials.tlsCertificate()
+			}
+			return &certificate, nil
+		}
+	} else if options.Credentials != nil {
+		config.Certificates = []tls.Certificate{options.Credentials.tlsCertificate()}
+	}
+	if len(options.ServerCertificateFingerprints) > 0 {
+		fingerprints := options.ServerCertificateFingerprints
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return verifyFingerprints(fingerprints, rawCerts)
+		}
+	}
+	return config
+}
+
+// verifyFingerprints returns nil if any of the certificates matches one of the fingerprints
+func verifyFingerprints(fingerprints [][]byte, rawCerts [][]byte) error {
+	for _, cert := range rawCerts {
+		fingerprint := CertificateFingerprint(cert)
+		for _, pinned := range fingerprints {
+			if bytes.Equal(fingerprint, pinned) {
+				return nil
+			}
+		}
+	}
+	return ErrCertificateNotPinned
+}
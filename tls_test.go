@@ -0,0 +1,113 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+
+	"github.com/vaelen/iot"
+)
+
+const CACertificatePath = "test_keys/ca_cert.pem"
+const ServerCertificatePath = "test_keys/server_cert.pem"
+const ServerPrivateKeyPath = "test_keys/server_private.pem"
+
+func TestGoogleRootCAs(t *testing.T) {
+	count := 0
+	rest := []byte(iot.GoogleRootCertificatesPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			t.Fatalf("Couldn't parse Google root certificate: %v", err)
+		}
+		count++
+	}
+	if count == 0 {
+		t.Fatal("No Google root certificates found")
+	}
+	if iot.GoogleRootCAs() == nil {
+		t.Fatal("Google root certificate pool not created")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	address, serverCert := startTLSServer(t)
+	rootCAs, err := iot.LoadRootCAs(CACertificatePath)
+	if err != nil {
+		t.Fatalf("Couldn't load root CAs: %v", err)
+	}
+	fingerprint := iot.CertificateFingerprint(serverCert)
+
+	tests := []struct {
+		name    string
+		options *iot.ThingOptions
+		ok      bool
+	}{
+		{"system roots", &iot.ThingOptions{}, false},
+		{"google roots", &iot.ThingOptions{RootCAs: iot.GoogleRootCAs()}, false},
+		{"test roots", &iot.ThingOptions{RootCAs: rootCAs}, true},
+		{"server name", &iot.ThingOptions{RootCAs: rootCAs, ServerName: "mqtt.example.com"}, true},
+		{"wrong server name", &iot.ThingOptions{RootCAs: rootCAs, ServerName: "mqtt.googleapis.com"}, false},
+		{"pinned", &iot.ThingOptions{RootCAs: rootCAs, ServerCertificateFingerprints: [][]byte{fingerprint}}, true},
+		{"wrong pin", &iot.ThingOptions{RootCAs: rootCAs, ServerCertificateFingerprints: [][]byte{make([]byte, 32)}}, false},
+		{"insecure", &iot.ThingOptions{InsecureSkipVerify: true}, true},
+		{"insecure wrong pin", &iot.ThingOptions{InsecureSkipVerify: true, ServerCertificateFingerprints: [][]byte{make([]byte, 32)}}, false},
+	}
+
+	for _, test := range tests {
+		conn, err := tls.Dial("tcp", address, iot.NewTLSConfig(test.options))
+		if err == nil {
+			conn.Close()
+		}
+		if test.ok && err != nil {
+			t.Fatalf("%s: Couldn't connect: %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Fatalf("%s: Connected when verification should have failed", test.name)
+		}
+	}
+}
+
+func TestLoadRootCAsWithBadPath(t *testing.T) {
+	if _, err := iot.LoadRootCAs("test_keys/missing.pem"); err == nil {
+		t.Fatal("Loading a missing file didn't return an error")
+	}
+	if _, err := iot.LoadRootCAs(ECPrivateKeyPath); err == nil {
+		t.Fatal("Loading a file without certificates didn't return an error")
+	}
+}
+
+// startTLSServer starts a TLS server using the test server certificate and returns its address and DER encoded certificate
+func startTLSServer(t *testing.T) (string, []byte) {
+	certificate, err := tls.LoadX509KeyPair(ServerCertificatePath, ServerPrivateKeyPath)
+	if err != nil {
+		t.Fatalf("Couldn't load server certificate: %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatalf("Couldn't start TLS server: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}(conn)
+		}
+	}()
+	return listener.Addr().String(), certificate.Certificate[0]
+}
@@ -0,0 +1,103 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// DefaultAuthTokenRefreshMargin is the default value for ThingOptions.AuthTokenRefreshMargin
+const DefaultAuthTokenRefreshMargin = time.Minute
+
+// authTokenRetryInterval is how long to wait before trying again if a token refresh fails
+const authTokenRetryInterval = time.Second * 10
+
+// tokenManager generates auth tokens and gracefully reconnects before the current token expires.
+type tokenManager struct {
+	t      *thing
+	mu     sync.Mutex
+	expiry time.Time
+	timer  *clock.Timer
+}
+
+// credentials returns the username and password generated by the backend.
+// If the password expires, a reconnect is scheduled shortly before it expires.
+func (m *tokenManager) credentials() (string, string, error) {
+	username, password, expiry, err := backendFor(m.t.options).Credentials(m.t.options, m.t.credentials.Current())
+	if err != nil {
+		return "", "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expiry = expiry
+	if expiry.IsZero() {
+		m.cancel()
+		return username, password, nil
+	}
+	m.t.debugf("Auth token expires at %v", expiry)
+	lifetime := expiry.Sub(m.t.options.Clock.Now())
+	m.schedule(lifetime - m.margin(lifetime))
+	return username, password, nil
+}
+
+// expiresAt returns the expiration time of the current auth token.
+func (m *tokenManager) expiresAt() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.expiry
+}
+
+// stop cancels any scheduled reconnect.
+func (m *tokenManager) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cancel()
+	m.expiry = time.Time{}
+}
+
+// cancel cancels any scheduled reconnect. The caller must hold the lock.
+func (m *tokenManager) cancel() {
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+}
+
+// schedule schedules a refresh after the given duration. The caller must hold the lock.
+func (m *tokenManager) schedule(d time.Duration) {
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	if d < 0 {
+		d = 0
+	}
+	m.timer = m.t.options.Clock.AfterFunc(d, m.refresh)
+}
+
+// margin returns how long before expiration a token with the given lifetime should be refreshed.
+func (m *tokenManager) margin(lifetime time.Duration) time.Duration {
+	margin := m.t.options.AuthTokenRefreshMargin
+	if margin <= 0 {
+		margin = DefaultAuthTokenRefreshMargin
+	}
+	if margin >= lifetime {
+		margin = lifetime / 2
+	}
+	return margin
+}
+
+// refresh reconnects so that a new auth token is sent to the server.
+// The reconnect follows the ReconnectPolicy and is stopped by Disconnect.
+// If it fails, the refresh is tried again after authTokenRetryInterval.
+func (m *tokenManager) refresh() {
+	m.t.infof("Auth token expires at %v, reconnecting", m.expiresAt())
+	m.t.reconnects.restart(m.t, func() {
+		m.mu.Lock()
+		m.schedule(authTokenRetryInterval)
+		m.mu.Unlock()
+	})
+}
@@ -0,0 +1,130 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/vaelen/iot"
+)
+
+func TestAuthTokenRefresh(t *testing.T) {
+	ctx := context.Background()
+	var connections int32
+	iot.NewClient = func(t iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
+		mockClient = iot.NewMockClient(t, o)
+		return &countingClient{mockClient, &connections}
+	}
+
+	mockClock := clock.NewMock()
+	credentials := getCredentials(t, iot.CredentialTypeRSA)
+	options, _ := getOptions(t, credentials)
+	options.Clock = mockClock
+	options.AuthTokenExpiration = time.Hour
+	options.AuthTokenRefreshMargin = time.Minute * 5
+
+	thing := getThing(t, options)
+	if !thing.AuthTokenExpiry().IsZero() {
+		t.Fatalf("Auth token expiry set before connecting: %v", thing.AuthTokenExpiry())
+	}
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+
+	expected := mockClock.Now().Add(time.Hour)
+	if !thing.AuthTokenExpiry().Equal(expected) {
+		t.Fatalf("Wrong auth token expiry. Expected: %v, Actual: %v", expected, thing.AuthTokenExpiry())
+	}
+
+	mockClock.Add(time.Minute * 54)
+	if atomic.LoadInt32(&connections) != 1 {
+		t.Fatalf("Reconnected too early. Connections: %v", connections)
+	}
+
+	mockClock.Add(time.Minute)
+	waitFor(t, func() bool { return atomic.LoadInt32(&connections) == 2 })
+	if !thing.IsConnected() {
+		t.Fatal("Not connected after refreshing auth token")
+	}
+
+	thing.Disconnect(ctx)
+	if !thing.AuthTokenExpiry().IsZero() {
+		t.Fatalf("Auth token expiry set after disconnecting: %v", thing.AuthTokenExpiry())
+	}
+	mockClock.Add(time.Hour * 2)
+	if atomic.LoadInt32(&connections) != 2 {
+		t.Fatalf("Reconnected after disconnecting. Connections: %v", atomic.LoadInt32(&connections))
+	}
+}
+
+func TestAuthTokenRefreshRetry(t *testing.T) {
+	errUnavailable := fmt.Errorf("server unavailable")
+	var attempts int32
+	iot.NewClient = func(t iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
+		mockClient = iot.NewMockClient(t, o)
+		mockClient.Authenticate = func(username string, password string) error {
+			// The first two attempts to reconnect with a new auth token fail
+			if n := atomic.AddInt32(&attempts, 1); n == 2 || n == 3 {
+				return errUnavailable
+			}
+			return nil
+		}
+		return mockClient
+	}
+
+	var reconnecting int32
+	mockClock := clock.NewMock()
+	options, _ := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.Clock = mockClock
+	options.AuthTokenExpiration = time.Hour
+	options.AuthTokenRefreshMargin = time.Minute * 5
+	options.ReconnectPolicy = &iot.ReconnectPolicy{InitialInterval: time.Second, Multiplier: 2}
+	options.ConnectionEventHandler = func(thing iot.Thing, event iot.ConnectionEvent) {
+		if event.Type == iot.ConnectionReconnecting {
+			atomic.AddInt32(&reconnecting, 1)
+		}
+	}
+	thing := getThing(t, options)
+	doConnectionTest(t, thing, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, thing)
+
+	// The refresh is retried according to the ReconnectPolicy
+	mockClock.Add(time.Minute * 55)
+	waitFor(t, func() bool {
+		mockClock.Add(time.Millisecond * 100)
+		return atomic.LoadInt32(&attempts) == 4 && thing.IsConnected()
+	})
+	if n := atomic.LoadInt32(&reconnecting); n != 3 {
+		t.Fatalf("Wrong number of reconnecting events: %v", n)
+	}
+	expected := mockClock.Now().Add(time.Hour)
+	if expiry := thing.AuthTokenExpiry(); expiry.Before(expected.Add(-time.Second)) || expiry.After(expected) {
+		t.Fatalf("Auth token wasn't refreshed. Expiry: %v", expiry)
+	}
+}
+
+// countingClient counts the number of times Connect is called
+type countingClient struct {
+	*iot.MockMQTTClient
+	connections *int32
+}
+
+func (c *countingClient) Connect(ctx context.Context, servers ...string) error {
+	defer atomic.AddInt32(c.connections, 1)
+	return c.MockMQTTClient.Connect(ctx, servers...)
+}
+
+// waitFor waits for a condition that is satisfied by a background goroutine
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 500; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("Timed out waiting for condition")
+}
@@ -7,3 +7,20 @@ openssl req -x509 -nodes -newkey rsa:2048 -keyout rsa_private.pem -days 1000000
 
 openssl ecparam -genkey -name prime256v1 -noout -out ec_private.pem
 openssl req -x509 -new -key ec_private.pem -days 1000000 -out ec_cert.pem -subj "/CN=unused"
+
+# Generate alternate encodings of the keys for testing key parsing.
+
+openssl pkcs8 -topk8 -in rsa_private.pem -v2 aes256 -passout pass:password -out rsa_private_encrypted.pem
+openssl pkcs8 -topk8 -nocrypt -in ec_private.pem -out ec_private_pkcs8.pem
+openssl ec -in ec_private.pem -aes128 -passout pass:password -out ec_private_encrypted.pem
+
+# Generate a self-signed certificate authority and a server certificate for local TLS tests.
+
+openssl ecparam -genkey -name prime256v1 -noout -out ca_private.pem
+openssl req -x509 -new -key ca_private.pem -days 1000000 -out ca_cert.pem -subj "/CN=iot test ca"
+
+openssl ecparam -genkey -name prime256v1 -noout -out server_private.pem
+openssl req -new -key server_private.pem -out server.csr -subj "/CN=localhost"
+printf "subjectAltName=DNS:localhost,DNS:mqtt.example.com,IP:127.0.0.1" > server.ext
+openssl x509 -req -in server.csr -CA ca_cert.pem -CAkey ca_private.pem -CAcreateserial -days 1000000 -extfile server.ext -out server_cert.pem
+rm -f server.csr server.ext ca_cert.srl
@@ -0,0 +1,202 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidSubfolder is returned when publishing an event with a subfolder that can't be used in an MQTT topic.
+var ErrInvalidSubfolder = fmt.Errorf("invalid subfolder")
+
+// ErrInvalidTopic is returned by TopicScheme.Validate if a template can't be used as an MQTT topic.
+var ErrInvalidTopic = fmt.Errorf("invalid topic template")
+
+// TopicScheme holds the templates used to build the topics of a device.
+// The templates can contain {project}, {location}, {registry} and {device},
+// which are replaced with the corresponding fields of the device's ID.
+type TopicScheme struct {
+	// Config is the topic that configs are received on.
+	Config string
+	// State is the topic that state is published to.
+	State string
+	// Events is the topic that events are published to. Event subfolders are appended to it.
+	Events string
+	// Commands is the topic that commands are received on. Commands are also received on its subtopics.
+	Commands string
+	// Errors is the topic that errors are received on. If it is empty, errors are not received.
+	Errors string
+	// Attach is the topic that gateways publish to when attaching a bound device.
+	Attach string
+	// Detach is the topic that gateways publish to when detaching a bound device.
+	Detach string
+}
+
+// GoogleTopicScheme is the TopicScheme used by Google Cloud IoT Core.
+// It is used by GoogleBackend for any templates that are empty in ThingOptions.Topics.
+var GoogleTopicScheme = TopicScheme{
+	Config:   "/devices/{device}/config",
+	State:    "/devices/{device}/state",
+	Events:   "/devices/{device}/events",
+	Commands: "/devices/{device}/commands",
+	Errors:   "/devices/{device}/errors",
+	Attach:   "/devices/{device}/attach",
+	Detach:   "/devices/{device}/detach",
+}
+
+// GenericTopicScheme is the TopicScheme used by GenericBackend if no templates are provided.
+var GenericTopicScheme = TopicScheme{
+	Config:   "devices/{device}/config",
+	State:    "devices/{device}/state",
+	Events:   "devices/{device}/events",
+	Commands: "devices/{device}/commands",
+}
+
+// ConfigTopic returns the config topic of the device.
+func (s TopicScheme) ConfigTopic(id *ID) string {
+	return s.render(s.Config, id)
+}
+
+// StateTopic returns the state topic of the device.
+func (s TopicScheme) StateTopic(id *ID) string {
+	return s.render(s.State, id)
+}
+
+// EventsTopic returns the events topic of the device followed by the subfolder.
+// The subfolder should be checked using ValidateSubfolder first.
+func (s TopicScheme) EventsTopic(id *ID, subfolder ...string) string {
+	return strings.Join(append([]string{s.render(s.Events, id)}, subfolder...), "/")
+}
+
+// CommandsTopic returns the commands topic of the device.
+func (s TopicScheme) CommandsTopic(id *ID) string {
+	return s.render(s.Commands, id)
+}
+
+// ErrorsTopic returns the errors topic of the device, or an empty string if there isn't one.
+func (s TopicScheme) ErrorsTopic(id *ID) string {
+	return s.render(s.Errors, id)
+}
+
+// AttachTopic returns the topic that a gateway publishes to when attaching the device.
+func (s TopicScheme) AttachTopic(id *ID) string {
+	return s.render(s.Attach, id)
+}
+
+// DetachTopic returns the topic that a gateway publishes to when detaching the device.
+func (s TopicScheme) DetachTopic(id *ID) string {
+	return s.render(s.Detach, id)
+}
+
+// Validate returns ErrInvalidTopic if any of the templates contain wildcards, empty levels or illegal characters.
+func (s TopicScheme) Validate() error {
+	for _, template := range s.templates() {
+		if template == "" {
+			continue
+		}
+		// A leading slash is allowed because Cloud IoT Core topics start with one
+		if !validTopicLevels(strings.Split(strings.TrimPrefix(template, "/"), "/")) {
+			return ErrInvalidTopic
+		}
+	}
+	return nil
+}
+
+// ValidateSubfolder returns ErrInvalidSubfolder if an event subfolder contains an empty level,
+// MQTT wildcards or characters that can't be used in a topic. Each subfolder may contain several levels separated by slashes.
+func ValidateSubfolder(subfolder ...string) error {
+	for _, s := range subfolder {
+		if !validTopicLevels(strings.Split(s, "/")) {
+			return ErrInvalidSubfolder
+		}
+	}
+	return nil
+}
+
+// validTopicLevels returns false if any of the topic levels are empty or contain wildcards or illegal characters.
+func validTopicLevels(levels []string) bool {
+	for _, level := range levels {
+		if level == "" || !utf8.ValidString(level) || strings.ContainsAny(level, "+#\x00") {
+			return false
+		}
+	}
+	return true
+}
+
+// withDefaults returns a copy of the scheme with any empty templates replaced by the default templates.
+func (s TopicScheme) withDefaults(defaults TopicScheme) TopicScheme {
+	fill := func(template *string, defaultTemplate string) {
+		if *template == "" {
+			*template = defaultTemplate
+		}
+	}
+	fill(&s.Config, defaults.Config)
+	fill(&s.State, defaults.State)
+	fill(&s.Events, defaults.Events)
+	fill(&s.Commands, defaults.Commands)
+	fill(&s.Errors, defaults.Errors)
+	fill(&s.Attach, defaults.Attach)
+	fill(&s.Detach, defaults.Detach)
+	return s
+}
+
+// templates returns all of the templates in the scheme.
+func (s TopicScheme) templates() []string {
+	return []string{s.Config, s.State, s.Events, s.Commands, s.Errors, s.Attach, s.Detach}
+}
+
+// deviceID returns the ID of the device that a topic built from one of the templates belongs to.
+// Topics are only matched if {device} makes up a whole topic level.
+// Subtopics of the events and commands topics are also matched.
+func (s TopicScheme) deviceID(topic string, id *ID) (string, bool) {
+	placeholder := *id
+	placeholder.DeviceID = "{device}"
+	levels := strings.Split(topic, "/")
+	templates := []struct {
+		template string
+		prefix   bool
+	}{
+		{s.Config, false}, {s.State, false}, {s.Events, true}, {s.Commands, true},
+		{s.Errors, false}, {s.Attach, false}, {s.Detach, false},
+	}
+	for _, t := range templates {
+		if t.template == "" {
+			continue
+		}
+		if deviceID, ok := matchTopic(strings.Split(s.render(t.template, &placeholder), "/"), levels, t.prefix); ok {
+			return deviceID, true
+		}
+	}
+	return "", false
+}
+
+// matchTopic matches the levels of a topic against the levels of a template and returns the level that matched {device}.
+// If prefix is true, the topic may have more levels than the template.
+func matchTopic(template []string, levels []string, prefix bool) (string, bool) {
+	if len(levels) < len(template) || (!prefix && len(levels) != len(template)) {
+		return "", false
+	}
+	deviceID := ""
+	for i, level := range template {
+		switch {
+		case level == "{device}":
+			deviceID = levels[i]
+		case level != levels[i]:
+			return "", false
+		}
+	}
+	return deviceID, deviceID != ""
+}
+
+// render replaces the placeholders in a template with the fields of the ID.
+func (s TopicScheme) render(template string, id *ID) string {
+	return strings.NewReplacer(
+		"{project}", id.ProjectID,
+		"{location}", id.Location,
+		"{registry}", id.Registry,
+		"{device}", id.DeviceID,
+	).Replace(template)
+}
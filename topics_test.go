@@ -0,0 +1,113 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vaelen/iot"
+)
+
+func TestTopicScheme(t *testing.T) {
+	scheme := iot.TopicScheme{
+		Config: "{project}/{location}/{registry}/{device}/config",
+		Events: "telemetry/{device}",
+	}
+	if topic := scheme.ConfigTopic(TestID); topic != "test-project/test-location/test-registry/test-device/config" {
+		t.Fatalf("Wrong config topic: %s", topic)
+	}
+	if topic := scheme.EventsTopic(TestID, "a", "b/c"); topic != "telemetry/test-device/a/b/c" {
+		t.Fatalf("Wrong events topic: %s", topic)
+	}
+	if topic := iot.GoogleTopicScheme.CommandsTopic(TestID); topic != "/devices/test-device/commands" {
+		t.Fatalf("Wrong commands topic: %s", topic)
+	}
+	if err := iot.GoogleTopicScheme.Validate(); err != nil {
+		t.Fatalf("Google topics aren't valid: %v", err)
+	}
+	for _, template := range []string{"devices/+/config", "devices/{device}/#", "devices//config", "devices/{device}/"} {
+		if err := (iot.TopicScheme{State: template}).Validate(); err != iot.ErrInvalidTopic {
+			t.Fatalf("Invalid template was accepted: %s", template)
+		}
+	}
+}
+
+func TestValidateSubfolder(t *testing.T) {
+	for _, subfolder := range [][]string{nil, {"a"}, {"a", "b"}, {"a/b"}, {"temp-1.2"}} {
+		if err := iot.ValidateSubfolder(subfolder...); err != nil {
+			t.Fatalf("Valid subfolder %v wasn't accepted: %v", subfolder, err)
+		}
+	}
+	for _, subfolder := range [][]string{{""}, {"a", ""}, {"a/"}, {"/a"}, {"a//b"}, {"+"}, {"a#"}, {"a\x00"}, {"\xff"}} {
+		if err := iot.ValidateSubfolder(subfolder...); err != iot.ErrInvalidSubfolder {
+			t.Fatalf("Invalid subfolder %q was accepted", subfolder)
+		}
+	}
+}
+
+func TestCustomTopics(t *testing.T) {
+	ctx := context.Background()
+	initMockClient()
+	options, configReceived := getOptions(t, getCredentials(t, iot.CredentialTypeRSA))
+	options.Topics = iot.TopicScheme{
+		Config: "/registries/{registry}/devices/{device}/config",
+		Events: "/registries/{registry}/devices/{device}/telemetry",
+		Attach: "/registries/{registry}/devices/{device}/attach",
+	}
+	options.ConfigHandler = func(thing iot.Thing, config []byte) {
+		configReceived.Write(config)
+	}
+	var received *iot.DeviceError
+	options.ErrorHandler = func(thing iot.Thing, err *iot.DeviceError) {
+		received = err
+	}
+
+	gateway := iot.NewGateway(options)
+	doConnectionTest(t, gateway, "ssl://mqtt.example.com:443")
+	defer doDisconnectTest(t, gateway)
+	mockClient.Receive("/registries/test-registry/devices/test-device/config", []byte("config"))
+	if configReceived.String() != "config" {
+		t.Fatalf("Wrong config: %s", configReceived.String())
+	}
+
+	if err := gateway.PublishEvent(ctx, []byte("event"), "a"); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	if len(mockClient.Messages["/registries/test-registry/devices/test-device/telemetry/a"]) != 1 {
+		t.Fatalf("Event wasn't published: %v", mockClient.Messages)
+	}
+	if err := gateway.PublishEvent(ctx, []byte("event"), "a/+"); err != iot.ErrInvalidSubfolder {
+		t.Fatalf("Wrong error publishing an event with a wildcard: %v", err)
+	}
+
+	// Bound devices use the same topics
+	device, err := gateway.Attach(ctx, &iot.BoundDeviceOptions{DeviceID: BoundDeviceID})
+	if err != nil {
+		t.Fatalf("Couldn't attach device: %v", err)
+	}
+	if len(mockClient.Messages["/registries/test-registry/devices/bound-device/attach"]) != 1 {
+		t.Fatalf("Device wasn't attached: %v", mockClient.Messages)
+	}
+	if err = device.PublishEvent(ctx, []byte("bound event"), "b"); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+	if len(mockClient.Messages["/registries/test-registry/devices/bound-device/telemetry/b"]) != 1 {
+		t.Fatalf("Bound event wasn't published: %v", mockClient.Messages)
+	}
+	if err = device.PublishEvent(ctx, []byte("bound event"), ""); err != iot.ErrInvalidSubfolder {
+		t.Fatalf("Wrong error publishing an event with an empty subfolder: %v", err)
+	}
+	// Errors are correlated with the last message published for the device
+	mockClient.Receive(ErrorsTopic, []byte(`{"error_type":"GATEWAY_UNKNOWN_ERROR","device_id":"bound-device"}`))
+	if received == nil || received.Publish == nil || received.Publish.Topic != "/registries/test-registry/devices/bound-device/telemetry/b" {
+		t.Fatalf("Error not correlated with the bound event: %+v", received)
+	}
+
+	options.Topics = iot.TopicScheme{State: "/devices/{device}/state/#"}
+	thing := getThing(t, options)
+	if err = thing.Connect(ctx, "ssl://mqtt.example.com:443"); err != iot.ErrConfigurationError {
+		t.Fatalf("Connected with an invalid topic template: %v", err)
+	}
+}
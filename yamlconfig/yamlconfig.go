@@ -0,0 +1,15 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+// Package yamlconfig decodes YAML configurations for iot.TypedConfig.
+//
+// It is a separate package so that devices that don't use YAML configurations don't include a YAML parser.
+package yamlconfig
+
+import (
+	"github.com/vaelen/iot"
+	"gopkg.in/yaml.v2"
+)
+
+// Unmarshal decodes YAML configurations.
+var Unmarshal iot.ConfigUnmarshaler = yaml.Unmarshal
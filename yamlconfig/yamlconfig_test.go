@@ -0,0 +1,20 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package yamlconfig
+
+import (
+	"testing"
+)
+
+type testConfig struct {
+	Interval int    `yaml:"interval"`
+	Name     string `yaml:"name"`
+}
+
+func TestUnmarshal(t *testing.T) {
+	c := &testConfig{}
+	if err := Unmarshal([]byte("interval: 3\nname: test\n"), c); err != nil || c.Interval != 3 || c.Name != "test" {
+		t.Fatalf("Couldn't decode YAML config. Config: %+v, Error: %v", c, err)
+	}
+}